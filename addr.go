@@ -0,0 +1,56 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// AddrFunc is the allocation-free alternative to IPFunc: it should extract
+// address from http request, reporting false if there is none, in which case
+// request is allowed without additional processing.
+type AddrFunc func(*http.Request) (netip.Addr, bool)
+
+// AddrFromRemoteAddr is IPFromRemoteAddr for AddrFunc.
+func AddrFromRemoteAddr(r *http.Request) (netip.Addr, bool) { return parseAddrPort(r.RemoteAddr) }
+
+// AddrFromXForwardedFor is IPFromXForwardedFor for AddrFunc.
+func AddrFromXForwardedFor(r *http.Request) (netip.Addr, bool) {
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for v != "" {
+			var entry string
+			entry, v, _ = strings.Cut(v, ",")
+			if entry = strings.TrimSpace(entry); entry != "" {
+				addr, err := netip.ParseAddr(entry)
+				return addr.WithZone(""), err == nil
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// parseAddrPort is parseAddr returning netip.Addr
+func parseAddrPort(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().WithZone(""), true
+	}
+	if len(s) > 1 && s[0] == '[' && s[len(s)-1] == ']' {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	return addr.WithZone(""), err == nil
+}
+
+// setAddr sets e.ip to addr, keeping its bytes in e.ipBuf instead of a
+// separately allocated slice
+func (e *evaluation) setAddr(addr netip.Addr) {
+	if !addr.IsValid() {
+		return
+	}
+	e.ipBuf = addr.As16()
+	if addr.Is4() {
+		e.ip = e.ipBuf[12:]
+		return
+	}
+	e.ip = e.ipBuf[:]
+}
@@ -0,0 +1,144 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestAddrFuncs checks that AddrFunc functions agree with their IPFunc
+// counterparts
+func TestAddrFuncs(t *testing.T) {
+	for _, remoteAddr := range []string{
+		"192.0.2.1:1234",
+		"[2001:db8::1]:1234",
+		"[fe80::1%eth0]:1234",
+		"[::ffff:192.0.2.1]:1234",
+		"192.0.2.1",
+		"2001:db8::1",
+		"[2001:db8::1]",
+		"fe80::1%eth0",
+		"",
+		"garbage",
+		"garbage:1234",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		checkAddrFunc(t, r, remoteAddr, AddrFromRemoteAddr, IPFromRemoteAddr)
+	}
+	for _, lines := range [][]string{
+		nil,
+		{"192.0.2.1"},
+		{" 192.0.2.1 ,198.51.100.1"},
+		{"", "2001:db8::1, 203.0.113.1"},
+		{" , ", "198.51.100.1"},
+		{"garbage, 192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, v := range lines {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		checkAddrFunc(t, r, lines, AddrFromXForwardedFor, IPFromXForwardedFor)
+	}
+}
+
+func checkAddrFunc(t *testing.T, r *http.Request, input any, addrfunc AddrFunc, ipfunc IPFunc) {
+	t.Helper()
+	var e evaluation
+	addr, ok := addrfunc(r)
+	if ok {
+		e.setAddr(addr)
+	}
+	if want := ipfunc(r); !e.ip.Equal(want) || (e.ip == nil) != (want == nil) {
+		t.Errorf("%q: got %v (%v), want %v", input, addr, ok, want)
+	}
+}
+
+func TestAddrFunc(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc:      func(*http.Request) net.IP { panic("IPFunc called") },
+		AddrFunc:    AddrFromXForwardedFor,
+	}).(*limiter)
+	serve := func(addr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, tc := range []struct {
+		addr string
+		want int
+	}{
+		{"192.0.2.1", http.StatusNotFound},
+		{"::ffff:192.0.2.1", http.StatusTooManyRequests},
+		{"2001:db8::1", http.StatusNotFound},
+		{"2001:db8::1", http.StatusTooManyRequests},
+		{"garbage", http.StatusNotFound},
+		{"garbage", http.StatusNotFound},
+	} {
+		if code := serve(tc.addr); code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.addr, code, tc.want)
+		}
+	}
+	// buckets are keyed the same way as with IPFunc
+	for _, ip := range []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1")} {
+		if _, ok := lh.bucketOf(keyOf(ip)); !ok {
+			t.Errorf("no bucket of %v", ip)
+		}
+	}
+}
+
+func TestAddrFuncAllocs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	r.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.1")
+	for name, f := range map[string]AddrFunc{
+		"AddrFromRemoteAddr":    AddrFromRemoteAddr,
+		"AddrFromXForwardedFor": AddrFromXForwardedFor,
+	} {
+		if n := testing.AllocsPerRun(100, func() { f(r) }); n != 0 {
+			t.Errorf("%s: got %v allocations per call", name, n)
+		}
+	}
+	allocs := func(cfg *Config) float64 {
+		cfg.RefillEvery, cfg.Burst = time.Nanosecond, 1<<20
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg).(*limiter)
+		w := httptest.NewRecorder()
+		return testing.AllocsPerRun(100, func() { lh.ServeHTTP(w, r) })
+	}
+	// address is kept in the evaluation instead of a separate slice
+	ipAllocs, addrAllocs := allocs(&Config{IPFunc: IPFromXForwardedFor}), allocs(&Config{AddrFunc: AddrFromXForwardedFor})
+	if addrAllocs != ipAllocs-1 {
+		t.Errorf("got %v allocations per request with AddrFunc, %v with IPFunc", addrAllocs, ipAllocs)
+	}
+}
+
+// BenchmarkAddrFunc compares requests handled with IPFunc and with AddrFunc
+func BenchmarkAddrFunc(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"IPFunc", Config{IPFunc: IPFromXForwardedFor}},
+		{"AddrFunc", Config{AddrFunc: AddrFromXForwardedFor}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			cfg := tc.cfg
+			cfg.RefillEvery, cfg.Burst = time.Nanosecond, 1<<20
+			lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &cfg)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Forwarded-For", "2001:db8::1")
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lh.ServeHTTP(w, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package ipratelimit
+
+import (
+	"net"
+	"time"
+)
+
+// maxAddrLimits is the number of distinct limits returned by Config.Limits
+// cached by addrLimits, the cache is cleared once it grows past it
+const maxAddrLimits = 1024
+
+// addrLimitsKey identifies limits returned by Config.Limits resolved
+// against base limits
+type addrLimitsKey struct {
+	base        *limits
+	refillEvery time.Duration
+	burst       int
+}
+
+// addrLimits returns limits of ip returned by Config.Limits, with zero
+// values taken from base, or nil if there are none. Resolved limits are
+// cached, so that requests of the same partners don't allocate them anew.
+func (h *limiter) addrLimits(ip net.IP, base *limits) *limits {
+	refillEvery, burst, ok := h.limitsOf(ip)
+	if !ok {
+		return nil
+	}
+	key := addrLimitsKey{base: base, refillEvery: max(refillEvery, 0), burst: max(burst, 0)}
+	if lim, ok := h.addrCache.Load(key); ok {
+		return lim.(*limits)
+	}
+	lim := Limit{RefillEvery: key.refillEvery, Burst: key.burst}.override(*base)
+	if lim.burst > base.burst {
+		// buckets of the address may hold more tokens than any
+		// configured limits allow
+		h.growMaxBurst(lim.burst)
+	}
+	if h.addrCacheLen.Add(1) > maxAddrLimits {
+		// keys of base limits replaced by SetLimit are never looked
+		// up again, and Config.Limits may return arbitrary values
+		h.addrCache.Clear()
+		h.addrCacheLen.Store(0)
+	}
+	h.addrCache.Store(key, &lim)
+	return &lim
+}
@@ -0,0 +1,112 @@
+package ipratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAddrLimits(t *testing.T) {
+	partnerBurst := 5
+	var events []TraceEvent
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		MaxBuckets:  100,
+		IPFunc:      IPFromXForwardedFor,
+		TraceHook:   func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+		// odd addresses of 192.0.0.0/16 are partners
+		Limits: func(ip net.IP) (time.Duration, int, bool) {
+			if ip4 := ip.To4(); ip4 != nil && ip4[0] == 192 && ip4[1] == 0 && ip4[3]%2 == 1 {
+				return 0, partnerBurst, true
+			}
+			return 0, 0, false
+		},
+	}).(*limiter)
+	serve := func(addr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code
+	}
+	// count allowed requests until the first denial
+	exhaust := func(addr string) int {
+		for n := 0; ; n++ {
+			if serve(addr) != http.StatusNotFound {
+				return n
+			}
+		}
+	}
+	if n := exhaust("192.0.2.1"); n != 5 {
+		t.Errorf("partner address: allowed %d requests, want 5", n)
+	}
+	if ev := events[len(events)-1]; ev.Source != SourceAddress {
+		t.Errorf("partner address: limits source %v", ev.Source)
+	}
+	if n := exhaust("198.51.100.1"); n != 2 {
+		t.Errorf("other address: allowed %d requests, want 2", n)
+	}
+	if ev := events[len(events)-1]; ev.Source != SourceDefault {
+		t.Errorf("other address: limits source %v", ev.Source)
+	}
+	if at := lh.Next(net.IPv4(192, 0, 2, 2), 5); !at.IsZero() {
+		t.Errorf("Next of other address with cost above its burst: %v", at)
+	}
+	if at := lh.Next(net.IPv4(192, 0, 2, 1), 5); at.IsZero() {
+		t.Error("Next of partner address with cost within its burst: zero time")
+	}
+
+	// once limits of the address change, its bucket adapts on the next
+	// access: refilled for a day, it's clamped to the new burst
+	partnerBurst = 1
+	lh.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	if n := exhaust("192.0.2.1"); n != 1 {
+		t.Errorf("partner address with lowered burst: allowed %d requests, want 1", n)
+	}
+
+	// buckets of both kinds share the storage and its eviction
+	for i := 0; i < 256; i++ {
+		lh.Allow(net.IPv4(192, 0, 3, byte(i)))
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if st := lh.Stats(); st.Buckets > 100 {
+		t.Errorf("got %d buckets of 100", st.Buckets)
+	}
+}
+
+// TestAddrLimitsCache checks that resolved limits are reused, that the
+// cache stays bounded and that bursts above the defaults are tracked
+func TestAddrLimitsCache(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		Limits: func(ip net.IP) (time.Duration, int, bool) {
+			ip4 := ip.To4()
+			return 0, 3 + int(ip4[2])<<8 + int(ip4[3]), true
+		},
+	}).(*limiter)
+	if got := math.Float64frombits(lh.maxBurstBits.Load()); got != lh.maxBurst {
+		t.Errorf("maxBurst mirror is %v, want %v", got, lh.maxBurst)
+	}
+	base := lh.gen.Load().def
+	a := net.IPv4(192, 0, 0, 1)
+	if x, y := lh.addrLimits(a, base), lh.addrLimits(a, base); x != y {
+		t.Error("limits of the same address resolved twice")
+	}
+	for i := 0; i < 2*maxAddrLimits; i++ {
+		lh.addrLimits(net.IPv4(192, 0, byte(i>>8), byte(i)), base)
+	}
+	if n := lh.addrCacheLen.Load(); n > maxAddrLimits {
+		t.Errorf("%d cached limits, want at most %d", n, maxAddrLimits)
+	}
+	if want := float64(3 + 2*maxAddrLimits - 1); lh.maxBurst != want {
+		t.Errorf("got maxBurst %v, want %v", lh.maxBurst, want)
+	}
+}
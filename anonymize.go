@@ -0,0 +1,58 @@
+package ipratelimit
+
+import (
+	"net"
+
+	"github.com/artyom/logger"
+)
+
+// Prefix lengths addresses are truncated to with Config.AnonymizeKeys: the
+// last octet of IPv4 and the last 80 bits of IPv6 addresses are dropped
+const (
+	anonymousIPv4Mask = 24
+	anonymousIPv6Mask = 48
+)
+
+// anonymousMask returns prefix length to mask addresses with when
+// Config.AnonymizeKeys is set, given the configured length n of the named
+// field: n if it's at most limit, limit otherwise
+func anonymousMask(log logger.Interface, name string, n, limit int) int {
+	if n > limit {
+		log.Printf("%s %d is longer than AnonymizeKeys allows, using %d", name, n, limit)
+	}
+	if n <= 0 || n > limit {
+		return limit
+	}
+	return n
+}
+
+// banKey returns key of the ban of ip, which must be in the form returned
+// by canonicalIP. Bans are per address, unless addresses are anonymized.
+func (h *limiter) banKey(ip net.IP) uint64 {
+	if h.anonymize {
+		return keyOf(h.maskIP(ip))
+	}
+	return keyOf(ip)
+}
+
+// formatSubject returns text form of the client of e for logs, see
+// formatClient; opaque keys are printed as their hashes
+func (h *limiter) formatSubject(e *evaluation) string {
+	if e.opaque != nil {
+		return formatKey(e.opaque)
+	}
+	return h.formatClient(e.ip)
+}
+
+// formatClient returns text form of client address ip for logs: the address
+// itself, or, if Config.AnonymizeKeys is set, hash of its truncated prefix,
+// as printed by ExportCSV for buckets keyed by address
+func (h *limiter) formatClient(ip net.IP) string {
+	if !h.anonymize {
+		return formatKey(ip)
+	}
+	if ip = canonicalIP(ip); ip == nil {
+		return formatKey(ip)
+	}
+	return formatKey(keyOf(h.maskIP(ip)))
+}
@@ -0,0 +1,125 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnonymizeKeys(t *testing.T) {
+	const v4, v6 = "192.0.2.77", "2001:db8:1:2:3:4:5:6"
+	var buf bytes.Buffer
+	var events []TraceEvent
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:                  time.Hour,
+		Burst:                        2,
+		IPFunc:                       IPFromXForwardedFor,
+		Logger:                       log.New(&buf, "", 0),
+		AnonymizeKeys:                true,
+		TrackStats:                   true,
+		TrackHistory:                 true,
+		ProblemDetails:               true,
+		SendRateLimitHeaders:         true,
+		BypassLogEvery:               1,
+		ExemptUserAgents:             []string{"probe/"},
+		KeyConcentrationWarnFraction: 0.5,
+		TraceHook:                    func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	var out bytes.Buffer
+	serve := func(xff, ua string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", xff)
+		req.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		fmt.Fprintf(&out, "%d %v %s\n", w.Code, w.Header(), w.Body)
+		return w
+	}
+	// two windows of traffic from a single prefix trigger the warning
+	for i := 0; i < misconfigMinRequests; i++ {
+		serve(v4, "")
+	}
+	now = now.Add(misconfigWindow)
+	for i := 0; i < misconfigMinRequests; i++ {
+		serve(v4, "")
+	}
+	serve(v6, "")
+	serve(v6, "")
+	now = now.Add(misconfigWindow)
+	serve(v4, "probe/1.0")
+	// addresses of the same truncated prefix share a bucket
+	if w := serve("192.0.2.5", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("address of the same /24 got %d", w.Code)
+	}
+	if w := serve("2001:db8:1:ffff::1", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("address of the same /48 got %d", w.Code)
+	}
+	if w := serve("192.0.3.77", ""); w.Code != http.StatusOK {
+		t.Errorf("address of another /24 got %d", w.Code)
+	}
+	if err := lh.Ban(net.ParseIP(v4), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := lh.AllowCtx(context.Background(), net.ParseIP("192.0.2.200")); d.Stage != StageBan {
+		t.Errorf("ban doesn't cover the prefix, decided by %v", d.Stage)
+	}
+	if len(lh.History(net.ParseIP(v4))) == 0 {
+		t.Error("no history of the truncated prefix")
+	}
+
+	if err := lh.ExportCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	lh.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	out.Write(w.Body.Bytes())
+	fmt.Fprintf(&out, "%+v\n%+v\n%s\n", lh.Stats(), events, lh.dumpState(100))
+	lh.misconfig.mu.Lock()
+	fmt.Fprintf(&out, "%v %v\n", lh.misconfig.candIP, lh.misconfig.topIP)
+	lh.misconfig.mu.Unlock()
+
+	if !strings.Contains(buf.String(), "WARNING") || !strings.Contains(buf.String(), "bypassed") ||
+		!strings.Contains(buf.String(), "limited") {
+		t.Fatalf("log misses some messages:\n%s", buf.String())
+	}
+	for _, s := range []string{v4, v6, "2001:db8:1:2:"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("log has %s:\n%s", s, buf.String())
+		}
+		if strings.Contains(out.String(), s) {
+			t.Errorf("output has %s:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestAnonymizeKeysMasks(t *testing.T) {
+	for _, tc := range []struct {
+		v4, v6         int
+		wantV4, wantV6 int
+		valid          bool
+	}{
+		{0, 0, 24, 48, true},
+		{16, 32, 16, 32, true},
+		{32, 64, 24, 48, false},
+	} {
+		cfg := &Config{AnonymizeKeys: true, IPv4Mask: tc.v4, IPv6Mask: tc.v6}
+		if err := cfg.Validate(); (err == nil) != tc.valid {
+			t.Errorf("masks %d/%d: Validate returned %v", tc.v4, tc.v6, err)
+		}
+		lh := New(http.NotFoundHandler(), cfg).(*limiter)
+		v4, _ := lh.v4Mask.Size()
+		v6, _ := lh.v6Mask.Size()
+		if v4 != tc.wantV4 || v6 != tc.wantV6 {
+			t.Errorf("masks %d/%d: got %d/%d, want %d/%d", tc.v4, tc.v6, v4, v6, tc.wantV4, tc.wantV6)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ipratelimit
+
+const (
+	// bucketMemSize is an estimated memory footprint of a single bucket:
+	// map entry with its share of map overhead
+	bucketMemSize = 72
+
+	// keyMemSize is the memory footprint of a slot in the eviction queue
+	// of keys; queues allocate between one and four slots per bucket, see
+	// keyQueue
+	keyMemSize = 8
+
+	// autoMinBuckets is the initial number of buckets in automatic sizing
+	// mode
+	autoMinBuckets = 1000
+)
+
+// autoSize doubles the number of buckets, up to h.autoMax, if young
+// buckets were evicted since the last call. It returns the number of
+// buckets before and after the call. Shards are resized one by one, each
+// keeping its share of the total.
+func (h *limiter) autoSize() (from, to int) {
+	var young int
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		from += s.capacity
+		young += s.youngEvictions
+		s.youngEvictions = 0
+		s.m.Unlock()
+	}
+	if young == 0 || from >= h.autoMax || h.draining.Load() {
+		return from, from
+	}
+	to = min(2*from, h.autoMax)
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		s.capacity = max(s.capacity, shardCapacity(to, len(h.shards), i))
+		s.m.Unlock()
+	}
+	return from, to
+}
+
+// Close stops background goroutines, if any. It always returns nil.
+//
+// Handler returned by New implements io.Closer.
+func (h *limiter) Close() error {
+	h.closeOnce.Do(func() { close(h.done) })
+	return nil
+}
@@ -0,0 +1,78 @@
+package ipratelimit
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAutoSize(t *testing.T) {
+	const wantMax = 8000
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:  time.Second,
+		Burst:        1,
+		TargetMemory: wantMax * (bucketMemSize + keyMemSize),
+	}).(*limiter)
+	defer lh.Close()
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	var n uint32
+	churn := func(keys int) {
+		ip := make(net.IP, 4)
+		for i := 0; i < keys; i++ {
+			n++
+			binary.BigEndian.PutUint32(ip, n)
+			lh.Allow(ip)
+		}
+	}
+	if st := lh.Stats(); st.MaxBuckets != autoMinBuckets {
+		t.Fatalf("initial MaxBuckets: %d, want %d", st.MaxBuckets, autoMinBuckets)
+	}
+	// unique keys without pause: evicted buckets are young, so the number
+	// of buckets grows until the memory target is reached
+	var sizes []int
+	for i := 0; i < 5; i++ {
+		churn(3 * wantMax)
+		_, to := lh.autoSize()
+		sizes = append(sizes, to)
+	}
+	want := []int{2000, 4000, wantMax, wantMax, wantMax}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("sizes after growth: %v, want %v", sizes, want)
+		}
+	}
+	if st := lh.Stats(); st.Buckets > wantMax || st.MaxBuckets != wantMax {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// fill with fresh buckets, then churn after a long pause, so only old
+	// buckets are evicted: size should stay the same
+	lh = New(http.NotFoundHandler(), &Config{
+		RefillEvery:  time.Second,
+		Burst:        1,
+		TargetMemory: wantMax * (bucketMemSize + keyMemSize),
+	}).(*limiter)
+	defer lh.Close()
+	lh.now = func() time.Time { return now }
+	churn(autoMinBuckets)
+	lh.autoSize()
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Hour)
+		churn(autoMinBuckets - 100)
+		if from, to := lh.autoSize(); from != to {
+			t.Fatalf("round %d: buckets grown from %d to %d on old evictions", i, from, to)
+		}
+	}
+}
+
+func TestAutoSizeDisabled(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{MaxBuckets: 500, TargetMemory: 1 << 20}).(*limiter)
+	defer lh.Close()
+	if _, capacity := lh.buckets(); lh.autoMax != 0 || capacity != 500 {
+		t.Fatalf("automatic sizing enabled with explicit MaxBuckets: autoMax=%d, cap=%d",
+			lh.autoMax, capacity)
+	}
+}
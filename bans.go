@@ -0,0 +1,125 @@
+package ipratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrBanTableFull is returned by Ban when the ban table is at capacity and
+// none of its entries have expired yet
+var ErrBanTableFull = errors.New("ipratelimit: ban table is full")
+
+// banTable keeps bans separately from token buckets, so that eviction of a
+// bucket never lifts a ban. Bans are only removed once expired or lifted
+// explicitly.
+type banTable struct {
+	mu    sync.Mutex
+	max   int
+	until map[uint64]int64 // ban expiration as nanoseconds since Unix epoch
+}
+
+func newBanTable(max int) *banTable {
+	return &banTable{max: max, until: make(map[uint64]int64)}
+}
+
+// add bans key until the given time, extending an existing ban if needed
+func (t *banTable) add(key uint64, now, until time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.until[key]; ok {
+		if until.UnixNano() > old {
+			t.until[key] = until.UnixNano()
+		}
+		return nil
+	}
+	if len(t.until) >= t.max {
+		t.purge(now)
+	}
+	if len(t.until) >= t.max {
+		return ErrBanTableFull
+	}
+	t.until[key] = until.UnixNano()
+	return nil
+}
+
+// left returns time left until ban of the key expires, or 0 if key is not
+// banned
+func (t *banTable) left(key uint64, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.until[key]
+	if !ok {
+		return 0
+	}
+	if left := until - now.UnixNano(); left > 0 {
+		return time.Duration(left)
+	}
+	delete(t.until, key)
+	return 0
+}
+
+func (t *banTable) remove(key uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.until, key)
+}
+
+func (t *banTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.until)
+}
+
+// purge removes expired bans, must be called with t.mu held
+func (t *banTable) purge(now time.Time) {
+	ts := now.UnixNano()
+	for k, until := range t.until {
+		if until <= ts {
+			delete(t.until, k)
+		}
+	}
+}
+
+// Ban makes all requests from the given IP address to be denied for the
+// duration d, with Retry-After reflecting the time left. Bans are kept
+// separately from token buckets and are not affected by their eviction. The
+// number of active bans is limited by Config.MaxBans; if the limit is
+// reached, ErrBanTableFull is returned. Allowlisted addresses are never
+// banned, since allowlist is evaluated before bans.
+//
+// Handler returned by New implements interface{ Ban(net.IP, time.Duration) error }.
+func (h *limiter) Ban(ip net.IP, d time.Duration) error {
+	ip = canonicalIP(ip)
+	if ip == nil {
+		return errors.New("ipratelimit: no usable address")
+	}
+	if d <= 0 {
+		h.bans.remove(h.banKey(ip))
+		return nil
+	}
+	now := h.now()
+	return h.bans.add(h.banKey(ip), now, now.Add(d))
+}
+
+// Unban lifts the ban of the given IP address, if any.
+//
+// Handler returned by New implements interface{ Unban(net.IP) }.
+func (h *limiter) Unban(ip net.IP) {
+	if ip = canonicalIP(ip); ip != nil {
+		h.bans.remove(h.banKey(ip))
+	}
+}
+
+func (h *limiter) evalBan(e *evaluation) bool {
+	if e.ip == nil {
+		return false // keyed by Config.KeyFunc
+	}
+	if left := h.bans.left(h.banKey(e.ip), h.now()); left > 0 {
+		e.d.allow = false
+		e.d.banLeft = left
+		return true
+	}
+	return false
+}
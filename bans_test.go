@@ -0,0 +1,77 @@
+package ipratelimit
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBanSurvivesEviction(t *testing.T) {
+	handler := func(http.ResponseWriter, *http.Request) {}
+	lim := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Second,
+		Burst:       10,
+		MaxBuckets:  100,
+		MaxBans:     2,
+		IPFunc:      IPFromXForwardedFor,
+	}).(*limiter)
+	now := time.Now()
+	lim.now = func() time.Time { return now }
+
+	banned := net.IPv4(192, 0, 2, 1)
+	if err := lim.Ban(banned, 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// flood with unique addresses to evict every bucket several times over
+	ip := make(net.IP, 4)
+	for i := 0; i < 1000; i++ {
+		binary.BigEndian.PutUint32(ip, 0x0a000000+uint32(i))
+		lim.Allow(ip)
+	}
+	if err := lim.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", banned.String())
+	rec := httptest.NewRecorder()
+	lim.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got code %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "90" {
+		t.Fatalf("got Retry-After %q, want 90", got)
+	}
+	st := lim.Stats()
+	if st.Bans != 1 || st.MaxBans != 2 {
+		t.Fatalf("got %d/%d bans, want 1/2", st.Bans, st.MaxBans)
+	}
+	if st.Buckets > st.MaxBuckets {
+		t.Fatalf("%d buckets over limit of %d", st.Buckets, st.MaxBuckets)
+	}
+
+	if err := lim.Ban(net.IPv4(192, 0, 2, 2), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := lim.Ban(net.IPv4(192, 0, 2, 3), time.Minute); err != ErrBanTableFull {
+		t.Fatalf("got error %v, want %v", err, ErrBanTableFull)
+	}
+	now = now.Add(time.Minute + time.Second)
+	if lim.Allow(net.IPv4(192, 0, 2, 2)) != true {
+		t.Fatal("ban has not expired")
+	}
+	if err := lim.Ban(net.IPv4(192, 0, 2, 3), time.Minute); err != nil {
+		t.Fatalf("expired ban was not purged: %v", err)
+	}
+	d, _ := lim.AllowCtx(req.Context(), banned)
+	if d.Allowed || d.Stage != StageBan {
+		t.Fatalf("got %+v, want denial at ban stage", d)
+	}
+	lim.Unban(banned)
+	if !lim.Allow(banned) {
+		t.Fatal("unbanned address is denied")
+	}
+}
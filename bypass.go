@@ -0,0 +1,47 @@
+package ipratelimit
+
+// bypassClass is a reason request was passed to the handler without being
+// subject to rate limiting
+type bypassClass int
+
+const (
+	bypassNilIP     bypassClass = iota // IPFunc returned no address
+	bypassAllowlist                    // Policy.Allowlist
+	bypassUserAgent                    // Config.ExemptUserAgents
+	bypassExempt                       // Config.Exempt
+	bypassMethod                       // Config.Methods
+	bypassSkip                         // Config.Skip
+	numBypassClasses
+)
+
+func (c bypassClass) String() string {
+	switch c {
+	case bypassNilIP:
+		return "no address"
+	case bypassAllowlist:
+		return "allowlisted"
+	case bypassUserAgent:
+		return "exempt user agent"
+	case bypassExempt:
+		return "exempt network"
+	case bypassMethod:
+		return "unlimited method"
+	case bypassSkip:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// trackBypass counts request bypassed for the given reason and logs every
+// Config.BypassLogEvery-th one of each class
+func (h *limiter) trackBypass(c bypassClass, e *evaluation) {
+	n := h.counters.bypassed[c].Add(1)
+	if h.bypassLogEvery == 0 || n%h.bypassLogEvery != 0 {
+		return
+	}
+	if e.ip == nil && len(e.opaque) == 0 {
+		h.log.Printf("bypassed request (%s), %d total", c, n)
+		return
+	}
+	h.log.Printf("bypassed %s (%s), %d total", h.formatSubject(e), c, n)
+}
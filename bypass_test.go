@@ -0,0 +1,65 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBypassCounters(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, path, xff, wantLog string
+		want                             func(Stats) uint64
+	}{
+		{"nil", "GET", "/", "", "no address", func(s Stats) uint64 { return s.BypassedNilIP }},
+		{"unspecified", "GET", "/", "::", "no address", func(s Stats) uint64 { return s.BypassedNilIP }},
+		{"allowlist", "GET", "/", "192.0.2.1", "allowlisted", func(s Stats) uint64 { return s.BypassedAllowlist }},
+		{"exempt", "GET", "/", "10.1.2.3", "exempt network", func(s Stats) uint64 { return s.BypassedExempt }},
+		{"method", "OPTIONS", "/", "198.51.100.2", "unlimited method", func(s Stats) uint64 { return s.BypassedMethod }},
+		{"skip", "GET", "/health", "198.51.100.2", "skipped", func(s Stats) uint64 { return s.BypassedSkip }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+				Burst:          1,
+				IPFunc:         IPFromXForwardedFor,
+				Logger:         log.New(&buf, "", 0),
+				BypassLogEvery: 2,
+				Policy:         Policy{Allowlist: []string{"192.0.2.0/24"}},
+				Exempt:         []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+				Methods:        []string{http.MethodGet},
+				Skip:           func(r *http.Request) bool { return r.URL.Path == "/health" },
+			}).(*limiter)
+			serve := func(method, path, xff string) {
+				req := httptest.NewRequest(method, path, nil)
+				if xff != "" {
+					req.Header.Set("X-Forwarded-For", xff)
+				}
+				lh.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			serve(http.MethodGet, "/", "198.51.100.1") // rate limited address, not a bypass
+			serve(tc.method, tc.path, tc.xff)
+			st := lh.Stats()
+			if got := tc.want(st); got != 1 {
+				t.Fatalf("got counter %d, want 1", got)
+			}
+			if total := st.Bypassed(); total != 1 {
+				t.Fatalf("other counters incremented: %+v", st)
+			}
+			if strings.Contains(buf.String(), "bypassed") {
+				t.Fatalf("first bypass logged: %q", buf.String())
+			}
+			serve(tc.method, tc.path, tc.xff)
+			if !strings.Contains(buf.String(), tc.wantLog) {
+				t.Fatalf("second bypass not logged as %q: %q", tc.wantLog, buf.String())
+			}
+			if !strings.Contains(lh.dumpState(0), "bypassed ("+tc.wantLog+"): 2") {
+				t.Fatalf("bypass not in debug output:\n%s", lh.dumpState(0))
+			}
+		})
+	}
+}
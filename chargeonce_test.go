@@ -0,0 +1,73 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChargeOnce(t *testing.T) {
+	for _, tc := range []struct {
+		chargeOnce bool
+		want       float64 // tokens left after a re-dispatched request
+	}{
+		{false, 8},
+		{true, 9},
+	} {
+		var lh *limiter
+		var inner int
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/inner" {
+				inner++
+				return
+			}
+			// re-dispatch a clone of the request internally
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/inner"
+			lh.ServeHTTP(w, r2)
+		})
+		lh = New(h, &Config{
+			RefillEvery: time.Hour,
+			Burst:       10,
+			ChargeOnce:  tc.chargeOnce,
+		}).(*limiter)
+		now := time.Unix(1000, 0)
+		lh.now = func() time.Time { return now }
+		req := httptest.NewRequest(http.MethodGet, "/outer", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+		if inner != 1 {
+			t.Fatalf("ChargeOnce %v: inner handler called %d times", tc.chargeOnce, inner)
+		}
+		bkt, _ := lh.bucketOf(keyOf(net.IPv4(192, 0, 2, 1).To4()))
+		if bkt.left != tc.want {
+			t.Errorf("ChargeOnce %v: got %v tokens left, want %v", tc.chargeOnce, bkt.left, tc.want)
+		}
+		// request with a fresh context is charged again
+		req = httptest.NewRequest(http.MethodGet, "/inner", nil).WithContext(context.Background())
+		req.RemoteAddr = "192.0.2.1:1234"
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+		if bkt, _ := lh.bucketOf(keyOf(net.IPv4(192, 0, 2, 1).To4())); bkt.left != tc.want-1 {
+			t.Errorf("ChargeOnce %v: fresh request not charged, %v tokens left", tc.chargeOnce, bkt.left)
+		}
+	}
+}
+
+// TestChargeOnceOtherLimiter checks that the marker of one limiter is not
+// honored by another
+func TestChargeOnceOtherLimiter(t *testing.T) {
+	inner := New(http.NotFoundHandler(), &Config{RefillEvery: time.Hour, Burst: 1, ChargeOnce: true})
+	outer := New(inner, &Config{RefillEvery: time.Hour, Burst: 10, ChargeOnce: true})
+	for i, want := range []int{http.StatusNotFound, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		outer.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("request %d: got %d, want %d", i, w.Code, want)
+		}
+	}
+}
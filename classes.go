@@ -0,0 +1,84 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"sort"
+)
+
+// maxClasses is the maximum number of classes in Config.ClassQuotas, one
+// index is taken by the class of requests not listed there
+const maxClasses = 255
+
+// setClasses sets up class quotas, classes are indexed in the order of
+// their names starting from 1; index 0 is for the class with empty name and
+// classes not listed in quotas
+func (h *limiter) setClasses(classify func(*http.Request) string, quotas map[string]float64) {
+	names := make([]string, 0, len(quotas))
+	for name := range quotas {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxClasses {
+		names = names[:maxClasses]
+	}
+	h.classify = classify
+	h.classIndex = make(map[string]uint8, len(names))
+	h.classNames = append([]string{""}, names...)
+	h.classQuota = make([]float64, len(h.classNames))
+	for i := range h.shards {
+		h.shards[i].classUsage = make([]int, len(h.classNames))
+	}
+	if q := quotas[""]; q > 0 && q <= 1 {
+		h.classQuota[0] = q
+	}
+	for i, name := range names {
+		h.classIndex[name] = uint8(i + 1)
+		if q := quotas[name]; q > 0 && q <= 1 {
+			h.classQuota[i+1] = q
+		}
+	}
+}
+
+// overQuota reports whether class c holds more buckets of shard s than
+// reserved for it, counting the bucket about to be created for class
+// adding. Must be called with s.m held.
+func (h *limiter) overQuota(s *shard, c, adding uint8) bool {
+	usage := s.classUsage[c]
+	if c == adding {
+		usage++
+	}
+	return usage > int(h.classQuota[c]*float64(s.capacity))
+}
+
+// classBuckets returns number of buckets by class name, the class of
+// requests not listed in quotas is reported under the empty name. It locks
+// one shard at a time.
+func (h *limiter) classBuckets() map[string]int {
+	if h.classQuota == nil {
+		return nil
+	}
+	out := make(map[string]int, len(h.classNames))
+	for _, name := range h.classNames {
+		out[name] = 0
+	}
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		for c, n := range s.classUsage {
+			out[h.classNames[c]] += n
+		}
+		s.m.Unlock()
+	}
+	return out
+}
+
+// className returns name of the class with the given index, empty for the
+// class of requests not listed in quotas
+func (h *limiter) className(class uint8) string {
+	if int(class) < len(h.classNames) {
+		return h.classNames[class]
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package ipratelimit
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassQuotas(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  100,
+		IPFunc:      IPFromXForwardedFor,
+		Class: func(r *http.Request) string {
+			if r.Header.Get("Authorization") != "" {
+				return "authenticated"
+			}
+			return "anonymous"
+		},
+		ClassQuotas: map[string]float64{"authenticated": 0.4},
+	}).(*limiter)
+	serve := func(ip net.IP, auth bool) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", ip.String())
+		if auth {
+			req.Header.Set("Authorization", "Bearer x")
+		}
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	ipOf := func(base uint32, i int) net.IP {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+uint32(i))
+		return ip
+	}
+	const authenticated = 30
+	for i := 0; i < authenticated; i++ {
+		if code := serve(ipOf(0xc0000200, i), true); code != http.StatusOK {
+			t.Fatalf("authenticated client %d: got code %d", i, code)
+		}
+	}
+	// flood of anonymous requests from unique addresses
+	for i := 0; i < 10000; i++ {
+		serve(ipOf(0x0a000000, i), false)
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	// buckets of authenticated clients are kept, so they are still limited
+	for i := 0; i < authenticated; i++ {
+		if code := serve(ipOf(0xc0000200, i), true); code != http.StatusTooManyRequests {
+			t.Fatalf("authenticated client %d: bucket was evicted, got code %d", i, code)
+		}
+	}
+	st := lh.Stats()
+	if got := st.ClassBuckets["authenticated"]; got != authenticated {
+		t.Fatalf("got %d authenticated buckets, want %d", got, authenticated)
+	}
+	if got := st.ClassBuckets["anonymous"] + st.ClassBuckets[""]; got+authenticated != st.Buckets {
+		t.Fatalf("got %d anonymous buckets of %d total", got, st.Buckets)
+	}
+
+	// authenticated clients over their reserve compete with the rest,
+	// but keep the reserve
+	for i := authenticated; i < 1000; i++ {
+		serve(ipOf(0xc0000200, i), true)
+	}
+	for i := 0; i < 1000; i++ {
+		serve(ipOf(0x0a100000, i), false)
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lh.Stats().ClassBuckets["authenticated"]; got != 40 {
+		t.Fatalf("got %d authenticated buckets, want reserved 40", got)
+	}
+}
+
+func TestClassQuotasValidate(t *testing.T) {
+	for _, quotas := range []map[string]float64{
+		{"a": -0.1},
+		{"a": 1.5},
+		{"a": 0.6, "b": 0.6},
+	} {
+		if err := (&Config{ClassQuotas: quotas}).Validate(); err == nil {
+			t.Errorf("%v: passed validation", quotas)
+		}
+	}
+}
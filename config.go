@@ -0,0 +1,156 @@
+package ipratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/artyom/logger"
+)
+
+// Supported range of Config.RefillEvery: with smaller intervals refill math
+// stops being meaningful as they approach clock granularity, effectively
+// disabling limiting.
+const (
+	MinRefillEvery = time.Millisecond
+	MaxRefillEvery = 365 * 24 * time.Hour
+)
+
+// Supported range of Config.Rate, tokens per second, equivalent to the range
+// of Config.RefillEvery.
+const (
+	MinRate = float64(time.Second) / float64(MaxRefillEvery)
+	MaxRate = float64(time.Second) / float64(MinRefillEvery)
+)
+
+// refillInterval returns interval to refill a single token: 1/Config.Rate
+// seconds if rate is positive, Config.RefillEvery otherwise, or the default
+// if neither is set. Values out of the supported range are clamped to it
+// with a warning logged.
+func refillInterval(cfg *Config, log logger.Interface) time.Duration {
+	if rate := cfg.Rate; rate > 0 {
+		switch {
+		case rate > MaxRate:
+			log.Printf("Rate %v is above the maximum, using %v", rate, MaxRate)
+			return MinRefillEvery
+		case rate < MinRate:
+			log.Printf("Rate %v is below the minimum, using %v", rate, MinRate)
+			return MaxRefillEvery
+		}
+		return time.Duration(math.Round(float64(time.Second) / rate))
+	}
+	interval := cfg.RefillEvery
+	switch {
+	case interval <= 0:
+		interval = defaultConfig.RefillEvery
+	case interval < MinRefillEvery:
+		log.Printf("RefillEvery %v is below the minimum, using %v", interval, MinRefillEvery)
+		interval = MinRefillEvery
+	case interval > MaxRefillEvery:
+		log.Printf("RefillEvery %v is above the maximum, using %v", interval, MaxRefillEvery)
+		interval = MaxRefillEvery
+	}
+	return interval
+}
+
+// Validate reports whether config values are within supported ranges. Zero
+// values are valid and mean defaults documented on the Config fields.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.RefillEvery == 0 || (c.RefillEvery >= MinRefillEvery && c.RefillEvery <= MaxRefillEvery),
+		"RefillEvery %v is out of [%v, %v] range", c.RefillEvery, MinRefillEvery, MaxRefillEvery)
+	check(c.Rate == 0 || (c.Rate >= MinRate && c.Rate <= MaxRate),
+		"Rate %v is out of [%v, %v] range", c.Rate, MinRate, MaxRate)
+	check(c.Burst >= 0, "negative Burst %d", c.Burst)
+	check(c.MaxBuckets == 0 || c.MaxBuckets >= 100, "MaxBuckets %d is less than 100", c.MaxBuckets)
+	check(c.TargetMemory >= 0, "negative TargetMemory %d", c.TargetMemory)
+	check(c.MinEvictionAge >= 0, "negative MinEvictionAge %v", c.MinEvictionAge)
+	check(c.NewKeyAlertRate >= 0, "negative NewKeyAlertRate %d", c.NewKeyAlertRate)
+	check(c.MaxLimiterTime >= 0, "negative MaxLimiterTime %v", c.MaxLimiterTime)
+	check(c.MaxBans >= 0, "negative MaxBans %d", c.MaxBans)
+	check(c.MaxRetryAfter >= 0, "negative MaxRetryAfter %v", c.MaxRetryAfter)
+	check(c.MaxWait >= 0, "negative MaxWait %v", c.MaxWait)
+	check(c.GlobalRefillEvery == 0 || (c.GlobalRefillEvery >= MinRefillEvery && c.GlobalRefillEvery <= MaxRefillEvery),
+		"GlobalRefillEvery %v is out of [%v, %v] range", c.GlobalRefillEvery, MinRefillEvery, MaxRefillEvery)
+	check(c.GlobalBurst >= 0, "negative GlobalBurst %d", c.GlobalBurst)
+	check((c.GlobalRefillEvery == 0) == (c.GlobalBurst == 0), "only one of GlobalRefillEvery and GlobalBurst is set")
+	check(c.IPv4Mask >= 0 && c.IPv4Mask <= 32, "IPv4Mask %d is out of [0, 32] range", c.IPv4Mask)
+	check(c.IPv6Mask >= 0 && c.IPv6Mask <= 128, "IPv6Mask %d is out of [0, 128] range", c.IPv6Mask)
+	check(!c.AnonymizeKeys || c.IPv4Mask <= anonymousIPv4Mask,
+		"IPv4Mask %d is longer than %d, which AnonymizeKeys allows", c.IPv4Mask, anonymousIPv4Mask)
+	check(!c.AnonymizeKeys || c.IPv6Mask <= anonymousIPv6Mask,
+		"IPv6Mask %d is longer than %d, which AnonymizeKeys allows", c.IPv6Mask, anonymousIPv6Mask)
+	check(c.InitialTokens >= 0 && c.InitialTokens <= max(c.Burst, 1),
+		"InitialTokens %d is out of [0, %d] range", c.InitialTokens, max(c.Burst, 1))
+	check(c.ForgiveAfter >= 0, "negative ForgiveAfter %v", c.ForgiveAfter)
+	check(c.NilIPWarnFraction >= 0 && c.NilIPWarnFraction < 1,
+		"NilIPWarnFraction %v is out of [0, 1) range", c.NilIPWarnFraction)
+	check(c.KeyConcentrationWarnFraction >= 0 && c.KeyConcentrationWarnFraction < 1,
+		"KeyConcentrationWarnFraction %v is out of [0, 1) range", c.KeyConcentrationWarnFraction)
+	check(c.SummaryEvery >= 0, "negative SummaryEvery %v", c.SummaryEvery)
+	check(c.EvictionSlice >= 0, "negative EvictionSlice %v", c.EvictionSlice)
+	check(c.MaxIdle >= 0, "negative MaxIdle %v", c.MaxIdle)
+	check(c.HistorySize >= 0, "negative HistorySize %d", c.HistorySize)
+	check(c.BypassLogEvery >= 0, "negative BypassLogEvery %d", c.BypassLogEvery)
+	check(c.MaxLogURL >= 0, "negative MaxLogURL %d", c.MaxLogURL)
+	check(c.EnforcePercent >= 0 && c.EnforcePercent <= 100, "EnforcePercent %d is out of [0, 100] range", c.EnforcePercent)
+	check(c.PenaltyThreshold >= 0 && c.PenaltyThreshold < math.MaxUint16,
+		"PenaltyThreshold %d is out of [0, %d) range", c.PenaltyThreshold, math.MaxUint16)
+	check(c.PenaltyDuration >= 0, "negative PenaltyDuration %v", c.PenaltyDuration)
+	check(c.RetryViolationBackoff >= 0, "negative RetryViolationBackoff %v", c.RetryViolationBackoff)
+	check(c.IPFuncTimeout >= 0, "negative IPFuncTimeout %v", c.IPFuncTimeout)
+	for name, l := range c.ServerNameLimits {
+		check(l.RefillEvery == 0 || (l.RefillEvery >= MinRefillEvery && l.RefillEvery <= MaxRefillEvery),
+			"ServerNameLimits[%q]: RefillEvery %v is out of [%v, %v] range", name, l.RefillEvery, MinRefillEvery, MaxRefillEvery)
+		check(l.Burst >= 0, "ServerNameLimits[%q]: negative Burst %d", name, l.Burst)
+		check(l.Response.valid(), "ServerNameLimits[%q]: invalid Response %+v", name, l.Response)
+	}
+	for _, p := range c.ServerNamePatterns {
+		name := strings.TrimPrefix(strings.TrimSpace(p), "*.")
+		check(name != "" && !strings.Contains(name, "*"), "invalid server name pattern %q", p)
+	}
+	for _, n := range c.Exempt {
+		check(normalizeNet(n) != nil, "invalid Exempt network %v", n)
+	}
+	for _, m := range c.Methods {
+		check(strings.TrimSpace(m) != "", "empty method in Methods")
+	}
+	for _, ua := range c.ExemptUserAgents {
+		check(ua != "", "empty ExemptUserAgents prefix exempts all requests")
+	}
+	check(c.Response.valid(), "invalid Response %+v", c.Response)
+	check(c.ShedResponse.valid(), "invalid ShedResponse %+v", c.ShedResponse)
+	var quotas float64
+	for name, q := range c.ClassQuotas {
+		check(q >= 0 && q <= 1, "ClassQuotas[%q]: %v is out of [0, 1] range", name, q)
+		quotas += q
+	}
+	check(quotas <= 1, "ClassQuotas add up to %v, more than 1", quotas)
+	check(len(c.ClassQuotas) <= maxClasses, "more than %d ClassQuotas", maxClasses)
+	if _, err := parsePolicy(c.Policy); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("ipratelimit: invalid config: %w", errors.Join(errs...))
+}
+
+// NewStrict is like New, but returns an error if config values are out of
+// supported ranges instead of replacing them, see Config.Validate.
+func NewStrict(h http.Handler, config *Config) (http.Handler, error) {
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return New(h, config), nil
+}
@@ -0,0 +1,338 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefillEveryExtremes(t *testing.T) {
+	for _, tc := range []struct {
+		in, want time.Duration
+		warn     bool
+	}{
+		{0, defaultConfig.RefillEvery, false},
+		{-time.Second, defaultConfig.RefillEvery, false},
+		{time.Nanosecond, MinRefillEvery, true},
+		{MinRefillEvery, MinRefillEvery, false},
+		{MaxRefillEvery, MaxRefillEvery, false},
+		{math.MaxInt64, MaxRefillEvery, true},
+	} {
+		var buf bytes.Buffer
+		cfg := &Config{RefillEvery: tc.in, Burst: 1000000, Logger: log.New(&buf, "", 0)}
+		lh := New(http.NotFoundHandler(), cfg).(*limiter)
+		if got := time.Duration(lh.gen.Load().def.refillEvery); got != tc.want {
+			t.Errorf("RefillEvery %v: got %v, want %v", tc.in, got, tc.want)
+		}
+		if warned := buf.Len() != 0; warned != tc.warn {
+			t.Errorf("RefillEvery %v: warning logged: %v, want %v (%q)", tc.in, warned, tc.warn, buf.String())
+		}
+		_, err := NewStrict(http.NotFoundHandler(), cfg)
+		if (err != nil) != (tc.warn || tc.in < 0) {
+			t.Errorf("RefillEvery %v: NewStrict error: %v", tc.in, err)
+		}
+		// bucket drained to zero with the largest interval must not
+		// produce negative or overflowed reset time
+		if reset := lh.gen.Load().def.resetIn(0); reset <= 0 {
+			t.Errorf("RefillEvery %v: resetIn(0) = %v", tc.in, reset)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate  float64
+		every time.Duration
+		want  time.Duration
+		warn  bool
+	}{
+		{10, 0, 100 * time.Millisecond, false},
+		{250, time.Second, 4 * time.Millisecond, false},
+		{0.5, 0, 2 * time.Second, false},
+		{3, 0, 333333333, false},
+		{0, time.Second, time.Second, false},
+		{-1, time.Second, time.Second, false},
+		{math.NaN(), 0, defaultConfig.RefillEvery, false},
+		{MaxRate, 0, MinRefillEvery, false},
+		{MinRate, 0, MaxRefillEvery, false},
+		{1e9, 0, MinRefillEvery, true},
+		{math.Inf(1), 0, MinRefillEvery, true},
+		{MinRate / 2, 0, MaxRefillEvery, true},
+	} {
+		var buf bytes.Buffer
+		cfg := &Config{Rate: tc.rate, RefillEvery: tc.every, Logger: log.New(&buf, "", 0)}
+		lh := New(http.NotFoundHandler(), cfg).(*limiter)
+		if got := time.Duration(lh.gen.Load().def.refillEvery); got != tc.want {
+			t.Errorf("Rate %v: got %v, want %v", tc.rate, got, tc.want)
+		}
+		if warned := buf.Len() != 0; warned != tc.warn {
+			t.Errorf("Rate %v: warning logged: %v, want %v (%q)", tc.rate, warned, tc.warn, buf.String())
+		}
+		invalid := tc.warn || tc.rate < 0 || math.IsNaN(tc.rate)
+		if err := cfg.Validate(); (err != nil) != invalid {
+			t.Errorf("Rate %v: Validate: %v", tc.rate, err)
+		}
+	}
+}
+
+// TestRateEquivalence checks that Rate 10 behaves exactly as RefillEvery
+// 100ms: same decisions and Retry-After values over the same traffic
+func TestRateEquivalence(t *testing.T) {
+	newLimiter := func(cfg *Config) (*limiter, *time.Time) {
+		cfg.Burst = 3
+		cfg.IPFunc = IPFromXForwardedFor
+		lh := New(http.NotFoundHandler(), cfg).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		return lh, &now
+	}
+	byRate, rateNow := newLimiter(&Config{Rate: 10})
+	byEvery, everyNow := newLimiter(&Config{RefillEvery: 100 * time.Millisecond})
+	if a, b := byRate.PolicyHash(), byEvery.PolicyHash(); a != b {
+		t.Fatalf("policy hashes differ: %s, %s", a, b)
+	}
+	serve := func(lh *limiter, addr string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code, w.Header().Get("Retry-After")
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		step := time.Duration(rnd.Intn(50)) * time.Millisecond
+		*rateNow, *everyNow = rateNow.Add(step), everyNow.Add(step)
+		addr := net.IPv4(192, 0, 2, byte(rnd.Intn(3))).String()
+		code1, retry1 := serve(byRate, addr)
+		code2, retry2 := serve(byEvery, addr)
+		if code1 != code2 || retry1 != retry2 {
+			t.Fatalf("request %d from %s: Rate got %d (Retry-After %q), RefillEvery got %d (Retry-After %q)",
+				i, addr, code1, retry1, code2, retry2)
+		}
+	}
+	if a, b := byRate.Counters(), byEvery.Counters(); a.Denied == 0 || a != b {
+		t.Errorf("counters differ or no denials: %+v, %+v", a, b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err != nil {
+		t.Fatalf("zero config: %v", err)
+	}
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	err := (&Config{Burst: -1, MaxBuckets: 10, NewKeyAlertRate: -1}).Validate()
+	if err == nil {
+		t.Fatal("invalid config passed validation")
+	}
+	for _, s := range []string{"Burst", "MaxBuckets", "NewKeyAlertRate"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not mention %s", err, s)
+		}
+	}
+	if _, err := NewStrict(http.NotFoundHandler(), &Config{Burst: -1}); err == nil {
+		t.Fatal("NewStrict accepted invalid config")
+	}
+	if h, err := NewStrict(http.NotFoundHandler(), nil); err != nil || h == nil {
+		t.Fatalf("NewStrict with nil config: %v, %v", h, err)
+	}
+}
+
+func TestDurationOf(t *testing.T) {
+	for _, tc := range []struct {
+		in   float64
+		want time.Duration
+	}{
+		{1.5, 1},
+		{math.Inf(1), math.MaxInt64},
+		{math.Inf(-1), math.MinInt64},
+		{math.NaN(), 0},
+		{1e30, math.MaxInt64},
+	} {
+		if got := durationOf(tc.in); got != tc.want {
+			t.Errorf("durationOf(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// FuzzTokensRange checks that bucket tokens always stay within [0, burst]
+// and are never NaN or infinite, for arbitrary access timings including the
+// clock going backwards, at both extremes of the supported refill intervals.
+func FuzzTokensRange(f *testing.F) {
+	f.Add(int64(1), uint8(1), false)
+	f.Add(int64(42), uint8(255), true)
+	f.Add(int64(-7), uint8(10), true)
+	f.Fuzz(func(t *testing.T, seed int64, burst uint8, slow bool) {
+		interval := MinRefillEvery
+		if slow {
+			interval = MaxRefillEvery
+		}
+		lh := New(http.NotFoundHandler(), &Config{RefillEvery: interval, Burst: int(burst), MaxBuckets: 100}).(*limiter)
+		rnd := rand.New(rand.NewSource(seed))
+		now := time.Unix(0, rnd.Int63())
+		lh.now = func() time.Time { return now }
+		ip := net.IPv4(10, 0, 0, 0)
+		for i := 0; i < 200; i++ {
+			now = time.Unix(0, rnd.Int63())
+			ip[15] = byte(rnd.Intn(4))
+			lh.Allow(ip)
+		}
+		if err := lh.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestConfigNotRetained(t *testing.T) {
+	var traced int
+	cfg := &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  100,
+		IPFunc:      IPFromXForwardedFor,
+		TraceHook:   func(context.Context, TraceEvent) { traced++ },
+		Vary:        "Origin",
+		TrackStats:  true,
+		MaxBans:     10,
+		LimitBody:   []byte("slow down"),
+		Policy: Policy{
+			Version:   "v1",
+			Allowlist: []string{"192.0.2.0/24"},
+			Denylist:  []string{"198.51.100.1"},
+		},
+	}
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg).(*limiter)
+
+	// mutate every field, including contents of shared slices
+	cfg.RefillEvery = time.Millisecond
+	cfg.Rate = 1
+	cfg.Burst = 1000
+	cfg.MaxBuckets = 1000
+	cfg.IPFunc = IPFromRemoteAddr
+	cfg.KeyFunc = func(*http.Request) []byte { return []byte("key") }
+	cfg.AddrFunc = AddrFromXForwardedFor
+	cfg.Logger = log.New(new(bytes.Buffer), "", 0)
+	cfg.TraceHook = nil
+	cfg.NewKeyAlertRate = 1
+	cfg.NewKeyAlertFunc = func(float64) {}
+	cfg.NewKeyAlertOverflow = true
+	cfg.CacheableDenials = true
+	cfg.Vary = "Cookie"
+	cfg.FailClosed = true
+	cfg.Store = failingStore{}
+	cfg.TargetMemory = 1 << 20
+	cfg.MinEvictionAge = time.Second
+	cfg.TrackStats = false
+	cfg.MaxLimiterTime = time.Nanosecond
+	cfg.Instrument = true
+	cfg.IPFuncTimeout = time.Nanosecond
+	cfg.Policy.Version = "v2"
+	cfg.Policy.Allowlist[0] = "203.0.113.0/24"
+	cfg.Policy.Denylist[0] = "192.0.2.1"
+	cfg.Score = &ScoreWeights{Usage: 1}
+	cfg.MaxBans = 1
+	cfg.BypassLogEvery = 1
+	cfg.KeyByServerName = true
+	cfg.ServerNameLimits = map[string]Limit{"example.com": {Burst: 100}}
+	cfg.ProblemDetails = true
+	cfg.ProblemType = "urn:x"
+	cfg.StrictServerNames = true
+	cfg.ServerNamePatterns = []string{"*.example.com"}
+	cfg.RejectUnknownServerNames = true
+	cfg.Class = func(*http.Request) string { return "x" }
+	cfg.ClassQuotas = map[string]float64{"x": 1}
+	cfg.Name = "other"
+	cfg.ForgiveAfter = time.Nanosecond
+	cfg.MaxIdle = time.Nanosecond
+	cfg.MaintenanceEvery = -1
+	cfg.HistorySize = 1
+	cfg.MaxRetryAfter = time.Second
+	cfg.Disabled = true
+	cfg.PolicyHashHeader = "X-Hash"
+	cfg.EvictionSlice = time.Nanosecond
+	cfg.ExemptUserAgents = []string{""}
+	cfg.SummaryEvery = time.Nanosecond
+	cfg.NilIPWarnFraction = 0.5
+	cfg.KeyConcentrationWarnFraction = 0.5
+	cfg.Response = Response{Status: http.StatusServiceUnavailable, RetryAfter: RetryAfterOmit, Body: BodyEmpty}
+	cfg.LimitedHandler = http.NotFoundHandler()
+	cfg.Cost = func(*http.Request) float64 { return 0 }
+	cfg.ShedResponse = Response{Status: http.StatusInternalServerError}
+	cfg.Exempt = []*net.IPNet{{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)}}
+	cfg.MaxLogURL = 1
+	cfg.RetryViolationBackoff = 2
+	cfg.EnforcePercent = 1
+	cfg.DryRun = true
+	cfg.ExactKeys = true
+	cfg.SendRateLimitHeaders = true
+	cfg.InitialTokens = 1
+	cfg.IPv4Mask = 1
+	cfg.IPv6Mask = 1
+	cfg.AnonymizeKeys = true
+	cfg.ChargeOnce = true
+	cfg.PenaltyThreshold = 1
+	cfg.PenaltyDuration = time.Hour
+	cfg.MaxWait = time.Hour
+	cfg.Methods = []string{http.MethodPost}
+	cfg.Skip = func(*http.Request) bool { return true }
+	cfg.GlobalRefillEvery = time.Hour
+	cfg.GlobalBurst = 1
+	cfg.SendScopeHeader = true
+	cfg.Refund = func(int) bool { return true }
+	cfg.Limits = func(net.IP) (time.Duration, int, bool) { return time.Nanosecond, 1000, true }
+	cfg.LimitBody[0] = 'S'
+	cfg.LimitContentType = "application/json"
+
+	serve := func(addr string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	for i := 0; i < 3; i++ {
+		if resp := serve("192.0.2.1"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("allowlisted address: got code %d", resp.StatusCode)
+		}
+	}
+	if resp := serve("198.51.100.1"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("denylisted address: got code %d", resp.StatusCode)
+	}
+	serve("203.0.113.1")
+	resp := serve("203.0.113.1")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got code %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "slow down" || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("got body %q of type %q", body, resp.Header.Get("Content-Type"))
+	}
+	if got := resp.Header.Get("Vary"); got != "Origin" {
+		t.Fatalf("got Vary %q, want Origin", got)
+	}
+	if got := resp.Header.Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("got Cache-Control %q, want no-store", got)
+	}
+	if got := resp.Header.Get(ScoreHeader); got != "" {
+		t.Fatalf("scoring mode enabled after New: %q", got)
+	}
+	if got := resp.Header.Get("RateLimit-Limit"); got != "" {
+		t.Fatalf("RateLimit headers enabled after New: %q", got)
+	}
+	st := lh.Stats()
+	if st.PolicyVersion != "v1" || st.MaxBans != 10 || st.MaxBuckets != 100 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if traced == 0 {
+		t.Fatal("TraceHook was not called")
+	}
+}
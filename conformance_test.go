@@ -0,0 +1,83 @@
+package ipratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestConformance runs test vectors storetest.RunConformance uses against
+// the built-in storage, also checking Retry-After values
+func TestConformance(t *testing.T) {
+	b, err := os.ReadFile("storetest/testdata/conformance.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Name          string
+		Burst         int
+		RefillEvery   string `json:"refill_every"`
+		MaxRetryAfter string `json:"max_retry_after"`
+		Steps         []struct {
+			At         string
+			Key        byte
+			Cost       float64
+			Allow      bool
+			Remaining  float64
+			RetryAfter int `json:"retry_after"`
+		}
+	}
+	if err := json.Unmarshal(b, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	parse := func(s string) time.Duration {
+		if s == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			lh := newLimiter(&Config{
+				RefillEvery:   parse(v.RefillEvery),
+				Burst:         v.Burst,
+				MaxRetryAfter: parse(v.MaxRetryAfter),
+			})
+			defer lh.Close()
+			var now time.Time
+			lh.now = func() time.Time { return now }
+			for j, s := range v.Steps {
+				now = start.Add(parse(s.At))
+				e := evaluation{ctx: context.Background(), ip: net.IPv4(192, 0, 2, s.Key), cost: s.Cost}
+				lh.evaluate(&e)
+				if e.err != nil {
+					t.Fatalf("step %d: %v", j, e.err)
+				}
+				if e.d.allow != s.Allow || math.Abs(e.d.remaining-s.Remaining) > 1e-9 {
+					t.Fatalf("step %d (key %d at %v, cost %v): got allowed=%v, remaining=%v, want %v, %v",
+						j, s.Key, s.At, e.cost, e.d.allow, e.d.remaining, s.Allow, s.Remaining)
+				}
+				if s.Allow {
+					continue
+				}
+				retryAfter := e.lim.retryAfter(e.d.remaining, e.cost)
+				if e.d.retryWait > 0 {
+					retryAfter = retryAfterValue(e.d.retryWait, e.lim.maxWait)
+				}
+				if want := strconv.Itoa(s.RetryAfter); retryAfter != want {
+					t.Fatalf("step %d: got Retry-After %s, want %s", j, retryAfter, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package ipratelimit
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCost(t *testing.T) {
+	var buf syncBuffer
+	var events []TraceEvent
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:          time.Second,
+		Burst:                100,
+		IPFunc:               IPFromXForwardedFor,
+		Logger:               log.New(&buf, "", 0),
+		SendRateLimitHeaders: true,
+		TraceHook:            func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+		Cost: func(r *http.Request) float64 {
+			switch r.URL.Path {
+			case "/search":
+				return 50
+			case "/export":
+				return 150
+			case "/small":
+				return 0.5
+			case "/health":
+				return 0
+			case "/bogus":
+				return -10
+			}
+			return 1
+		},
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func(addr, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w
+	}
+	for i, tc := range []struct {
+		path    string
+		code    int
+		charged float64
+		left    float64
+	}{
+		{"/export", http.StatusTooManyRequests, 0, 100}, // more than Burst, never allowed
+		{"/search", http.StatusNotFound, 50, 50},
+		{"/small", http.StatusNotFound, 0.5, 49.5},
+		{"/", http.StatusNotFound, 1, 48.5},
+		{"/search", http.StatusTooManyRequests, 0, 48.5},
+		{"/health", http.StatusNotFound, 0, 0},
+		{"/bogus", http.StatusNotFound, 0, 0},
+	} {
+		events = nil
+		w := serve("192.0.2.1", tc.path)
+		if w.Code != tc.code || len(events) != 1 || events[0].Charged != tc.charged || events[0].Remaining != tc.left {
+			t.Fatalf("request %d to %s: got status %d, events %+v", i, tc.path, w.Code, events)
+		}
+		if tc.charged == 0 && tc.left == 0 && w.Header().Get("RateLimit-Remaining") != "" {
+			t.Errorf("request %d to %s: free request got RateLimit headers", i, tc.path)
+		}
+	}
+	if !strings.Contains(buf.String(), "rate limited for 192.0.2.1 (cost 50): ") {
+		t.Errorf("cost of denied request not logged:\n%s", buf.String())
+	}
+	// free requests don't touch buckets
+	serve("192.0.2.2", "/health")
+	if n, _ := lh.buckets(); n != 1 {
+		t.Fatalf("got %d buckets", n)
+	}
+	if bkt, _ := lh.bucketOf(keyOf(canonicalIP(net.ParseIP("192.0.2.1")))); bkt.left != 48.5 || bkt.mtime != now.UnixNano() {
+		t.Fatalf("bucket changed by free requests: %+v", bkt)
+	}
+	now = now.Add(2 * time.Second)
+	if w := serve("192.0.2.1", "/search"); w.Code != http.StatusNotFound {
+		t.Fatalf("search after refill: got status %d", w.Code)
+	}
+}
@@ -0,0 +1,270 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// Counters are monotonic event counts of the limiter. Stats, metrics and the
+// periodic summary all report the same counters, so their numbers are
+// consistent with each other.
+type Counters struct {
+	Allowed uint64 // requests allowed by the pipeline
+	Denied  uint64 // requests denied by the pipeline
+	Failed  uint64 // decisions that could not be made, see Config.FailClosed
+
+	// LimiterTimeouts is the number of decisions failed because of
+	// Config.MaxLimiterTime
+	LimiterTimeouts uint64
+
+	// IPFuncTimeouts is the number of IPFunc calls that did not complete
+	// within Config.IPFuncTimeout
+	IPFuncTimeouts uint64
+
+	// Requests passed to the handler without rate limiting, by reason
+	BypassedNilIP     uint64 // IPFunc returned no usable address, or KeyFunc no key
+	BypassedAllowlist uint64 // Policy.Allowlist
+	BypassedUserAgent uint64 // Config.ExemptUserAgents
+	BypassedExempt    uint64 // Config.Exempt
+	BypassedMethod    uint64 // Config.Methods
+	BypassedSkip      uint64 // Config.Skip
+
+	Restored       uint64 // buckets added by RestoreCSV
+	RestoreSkipped uint64 // buckets skipped by RestoreCSV: already present or no capacity
+
+	// RetryViolations is the number of requests that came before the
+	// Retry-After given to the previous denied request of the same
+	// client, see Config.RetryViolationBackoff
+	RetryViolations uint64
+
+	// Penalties is the number of penalty bans imposed, see
+	// Config.PenaltyThreshold
+	Penalties uint64
+
+	// Decisions on requests of clients in the observed cohort, see
+	// Config.EnforcePercent and Config.DryRun; they are also counted in Allowed and Denied,
+	// the rest of which are decisions on the enforced cohort. Requests
+	// counted in ObservedDenied were passed to the handler.
+	ObservedAllowed uint64
+	ObservedDenied  uint64
+
+	// Evictions is the number of times excess buckets were evicted,
+	// Evicted is the number of buckets removed, and EvictionTime is the
+	// total time spent on evictions
+	Evictions    uint64
+	Evicted      uint64
+	EvictionTime time.Duration
+
+	// Expired is the number of buckets removed after Config.MaxIdle
+	Expired uint64
+
+	// Abandoned is the number of denied requests whose context was done
+	// before the response was written, e.g. because the client has
+	// disconnected. No response is written for them: Config.LimitedHandler
+	// is not called, and denial is not logged. They are also counted in
+	// Denied or, if denied by Config.FailClosed, in Failed. Requests whose
+	// context was done while waiting for tokens, see Config.MaxWait, are
+	// counted here as well as in Allowed.
+	Abandoned uint64
+
+	// Refunded is the number of requests whose tokens were returned, see
+	// Config.Refund. They are also counted in Allowed.
+	Refunded uint64
+
+	// KeyCollisions is the number of bucket lookups which found the bucket
+	// of a key owned by another client, see Config.ExactKeys
+	KeyCollisions uint64
+
+	// GlobalDenied is the number of requests denied by the global limit,
+	// see Config.GlobalBurst. They are also counted in Denied.
+	GlobalDenied uint64
+
+	// Shed is the number of requests denied because of the limiter's own
+	// capacity, see Config.ShedResponse. They are also counted in Failed
+	// or Denied.
+	Shed uint64
+}
+
+// Requests returns the total number of requests seen by the limiter
+func (c Counters) Requests() uint64 {
+	return c.Allowed + c.Denied + c.Failed + c.Bypassed()
+}
+
+// Bypassed returns the total number of requests passed to the handler
+// without rate limiting
+func (c Counters) Bypassed() uint64 {
+	return c.BypassedNilIP + c.BypassedAllowlist + c.BypassedUserAgent + c.BypassedExempt +
+		c.BypassedMethod + c.BypassedSkip
+}
+
+// since returns counts accrued since prev was taken; counters reset since
+// then are reported as accrued from zero
+func (c Counters) since(prev Counters) Counters {
+	cur, old := reflect.ValueOf(&c).Elem(), reflect.ValueOf(prev)
+	for i := 0; i < cur.NumField(); i++ {
+		if cur.Field(i).CanInt() {
+			if n, p := cur.Field(i).Int(), old.Field(i).Int(); n >= p {
+				cur.Field(i).SetInt(n - p)
+			}
+			continue
+		}
+		if n, p := cur.Field(i).Uint(), old.Field(i).Uint(); n >= p {
+			cur.Field(i).SetUint(n - p)
+		}
+	}
+	return c
+}
+
+// counters is a concurrency-safe version of Counters
+type counters struct {
+	allowed         atomic.Uint64
+	denied          atomic.Uint64
+	failed          atomic.Uint64
+	limiterTimeouts atomic.Uint64
+	ipfuncTimeouts  atomic.Uint64
+	bypassed        [numBypassClasses]atomic.Uint64
+	restored        atomic.Uint64
+	restoreSkipped  atomic.Uint64
+	retryViolations atomic.Uint64
+	penalties       atomic.Uint64
+	observedAllowed atomic.Uint64
+	observedDenied  atomic.Uint64
+	evictions       atomic.Uint64
+	evicted         atomic.Uint64
+	evictionTime    atomic.Int64
+	expired         atomic.Uint64
+	abandoned       atomic.Uint64
+	refunded        atomic.Uint64
+	keyCollisions   atomic.Uint64
+	globalDenied    atomic.Uint64
+	shed            atomic.Uint64
+}
+
+func (c *counters) snapshot() Counters {
+	return Counters{
+		Allowed:           c.allowed.Load(),
+		Denied:            c.denied.Load(),
+		Failed:            c.failed.Load(),
+		LimiterTimeouts:   c.limiterTimeouts.Load(),
+		IPFuncTimeouts:    c.ipfuncTimeouts.Load(),
+		BypassedNilIP:     c.bypassed[bypassNilIP].Load(),
+		BypassedAllowlist: c.bypassed[bypassAllowlist].Load(),
+		BypassedUserAgent: c.bypassed[bypassUserAgent].Load(),
+		BypassedExempt:    c.bypassed[bypassExempt].Load(),
+		BypassedMethod:    c.bypassed[bypassMethod].Load(),
+		BypassedSkip:      c.bypassed[bypassSkip].Load(),
+		Restored:          c.restored.Load(),
+		RestoreSkipped:    c.restoreSkipped.Load(),
+		RetryViolations:   c.retryViolations.Load(),
+		Penalties:         c.penalties.Load(),
+		ObservedAllowed:   c.observedAllowed.Load(),
+		ObservedDenied:    c.observedDenied.Load(),
+		Evictions:         c.evictions.Load(),
+		Evicted:           c.evicted.Load(),
+		EvictionTime:      time.Duration(c.evictionTime.Load()),
+		Expired:           c.expired.Load(),
+		Abandoned:         c.abandoned.Load(),
+		Refunded:          c.refunded.Load(),
+		KeyCollisions:     c.keyCollisions.Load(),
+		GlobalDenied:      c.globalDenied.Load(),
+		Shed:              c.shed.Load(),
+	}
+}
+
+func (c *counters) reset() {
+	for _, v := range []*atomic.Uint64{&c.allowed, &c.denied, &c.failed,
+		&c.limiterTimeouts, &c.ipfuncTimeouts, &c.restored, &c.restoreSkipped,
+		&c.retryViolations, &c.penalties, &c.observedAllowed, &c.observedDenied, &c.evictions,
+		&c.evicted, &c.expired, &c.abandoned, &c.globalDenied, &c.refunded,
+		&c.keyCollisions, &c.shed} {
+		v.Store(0)
+	}
+	c.evictionTime.Store(0)
+	for i := range c.bypassed {
+		c.bypassed[i].Store(0)
+	}
+}
+
+// count records the outcome of the evaluation
+func (c *counters) count(e *evaluation) {
+	switch {
+	case e.bypass: // counted by trackBypass
+	case e.err != nil:
+		c.failed.Add(1)
+	case e.d.allow:
+		c.allowed.Add(1)
+		if e.observed {
+			c.observedAllowed.Add(1)
+		}
+	default:
+		c.denied.Add(1)
+		if e.observed {
+			c.observedDenied.Add(1)
+		}
+	}
+}
+
+// Counters returns current Counters. Unlike Stats, it doesn't take any
+// locks, so it's cheap enough to be called often.
+//
+// Handler returned by New implements interface{ Counters() Counters }.
+func (h *limiter) Counters() Counters { return h.counters.snapshot() }
+
+// ResetCounters sets all Counters to zero, e.g. between test cases or after
+// an incident. Other parts of Stats, like histograms, are not affected.
+//
+// Handler returned by New implements interface{ ResetCounters() }.
+func (h *limiter) ResetCounters() {
+	h.counters.reset()
+	for i := range h.exemptUACounts {
+		h.exemptUACounts[i].Store(0)
+	}
+}
+
+// summaryLoop calls EmitSummary every interval until h.done is closed
+func (h *limiter) summaryLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.EmitSummary(now)
+		}
+	}
+}
+
+// EmitSummary logs counters accrued since the previous summary, or since
+// the limiter was created, as of now, and, if Config.TrackStats is set,
+// denial streaks completed since then; nothing is logged if there were no
+// events. It is called every Config.SummaryEvery in background; if
+// SummaryEvery is not set, it can be called on the embedder's own schedule
+// instead.
+//
+// Handler returned by New implements interface{ EmitSummary(time.Time) }.
+func (h *limiter) EmitSummary(now time.Time) {
+	h.summaryMu.Lock()
+	defer h.summaryMu.Unlock()
+	cur := h.counters.snapshot()
+	var streaks StreakHistogram
+	if h.trackStats {
+		streaks = h.denialStreaks()
+	}
+	if delta := cur.since(h.summaryPrev); delta != (Counters{}) {
+		h.logSummary(delta, streaks.since(h.summaryStreaks), now.Sub(h.summaryAt).Round(time.Millisecond))
+	}
+	h.summaryPrev, h.summaryStreaks, h.summaryAt = cur, streaks, now
+}
+
+func (h *limiter) logSummary(c Counters, streaks StreakHistogram, over time.Duration) {
+	var streakInfo string
+	if n := streaks.Total(); n > 0 {
+		streakInfo = fmt.Sprintf("; denial streaks %d, median length %s, p99 %s",
+			n, formatStreakLength(streaks.Percentile(50)), formatStreakLength(streaks.Percentile(99)))
+	}
+	h.log.Printf("summary over %v: allowed %d, denied %d, failed %d, bypassed %d, limiter timeouts %d, IPFunc timeouts %d, evicted %d in %v%s",
+		over, c.Allowed, c.Denied, c.Failed, c.Bypassed(), c.LimiterTimeouts, c.IPFuncTimeouts, c.Evicted, c.EvictionTime, streakInfo)
+}
@@ -0,0 +1,205 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestCountersConsistent(t *testing.T) {
+	var buf syncBuffer
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:  time.Hour,
+		Burst:        2,
+		IPFunc:       IPFromXForwardedFor,
+		Logger:       log.New(&buf, "", 0),
+		SummaryEvery: 10 * time.Millisecond,
+		Policy:       Policy{Allowlist: []string{"198.51.100.0/24"}},
+	}).(*limiter)
+	defer lh.Close()
+	serve := func(xff string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", xff)
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for i := 0; i < 20; i++ {
+		serve(fmt.Sprintf("192.0.2.%d", i%4)) // 8 allowed, 12 denied
+		if i%5 == 0 {
+			serve("198.51.100.1") // bypassed
+			serve("2001:db8::1")  // 2 allowed, 2 denied
+		}
+	}
+	st := lh.Stats()
+	if st.Allowed != 10 || st.Denied != 14 || st.Bypassed() != 4 || st.Failed != 0 {
+		t.Fatalf("got counters %+v", st.Counters)
+	}
+
+	rec := httptest.NewRecorder()
+	lh.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metric := func(series string) uint64 {
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if v, ok := strings.CutPrefix(line, series+" "); ok {
+				n, _ := strconv.ParseUint(v, 10, 64)
+				return n
+			}
+		}
+		t.Fatalf("no %s in metrics", series)
+		return 0
+	}
+	fromMetrics := Counters{
+		Allowed:           metric(`ipratelimit_decisions_total{limiter="",decision="allowed"}`),
+		Denied:            metric(`ipratelimit_decisions_total{limiter="",decision="denied"}`),
+		Failed:            metric(`ipratelimit_decisions_total{limiter="",decision="failed"}`),
+		BypassedAllowlist: metric(`ipratelimit_bypassed_total{limiter="",reason="allowlist"}`),
+		BypassedNilIP:     metric(`ipratelimit_bypassed_total{limiter="",reason="nil_ip"}`),
+	}
+	if fromMetrics.Allowed != st.Allowed || fromMetrics.Denied != st.Denied ||
+		fromMetrics.Failed != st.Failed || fromMetrics.Bypassed() != st.Bypassed() {
+		t.Errorf("metrics %+v don't match stats %+v", fromMetrics, st.Counters)
+	}
+
+	// summaries report deltas, their sum converges to the totals
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var allowed, denied, failed, bypassed uint64
+		sc := bufio.NewScanner(strings.NewReader(buf.String()))
+		for sc.Scan() {
+			_, line, ok := strings.Cut(sc.Text(), ": ")
+			if !strings.HasPrefix(sc.Text(), "summary over ") || !ok {
+				continue
+			}
+			var a, d, f, b, lt, it, ev uint64
+			var et string
+			if _, err := fmt.Sscanf(line, "allowed %d, denied %d, failed %d, bypassed %d, limiter timeouts %d, IPFunc timeouts %d, evicted %d in %s",
+				&a, &d, &f, &b, &lt, &it, &ev, &et); err != nil {
+				t.Fatalf("malformed summary %q: %v", sc.Text(), err)
+			}
+			allowed, denied, failed, bypassed = allowed+a, denied+d, failed+f, bypassed+b
+		}
+		if allowed == st.Allowed && denied == st.Denied && failed == st.Failed && bypassed == st.Bypassed() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("summaries add up to allowed %d, denied %d, failed %d, bypassed %d; stats: %+v\n%s",
+				allowed, denied, failed, bypassed, st.Counters, buf.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lh.ResetCounters()
+	if st := lh.Stats(); st.Counters != (Counters{}) {
+		t.Fatalf("counters not reset: %+v", st.Counters)
+	}
+	serve("192.0.2.10")
+	if st := lh.Stats(); st.Allowed != 1 || st.Denied != 0 {
+		t.Fatalf("got counters %+v after reset", st.Counters)
+	}
+}
+
+func TestEvictionCounters(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  100,
+	}).(*limiter)
+	for i := 0; i < 100; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i))
+		lh.Allow(ip)
+		lh.Allow(ip)
+	}
+	c := lh.Counters()
+	if c.Requests() != 200 || c.Allowed != 100 || c.Denied != 100 || c.Evictions != 0 || c.Evicted != 0 {
+		t.Fatalf("before eviction: got counters %+v", c)
+	}
+	lh.Allow(net.IPv4(10, 0, 1, 0))
+	c = lh.Counters()
+	if c.Requests() != 201 || c.Allowed != 101 || c.Evictions != 1 || c.Evicted != 10 || c.EvictionTime <= 0 {
+		t.Fatalf("after eviction: got counters %+v", c)
+	}
+	if st := lh.Stats(); st.Counters != c || st.Buckets != 91 {
+		t.Fatalf("stats %+v don't match counters %+v", st, c)
+	}
+	lh.ResetCounters()
+	if c := lh.Counters(); c != (Counters{}) {
+		t.Fatalf("counters not reset: %+v", c)
+	}
+}
+
+func TestCountersSince(t *testing.T) {
+	prev := Counters{Allowed: 5, Denied: 3, BypassedNilIP: 2}
+	cur := Counters{Allowed: 7, Denied: 1, BypassedNilIP: 2, Restored: 4, EvictionTime: time.Second}
+	want := Counters{Allowed: 2, Denied: 1, Restored: 4, EvictionTime: time.Second}
+	if got := cur.since(prev); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+// TestSummaryStreaks checks that summaries report denial streaks completed
+// since the previous summary
+func TestSummaryStreaks(t *testing.T) {
+	var buf syncBuffer
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+		TrackStats:  true,
+		Logger:      log.New(&buf, "", 0),
+	}).(*limiter)
+	defer lh.Close()
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	streak := func(ip net.IP, denials int) {
+		for i := 0; i <= denials; i++ {
+			lh.Allow(ip)
+		}
+		now = now.Add(time.Second)
+		lh.Allow(ip) // completes the streak
+	}
+	streak(net.IPv4(192, 0, 2, 1), 3)
+	streak(net.IPv4(192, 0, 2, 2), 1)
+	lh.EmitSummary(now)
+	streak(net.IPv4(192, 0, 2, 3), 200)
+	lh.EmitSummary(now)
+	lh.Allow(net.IPv4(192, 0, 2, 4))
+	lh.EmitSummary(now)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d summaries:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []string{
+		"; denial streaks 2, median length <=1, p99 <=4",
+		"; denial streaks 1, median length >128, p99 >128",
+		" in 0s",
+	} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("summary %d %q doesn't end with %q", i, lines[i], want)
+		}
+	}
+}
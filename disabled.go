@@ -0,0 +1,106 @@
+package ipratelimit
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Disabled returns handler passing all requests to h. It implements the same
+// methods as handler returned by New, so code using them works unchanged:
+// all requests are allowed, Stats are zero, bans are ignored; policies are
+// validated, but not applied. It's meant for environments where limiting
+// should be turned off without changes to the code, see also
+// Config.Disabled.
+func Disabled(h http.Handler) http.Handler {
+	if h == nil {
+		panic("nil handler")
+	}
+	return disabled{h}
+}
+
+type disabled struct{ handler http.Handler }
+
+func (d disabled) ServeHTTP(w http.ResponseWriter, r *http.Request) { d.handler.ServeHTTP(w, r) }
+
+func (disabled) Allow(net.IP) bool { return true }
+
+func (disabled) AllowCtx(context.Context, net.IP) (Decision, error) {
+	return Decision{Allowed: true, NextAllowed: time.Now()}, nil
+}
+
+func (disabled) Next(net.IP, int) time.Time { return time.Now() }
+
+func (disabled) Stats() Stats { return Stats{} }
+
+func (disabled) Counters() Counters { return Counters{} }
+
+func (disabled) RecentlyLimited(net.IP, time.Duration) bool { return false }
+
+func (disabled) History(net.IP) []DecisionRecord { return nil }
+
+func (disabled) Buckets(func(BucketEntry) bool) {}
+
+func (disabled) TopLimited(int) []BucketEntry { return nil }
+
+func (disabled) PolicyHash() string { return "" }
+
+func (disabled) Ban(net.IP, time.Duration) error { return nil }
+
+func (disabled) Unban(net.IP) {}
+
+func (disabled) ResetCounters() {}
+
+func (disabled) SetLimit(time.Duration, int) {}
+
+func (disabled) RunMaintenance(time.Time) {}
+
+func (disabled) EmitSummary(time.Time) {}
+
+func (disabled) BeginDrain() {}
+
+func (disabled) ApplyPolicy(p Policy) error {
+	if _, err := parsePolicy(p); err != nil {
+		return fmt.Errorf("ipratelimit: %w", err)
+	}
+	return nil
+}
+
+func (disabled) WatchPolicy(ctx context.Context, _ func() (Policy, error), _ time.Duration) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (disabled) MetricsHandler() http.Handler {
+	return metricsHandler("", func() Stats { return Stats{} })
+}
+
+func (disabled) ExportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	cw.Flush()
+	return cw.Error()
+}
+
+func (d disabled) ExportHandler(authorize func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		d.ExportCSV(w)
+	})
+}
+
+func (disabled) Close() error { return nil }
+
+func (disabled) RestoreCSV(context.Context, io.Reader) error { return nil }
+
+func (disabled) Snapshot(w io.Writer) error { return newSnapshotWriter(w).close() }
+
+func (disabled) Restore(io.Reader) error { return nil }
@@ -0,0 +1,110 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDisabledMethods(t *testing.T) {
+	// disabled handler must implement every method of the real one, so
+	// type assertions don't fail when limiting is turned off
+	lt, dt := reflect.TypeOf(&limiter{}), reflect.TypeOf(disabled{})
+	for i := 0; i < lt.NumMethod(); i++ {
+		m := lt.Method(i)
+		dm, ok := dt.MethodByName(m.Name)
+		if !ok {
+			t.Errorf("disabled handler has no %s method", m.Name)
+			continue
+		}
+		// compare signatures without the receiver
+		if !reflect.DeepEqual(funcArgs(m.Type), funcArgs(dm.Type)) {
+			t.Errorf("method %s: got %v, want %v", m.Name, dm.Type, m.Type)
+		}
+	}
+}
+
+func funcArgs(ft reflect.Type) (out []reflect.Type) {
+	for i := 1; i < ft.NumIn(); i++ {
+		out = append(out, ft.In(i))
+	}
+	for i := 0; i < ft.NumOut(); i++ {
+		out = append(out, ft.Out(i))
+	}
+	return out
+}
+
+func TestDisabled(t *testing.T) {
+	var served int
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { served++ })
+	lh := New(handler, &Config{Disabled: true, Burst: 1})
+	for i := 0; i < 10; i++ {
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if served != 10 {
+		t.Fatalf("handler served %d requests, want 10", served)
+	}
+	d := lh.(disabled)
+	ip := net.IPv4(192, 0, 2, 1)
+	if err := d.Ban(ip, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	d.Unban(ip)
+	if !d.Allow(ip) {
+		t.Fatal("request denied")
+	}
+	if dec, err := d.AllowCtx(context.Background(), ip); err != nil || !dec.Allowed {
+		t.Fatalf("got %+v, %v", dec, err)
+	}
+	if !reflect.DeepEqual(d.Stats(), Stats{}) {
+		t.Fatalf("got non-zero stats %+v", d.Stats())
+	}
+	if err := d.ApplyPolicy(Policy{Denylist: []string{"bogus"}}); err == nil {
+		t.Fatal("invalid policy accepted")
+	}
+	var buf bytes.Buffer
+	if err := d.ExportCSV(&buf); err != nil || buf.String() != "key,tokens,last_access,denial_streak,max_denial_streak,class,first_seen,requests,denials\n" {
+		t.Fatalf("got export %q, %v", buf.String(), err)
+	}
+	rec := httptest.NewRecorder()
+	d.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`ipratelimit_buckets{limiter=""} 0`)) {
+		t.Fatalf("unexpected metrics:\n%s", rec.Body)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.WatchPolicy(ctx, nil, time.Second); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStrict(handler, &Config{Disabled: true, Burst: -1}); err == nil {
+		t.Fatal("invalid config of disabled limiter accepted")
+	}
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, tc := range []struct {
+		name string
+		h    http.Handler
+	}{
+		{"direct", handler},
+		{"disabled", Disabled(handler)},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tc.h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
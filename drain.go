@@ -0,0 +1,33 @@
+package ipratelimit
+
+import "time"
+
+// BeginDrain switches the limiter into drain mode for graceful shutdown:
+// requests are still served, but no new state is created. Addresses with
+// existing buckets keep being limited by them, requests from other
+// addresses are all accounted in a single shared bucket, like with
+// Config.NewKeyAlertOverflow. If Config.Store is set, it is no longer
+// called, and all requests are accounted in the shared bucket. Automatic
+// sizing stops growing the number of buckets and RestoreCSV skips all
+// buckets. Drain mode can't be left; Close should still be called to stop
+// background goroutines.
+//
+// Handler returned by New implements interface{ BeginDrain() }.
+func (h *limiter) BeginDrain() {
+	if h.draining.CompareAndSwap(false, true) {
+		h.log.Print("drain mode started")
+	}
+}
+
+// takeOverflow takes cost tokens from the bucket shared by addresses which
+// can't have buckets of their own, must be called with h.m held
+func (h *limiter) takeOverflow(d *decision, cost float64, now time.Time) {
+	d.shared = true
+	def := h.gen.Load().def
+	d.allow = def.take(&h.overflow, cost, now)
+	d.remaining = h.overflow.left
+	if d.allow {
+		d.charged = cost
+	}
+	d.nextToken = def.nextTokenIn(h.overflow.left)
+}
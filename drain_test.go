@@ -0,0 +1,63 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBeginDrain(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:  time.Hour,
+		Burst:        3,
+		TargetMemory: 1 << 20,
+	}).(*limiter)
+	known := net.IPv4(192, 0, 2, 1)
+	lh.Allow(known)
+	lh.BeginDrain()
+	if !lh.Stats().Draining {
+		t.Fatal("Stats.Draining is not set")
+	}
+
+	// known address keeps its bucket
+	for i, want := range []bool{true, true, false} {
+		if got := lh.Allow(known); got != want {
+			t.Fatalf("known address request %d: got %v, want %v", i, got, want)
+		}
+	}
+	// new addresses share a single bucket of Burst tokens
+	var allowed int
+	for i := 0; i < 10; i++ {
+		if lh.Allow(net.IPv4(198, 51, 100, byte(i))) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("new addresses: %d requests allowed, want 3", allowed)
+	}
+	if n := lh.Stats().Buckets; n != 1 {
+		t.Fatalf("got %d buckets, want 1", n)
+	}
+
+	csv := "key,tokens,last_access,denial_streak,max_denial_streak,class\n" +
+		"#0000000000000001,1,2024-01-01T00:00:00Z,0,0,\n"
+	if err := lh.RestoreCSV(context.Background(), strings.NewReader(csv)); err != nil {
+		t.Fatal(err)
+	}
+	if st := lh.Stats(); st.Buckets != 1 || st.RestoreSkipped != 1 {
+		t.Fatalf("restore while draining: %d buckets, %d skipped", st.Buckets, st.RestoreSkipped)
+	}
+
+	lh.shards[0].youngEvictions = 1
+	if from, to := lh.autoSize(); to != from {
+		t.Fatalf("grown from %d to %d buckets while draining", from, to)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lh.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
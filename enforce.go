@@ -0,0 +1,13 @@
+package ipratelimit
+
+// DryRunHeader is the response header set to "limited" on requests which
+// would have been denied, see Config.DryRun.
+const DryRunHeader = "X-RateLimit-DryRun"
+
+// observed reports whether decisions on the client with the given address
+// key are not enforced, see Config.EnforcePercent and Config.DryRun. Cohort
+// is selected by address key before it's combined with the server name, so
+// it's the same for all requests of the client.
+func (h *limiter) observed(key uint64) bool {
+	return h.dryRun || (h.enforce != 0 && key%100 >= h.enforce)
+}
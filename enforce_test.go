@@ -0,0 +1,151 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnforcePercent(t *testing.T) {
+	const clients = 200
+	var buf syncBuffer
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:    time.Hour,
+		Burst:          1,
+		IPFunc:         IPFromXForwardedFor,
+		Logger:         log.New(&buf, "", 0),
+		EnforcePercent: 30,
+	}).(*limiter)
+	var observed uint64
+	for i := 0; i < clients; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		cohort := lh.observed(keyOf(net.ParseIP(addr).To4()))
+		if cohort {
+			observed++
+		}
+		for j := 0; j < 3; j++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", addr)
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			want := http.StatusNotFound // passed to the handler
+			if j > 0 && !cohort {
+				want = http.StatusTooManyRequests
+			}
+			if w.Code != want {
+				t.Fatalf("%s (observed %v), request %d: got status %d, want %d", addr, cohort, j, w.Code, want)
+			}
+		}
+	}
+	if enforced := clients - observed; enforced < 40 || enforced > 80 {
+		t.Errorf("%d of %d clients enforced, want about 30%%", enforced, clients)
+	}
+	st := lh.Stats()
+	if st.Allowed != clients || st.Denied != 2*clients {
+		t.Errorf("got %d allowed, %d denied", st.Allowed, st.Denied)
+	}
+	if st.ObservedAllowed != observed || st.ObservedDenied != 2*observed {
+		t.Errorf("observed cohort of %d clients: got %d allowed, %d denied", observed, st.ObservedAllowed, st.ObservedDenied)
+	}
+	if n := strings.Count(buf.String(), "not enforced: "); n != int(2*observed) {
+		t.Errorf("got %d not enforced denials logged, want %d", n, 2*observed)
+	}
+
+	// standalone limiter splits clients into the same cohorts
+	l := NewLimiter(&Config{RefillEvery: time.Hour, Burst: 1, EnforcePercent: 30})
+	defer l.Close()
+	for i := 0; i < clients; i++ {
+		ip := net.IPv4(10, 0, byte(i/256), byte(i%256))
+		l.Allow(ip)
+		if got, want := l.Allow(ip), lh.observed(keyOf(ip.To4())); got != want {
+			t.Fatalf("%s: second request allowed: %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestEnforcePercentBounds(t *testing.T) {
+	for _, p := range []int{0, 100} {
+		lh := New(http.NotFoundHandler(), &Config{EnforcePercent: p}).(*limiter)
+		for k := uint64(0); k < 100; k++ {
+			if lh.observed(k) {
+				t.Fatalf("EnforcePercent %d: key %d observed", p, k)
+			}
+		}
+	}
+	for _, p := range []int{-1, 101} {
+		if err := (&Config{EnforcePercent: p}).Validate(); err == nil || !strings.Contains(err.Error(), "EnforcePercent") {
+			t.Errorf("EnforcePercent %d: got error %v", p, err)
+		}
+	}
+}
+
+// TestDryRun replays the same requests through enforcing and dry run
+// limiters: bucket state must be identical, only responses differ
+func TestDryRun(t *testing.T) {
+	newLimiter := func(dryRun bool, buf *syncBuffer) (*limiter, *time.Time) {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: time.Second,
+			Burst:       3,
+			IPFunc:      IPFromXForwardedFor,
+			Logger:      log.New(buf, "", 0),
+			DryRun:      dryRun,
+		}).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		return lh, &now
+	}
+	var enforcedLog, dryRunLog syncBuffer
+	enforced, enforcedNow := newLimiter(false, &enforcedLog)
+	dryRun, dryRunNow := newLimiter(true, &dryRunLog)
+	serve := func(lh *limiter, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w
+	}
+	addrs := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}
+	var limited int
+	for i := 0; i < 200; i++ {
+		step := time.Duration(i%7) * 50 * time.Millisecond
+		*enforcedNow, *dryRunNow = enforcedNow.Add(step), dryRunNow.Add(step)
+		addr := addrs[i%len(addrs)]
+		w1, w2 := serve(enforced, addr), serve(dryRun, addr)
+		if w2.Code != http.StatusNotFound {
+			t.Fatalf("request %d: dry run got status %d", i, w2.Code)
+		}
+		wasLimited := w1.Code == http.StatusTooManyRequests
+		if wasLimited {
+			limited++
+		}
+		if got := w2.Header().Get(DryRunHeader); (got == "limited") != wasLimited {
+			t.Fatalf("request %d: enforcing got status %d, dry run got %s %q", i, w1.Code, DryRunHeader, got)
+		}
+		if w1.Header().Get(DryRunHeader) != "" {
+			t.Fatalf("request %d: %s set in enforcing mode", i, DryRunHeader)
+		}
+	}
+	if limited == 0 {
+		t.Fatal("no requests limited")
+	}
+	for _, addr := range addrs {
+		key := keyOf(canonicalIP(net.ParseIP(addr)))
+		b1, ok1 := enforced.bucketOf(key)
+		b2, ok2 := dryRun.bucketOf(key)
+		if !ok1 || !ok2 || b1 != b2 {
+			t.Errorf("%s: bucket %+v (%v) in enforcing mode, %+v (%v) in dry run", addr, b1, ok1, b2, ok2)
+		}
+	}
+	c1, c2 := enforced.Counters(), dryRun.Counters()
+	if c2.Denied != c1.Denied || c2.ObservedDenied != c1.Denied || c2.Allowed != c1.Allowed {
+		t.Errorf("enforcing counters %+v, dry run counters %+v", c1, c2)
+	}
+	if n := strings.Count(dryRunLog.String(), "not enforced: "); n != limited {
+		t.Errorf("got %d not enforced denials logged, want %d", n, limited)
+	}
+}
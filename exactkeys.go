@@ -0,0 +1,57 @@
+package ipratelimit
+
+import (
+	"hash/maphash"
+	"math"
+
+	"github.com/cespare/xxhash"
+)
+
+// ownerMemSize is an estimated memory footprint of the owner hash of a
+// single bucket kept with Config.ExactKeys: map entry with its share of map
+// overhead
+const ownerMemSize = 24
+
+// keyHash is the hash of addresses and opaque keys used as bucket keys,
+// tests replace it to force collisions
+var keyHash = xxhash.Sum64
+
+// Buckets are keyed by 64-bit hashes, so data of different clients may hash
+// to the same key and share a bucket. With Config.ExactKeys each shard also
+// keeps an independent hash of the data that created each bucket, its
+// owner. Data hashing to a key owned by other data is moved to the next key
+// of the same shard, in steps of the number of shards, until a key owned by
+// the same data or not owned at all is found. Once a bucket in the middle
+// of such chain is removed, keys past it lose their buckets, as if they
+// were evicted.
+
+// slotOf returns key of the bucket of data hashed to key in shard s, and
+// owner hash of data, see Config.ExactKeys. Key is returned as is if
+// h.exactKeys is not set or data is nil. Must be called with s.m held.
+func (h *limiter) slotOf(s *shard, key uint64, data []byte) (slot, owner uint64) {
+	if !h.exactKeys || data == nil {
+		return key, 0
+	}
+	owner = maphash.Bytes(h.ownerSeed, data)
+	step := uint64(len(h.shards))
+	for {
+		if o, ok := s.owners[key]; !ok || o == owner {
+			return key, owner
+		}
+		h.counters.keyCollisions.Add(1)
+		if key > math.MaxUint64-step {
+			key %= step // wrap around staying in the same shard
+		} else {
+			key += step
+		}
+	}
+}
+
+// claim records owner of the bucket with the given key, must be called with
+// s.m held
+func (s *shard) claim(key, owner uint64) {
+	if s.owners == nil {
+		s.owners = make(map[uint64]uint64)
+	}
+	s.owners[key] = owner
+}
@@ -0,0 +1,109 @@
+package ipratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// collideKeys makes all bucket keys hash to the same value for the duration
+// of the test
+func collideKeys(t *testing.T, key uint64) {
+	t.Helper()
+	orig := keyHash
+	keyHash = func([]byte) uint64 { return key }
+	t.Cleanup(func() { keyHash = orig })
+}
+
+func TestExactKeys(t *testing.T) {
+	collideKeys(t, 42)
+	a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	for _, exact := range []bool{false, true} {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery:  time.Hour,
+			Burst:        1,
+			MaxBuckets:   10,
+			TrackStats:   true,
+			TrackHistory: true,
+			ExactKeys:    exact,
+		}).(*limiter)
+		if !lh.Allow(a) {
+			t.Fatalf("exact=%v: first request of %v denied", exact, a)
+		}
+		if got := lh.Allow(b); got != exact {
+			t.Fatalf("exact=%v: first request of %v allowed: %v", exact, b, got)
+		}
+		if !exact {
+			continue // colliding addresses share a bucket
+		}
+		if lh.Allow(a) || lh.Allow(b) {
+			t.Fatal("second requests allowed")
+		}
+		if st := lh.Stats(); st.Buckets != 2 || st.KeyCollisions != 2 {
+			t.Fatalf("got %d buckets, %d collisions, want 2 and 2", st.Buckets, st.KeyCollisions)
+		}
+		if got := len(lh.History(b)); got != 2 {
+			t.Errorf("history of %v holds %d decisions, want 2", b, got)
+		}
+		if !lh.RecentlyLimited(b, time.Hour) {
+			t.Errorf("%v not reported as limited", b)
+		}
+		if err := lh.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestExactKeysWrap checks that keys of colliding addresses stay in the
+// shard of their hash when they wrap around
+func TestExactKeysWrap(t *testing.T) {
+	collideKeys(t, math.MaxUint64)
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  20000,
+		ExactKeys:   true,
+	}).(*limiter)
+	if len(lh.shards) < 2 {
+		t.Fatalf("got %d shards", len(lh.shards))
+	}
+	for i := 0; i < 3; i++ {
+		if !lh.Allow(net.IPv4(192, 0, 2, byte(i))) {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExactKeysEviction checks that addresses keep their own buckets while
+// buckets of colliding ones are evicted and expired
+func TestExactKeysEviction(t *testing.T) {
+	collideKeys(t, 7)
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  10,
+		ExactKeys:   true,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	for i := 0; i < 50; i++ {
+		lh.Allow(net.IPv4(192, 0, 2, byte(i)))
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	lh.maxIdle = int64(time.Minute)
+	now = now.Add(time.Hour)
+	lh.expire(now)
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(lh.shards[0].owners); n != 0 {
+		t.Errorf("%d owners left after expiration", n)
+	}
+}
@@ -0,0 +1,177 @@
+// Command ratelimit-proxy is a reverse proxy with the rate limiter in front
+// of the target URL, a runnable example of the ipratelimit package.
+//
+// Address tables are loaded from a JSON file holding ipratelimit.Policy:
+//
+//	{
+//		"version": "2024-05-01",
+//		"allowlist": ["10.0.0.0/8"],
+//		"denylist": ["192.0.2.0/24"]
+//	}
+//
+// On SIGHUP the file is read again and applied with ApplyPolicy; if it's
+// invalid, the current policy is kept.
+//
+// Second, debug listener serves metrics in Prometheus text format at
+// /metrics, limiter statistics as JSON at /debug/stats and bucket table as
+// CSV at /debug/buckets. It's not protected in any way and must not be
+// exposed to clients.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+func main() {
+	args := runArgs{
+		Addr:        "localhost:8080",
+		DebugAddr:   "localhost:8081",
+		RefillEvery: time.Second,
+		Burst:       10,
+	}
+	flag.StringVar(&args.Addr, "addr", args.Addr, "address to serve proxied requests on")
+	flag.StringVar(&args.DebugAddr, "debug", args.DebugAddr, "address to serve metrics and debug endpoints on")
+	flag.StringVar(&args.Target, "target", args.Target, "absolute `URL` to proxy requests to")
+	flag.StringVar(&args.PolicyFile, "policy", args.PolicyFile, "JSON `file` with allowlist and denylist, reloaded on SIGHUP")
+	flag.DurationVar(&args.RefillEvery, "every", args.RefillEvery, "add a token to each bucket this often")
+	flag.IntVar(&args.Burst, "burst", args.Burst, "bucket capacity")
+	flag.BoolVar(&args.Forwarded, "xff", args.Forwarded, "identify clients by X-Forwarded-For, only safe behind a trusted proxy")
+	flag.Parse()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	if err := run(ctx, args, hup, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type runArgs struct {
+	Addr        string
+	DebugAddr   string
+	Target      string
+	PolicyFile  string
+	RefillEvery time.Duration
+	Burst       int
+	Forwarded   bool
+}
+
+// limiter is the set of limiter methods the program uses
+type limiter interface {
+	http.Handler
+	ApplyPolicy(ipratelimit.Policy) error
+	MetricsHandler() http.Handler
+	ExportHandler(func(*http.Request) bool) http.Handler
+	Stats() ipratelimit.Stats
+	Close() error
+}
+
+// run serves until ctx is canceled, reloading policy on each value received
+// from hup. If ready is not nil, it's called with addresses of both
+// listeners once they are open.
+func run(ctx context.Context, args runArgs, hup <-chan os.Signal, ready func(addr, debugAddr net.Addr)) error {
+	target, err := url.Parse(args.Target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	cfg := &ipratelimit.Config{
+		RefillEvery: args.RefillEvery,
+		Burst:       args.Burst,
+		Logger:      log.Default(),
+		TrackStats:  true,
+	}
+	if args.Forwarded {
+		cfg.IPFunc = ipratelimit.IPFromXForwardedFor
+	}
+	if args.PolicyFile != "" {
+		if cfg.Policy, err = loadPolicy(args.PolicyFile); err != nil {
+			return err
+		}
+	}
+	h, err := ipratelimit.ProxyHandler(target, cfg)
+	if err != nil {
+		return err
+	}
+	lim := h.(limiter)
+	defer lim.Close()
+
+	ln, err := net.Listen("tcp", args.Addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	debugLn, err := net.Listen("tcp", args.DebugAddr)
+	if err != nil {
+		return err
+	}
+	defer debugLn.Close()
+
+	srv := &http.Server{Handler: lim, ReadHeaderTimeout: 10 * time.Second}
+	debugSrv := &http.Server{Handler: debugMux(lim), ReadHeaderTimeout: 10 * time.Second}
+	errc := make(chan error, 2)
+	go func() { errc <- srv.Serve(ln) }()
+	go func() { errc <- debugSrv.Serve(debugLn) }()
+	if ready != nil {
+		ready(ln.Addr(), debugLn.Addr())
+	}
+	for {
+		select {
+		case <-hup:
+			if args.PolicyFile == "" {
+				continue
+			}
+			p, err := loadPolicy(args.PolicyFile)
+			if err == nil {
+				err = lim.ApplyPolicy(p)
+			}
+			if err != nil {
+				log.Printf("policy reload: %v", err)
+			}
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return errors.Join(srv.Shutdown(sctx), debugSrv.Shutdown(sctx))
+		}
+	}
+}
+
+func debugMux(lim limiter) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", lim.MetricsHandler())
+	mux.Handle("GET /debug/buckets", lim.ExportHandler(func(*http.Request) bool { return true }))
+	mux.HandleFunc("GET /debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(lim.Stats())
+	})
+	return mux
+}
+
+func loadPolicy(name string) (ipratelimit.Policy, error) {
+	var p ipratelimit.Policy
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("%s: %w", name, err)
+	}
+	return p, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+func TestRun(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, policyFile, ipratelimit.Policy{Version: "v1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal, 1)
+	type addrs struct{ addr, debug string }
+	readyc := make(chan addrs, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- run(ctx, runArgs{
+			Addr:        "127.0.0.1:0",
+			DebugAddr:   "127.0.0.1:0",
+			Target:      backend.URL,
+			PolicyFile:  policyFile,
+			RefillEvery: time.Hour,
+			Burst:       2,
+			Forwarded:   true,
+		}, hup, func(addr, debugAddr net.Addr) {
+			readyc <- addrs{addr.String(), debugAddr.String()}
+		})
+	}()
+	var a addrs
+	select {
+	case a = <-readyc:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+
+	get := func(client string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+a.addr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", client)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	debug := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + a.debug + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %s, %v", path, resp.Status, err)
+		}
+		return string(b)
+	}
+
+	const client = "192.0.2.1"
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := get(client); got != want {
+			t.Fatalf("request %d: got status %d, want %d", i, got, want)
+		}
+	}
+
+	writePolicy(t, policyFile, ipratelimit.Policy{Version: "v2", Allowlist: []string{client}})
+	hup <- syscall.SIGHUP
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var st ipratelimit.Stats
+		if err := json.Unmarshal([]byte(debug("/debug/stats")), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.PolicyVersion == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("policy not reloaded, version %q", st.PolicyVersion)
+		}
+	}
+	if got := get(client); got != http.StatusOK {
+		t.Fatalf("allowlisted client got status %d", got)
+	}
+
+	if m := debug("/metrics"); !strings.Contains(m, "ipratelimit_") {
+		t.Errorf("unexpected metrics:\n%s", m)
+	}
+	if b := debug("/debug/buckets"); len(strings.Split(strings.TrimSpace(b), "\n")) != 2 {
+		t.Errorf("want header and a single bucket, got:\n%s", b)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePolicy(t *testing.T, name string, p ipratelimit.Policy) {
+	t.Helper()
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,225 @@
+package ipratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func ExampleNewStrict() {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	_, err := NewStrict(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Nanosecond,
+		Burst:       -1,
+	})
+	fmt.Println(err)
+	// Output:
+	// ipratelimit: invalid config: RefillEvery 1ns is out of [1ms, 8760h0m0s] range
+	// negative Burst -1
+}
+
+func ExampleIPFromXForwardedFor() {
+	req := httptest.NewRequest("GET", "/", nil)
+	// two proxies each added their own header line
+	req.Header.Add("X-Forwarded-For", "192.0.2.1")
+	req.Header.Add("X-Forwarded-For", "198.51.100.1")
+	fmt.Println(IPFromXForwardedFor(req))
+	// Output:
+	// 192.0.2.1
+}
+
+func ExamplePolicy() {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc:      IPFromXForwardedFor,
+		Policy: Policy{
+			Version:   "v1",
+			Allowlist: []string{"192.0.2.0/24"},
+			Denylist:  []string{"198.51.100.1"},
+		},
+	})
+	for _, addr := range []string{"192.0.2.1", "192.0.2.1", "198.51.100.1", "203.0.113.1", "203.0.113.1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		fmt.Println(addr, rec.Code)
+	}
+	// Output:
+	// 192.0.2.1 200
+	// 192.0.2.1 200
+	// 198.51.100.1 403
+	// 203.0.113.1 200
+	// 203.0.113.1 429
+}
+
+func ExampleConfig_problemDetails() {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery:    time.Minute,
+		Burst:          1,
+		ProblemDetails: true,
+		ProblemType:    "https://example.com/probs/rate-limited",
+	})
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		lh.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	}
+	fmt.Println(rec.Code, rec.Header().Get("Content-Type"))
+	fmt.Print(rec.Body)
+	// Output:
+	// 429 application/problem+json
+	// {"type":"https://example.com/probs/rate-limited","title":"Too Many Requests","status":429,"detail":"Request rate limit of 1 exceeded, retry in 60 seconds.","retry_after":60,"limit":1}
+}
+
+func ExampleConfig_score() {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		score, _ := ScoreFromContext(r.Context())
+		fmt.Printf("handler called with score %.2f\n", score)
+	}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		Score:       &ScoreWeights{Usage: 1},
+	})
+	for i := 0; i < 3; i++ {
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	// Output:
+	// handler called with score 0.50
+	// handler called with score 1.00
+	// handler called with score 1.00
+}
+
+func ExampleInfoFromContext() {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if info, ok := InfoFromContext(r.Context()); ok {
+			fmt.Println(info.IP, "tokens left:", int(info.Remaining))
+		}
+	}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Hour,
+		Burst:       3,
+	})
+	for i := 0; i < 3; i++ {
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	// Output:
+	// 192.0.2.1 tokens left: 2
+	// 192.0.2.1 tokens left: 1
+	// 192.0.2.1 tokens left: 0
+}
+
+// Limiter can be used outside of HTTP serving, e.g. for connections accepted
+// by a custom server loop.
+func Example_allowCtx() {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+	})
+	lim := lh.(interface {
+		AllowCtx(context.Context, net.IP) (Decision, error)
+	})
+	for _, addr := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.1", "2001:db8::1", "::"} {
+		d, err := lim.AllowCtx(context.Background(), net.ParseIP(addr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(addr, d.Allowed, int(d.Remaining), d.Stage)
+	}
+	// Output:
+	// 192.0.2.1 true 1 limit
+	// 192.0.2.1 true 0 limit
+	// 192.0.2.1 false 0 limit
+	// 2001:db8::1 true 1 limit
+	// :: true 0 address
+}
+
+// Example_topLimited serves clients being limited now as JSON on an admin
+// endpoint, which must not be exposed to clients
+func Example_topLimited() {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		TrackStats:  true,
+	})
+	lim := lh.(interface{ TopLimited(int) []BucketEntry })
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err != nil {
+			n = 10
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lim.TopLimited(n))
+	})
+
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.1:1234", "192.0.2.1:1234", "198.51.100.1:1234", "198.51.100.1:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/limited?n=5", nil))
+	var top []BucketEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &top); err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range top {
+		fmt.Println(e.Key, e.DenialStreak)
+	}
+	// Output:
+	// #9c3163f48c1ed6ff 2
+	// #302fe1d8e83af7f9 1
+}
+
+func ExampleLimiter() {
+	l := NewLimiter(&Config{
+		RefillEvery: time.Hour,
+		Burst:       3,
+	})
+	defer l.Close()
+	peer := net.ParseIP("192.0.2.1") // e.g. address of an SMTP client
+	fmt.Println(l.AllowN(peer, 2), l.AllowN(peer, 2), l.Allow(peer))
+	// Output:
+	// true false true
+}
+
+func ExampleProxyHandler() {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "origin saw X-Forwarded-Proto:", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer origin.Close()
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ph, err := ProxyHandler(target, &Config{RefillEvery: time.Hour, Burst: 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+	front := httptest.NewServer(ph)
+	defer front.Close()
+	for i := 0; i < 2; i++ {
+		res, err := http.Get(front.URL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Printf("%s: %s", res.Status, body)
+	}
+	// Output:
+	// 200 OK: origin saw X-Forwarded-Proto: http
+	// 429 Too Many Requests: Too Many Requests
+}
@@ -0,0 +1,38 @@
+package ipratelimit
+
+import "time"
+
+// expire removes buckets not accessed for h.maxIdle as of now and returns
+// the number of buckets removed. Shards are processed one by one, each
+// queue of keys is passed over once, keeping the order of the remaining
+// keys, so they are evicted in the same order as before.
+func (h *limiter) expire(now time.Time) int {
+	cutoff := now.UnixNano() - h.maxIdle
+	var expired int
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		for n := s.keys.len(); n > 0; n-- {
+			k := s.keys.pop()
+			bkt := s.ipmap[k]
+			if bkt.mtime > cutoff {
+				s.keys.push(k)
+				continue
+			}
+			if h.trackStats && bkt.streak > 0 {
+				s.streaks.add(bkt.streak)
+			}
+			if s.classUsage != nil {
+				s.classUsage[bkt.class]--
+			}
+			delete(s.ipmap, k)
+			delete(s.history, k)
+			delete(s.owners, k)
+			delete(s.totals, k)
+			expired++
+		}
+		s.m.Unlock()
+	}
+	h.counters.expired.Add(uint64(expired))
+	return expired
+}
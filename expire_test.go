@@ -0,0 +1,74 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Minute,
+		Burst:       2,
+		MaxBuckets:  5000,
+		MaxIdle:     time.Hour,
+		TrackStats:  true,
+	}).(*limiter)
+	defer lh.Close()
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	for i := 0; i < 3000; i++ {
+		lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	// denied client whose denial streak should be kept in stats
+	idle := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 3; i++ {
+		lh.Allow(idle)
+	}
+	now = now.Add(30 * time.Minute)
+	for i := 0; i < 1000; i++ {
+		lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	if n := lh.expire(now.Add(30*time.Minute - time.Second)); n != 0 {
+		t.Fatalf("expired %d buckets before MaxIdle", n)
+	}
+	if n := lh.expire(now.Add(30 * time.Minute)); n != 2001 {
+		t.Fatalf("expired %d buckets, want 2001", n)
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatalf("%v\nstate:\n%s", err, lh.dumpState(20))
+	}
+	st := lh.Stats()
+	if st.Buckets != 1000 || st.Expired != 2001 || st.Evicted != 0 {
+		t.Fatalf("got %d buckets, %d expired, %d evicted", st.Buckets, st.Expired, st.Evicted)
+	}
+	if st.DenialStreaks.Total() != 1 {
+		t.Fatalf("denial streak of expired bucket not recorded: %v", st.DenialStreaks)
+	}
+	if queues := st.BookkeepingMemory - int64(st.Buckets)*totalsMemSize; queues > 2*1000*keyMemSize*4 {
+		t.Fatalf("queues hold %d bytes for 1000 buckets", queues)
+	}
+	// client of the expired bucket starts afresh
+	now = now.Add(30 * time.Minute)
+	if !lh.Allow(idle) || !lh.Allow(idle) || lh.Allow(idle) {
+		t.Fatal("client of expired bucket didn't get a full bucket")
+	}
+}
+
+func TestExpireLoop(t *testing.T) {
+	defer func(d time.Duration) { minExpireEvery = d }(minExpireEvery)
+	minExpireEvery = time.Millisecond
+	lh := New(http.NotFoundHandler(), &Config{MaxIdle: time.Millisecond}).(*limiter)
+	defer lh.Close()
+	lh.Allow(net.IPv4(192, 0, 2, 1))
+	for deadline := time.Now().Add(5 * time.Second); lh.Counters().Expired == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("idle bucket was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n, _ := lh.buckets(); n != 0 {
+		t.Fatalf("got %d buckets", n)
+	}
+}
@@ -0,0 +1,125 @@
+package ipratelimit
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportBatch is the number of buckets ExportCSV copies under a single lock
+const exportBatch = 1000
+
+// csvHeader lists columns written by ExportCSV
+var csvHeader = []string{"key", "tokens", "last_access", "denial_streak", "max_denial_streak", "class",
+	"first_seen", "requests", "denials"}
+
+// csvHeaderColumns1 is the number of columns written by ExportCSV before
+// lifetime totals were added, RestoreCSV accepts such input
+const csvHeaderColumns1 = 6
+
+// ExportCSV writes all buckets to w as CSV, one row per bucket after the
+// header row. Columns are: bucket key (addresses are not stored, only their
+// hashes), tokens left as of the last access, last access time in RFC 3339
+// format, current and longest denial streaks, class name (see
+// Config.ClassQuotas), time the bucket was created, and the numbers of
+// requests it decided and of denials among them. Streaks and the last three
+// columns are only maintained if Config.TrackStats is set, otherwise they
+// are zero or, for the creation time, empty.
+//
+// Buckets are walked as by Buckets, so the lock is not held while writing.
+//
+// Handler returned by New implements interface{ ExportCSV(io.Writer) error }.
+func (h *limiter) ExportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	row := make([]string, len(csvHeader))
+	var err error
+	h.walkBuckets(func(key uint64, bkt bucket, t totals) bool {
+		row[0] = formatKey(key)
+		row[1] = strconv.FormatFloat(bkt.left, 'f', -1, 64)
+		row[2] = time.Unix(0, bkt.mtime).UTC().Format(time.RFC3339Nano)
+		row[3] = strconv.Itoa(int(bkt.streak))
+		row[4] = strconv.Itoa(int(bkt.maxStreak))
+		row[5] = h.className(bkt.class)
+		row[6] = ""
+		if t.firstSeen != 0 {
+			row[6] = time.Unix(0, t.firstSeen).UTC().Format(time.RFC3339Nano)
+		}
+		row[7] = strconv.FormatUint(uint64(t.requests), 10)
+		row[8] = strconv.FormatUint(uint64(t.denials), 10)
+		err = cw.Write(row)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// walkBuckets calls fn with each bucket of the built-in storage and its key
+// until fn returns false, copying buckets of each shard in batches of
+// exportBatch, see Buckets
+func (h *limiter) walkBuckets(fn func(key uint64, bkt bucket, t totals) bool) {
+	var keys []uint64
+	batch := make([]bucket, 0, exportBatch)
+	batchTotals := make([]totals, 0, exportBatch)
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		keys = keys[:0]
+		for k := range s.ipmap {
+			keys = append(keys, k)
+		}
+		s.m.Unlock()
+
+		for len(keys) > 0 {
+			n := min(len(keys), exportBatch)
+			batch, batchTotals = batch[:0], batchTotals[:0]
+			s.m.Lock()
+			for _, k := range keys[:n] {
+				batchTotals = append(batchTotals, s.totals[k])
+				if bkt, ok := s.ipmap[k]; ok {
+					batch = append(batch, bkt)
+					continue
+				}
+				batch = append(batch, bucket{mtime: -1}) // evicted
+			}
+			s.m.Unlock()
+			for i, bkt := range batch {
+				if bkt.mtime < 0 {
+					continue
+				}
+				if !fn(keys[i], bkt, batchTotals[i]) {
+					return
+				}
+			}
+			keys = keys[n:]
+		}
+	}
+}
+
+// ExportHandler returns handler serving ExportCSV output. Bucket table is
+// sensitive and exporting it is expensive, so requests are only served if
+// authorize returns true for them; others get "403 Forbidden" response. If
+// authorize is nil, all requests are forbidden.
+//
+// Handler returned by New implements
+// interface{ ExportHandler(func(*http.Request) bool) http.Handler }.
+func (h *limiter) ExportHandler(authorize func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := h.ExportCSV(w); err != nil {
+			h.log.Printf("bucket export: %v", err)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExportCSV(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		MaxBuckets:  5000,
+		TrackStats:  true,
+	}).(*limiter)
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	lh.now = func() time.Time { return now }
+	const n = 2500 // more than a single batch
+	ip := make(net.IP, 4)
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(ip, 0x0a000000+uint32(i))
+		lh.Allow(ip)
+	}
+	limited := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 5; i++ {
+		lh.Allow(limited)
+	}
+
+	var buf bytes.Buffer
+	if err := lh.ExportCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != n+2 {
+		t.Fatalf("got %d records, want %d", len(records), n+2)
+	}
+	if got := records[0]; len(got) != len(csvHeader) || got[0] != "key" {
+		t.Fatalf("unexpected header: %q", got)
+	}
+	want := []string{formatKey(keyOf(limited.To4())), "0", "2024-01-02T03:04:05.000000006Z", "3", "3", "",
+		"2024-01-02T03:04:05.000000006Z", "5", "3"}
+	var found bool
+	for _, rec := range records[1:] {
+		if rec[0] != want[0] {
+			if rec[1] != "1" || rec[3] != "0" || rec[6] != want[6] || rec[7] != "1" || rec[8] != "0" {
+				t.Fatalf("unexpected row %q", rec)
+			}
+			continue
+		}
+		found = true
+		for i := range want {
+			if rec[i] != want[i] {
+				t.Fatalf("got row %q, want %q", rec, want)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no row for the limited address")
+	}
+
+	h := lh.ExportHandler(func(r *http.Request) bool { return r.Header.Get("X-Token") == "secret" })
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("unauthorized export: got code %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Token", "secret")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || bytes.Count(rec.Body.Bytes(), []byte("\n")) != n+2 {
+		t.Fatalf("authorized export: got code %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	rec = httptest.NewRecorder()
+	lh.ExportHandler(nil).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("export with nil authorize: got code %d", rec.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package ipratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBounds lists inclusive upper bounds of DurationHistogram buckets,
+// the last bucket counts all durations longer than the last bound.
+var DurationBounds = [...]time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// DurationHistogram counts durations: i-th element counts durations not
+// longer than DurationBounds[i] and longer than the previous bound; the last
+// element counts durations longer than all bounds.
+type DurationHistogram [len(DurationBounds) + 1]uint64
+
+// durationHistogram is a concurrency-safe version of DurationHistogram
+type durationHistogram [len(DurationBounds) + 1]atomic.Uint64
+
+func (hs *durationHistogram) add(d time.Duration) {
+	for i, b := range DurationBounds {
+		if d <= b {
+			hs[i].Add(1)
+			return
+		}
+	}
+	hs[len(hs)-1].Add(1)
+}
+
+func (hs *durationHistogram) snapshot() DurationHistogram {
+	var out DurationHistogram
+	for i := range hs {
+		out[i] = hs[i].Load()
+	}
+	return out
+}
+
+type overheadKey struct{}
+
+// OverheadFromContext returns time the limiter spent on the request before
+// passing it to the handler; it is only available if Config.Instrument is
+// set.
+func OverheadFromContext(ctx context.Context) (d time.Duration, ok bool) {
+	d, ok = ctx.Value(overheadKey{}).(time.Duration)
+	return d, ok
+}
+
+// extract returns key of the request using h.keyfunc: IP address, or key
+// returned by Config.KeyFunc. It times the call if h.instrument is set and
+// bounds it by h.ipfuncTimeout if it is positive.
+func (h *limiter) extract(r *http.Request) []byte { return extractWith(h, r, h.keyfunc) }
+
+// extractAddr is extract using h.addrfunc, it returns zero Addr if there is
+// no address
+func (h *limiter) extractAddr(r *http.Request) netip.Addr { return extractWith(h, r, h.addrfunc) }
+
+func extractWith[K any](h *limiter, r *http.Request, f func(*http.Request) K) K {
+	if h.ipfuncTimeout > 0 {
+		return extractTimeout(h, r, f)
+	}
+	if !h.instrument {
+		return f(r)
+	}
+	begin := time.Now()
+	k := f(r)
+	h.ipfuncTimes.add(time.Since(begin))
+	return k
+}
+
+func extractTimeout[K any](h *limiter, r *http.Request, f func(*http.Request) K) K {
+	begin := time.Now()
+	// IPFunc may outlive ServeHTTP call, so give it a copy of request
+	// not shared with the wrapped handler
+	r2 := r.Clone(r.Context())
+	ch := make(chan K, 1)
+	go func() { ch <- f(r2) }()
+	t := time.NewTimer(h.ipfuncTimeout)
+	defer t.Stop()
+	select {
+	case k := <-ch:
+		if h.instrument {
+			h.ipfuncTimes.add(time.Since(begin))
+		}
+		return k
+	case <-t.C:
+		if h.instrument {
+			h.ipfuncTimes.add(time.Since(begin))
+		}
+		h.counters.ipfuncTimeouts.Add(1)
+		name := "IPFunc"
+		switch {
+		case h.opaqueKeys:
+			name = "KeyFunc"
+		case h.addrfunc != nil:
+			name = "AddrFunc"
+		}
+		h.log.Printf("%s did not complete in %v: %s", name, h.ipfuncTimeout, h.formatRequest(r))
+		var zero K
+		return zero
+	}
+}
@@ -0,0 +1,163 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIPFuncTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := func(r *http.Request) net.IP {
+		<-release
+		return net.IPv4(192, 0, 2, 1)
+	}
+	var called bool
+	handler := func(http.ResponseWriter, *http.Request) { called = true }
+	lh := New(http.HandlerFunc(handler), &Config{
+		IPFunc:        slow,
+		IPFuncTimeout: 10 * time.Millisecond,
+		Instrument:    true,
+	}).(*limiter)
+	begin := time.Now()
+	w := httptest.NewRecorder()
+	lh.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if d := time.Since(begin); d > time.Second {
+		t.Fatalf("request took %v", d)
+	}
+	if !called || w.Code != http.StatusOK {
+		t.Fatalf("request with timed out IPFunc not passed to handler: %d", w.Code)
+	}
+	st := lh.Stats()
+	if st.IPFuncTimeouts != 1 {
+		t.Fatalf("IPFuncTimeouts: %d, want 1", st.IPFuncTimeouts)
+	}
+	// 10ms timeout falls into (1ms, 10ms] or (10ms, 100ms] bucket
+	if n := st.IPFuncDurations[4] + st.IPFuncDurations[5]; n != 1 {
+		t.Fatalf("unexpected IPFunc durations: %v", st.IPFuncDurations)
+	}
+	if n, _ := lh.buckets(); n != 0 {
+		t.Fatal("bucket created for request with timed out IPFunc")
+	}
+}
+
+func TestIPFuncInstrument(t *testing.T) {
+	for _, instrument := range []bool{false, true} {
+		for _, timeout := range []time.Duration{0, time.Second} {
+			lh := New(http.NotFoundHandler(), &Config{
+				Instrument:    instrument,
+				IPFuncTimeout: timeout,
+			}).(*limiter)
+			for i := 0; i < 3; i++ {
+				lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+			st := lh.Stats()
+			var total uint64
+			for _, n := range st.IPFuncDurations {
+				total += n
+			}
+			if want := map[bool]uint64{false: 0, true: 3}[instrument]; total != want {
+				t.Errorf("instrument=%v, timeout=%v: %d durations recorded, want %d",
+					instrument, timeout, total, want)
+			}
+			if st.IPFuncTimeouts != 0 {
+				t.Errorf("instrument=%v, timeout=%v: unexpected timeouts", instrument, timeout)
+			}
+			if n, _ := lh.buckets(); n != 1 {
+				t.Errorf("instrument=%v, timeout=%v: %d buckets, want 1", instrument, timeout, n)
+			}
+		}
+	}
+}
+
+func TestLimiterOverhead(t *testing.T) {
+	var got []time.Duration
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		d, ok := OverheadFromContext(r.Context())
+		if !ok {
+			t.Error("no overhead in context")
+		}
+		got = append(got, d)
+	}
+	lh := New(http.HandlerFunc(handler), &Config{Burst: 10, Instrument: true}).(*limiter)
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	elapsed := time.Since(begin)
+	if len(got) != 3 {
+		t.Fatalf("handler called %d times, want 3", len(got))
+	}
+	for _, d := range got {
+		if d <= 0 || d > elapsed {
+			t.Fatalf("implausible overhead %v, all requests took %v", d, elapsed)
+		}
+	}
+	var total uint64
+	for _, n := range lh.Stats().LimiterOverhead {
+		total += n
+	}
+	if total != 3 {
+		t.Fatalf("%d overhead durations recorded, want 3", total)
+	}
+
+	lh = New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := OverheadFromContext(r.Context()); ok {
+			t.Error("overhead in context without Instrument")
+		}
+	}), nil).(*limiter)
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if lh.Stats().LimiterOverhead != (DurationHistogram{}) {
+		t.Fatal("overhead recorded without Instrument")
+	}
+}
+
+func BenchmarkInstrument(b *testing.B) {
+	// difference between sub-benchmarks is the cost of instrumentation,
+	// with Instrument off it should be indistinguishable from noise
+	for _, instrument := range []bool{false, true} {
+		b.Run(map[bool]string{false: "off", true: "on"}[instrument], func(b *testing.B) {
+			lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+				RefillEvery: time.Nanosecond,
+				Burst:       1 << 20,
+				Instrument:  instrument,
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lh.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+// BenchmarkPartnerLimits measures requests of partners with Config.Limits
+// above the defaults, which should neither allocate their limits nor
+// serialize on the limiter-wide lock
+func BenchmarkPartnerLimits(b *testing.B) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Nanosecond,
+		Burst:       1 << 10,
+		Limits: func(net.IP) (time.Duration, int, bool) {
+			return 0, 1 << 20, true
+		},
+	})
+	var n atomic.Uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := n.Add(1)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = net.IPv4(192, 0, byte(i>>8), byte(i)).String() + ":1234"
+		w := httptest.NewRecorder()
+		for pb.Next() {
+			lh.ServeHTTP(w, req)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package ipratelimit
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cespare/xxhash"
+)
+
+// formatKey returns canonical text form of a key for logs, errors, headers
+// and other output, so the same key is always printed the same way:
+//
+//   - net.IP: dotted-quad for IPv4, including 16-byte and IPv4-mapped
+//     forms; RFC 5952 for IPv6; "<nil>" for nil.
+//   - *net.IPNet: CIDR notation of the network address, with IPv4 networks
+//     in 16-byte form printed as IPv4.
+//   - uint64 bucket key hash: "#" followed by 16 hex digits.
+//   - []byte opaque key: "key:" followed by 8 hex digits of its hash, so
+//     that secrets like API keys never appear in the output.
+func formatKey(k interface{}) string {
+	switch k := k.(type) {
+	case net.IP:
+		return formatIP(k)
+	case *net.IPNet:
+		return formatNet(k)
+	case uint64:
+		return formatHash(k)
+	case []byte:
+		return formatOpaque(k)
+	}
+	return "?"
+}
+
+func formatIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.String() // net.IP.String follows RFC 5952
+}
+
+func formatNet(n *net.IPNet) string {
+	if n == nil {
+		return "<nil>"
+	}
+	ip, mask := n.IP.Mask(n.Mask), n.Mask
+	if v4 := ip.To4(); v4 != nil && len(mask) == net.IPv6len {
+		ip, mask = v4, mask[12:]
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return formatIP(ip) + "/?"
+	}
+	return formatIP(ip) + "/" + strconv.Itoa(ones)
+}
+
+func formatHash(key uint64) string {
+	const digits = "0123456789abcdef"
+	var b [17]byte
+	b[0] = '#'
+	for i := 16; i > 0; i-- {
+		b[i] = digits[key&0xf]
+		key >>= 4
+	}
+	return string(b[:])
+}
+
+func formatOpaque(key []byte) string {
+	sum := xxhash.Sum64(key)
+	var b [4]byte
+	for i := range b {
+		b[i] = byte(sum >> (56 - 8*i))
+	}
+	return "key:" + hex.EncodeToString(b[:])
+}
+
+// defaultMaxLogURL is the default of Config.MaxLogURL
+const defaultMaxLogURL = 256
+
+// formatRequest returns method and URL of the request for logs, see
+// sanitizeLog
+func (h *limiter) formatRequest(r *http.Request) string {
+	u := "<nil>"
+	if r.URL != nil {
+		u = r.URL.String()
+	}
+	return sanitizeLog(r.Method, h.maxLogURL) + " " + sanitizeLog(u, h.maxLogURL)
+}
+
+// sanitizeLog returns s safe to be printed in a log line: truncated to
+// max bytes with "..." marker appended, if longer, and with control
+// characters, backslashes and invalid UTF-8 escaped in Go string literal
+// style, so that it never spans multiple lines or carries terminal escape
+// sequences
+func sanitizeLog(s string, max int) string {
+	truncated := false
+	if len(s) > max {
+		// don't split a multi-byte character
+		for max > 0 && !utf8.RuneStart(s[max]) {
+			max--
+		}
+		s, truncated = s[:max], true
+	}
+	clean := true
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == 0x7f || c == '\\' || c >= utf8.RuneSelf {
+			clean = false
+			break
+		}
+	}
+	if clean && !truncated {
+		return s
+	}
+	var b strings.Builder
+	for i, w := 0, 0; i < len(s); i += w {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		w = size
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`\x`)
+			b.WriteString(hex.EncodeToString([]byte{s[i]}))
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r < 0x20 || (r >= 0x7f && r < 0xa0) || r == '\u2028' || r == '\u2029':
+			// C0, C1 controls and Unicode line breaks
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if truncated {
+		b.WriteString("...")
+	}
+	return b.String()
+}
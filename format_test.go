@@ -0,0 +1,152 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+func TestFormatKey(t *testing.T) {
+	_, v4net, _ := net.ParseCIDR("192.0.2.77/24")
+	_, v6net, _ := net.ParseCIDR("2001:db8:0:0:1::/64")
+	mapped := &net.IPNet{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(120, 128)}
+	for _, tc := range []struct {
+		key  interface{}
+		want string
+	}{
+		{net.IP{192, 0, 2, 1}, "192.0.2.1"},
+		{net.IPv4(192, 0, 2, 1), "192.0.2.1"},
+		{net.ParseIP("::ffff:192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("2001:0db8:0000:0000:0000:0000:0000:0001"), "2001:db8::1"},
+		{net.ParseIP("2001:db8:0:0:1:0:0:1"), "2001:db8::1:0:0:1"},
+		{net.IP(nil), "<nil>"},
+		{v4net, "192.0.2.0/24"},
+		{v6net, "2001:db8::/64"},
+		{mapped, "192.0.2.0/24"},
+		{(*net.IPNet)(nil), "<nil>"},
+		{uint64(0xabc), "#0000000000000abc"},
+		{[]byte("secret-api-key"), "key:" + formatHash(xxhash.Sum64String("secret-api-key"))[1:9]},
+		{"unsupported", "?"},
+	} {
+		if got := formatKey(tc.key); got != tc.want {
+			t.Errorf("formatKey(%#v) = %q, want %q", tc.key, got, tc.want)
+		}
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	return false, 0, errors.New("unavailable")
+}
+
+// TestFormatKeyOutputs checks that address is printed the same way on every
+// output surface, regardless of the form IPFunc returned it in
+func TestFormatKeyOutputs(t *testing.T) {
+	for _, ip := range []net.IP{
+		{192, 0, 2, 1},
+		net.IPv4(192, 0, 2, 1),
+		net.ParseIP("::ffff:192.0.2.1"),
+	} {
+		var buf bytes.Buffer
+		ipfunc := func(*http.Request) net.IP { return ip }
+		// denial log
+		lh := New(http.NotFoundHandler(), &Config{
+			Burst:  1,
+			IPFunc: ipfunc,
+			Logger: log.New(&buf, "", 0),
+		}).(*limiter)
+		for i := 0; i < 2; i++ {
+			lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+		}
+		if want := "rate limited for 192.0.2.1: GET /x\n"; buf.String() != want {
+			t.Errorf("%#v: denial log %q, want %q", ip, buf.String(), want)
+		}
+		// debug output
+		if want := formatKey(keyOf(ip.To4())) + ": "; !strings.Contains(lh.dumpState(10), want) {
+			t.Errorf("%#v: state dump does not contain %q", ip, want)
+		}
+		// store error log
+		buf.Reset()
+		lh = New(http.NotFoundHandler(), &Config{
+			IPFunc: ipfunc,
+			Logger: log.New(&buf, "", 0),
+			Store:  failingStore{},
+		}).(*limiter)
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+		if want := "store error for 192.0.2.1: unavailable\n"; buf.String() != want {
+			t.Errorf("%#v: store error log %q, want %q", ip, buf.String(), want)
+		}
+	}
+}
+
+func TestSanitizeLog(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"/x?a=1", 100, "/x?a=1"},
+		{"/x\n[error] forged entry", 100, `/x\n[error] forged entry`},
+		{"/\x1b[31mred\x1b[0m", 100, `/\x1b[31mred\x1b[0m`},
+		{"/\r\t\x00\x7f", 100, `/\r\t\x00\x7f`},
+		{"/\u0085\u2028", 100, `/\u0085\u2028`},
+		{`/a\nb`, 100, `/a\\nb`},
+		{"/\xff\xfe", 100, `/\xff\xfe`},
+		{"/ok/ünïcode", 100, "/ok/ünïcode"},
+		{"/abcdef", 4, "/abc..."},
+		{"/ééé", 4, "/é..."}, // multi-byte character not split
+		{"/\n\n\n", 2, `/\n...`},
+	} {
+		if got := sanitizeLog(tc.in, tc.max); got != tc.want {
+			t.Errorf("sanitizeLog(%q, %d) = %q, want %q", tc.in, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestHostileRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	lh := New(http.NotFoundHandler(), &Config{
+		Burst:     1,
+		IPFunc:    func(*http.Request) net.IP { return net.IPv4(192, 0, 2, 1) },
+		Logger:    log.New(&buf, "", 0),
+		MaxLogURL: 64,
+	}).(*limiter)
+	serve := func(r *http.Request) string {
+		buf.Reset()
+		lh.ServeHTTP(httptest.NewRecorder(), r)
+		return buf.String()
+	}
+	serve(httptest.NewRequest("GET", "/", nil)) // use up the token
+
+	huge := httptest.NewRequest("GET", "/search?q="+strings.Repeat("A", 1<<20), nil)
+	if got, want := serve(huge), "rate limited for 192.0.2.1: GET /search?q="+strings.Repeat("A", 54)+"...\n"; got != want {
+		t.Errorf("megabyte URL logged as %q, want %q", got, want)
+	}
+
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.Method = "GET\x1b[2J"
+	forged.URL.RawQuery = "a=1\r\nrate limited for 203.0.113.1: GET /"
+	got := serve(forged)
+	if strings.Count(got, "\n") != 1 || strings.ContainsAny(got[:len(got)-1], "\r\n\x1b") {
+		t.Errorf("control characters in log line %q", got)
+	}
+	if want := `rate limited for 192.0.2.1: GET\x1b[2J /?a=1\r\nrate limited for 203.0.113.1: GET /` + "\n"; got != want {
+		t.Errorf("got log line %q, want %q", got, want)
+	}
+
+	noURL := httptest.NewRequest("GET", "/", nil)
+	noURL.URL = nil
+	if got, want := serve(noURL), "rate limited for 192.0.2.1: GET <nil>\n"; got != want {
+		t.Errorf("request without URL logged as %q, want %q", got, want)
+	}
+}
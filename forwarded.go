@@ -0,0 +1,70 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPFromForwarded extracts client IP address from the "for" parameter of the
+// first element of RFC 7239 Forwarded header of the request. Multiple
+// header lines are treated as a single comma-separated list in their order;
+// empty elements are skipped. Quoted values, bracketed IPv6 addresses and
+// ports are supported, as in for="[2001:db8:cafe::17]:4711". If the first
+// element has no "for" parameter, or it is "unknown" or an obfuscated
+// identifier like "_hidden", nil is returned. Like X-Forwarded-For, the
+// header can be sent by clients themselves, so use this only behind a
+// proxy which replaces it.
+func IPFromForwarded(r *http.Request) net.IP {
+	for _, v := range r.Header.Values("Forwarded") {
+		for v != "" {
+			var elem string
+			elem, v = cutUnquoted(v, ',')
+			if strings.TrimSpace(elem) != "" {
+				return forwardedFor(elem)
+			}
+		}
+	}
+	return nil
+}
+
+// forwardedFor returns address from the "for" parameter of a single element
+// of Forwarded header, nil if it has no such parameter, or its value is not
+// an address
+func forwardedFor(elem string) net.IP {
+	for elem != "" {
+		var pair string
+		pair, elem = cutUnquoted(elem, ';')
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "for") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if value == "" || value[0] == '_' || strings.EqualFold(value, "unknown") {
+			return nil
+		}
+		return parseAddr(value)
+	}
+	return nil
+}
+
+// cutUnquoted slices s around the first sep outside of quoted strings,
+// returning text before and after it; if there's no such sep, it returns s
+// and an empty string
+func cutUnquoted(s string, sep byte) (before, after string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++ // skip escaped character
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
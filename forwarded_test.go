@@ -0,0 +1,60 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPFromForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		// examples of RFC 7239
+		{[]string{`for="_gazonk"`}, ""},
+		{[]string{`For="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{[]string{`for=192.0.2.60;proto=http;by=203.0.113.43`}, "192.0.2.60"},
+		{[]string{`for=192.0.2.43, for=198.51.100.17`}, "192.0.2.43"},
+		{[]string{`for=192.0.2.43`, `for=198.51.100.17;by=203.0.113.60;proto=http;host=example.com`}, "192.0.2.43"},
+		{[]string{`for=192.0.2.43, for="[2001:db8:cafe::17]", for=unknown`}, "192.0.2.43"},
+		{[]string{`for=unknown, for=192.0.2.43`}, ""},
+		{[]string{`for="_hidden", for="_SEVKISEK"`}, ""},
+		{[]string{`for="192.0.2.43:47011"`}, "192.0.2.43"},
+		{[]string{`for="[2001:db8:cafe::17]:47011"`}, "2001:db8:cafe::17"},
+		{[]string{`for="[2001:db8:cafe::17]"`}, "2001:db8:cafe::17"},
+		{[]string{`for="[2001:db8:cafe::17]:_abc"`}, "2001:db8:cafe::17"},
+		// header of the request
+		{nil, ""},
+		{[]string{`for=192.0.2.60;proto=https, for=203.0.113.43`}, "192.0.2.60"},
+		{[]string{`proto=https;for=192.0.2.60`}, "192.0.2.60"},
+		{[]string{`by=203.0.113.43, for=192.0.2.60`}, ""},
+		{[]string{` , `, `for=192.0.2.60`}, "192.0.2.60"},
+		{[]string{` for = 192.0.2.60 ; proto=https`}, "192.0.2.60"},
+		{[]string{`FOR=UNKNOWN`}, ""},
+		{[]string{`host="a,b;for=198.51.100.1";for=192.0.2.60`}, "192.0.2.60"},
+		{[]string{`host="a\",for=198.51.100.1";for=192.0.2.60`}, "192.0.2.60"},
+		{[]string{`for=[::ffff:192.0.2.60]`}, "192.0.2.60"},
+		{[]string{`for=garbage, for=192.0.2.60`}, ""},
+		{[]string{`for=""`}, ""},
+		{[]string{`for="192.0.2.60`}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, v := range tc.lines {
+			r.Header.Add("Forwarded", v)
+		}
+		got := IPFromForwarded(r)
+		if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.lines, got, tc.want)
+		}
+	}
+}
+
+func TestIPFromForwardedAllocs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Forwarded", `proto=https;for="[2001:db8:cafe::17]:4711", for=192.0.2.43`)
+	// the only allocation is the returned address
+	if n := testing.AllocsPerRun(100, func() { IPFromForwarded(r) }); n > 1 {
+		t.Errorf("got %v allocations per call", n)
+	}
+}
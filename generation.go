@@ -0,0 +1,36 @@
+package ipratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// generation holds the parts of the limiter configuration which can be
+// replaced at runtime: default limits, with the response settings they
+// point to, the policy, and the hash of the whole effective configuration.
+// Generation is immutable once published, and each request loads it once,
+// so its decision, Retry-After and policy hash header all come from the
+// same configuration even if it is replaced concurrently.
+type generation struct {
+	def    *limits // default limits, never nil
+	policy *policy // current policy, nil only while New runs
+	hash   string  // PolicyHash value
+}
+
+// publish replaces the current generation with its copy modified by
+// update, if not nil, and with the hash recalculated, returning the new
+// generation. Updates are serialized, so none of them is lost. It must be
+// called after every change of the effective configuration.
+func (h *limiter) publish(update func(*generation)) *generation {
+	h.genMu.Lock()
+	defer h.genMu.Unlock()
+	g := *h.gen.Load()
+	if update != nil {
+		update(&g)
+	}
+	sum := sha256.New()
+	h.writePolicy(sum, &g)
+	g.hash = hex.EncodeToString(sum.Sum(nil)[:8])
+	h.gen.Store(&g)
+	return &g
+}
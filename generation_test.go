@@ -0,0 +1,79 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestGenerationConsistent flips limits during traffic, checking that each
+// denial reports Retry-After and policy hash of the same configuration
+func TestGenerationConsistent(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:      10 * time.Second,
+		Burst:            1,
+		MaxBuckets:       1000,
+		IPFunc:           IPFromXForwardedFor,
+		PolicyHashHeader: "X-Policy-Hash",
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now } // no refills during the test
+	hashA := lh.PolicyHash()
+	lh.SetLimit(time.Hour, 1)
+	hashB := lh.PolicyHash()
+	want := map[string]string{hashA: "10", hashB: "3600"}
+
+	done := make(chan struct{})
+	var flips atomic.Int64
+	var flipper sync.WaitGroup
+	flipper.Add(1)
+	go func() {
+		defer flipper.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				lh.SetLimit(10*time.Second, 1)
+			} else {
+				lh.SetLimit(time.Hour, 1)
+			}
+			flips.Add(1)
+		}
+	}()
+	var wg sync.WaitGroup
+	var denials atomic.Int64
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", net.IPv4(192, 0, 2, byte(g)).String())
+				w := httptest.NewRecorder()
+				lh.ServeHTTP(w, req)
+				if w.Code != http.StatusTooManyRequests {
+					continue
+				}
+				denials.Add(1)
+				hash, retryAfter := w.Header().Get("X-Policy-Hash"), w.Header().Get("Retry-After")
+				if wantRetry, ok := want[hash]; !ok || retryAfter != wantRetry {
+					t.Errorf("hash %q with Retry-After %q", hash, retryAfter)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	flipper.Wait()
+	if denials.Load() == 0 || flips.Load() < 2 {
+		t.Fatalf("%d denials, %d flips", denials.Load(), flips.Load())
+	}
+}
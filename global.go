@@ -0,0 +1,83 @@
+package ipratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// ScopeHeader is the header limiter adds to denials of requests decided by
+// the token buckets if Config.SendScopeHeader is set: "global" for denials
+// by the global limit, "client" for ones by the client bucket.
+const ScopeHeader = "X-RateLimit-Scope"
+
+// globalBucket is a token bucket shared by all requests, see
+// Config.GlobalBurst. It has its own lock, so it's not guarded by locks of
+// shards.
+type globalBucket struct {
+	m   sync.Mutex
+	lim limits
+	bkt bucket
+}
+
+func newGlobalBucket(refillEvery time.Duration, burst int, maxWait time.Duration) *globalBucket {
+	g := &globalBucket{lim: newLimits(refillEvery, burst, maxWait)}
+	g.bkt.left = g.lim.burst
+	return g
+}
+
+// take tries to take cost tokens from the bucket, reporting whether it
+// succeeded and, if not, the time until they are refilled
+func (g *globalBucket) take(cost float64, now time.Time) (bool, time.Duration) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.lim.take(&g.bkt, cost, now) {
+		return true, 0
+	}
+	return false, g.lim.retryWait(g.bkt.left, cost)
+}
+
+// refund returns cost tokens to the bucket, up to its burst
+func (g *globalBucket) refund(cost float64) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.bkt.left = min(g.bkt.left+cost, g.lim.burst)
+}
+
+// nextAt returns the earliest time the bucket holds cost tokens, zero Time
+// if it never would
+func (g *globalBucket) nextAt(cost float64, now time.Time) time.Time {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if cost > g.lim.burst {
+		return time.Time{}
+	}
+	return g.lim.nextAt(g.bkt, cost, now)
+}
+
+// takeGlobal takes cost tokens of request allowed by the client bucket bkt
+// from the global bucket. If the global limit is exceeded, d is turned into
+// a denial and tokens are returned to bkt. It is called by allow with shard
+// lock held, before bookkeeping of the client bucket, so that it sees the
+// request as denied.
+func (h *limiter) takeGlobal(bkt *bucket, d *decision, cost float64, now time.Time) {
+	ok, wait := h.global.take(cost, now)
+	if ok {
+		return
+	}
+	bkt.left += cost
+	d.allow, d.delay = false, 0
+	d.retryWait, d.global = wait, true
+	h.counters.globalDenied.Add(1)
+}
+
+// takeGlobalShared is takeGlobal for requests decided by Config.Store or the
+// shared overflow bucket: tokens they took are not returned.
+func (h *limiter) takeGlobalShared(e *evaluation) {
+	ok, wait := h.global.take(e.cost, h.now())
+	if ok {
+		return
+	}
+	e.d.allow, e.d.charged, e.d.delay = false, 0, 0
+	e.d.retryWait, e.d.global = wait, true
+	h.counters.globalDenied.Add(1)
+}
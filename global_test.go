@@ -0,0 +1,118 @@
+package ipratelimit
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobalLimit(t *testing.T) {
+	var buf syncBuffer
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:       time.Hour,
+		Burst:             2,
+		IPFunc:            IPFromXForwardedFor,
+		Logger:            log.New(&buf, "", 0),
+		GlobalRefillEvery: time.Minute,
+		GlobalBurst:       3,
+		SendScopeHeader:   true,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w
+	}
+	for i, tc := range []struct {
+		addr, scope string
+		code        int
+	}{
+		{"192.0.2.1", "", http.StatusNotFound},
+		{"192.0.2.1", "", http.StatusNotFound},
+		{"192.0.2.1", "client", http.StatusTooManyRequests},
+		{"192.0.2.2", "", http.StatusNotFound},
+		{"192.0.2.3", "global", http.StatusTooManyRequests},
+	} {
+		w := serve(tc.addr)
+		if w.Code != tc.code || w.Header().Get(ScopeHeader) != tc.scope {
+			t.Fatalf("request %d: got status %d, scope %q; want %d, %q",
+				i, w.Code, w.Header().Get(ScopeHeader), tc.code, tc.scope)
+		}
+		if tc.scope == "global" {
+			if got := w.Header().Get("Retry-After"); got != "60" {
+				t.Errorf("global denial: got Retry-After %q, want 60", got)
+			}
+		}
+	}
+	if bkt, _ := lh.bucketOf(keyOf(net.ParseIP("192.0.2.3").To4())); bkt.left != 2 {
+		t.Errorf("globally denied client has %v tokens left, want 2", bkt.left)
+	}
+	if c := lh.Counters(); c.GlobalDenied != 1 || c.Denied != 2 {
+		t.Errorf("got %d global denials of %d, want 1 of 2", c.GlobalDenied, c.Denied)
+	}
+	if !strings.Contains(buf.String(), "global rate limit exceeded by 192.0.2.3") {
+		t.Errorf("global denial not logged:\n%s", buf.String())
+	}
+
+	now = now.Add(time.Minute)
+	if w := serve("192.0.2.3"); w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d after global bucket refill", w.Code)
+	}
+}
+
+// TestGlobalBookkeeping checks that global denials leave Retry-After and
+// penalty state of the client bucket alone, are recorded as denials, and are
+// accounted for by NextAllowed and Next
+func TestGlobalBookkeeping(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:       time.Hour,
+		Burst:             3,
+		TrackHistory:      true,
+		PenaltyThreshold:  1,
+		GlobalRefillEvery: time.Minute,
+		GlobalBurst:       1,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	ip := net.IPv4(192, 0, 2, 1)
+	if !lh.Allow(ip) {
+		t.Fatal("first request denied")
+	}
+	for i := 0; i < 2; i++ {
+		d, err := lh.AllowCtx(context.Background(), ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed {
+			t.Fatalf("request %d allowed", i)
+		}
+		if want := now.Add(time.Minute); !d.NextAllowed.Equal(want) {
+			t.Errorf("request %d: got NextAllowed %v, want %v", i, d.NextAllowed, want)
+		}
+	}
+	bkt, _ := lh.bucketOf(keyOf(ip.To4()))
+	if bkt.left != 2 || bkt.retryAt != 0 || bkt.denials != 0 || bkt.bannedTo != 0 {
+		t.Errorf("got bucket %+v after global denials", bkt)
+	}
+	if h := lh.History(ip); len(h) != 3 || !h[0].Allowed || h[1].Allowed || h[2].Allowed {
+		t.Errorf("got history %+v", h)
+	}
+	if got, want := lh.Next(ip, 1), now.Add(time.Minute); got.Before(want) || got.After(want.Add(time.Millisecond)) {
+		t.Errorf("Next: got %v, want %v", got, want)
+	}
+	if got := lh.Next(ip, 2); !got.IsZero() {
+		t.Errorf("Next with cost over GlobalBurst: got %v, want zero", got)
+	}
+	now = now.Add(time.Minute)
+	if !lh.Allow(ip) {
+		t.Fatal("request denied after global bucket refill")
+	}
+}
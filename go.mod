@@ -1,6 +1,8 @@
-module "github.com/artyom/ipratelimit"
+module github.com/artyom/ipratelimit
+
+go 1.27.1
 
 require (
-	"github.com/artyom/logger" v1.0.0
-	"github.com/cespare/xxhash" v1.0.0
+	github.com/artyom/logger v1.0.0
+	github.com/cespare/xxhash v1.0.0
 )
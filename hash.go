@@ -0,0 +1,168 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+// PolicyHash returns a hash of the effective limiter configuration: token
+// bucket limits, capacity, address tables, server name and class settings
+// and the way denials are handled. Labels, loggers and callbacks are not
+// included, nor is Policy.Version. Limiters created with identical
+// configuration have the same hash, also across restarts; changing any
+// effective parameter, including with ApplyPolicy, changes it. It is
+// reported in Stats.PolicyHash, so the policy in effect can be audited
+// across instances.
+//
+// Handler returned by New implements interface{ PolicyHash() string }.
+func (h *limiter) PolicyHash() string { return h.gen.Load().hash }
+
+// writePolicy writes normalized effective configuration with generation g
+// to w, one parameter per line; maps and address tables are written sorted
+func (h *limiter) writePolicy(w io.Writer, g *generation) {
+	line := func(name string, v any) { fmt.Fprintf(w, "%s=%v\n", name, v) }
+	writeLimits := func(name string, l *limits) {
+		line(name, fmt.Sprintf("%v/%v/%v", time.Duration(l.refillEvery), l.burst, l.maxWait))
+		if l.resp != nil && *l.resp != h.response {
+			line(name+" response", fmt.Sprintf("%+v", *l.resp))
+		}
+	}
+	writeLimits("limits", g.def)
+	if h.autoMax > 0 {
+		line("auto_max_buckets", h.autoMax)
+		line("min_evict_age", h.minEvictAge)
+	} else {
+		line("max_buckets", h.capacity)
+	}
+	line("evict_slice", h.evictSlice)
+	if h.store != nil {
+		line("store", fmt.Sprintf("%T", h.store))
+	}
+	line("fail_closed", h.failClosed)
+	line("cacheable", h.cacheable)
+	line("vary", strconv.Quote(h.vary))
+	line("max_time", h.maxTime)
+	line("ipfunc_timeout", h.ipfuncTimeout)
+	line("forgive_after", time.Duration(h.forgiveAfter))
+	line("max_idle", time.Duration(h.maxIdle))
+	line("initial_tokens", h.initialTokens)
+	line("max_bans", h.bans.max)
+	line("retry_violation_backoff", h.retryBackoff)
+	line("enforce_percent", h.enforce)
+	line("dry_run", h.dryRun)
+	line("exact_keys", h.exactKeys)
+	line("alert_rate", h.alertRate)
+	line("alert_overflow", h.alertOverflow)
+	if h.score != nil {
+		line("score", fmt.Sprintf("%v/%v", h.score.Usage, h.score.Streak))
+	}
+	line("response", fmt.Sprintf("%+v", h.response))
+	if h.limitBody != nil {
+		line("limit_body", fmt.Sprintf("%q/%x", h.limitType, xxhash.Sum64(h.limitBody)))
+	}
+	line("shed_response", fmt.Sprintf("%+v", h.shedResponse))
+	line("charge_once", h.chargeOnce)
+	line("max_wait", h.maxDelay)
+	if h.global != nil {
+		line("global_limits", fmt.Sprintf("%v/%v", time.Duration(h.global.lim.refillEvery), h.global.lim.burst))
+	}
+	line("scope_header", h.scopeHeader)
+	if h.penaltyThreshold > 0 {
+		line("penalty", fmt.Sprintf("%d/%v", h.penaltyThreshold, h.penaltyDuration))
+	}
+	if h.opaqueKeys {
+		line("key_func", true)
+	}
+	if h.addrfunc != nil {
+		line("addr_func", true)
+	}
+	if h.skip != nil {
+		line("skip", true)
+	}
+	if h.refundStatus != nil {
+		line("refund", true)
+	}
+	if h.limitsOf != nil {
+		line("limits_func", true)
+	}
+	if h.cost != nil {
+		line("cost", fmt.Sprintf("%T", h.cost))
+	}
+	if h.limitedHandler != nil {
+		line("limited_handler", fmt.Sprintf("%T", h.limitedHandler))
+	}
+	line("rate_limit_headers", h.rateLimitHeaders)
+	line("problem_details", h.problemDetails)
+	line("problem_type", strconv.Quote(h.problemType))
+	line("ipv4_mask", h.v4Mask)
+	line("ipv6_mask", h.v6Mask)
+	line("anonymize_keys", h.anonymize)
+	for _, n := range sortedNets(h.exempt.nets) {
+		line("exempt", n)
+	}
+	exemptUA := append([]string(nil), h.exemptUA...)
+	sort.Strings(exemptUA)
+	for _, ua := range exemptUA {
+		line("exempt_user_agent", strconv.Quote(ua))
+	}
+	methods := make([]string, 0, len(h.methods))
+	for m := range h.methods {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		line("method", strconv.Quote(m))
+	}
+	if p := g.policy; p != nil {
+		for _, n := range sortedNets(p.allow.nets) {
+			line("allow", n)
+		}
+		for _, n := range sortedNets(p.deny.nets) {
+			line("deny", n)
+		}
+	}
+	if h.keyBySNI {
+		line("key_by_server_name", true)
+		names := make([]string, 0, len(h.sniLimits))
+		for name := range h.sniLimits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeLimits("server_name_limits "+strconv.Quote(name), h.sniLimits[name])
+		}
+		if h.sniKnown != nil {
+			known := make([]string, 0, len(h.sniKnown.names)+len(h.sniKnown.suffixes))
+			for name := range h.sniKnown.names {
+				known = append(known, name)
+			}
+			for _, suffix := range h.sniKnown.suffixes {
+				known = append(known, "*"+suffix)
+			}
+			sort.Strings(known)
+			for _, name := range known {
+				line("server_name_pattern", strconv.Quote(name))
+			}
+			line("reject_unknown_server_names", h.sniReject)
+		}
+	}
+	for i, name := range h.classNames {
+		line("class_quota "+strconv.Quote(name), h.classQuota[i])
+	}
+}
+
+// sortedNets returns sorted string forms of networks
+func sortedNets(nets []*net.IPNet) []string {
+	out := make([]string, len(nets))
+	for i, n := range nets {
+		out[i] = n.String()
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,158 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyHash(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			RefillEvery: time.Second,
+			Burst:       5,
+			MaxBuckets:  1000,
+			Name:        "api",
+			Policy: Policy{
+				Version:   "v1",
+				Allowlist: []string{"192.0.2.0/24", "198.51.100.1"},
+			},
+			KeyByServerName:    true,
+			StrictServerNames:  true,
+			ServerNamePatterns: []string{"*.example.com", "example.org"},
+			ServerNameLimits:   map[string]Limit{"a.example.com": {Burst: 10}, "b.example.com": {Burst: 20}},
+			Class:              func(*http.Request) string { return "" },
+			ClassQuotas:        map[string]float64{"a": 0.2, "b": 0.3},
+		}
+	}
+	hashOf := func(cfg *Config) string {
+		return New(http.NotFoundHandler(), cfg).(*limiter).PolicyHash()
+	}
+	want := hashOf(base())
+	for i := 0; i < 10; i++ {
+		if got := hashOf(base()); got != want {
+			t.Fatalf("hash of identical config changed: %s, want %s", got, want)
+		}
+	}
+	// order of lists and labels don't matter
+	cfg := base()
+	cfg.Policy.Allowlist = []string{"198.51.100.1/32", "192.0.2.0/24"}
+	cfg.Policy.Version = "v2"
+	cfg.Name = "other"
+	cfg.ServerNamePatterns = []string{"Example.org.", "*.example.com"}
+	if got := hashOf(cfg); got != want {
+		t.Errorf("hash of equivalent config: got %s, want %s", got, want)
+	}
+
+	for name, change := range map[string]func(*Config){
+		"RefillEvery":      func(c *Config) { c.RefillEvery = 2 * time.Second },
+		"Burst":            func(c *Config) { c.Burst = 6 },
+		"MaxBuckets":       func(c *Config) { c.MaxBuckets = 2000 },
+		"TargetMemory":     func(c *Config) { c.MaxBuckets, c.TargetMemory = 0, 1<<20 },
+		"Store":            func(c *Config) { c.Store = failingStore{} },
+		"EvictionSlice":    func(c *Config) { c.EvictionSlice = time.Millisecond },
+		"ExemptUserAgents": func(c *Config) { c.ExemptUserAgents = []string{"probe/"} },
+		"Response":         func(c *Config) { c.Response.RetryAfter = RetryAfterOmit },
+		"ShedResponse":     func(c *Config) { c.ShedResponse.Status = http.StatusInternalServerError },
+		"LimitedHandler":   func(c *Config) { c.LimitedHandler = http.NotFoundHandler() },
+		"Cost":             func(c *Config) { c.Cost = func(*http.Request) float64 { return 2 } },
+		"Rate":             func(c *Config) { c.Rate = 3 },
+		"KeyFunc":          func(c *Config) { c.KeyFunc = func(*http.Request) []byte { return nil } },
+		"AddrFunc":         func(c *Config) { c.AddrFunc = AddrFromRemoteAddr },
+		"Limits":           func(c *Config) { c.Limits = func(net.IP) (time.Duration, int, bool) { return 0, 0, false } },
+		"ChargeOnce":       func(c *Config) { c.ChargeOnce = true },
+		"PenaltyThreshold": func(c *Config) { c.PenaltyThreshold = 10 },
+		"PenaltyDuration":  func(c *Config) { c.PenaltyThreshold, c.PenaltyDuration = 10, time.Hour },
+		"MaxWait":          func(c *Config) { c.MaxWait = time.Second },
+		"Methods":          func(c *Config) { c.Methods = []string{http.MethodPost} },
+		"Skip":             func(c *Config) { c.Skip = func(*http.Request) bool { return false } },
+		"GlobalLimit":      func(c *Config) { c.GlobalRefillEvery, c.GlobalBurst = time.Second, 100 },
+		"SendScopeHeader":  func(c *Config) { c.SendScopeHeader = true },
+		"Refund":           func(c *Config) { c.Refund = func(int) bool { return false } },
+		"Exempt": func(c *Config) {
+			c.Exempt = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+		},
+		"ServerNameResponse": func(c *Config) {
+			c.ServerNameLimits["a.example.com"] = Limit{Burst: 10, Response: Response{Status: 503}}
+		},
+		"FailClosed":               func(c *Config) { c.FailClosed = true },
+		"CacheableDenials":         func(c *Config) { c.CacheableDenials = true },
+		"Vary":                     func(c *Config) { c.Vary = "X-Forwarded-For" },
+		"MaxLimiterTime":           func(c *Config) { c.MaxLimiterTime = time.Second },
+		"IPFuncTimeout":            func(c *Config) { c.IPFuncTimeout = time.Second },
+		"ForgiveAfter":             func(c *Config) { c.ForgiveAfter = time.Hour },
+		"MaxIdle":                  func(c *Config) { c.MaxIdle = time.Hour },
+		"MaxRetryAfter":            func(c *Config) { c.MaxRetryAfter = time.Hour },
+		"MaxBans":                  func(c *Config) { c.MaxBans = 10 },
+		"RetryViolationBackoff":    func(c *Config) { c.RetryViolationBackoff = 2 },
+		"EnforcePercent":           func(c *Config) { c.EnforcePercent = 50 },
+		"SendRateLimitHeaders":     func(c *Config) { c.SendRateLimitHeaders = true },
+		"InitialTokens":            func(c *Config) { c.InitialTokens = 1 },
+		"IPv4Mask":                 func(c *Config) { c.IPv4Mask = 24 },
+		"IPv6Mask":                 func(c *Config) { c.IPv6Mask = 64 },
+		"AnonymizeKeys":            func(c *Config) { c.AnonymizeKeys = true },
+		"NewKeyAlertRate":          func(c *Config) { c.NewKeyAlertRate = 10 },
+		"NewKeyAlertOverflow":      func(c *Config) { c.NewKeyAlertOverflow = true },
+		"Score":                    func(c *Config) { c.Score = &ScoreWeights{Usage: 1} },
+		"ProblemDetails":           func(c *Config) { c.ProblemDetails = true },
+		"DryRun":                   func(c *Config) { c.DryRun = true },
+		"ExactKeys":                func(c *Config) { c.ExactKeys = true },
+		"LimitBody":                func(c *Config) { c.LimitBody = []byte("slow down") },
+		"Allowlist":                func(c *Config) { c.Policy.Allowlist = c.Policy.Allowlist[:1] },
+		"Denylist":                 func(c *Config) { c.Policy.Denylist = []string{"203.0.113.1"} },
+		"KeyByServerName":          func(c *Config) { c.KeyByServerName = false },
+		"ServerNameLimits":         func(c *Config) { c.ServerNameLimits["b.example.com"] = Limit{Burst: 30} },
+		"StrictServerNames":        func(c *Config) { c.StrictServerNames = false },
+		"ServerNamePatterns":       func(c *Config) { c.ServerNamePatterns = c.ServerNamePatterns[:1] },
+		"RejectUnknownServerNames": func(c *Config) { c.RejectUnknownServerNames = true },
+		"ClassQuotas":              func(c *Config) { c.ClassQuotas["b"] = 0.4 },
+	} {
+		cfg := base()
+		change(cfg)
+		if got := hashOf(cfg); got == want {
+			t.Errorf("%s: hash did not change", name)
+		}
+	}
+}
+
+func TestPolicyHashReload(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:      time.Hour,
+		Burst:            1,
+		PolicyHashHeader: "x-policy-hash",
+	}).(*limiter)
+	h1 := lh.PolicyHash()
+	if err := lh.ApplyPolicy(Policy{Denylist: []string{"192.0.2.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	h2 := lh.PolicyHash()
+	if h2 == h1 {
+		t.Fatal("hash did not change on ApplyPolicy")
+	}
+	if st := lh.Stats(); st.PolicyHash != h2 {
+		t.Fatalf("Stats.PolicyHash is %q, want %q", st.PolicyHash, h2)
+	}
+	if err := lh.ApplyPolicy(Policy{}); err != nil {
+		t.Fatal(err)
+	}
+	if h := lh.PolicyHash(); h != h1 {
+		t.Fatalf("hash after reverting policy is %s, want %s", h, h1)
+	}
+	lh.setDefaultLimits(newLimits(time.Minute, 1, defaultMaxRetryAfter))
+	if h := lh.PolicyHash(); h == h1 {
+		t.Fatal("hash did not change on limits change")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	lh.ServeHTTP(httptest.NewRecorder(), req)
+	rec := httptest.NewRecorder()
+	lh.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Policy-Hash"); got != lh.PolicyHash() {
+		t.Fatalf("got policy hash header %q, want %q", got, lh.PolicyHash())
+	}
+}
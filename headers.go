@@ -0,0 +1,35 @@
+package ipratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRateLimitHeaders sets RateLimit-* headers describing the state of the
+// bucket after decision on e, see Config.SendRateLimitHeaders. Only
+// decisions made by the token bucket or a ban get them, free requests (see
+// Config.Cost) don't touch the bucket, so they don't get them either.
+func (h *limiter) setRateLimitHeaders(hdr http.Header, e *evaluation) {
+	var remaining float64
+	var reset time.Duration
+	switch {
+	case e.free:
+		return
+	case e.stage == StageLimit:
+		remaining, reset = e.d.remaining, e.d.nextToken
+	case e.stage == StageBan:
+		reset = e.d.banLeft
+	default:
+		return
+	}
+	reset = min(reset, e.lim.maxWait)
+	secs := int64(reset / time.Second)
+	if reset%time.Second > 0 {
+		secs++
+	}
+	hdr.Set("RateLimit-Limit", strconv.FormatFloat(e.lim.burst, 'f', 0, 64))
+	hdr.Set("RateLimit-Remaining", strconv.FormatFloat(math.Max(math.Floor(remaining), 0), 'f', 0, 64))
+	hdr.Set("RateLimit-Reset", strconv.FormatInt(secs, 10))
+}
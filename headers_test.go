@@ -0,0 +1,92 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	var seen string // RateLimit-Remaining as seen by the handler
+	lh := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = w.Header().Get("RateLimit-Remaining")
+	}), &Config{
+		RefillEvery:          1500 * time.Millisecond,
+		Burst:                3,
+		IPFunc:               IPFromXForwardedFor,
+		Exempt:               []*net.IPNet{{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)}},
+		SendRateLimitHeaders: true,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func(addr string) *httptest.ResponseRecorder {
+		seen = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w
+	}
+	for i, tc := range []struct {
+		advance                 time.Duration
+		code                    int
+		limit, remaining, reset string
+	}{
+		{0, http.StatusOK, "3", "2", "2"},
+		{0, http.StatusOK, "3", "1", "2"},
+		{0, http.StatusOK, "3", "0", "2"},
+		{0, http.StatusTooManyRequests, "3", "0", "2"},
+		{500 * time.Millisecond, http.StatusTooManyRequests, "3", "0", "1"},
+		{time.Second, http.StatusOK, "3", "0", "2"},
+		{time.Hour, http.StatusOK, "3", "2", "2"},
+	} {
+		now = now.Add(tc.advance)
+		w := serve("192.0.2.1")
+		hdr := w.Header()
+		if w.Code != tc.code || hdr.Get("RateLimit-Limit") != tc.limit ||
+			hdr.Get("RateLimit-Remaining") != tc.remaining || hdr.Get("RateLimit-Reset") != tc.reset {
+			t.Fatalf("request %d: got status %d, headers %v", i, w.Code, hdr)
+		}
+		if tc.code == http.StatusOK && seen != tc.remaining {
+			t.Fatalf("request %d: handler saw RateLimit-Remaining %q", i, seen)
+		}
+	}
+
+	if err := lh.Ban(net.IPv4(192, 0, 2, 2), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w := serve("192.0.2.2")
+	if hdr := w.Header(); w.Code != http.StatusTooManyRequests || hdr.Get("RateLimit-Remaining") != "0" ||
+		hdr.Get("RateLimit-Reset") != "90" {
+		t.Errorf("banned client: got status %d, headers %v", w.Code, hdr)
+	}
+
+	if w := serve("203.0.113.1"); w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("exempt client got headers %v", w.Header())
+	}
+
+	lh = New(http.NotFoundHandler(), &Config{IPFunc: IPFromXForwardedFor}).(*limiter)
+	if w := serve("192.0.2.1"); w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("headers set without SendRateLimitHeaders: %v", w.Header())
+	}
+}
+
+func TestNextTokenIn(t *testing.T) {
+	l := newLimits(time.Second, 5, time.Hour)
+	for _, tc := range []struct {
+		left float64
+		want time.Duration
+	}{
+		{5, 0},
+		{4, time.Second},
+		{0, time.Second},
+		{0.25, 750 * time.Millisecond},
+		{2.5, 500 * time.Millisecond},
+	} {
+		if got := l.nextTokenIn(tc.left); got != tc.want {
+			t.Errorf("nextTokenIn(%v) = %v, want %v", tc.left, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ipratelimit
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// defaultHistorySize is the number of decisions kept per bucket if
+	// Config.HistorySize is not set
+	defaultHistorySize = 16
+
+	// historyOverhead is an estimated memory footprint of the history of
+	// a single bucket without its records: the ring itself and its map
+	// entry
+	historyOverhead = 96
+)
+
+// DecisionRecord is a decision made by the token bucket of a client, see
+// History
+type DecisionRecord struct {
+	Time    time.Time
+	Allowed bool
+}
+
+// history is a ring buffer of the last decisions made by a bucket, 9 bytes
+// per decision
+type history struct {
+	at      []int64 // decision times as nanoseconds since Unix epoch
+	allowed []bool
+	next    int // index of the slot to record the next decision into
+	n       int // number of decisions recorded, up to len(at)
+}
+
+// add records a decision made at the given time, overwriting the oldest
+// one if the ring is full
+func (r *history) add(now int64, allowed bool) {
+	r.at[r.next], r.allowed[r.next] = now, allowed
+	r.next = (r.next + 1) % len(r.at)
+	r.n = min(r.n+1, len(r.at))
+}
+
+// records returns recorded decisions, oldest first
+func (r *history) records() []DecisionRecord {
+	out := make([]DecisionRecord, r.n)
+	for i := range out {
+		j := (r.next - r.n + i + len(r.at)) % len(r.at)
+		out[i] = DecisionRecord{Time: time.Unix(0, r.at[j]), Allowed: r.allowed[j]}
+	}
+	return out
+}
+
+// historyMemSize returns memory held by the history of a single bucket of
+// the given size, in bytes
+func historyMemSize(size int) int64 { return historyOverhead + int64(size)*9 }
+
+// recordHistory records decision of the bucket with the given key in its
+// history of the given size, must be called with s.m held
+func (s *shard) recordHistory(key uint64, now int64, allowed bool, size int) {
+	r := s.history[key]
+	if r == nil {
+		if s.history == nil {
+			s.history = make(map[uint64]*history)
+		}
+		r = &history{at: make([]int64, size), allowed: make([]bool, size)}
+		s.history[key] = r
+	}
+	r.add(now, allowed)
+}
+
+// History returns the last decisions made by the token bucket of the given
+// IP address, oldest first, up to Config.HistorySize of them. It is meant
+// for support tooling answering questions like "when did this client use
+// up its budget". It returns nil unless Config.TrackHistory is set, and for
+// addresses without a local bucket: ones never seen, ones whose bucket was
+// evicted or expired, which also discards its history, and all addresses
+// if Config.Store is set. Denials by policy or bans are not recorded.
+//
+// Handler returned by New implements interface{ History(net.IP) []DecisionRecord }.
+func (h *limiter) History(ip net.IP) []DecisionRecord {
+	if h.historySize == 0 || h.store != nil {
+		return nil
+	}
+	if ip = canonicalIP(ip); ip == nil {
+		return nil
+	}
+	masked := h.maskIP(ip)
+	s := h.shardOf(keyOf(masked))
+	s.m.Lock()
+	defer s.m.Unlock()
+	key, _ := h.slotOf(s, keyOf(masked), masked)
+	if r := s.history[key]; r != nil {
+		return r.records()
+	}
+	return nil
+}
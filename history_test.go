@@ -0,0 +1,85 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:  time.Minute,
+		Burst:        3,
+		MaxIdle:      time.Hour,
+		TrackHistory: true,
+		HistorySize:  4,
+	}).(*limiter)
+	defer lh.Close()
+	start := time.Unix(1000, 0)
+	now := start
+	lh.now = func() time.Time { return now }
+	ip := net.ParseIP("192.0.2.1")
+	if h := lh.History(ip); h != nil {
+		t.Fatalf("history of unknown address: %v", h)
+	}
+	// 6 requests a second apart: the first 3 are allowed, then the ring
+	// rolls over keeping the last 4
+	for i := 0; i < 6; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		lh.Allow(ip)
+	}
+	got := lh.History(net.ParseIP("::ffff:192.0.2.1"))
+	if len(got) != 4 {
+		t.Fatalf("got %d records: %v", len(got), got)
+	}
+	for i, r := range got {
+		want := DecisionRecord{Time: start.Add(time.Duration(i+2) * time.Second), Allowed: i == 0}
+		if !r.Time.Equal(want.Time) || r.Allowed != want.Allowed {
+			t.Errorf("record %d: got %+v, want %+v", i, r, want)
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if st := lh.Stats(); st.BookkeepingMemory < historyMemSize(4) {
+		t.Errorf("history not accounted for in bookkeeping memory: %d", st.BookkeepingMemory)
+	}
+	// history is discarded along with the bucket
+	if n := lh.expire(now.Add(time.Hour)); n != 1 {
+		t.Fatalf("expired %d buckets", n)
+	}
+	if h := lh.History(ip); h != nil {
+		t.Fatalf("history of expired bucket: %v", h)
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	for _, cfg := range []*Config{
+		{HistorySize: 4},
+		{TrackHistory: true, Store: failingStore{}},
+	} {
+		lh := New(http.NotFoundHandler(), cfg).(*limiter)
+		ip := net.ParseIP("192.0.2.1")
+		lh.Allow(ip)
+		if h := lh.History(ip); h != nil {
+			t.Errorf("%+v: got history %v", cfg, h)
+		}
+		for i := range lh.shards {
+			if lh.shards[i].history != nil {
+				t.Errorf("%+v: history allocated", cfg)
+			}
+		}
+	}
+	lh := New(http.NotFoundHandler(), &Config{TrackHistory: true, Burst: 100}).(*limiter)
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 20; i++ {
+		lh.Allow(ip)
+	}
+	if h := lh.History(ip); len(h) != defaultHistorySize {
+		t.Errorf("got %d records with default size", len(h))
+	}
+}
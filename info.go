@@ -0,0 +1,30 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+)
+
+// Info describes the decision the limiter made on the request passed to the
+// wrapped handler, see InfoFromContext.
+type Info struct {
+	IP        net.IP  // address the request was limited by, nil for keys of Config.KeyFunc
+	Remaining float64 // tokens left in the bucket after the request was charged
+
+	// Limited is set if the request was denied but passed to the handler
+	// anyway: because the limiter doesn't enforce decisions on it, see
+	// Config.EnforcePercent, or because it runs in scoring mode, see
+	// Config.Score.
+	Limited bool
+}
+
+type infoKey struct{}
+
+// InfoFromContext returns the decision the limiter made on the request
+// passed to the handler. It is not available for requests the limiter
+// made no decision on: ones bypassing it, e.g. without an address, and ones
+// passed on error, see Config.FailClosed.
+func InfoFromContext(ctx context.Context) (info Info, ok bool) {
+	info, ok = ctx.Value(infoKey{}).(Info)
+	return info, ok
+}
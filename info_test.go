@@ -0,0 +1,62 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfoFromContext(t *testing.T) {
+	var got []Info
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		info, ok := InfoFromContext(r.Context())
+		if !ok {
+			t.Errorf("no info for request from %s", r.RemoteAddr)
+			return
+		}
+		got = append(got, info)
+	}
+	for _, tc := range []struct {
+		name string
+		conf Config
+	}{
+		{"score", Config{Score: &ScoreWeights{Usage: 1}}},
+		{"not enforced", Config{EnforcePercent: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = got[:0]
+			conf := tc.conf
+			conf.RefillEvery, conf.Burst = time.Hour, 1
+			lh := New(http.HandlerFunc(handler), &conf).(*limiter)
+			if tc.conf.EnforcePercent != 0 && !lh.observed(keyOf(net.ParseIP("192.0.2.1").To4())) {
+				t.Fatal("test address is in the enforced cohort")
+			}
+			for i := 0; i < 2; i++ {
+				lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+			if len(got) != 2 {
+				t.Fatalf("handler called %d times, want 2", len(got))
+			}
+			if got[0].Limited || got[0].Remaining != 0 || got[0].IP.String() != "192.0.2.1" {
+				t.Errorf("first request: %+v", got[0])
+			}
+			if !got[1].Limited {
+				t.Errorf("second request: %+v", got[1])
+			}
+		})
+	}
+}
+
+func TestInfoFromContextBypass(t *testing.T) {
+	var called, ok bool
+	lh := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		_, ok = InfoFromContext(r.Context())
+	}), &Config{IPFunc: func(*http.Request) net.IP { return nil }})
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !called || ok {
+		t.Errorf("handler called: %v, info attached: %v", called, ok)
+	}
+}
@@ -0,0 +1,82 @@
+package ipratelimit
+
+import (
+	"sort"
+	"time"
+)
+
+// BucketEntry describes a bucket of the built-in storage, see Buckets and
+// TopLimited. Addresses are not stored, only their hashes, so buckets are
+// identified by key, formatted as in logs and ExportCSV.
+type BucketEntry struct {
+	Key             string    // bucket key
+	Tokens          float64   // tokens left as of the last access
+	LastAccess      time.Time // time of the last access
+	LastDenial      time.Time // time of the last denial, zero if none or if Config.TrackStats is not set
+	DenialStreak    int       // current number of consecutive denials, if Config.TrackStats is set
+	MaxDenialStreak int       // longest number of consecutive denials, if Config.TrackStats is set
+	Class           string    // class of the request which created the bucket, see Config.ClassQuotas
+}
+
+func (h *limiter) bucketEntry(key uint64, bkt bucket) BucketEntry {
+	e := BucketEntry{
+		Key:             formatKey(key),
+		Tokens:          bkt.left,
+		LastAccess:      time.Unix(0, bkt.mtime),
+		DenialStreak:    int(bkt.streak),
+		MaxDenialStreak: int(bkt.maxStreak),
+		Class:           h.className(bkt.class),
+	}
+	if bkt.denied != 0 {
+		e.LastDenial = time.Unix(0, bkt.denied)
+	}
+	return e
+}
+
+// Buckets calls fn with each bucket of the built-in storage until fn returns
+// false. Shards are walked one by one: bucket keys of a shard are collected
+// first, then its buckets are copied in batches, so fn is called without
+// locks held and traffic proceeds during the walk. Walk is not a consistent
+// snapshot: buckets evicted during the walk are skipped, buckets created
+// during the walk may not be visited. If Config.Store is set, there are no
+// buckets to walk. Number of buckets is reported in Stats.Buckets.
+//
+// Handler returned by New implements interface{ Buckets(func(BucketEntry) bool) }.
+func (h *limiter) Buckets(fn func(BucketEntry) bool) {
+	h.walkBuckets(func(key uint64, bkt bucket, _ totals) bool { return fn(h.bucketEntry(key, bkt)) })
+}
+
+// TopLimited returns up to n buckets being denied now, those with the
+// longest current denial streaks first, the most recently denied first on
+// ties. It walks all buckets as Buckets does. Denial streaks are only
+// maintained if Config.TrackStats is set, otherwise it returns nil.
+//
+// Handler returned by New implements interface{ TopLimited(int) []BucketEntry }.
+func (h *limiter) TopLimited(n int) []BucketEntry {
+	if !h.trackStats || n <= 0 {
+		return nil
+	}
+	type limited struct {
+		key uint64
+		bkt bucket
+	}
+	var top []limited
+	h.walkBuckets(func(key uint64, bkt bucket, _ totals) bool {
+		if bkt.streak > 0 {
+			top = append(top, limited{key, bkt})
+		}
+		return true
+	})
+	sort.Slice(top, func(i, j int) bool {
+		a, b := top[i].bkt, top[j].bkt
+		if a.streak != b.streak {
+			return a.streak > b.streak
+		}
+		return a.denied > b.denied
+	})
+	out := make([]BucketEntry, 0, min(n, len(top)))
+	for _, l := range top[:min(n, len(top))] {
+		out = append(out, h.bucketEntry(l.key, l.bkt))
+	}
+	return out
+}
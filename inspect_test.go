@@ -0,0 +1,102 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       3,
+		MaxBuckets:  5000,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	if n := len(lh.shards); n < 2 {
+		t.Fatalf("got %d shards", n)
+	}
+	want := make(map[string]float64)
+	for i := 0; i < 2500; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		for j := 0; j <= i%3; j++ {
+			lh.Allow(ip)
+		}
+		want[formatKey(keyOf(ip.To4()))] = float64(2 - i%3)
+	}
+	var visited int
+	created := make(map[string]bool) // buckets created during the walk
+	lh.Buckets(func(e BucketEntry) bool {
+		visited++
+		if created[e.Key] {
+			return true
+		}
+		if tokens, ok := want[e.Key]; !ok || e.Tokens != tokens || !e.LastAccess.Equal(now) {
+			t.Fatalf("unexpected bucket %+v", e)
+		}
+		delete(want, e.Key)
+		// locks are not held while fn is called
+		ip := net.IPv4(192, 0, byte(visited>>8), byte(visited))
+		created[formatKey(keyOf(ip.To4()))] = true
+		lh.Allow(ip)
+		return true
+	})
+	if len(want) != 0 {
+		t.Errorf("%d buckets not visited", len(want))
+	}
+	visited = 0
+	lh.Buckets(func(BucketEntry) bool { visited++; return visited < 10 })
+	if visited != 10 {
+		t.Errorf("walk not stopped, visited %d buckets", visited)
+	}
+}
+
+func TestTopLimited(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cfg := &Config{RefillEvery: time.Hour, Burst: 1, TrackStats: true}
+	lh := New(http.NotFoundHandler(), cfg).(*limiter)
+	lh.now = func() time.Time { return now }
+	for _, tc := range []struct {
+		ip       net.IP
+		requests int
+	}{
+		{net.IPv4(192, 0, 2, 1), 2},
+		{net.IPv4(192, 0, 2, 2), 4},
+		{net.IPv4(192, 0, 2, 3), 2},
+		{net.IPv4(192, 0, 2, 4), 1},
+	} {
+		now = now.Add(time.Second)
+		for i := 0; i < tc.requests; i++ {
+			lh.Allow(tc.ip)
+		}
+	}
+	var got []string
+	for _, e := range lh.TopLimited(10) {
+		got = append(got, e.Key)
+		if e.LastDenial.IsZero() || e.DenialStreak == 0 {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+	// longest streak first, then the most recently denied
+	want := []string{
+		formatKey(keyOf(net.IPv4(192, 0, 2, 2).To4())),
+		formatKey(keyOf(net.IPv4(192, 0, 2, 3).To4())),
+		formatKey(keyOf(net.IPv4(192, 0, 2, 1).To4())),
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if top := lh.TopLimited(1); len(top) != 1 || top[0].Key != want[0] || top[0].DenialStreak != 3 {
+		t.Errorf("TopLimited(1) = %+v", top)
+	}
+
+	cfg.TrackStats = false
+	lh = New(http.NotFoundHandler(), cfg).(*limiter)
+	lh.Allow(net.IPv4(192, 0, 2, 1))
+	lh.Allow(net.IPv4(192, 0, 2, 1))
+	if top := lh.TopLimited(10); top != nil {
+		t.Errorf("got %+v without TrackStats", top)
+	}
+}
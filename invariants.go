@@ -0,0 +1,165 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// checkInvariants verifies consistency of the limiter internal state and
+// returns an error describing the first violation found. It walks the whole
+// state under the locks, so it is only meant to be used in tests.
+func (h *limiter) checkInvariants() error {
+	for i := range h.shards {
+		if err := h.checkShard(i); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err := checkBucket(h.overflow, h.maxBurst, false); err != nil {
+		return fmt.Errorf("overflow bucket: %w", err)
+	}
+	return nil
+}
+
+// checkShard verifies consistency of the i-th shard, see checkInvariants
+func (h *limiter) checkShard(i int) error {
+	s := &h.shards[i]
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.ipmap) > s.capacity {
+		return fmt.Errorf("%d buckets exceed capacity of %d", len(s.ipmap), s.capacity)
+	}
+	if s.keys.len() != len(s.ipmap) {
+		return fmt.Errorf("keys queue holds %d keys, map holds %d buckets", s.keys.len(), len(s.ipmap))
+	}
+	if n, size := s.keys.len(), len(s.keys.buf); size > minQueueSize && n < size/4 {
+		return fmt.Errorf("keys queue of %d keys holds buffer of %d", n, size)
+	}
+	seen := make(map[uint64]struct{}, s.keys.len())
+	var err error
+	for i, n := 0, s.keys.len(); i < n; i++ {
+		k := s.keys.pop()
+		s.keys.push(k)
+		if err != nil {
+			continue // keep rotating to restore the original order
+		}
+		if _, ok := seen[k]; ok {
+			err = fmt.Errorf("key %s is queued more than once", formatKey(k))
+			continue
+		}
+		seen[k] = struct{}{}
+		if _, ok := s.ipmap[k]; !ok {
+			err = fmt.Errorf("queued key %s has no bucket", formatKey(k))
+			continue
+		}
+		if h.shardOf(k) != s {
+			err = fmt.Errorf("key %s belongs to another shard", formatKey(k))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for k := range s.history {
+		if _, ok := s.ipmap[k]; !ok {
+			return fmt.Errorf("history of key %s has no bucket", formatKey(k))
+		}
+	}
+	for k := range s.owners {
+		if _, ok := s.ipmap[k]; !ok {
+			return fmt.Errorf("owner of key %s has no bucket", formatKey(k))
+		}
+	}
+	for k := range s.totals {
+		if _, ok := s.ipmap[k]; !ok {
+			return fmt.Errorf("totals of key %s have no bucket", formatKey(k))
+		}
+	}
+	// limits only grow maxBurst, and h.m is taken after shard lock, so
+	// buckets of the shard were all created within this bound
+	h.m.Lock()
+	maxBurst := h.maxBurst
+	h.m.Unlock()
+	for k, bkt := range s.ipmap {
+		if err := checkBucket(bkt, maxBurst, h.maxDelay > 0); err != nil {
+			return fmt.Errorf("bucket %s: %w", formatKey(k), err)
+		}
+	}
+	if s.classUsage != nil {
+		usage := make([]int, len(s.classUsage))
+		for _, bkt := range s.ipmap {
+			if int(bkt.class) >= len(usage) {
+				return fmt.Errorf("bucket of unknown class %d", bkt.class)
+			}
+			usage[bkt.class]++
+		}
+		for c := range usage {
+			if usage[c] != s.classUsage[c] {
+				return fmt.Errorf("class %q has %d buckets, %d accounted", h.classNames[c], usage[c], s.classUsage[c])
+			}
+		}
+	}
+	return nil
+}
+
+// checkBucket checks bucket state; tokens may only be negative if they were
+// reserved, see Config.MaxWait
+func checkBucket(bkt bucket, maxBurst float64, reserved bool) error {
+	if math.IsNaN(bkt.left) || math.IsInf(bkt.left, 0) || (bkt.left < 0 && !reserved) || bkt.left > maxBurst {
+		return fmt.Errorf("tokens %v out of [0, %v] range", bkt.left, maxBurst)
+	}
+	if bkt.mtime < 0 {
+		return fmt.Errorf("negative access time %d", bkt.mtime)
+	}
+	return nil
+}
+
+// dumpState returns human-readable summary of the limiter internal state, up
+// to maxBuckets buckets are listed, meant for diagnosing invariant
+// violations in tests.
+func (h *limiter) dumpState(maxBuckets int) string {
+	var b strings.Builder
+	n, capacity := h.buckets()
+	fmt.Fprintf(&b, "buckets: %d, capacity: %d, shards: %d\n", n, capacity, len(h.shards))
+	g := h.gen.Load()
+	def := g.def
+	fmt.Fprintf(&b, "burst: %v, refill every: %v ns\n", def.burst, def.refillEvery)
+	h.m.Lock()
+	fmt.Fprintf(&b, "alerting: %v, overflow bucket: %+v\n", h.alerting, h.overflow)
+	h.m.Unlock()
+	for c := range h.counters.bypassed {
+		fmt.Fprintf(&b, "bypassed (%s): %d\n", bypassClass(c), h.counters.bypassed[c].Load())
+	}
+	for _, rh := range h.ruleHits(g.policy) {
+		fmt.Fprintf(&b, "rule hits (%s %s): %d\n", rh.List, rh.Rule, rh.Hits)
+	}
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		var streaks, penalties int
+		for _, bkt := range s.ipmap {
+			streak, penalty := bkt.saturated()
+			if streak {
+				streaks++
+			}
+			if penalty {
+				penalties++
+			}
+		}
+		fmt.Fprintf(&b, "shard %d: buckets: %d, queued keys: %d, capacity: %d, saturated streaks: %d, saturated penalties: %d\n",
+			i, len(s.ipmap), s.keys.len(), s.capacity, streaks, penalties)
+		for k, bkt := range s.ipmap {
+			if maxBuckets--; maxBuckets < 0 {
+				break
+			}
+			fmt.Fprintf(&b, "%s: %+v\n", formatKey(k), bkt)
+		}
+		s.m.Unlock()
+		if maxBuckets < 0 {
+			b.WriteString("...\n")
+			break
+		}
+	}
+	return b.String()
+}
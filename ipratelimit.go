@@ -2,29 +2,568 @@
 package ipratelimit
 
 import (
+	"context"
+	"hash/maphash"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/artyom/logger"
-	"github.com/cespare/xxhash"
 )
 
 // Config holds rate limiter configuration
 type Config struct {
 	RefillEvery time.Duration    // interval to refill bucket by single token up to Burst size
 	Burst       int              // bucket capacity
-	MaxBuckets  int              // maximum number of buckets — per-IP states to keep; on overflow oldest records would be evicted
+	MaxBuckets  int              // maximum number of buckets — per-IP states to keep; on overflow least recently used records would be evicted
 	IPFunc      IPFunc           // function to extract IP address from http request
 	Logger      logger.Interface // if nil, nothing would be logged
+
+	// Rate, if positive, is used instead of RefillEvery: it is the number
+	// of tokens refilled per second, so Rate 250 is the same as
+	// RefillEvery 4ms. Fractional rates are allowed, e.g. Rate 0.5 is one
+	// token per 2 seconds. Supported range is [MinRate, MaxRate].
+	Rate float64
+
+	// AddrFunc, if set, is used instead of IPFunc. Unlike IPFunc, it
+	// doesn't need to allocate address on each request, see
+	// AddrFromRemoteAddr and AddrFromXForwardedFor.
+	AddrFunc AddrFunc
+
+	// KeyFunc, if set, is used instead of IPFunc and AddrFunc: requests
+	// are limited by the key it returns, e.g. API key for authenticated
+	// requests and client address for anonymous ones. Requests for which
+	// it returns an empty key are allowed without additional processing,
+	// as with IPFunc returning nil. Keys are only kept hashed and are
+	// never logged. Address-based features (Policy, Exempt, bans, IPv4Mask
+	// and IPv6Mask) don't apply to requests limited by key. IPFuncTimeout
+	// and Instrument apply to KeyFunc and AddrFunc as they do to IPFunc.
+	KeyFunc func(*http.Request) []byte
+
+	// TraceHook, if set, is called once per rate limited request with the
+	// request context and details of the limiter decision. It is called
+	// for allowed and denied requests, as well as for requests whose
+	// decision failed (see TraceEvent.Err) and ones abandoned while waiting
+	// for tokens (see TraceEvent.Abandoned), outside of any internal locks,
+	// before the wrapped handler is called or the denial response is
+	// written. It is not called for requests bypassing the limiter (e.g.
+	// when IPFunc returns nil).
+	//
+	// This can be used to attach limiter details to the request trace span,
+	// see example.
+	TraceHook func(ctx context.Context, ev TraceEvent)
+
+	// NewKeyAlertRate, if positive, is the number of previously unseen IP
+	// addresses per minute which, if exceeded, raises an alert: a message is
+	// logged and NewKeyAlertFunc is called. Such an explosion of unique
+	// addresses usually means an attack or a misconfigured IPFunc. Alert is
+	// raised again only after the rate drops to the limit and exceeds it
+	// once more.
+	NewKeyAlertRate int
+
+	// NewKeyAlertFunc, if set, is called with the current rate of new
+	// addresses per minute when the NewKeyAlertRate alert is raised.
+	NewKeyAlertFunc func(perMinute float64)
+
+	// NewKeyAlertOverflow, if set, makes the limiter stop creating buckets
+	// for previously unseen addresses while the NewKeyAlertRate alert is
+	// raised: all such requests are accounted in a single shared bucket
+	// instead, so the flood of new addresses does not evict the state of
+	// known clients. Normal operation resumes once the rate subsides.
+	NewKeyAlertOverflow bool
+
+	// CacheableDenials disables "Cache-Control: no-store" header which is
+	// otherwise set on limiter-generated denial responses, so that shared
+	// caches in front of the service (e.g. CDN) never serve response denied
+	// for one client to other clients.
+	CacheableDenials bool
+
+	// Vary, if set, is added to the Vary header of limiter-generated denial
+	// responses. When IPFunc extracts address from a request header, set
+	// this to the name of such header (e.g. "X-Forwarded-For"), so shared
+	// caches never reuse denial response across clients.
+	Vary string
+
+	// FailClosed makes requests to be denied if limiter is unable to make a
+	// decision, e.g. because request context is canceled before the
+	// decision is made or Store returned an error. By default such requests
+	// are allowed. Denied requests whose context is done get no response,
+	// see Counters.Abandoned.
+	FailClosed bool
+
+	// Store, if set, keeps token buckets instead of the built-in in-memory
+	// storage, e.g. to share limits across multiple instances of the
+	// service. MaxBuckets, TargetMemory and NewKeyAlert* settings only
+	// apply to the built-in storage and are ignored when Store is set.
+	Store Store
+
+	// TargetMemory, if positive and MaxBuckets is 0, enables automatic
+	// sizing of the number of buckets: limiter starts with a small number
+	// of buckets and doubles it in background while evicted buckets are
+	// younger than MinEvictionAge, up to the number of buckets estimated to
+	// fit into TargetMemory bytes. Handler returned by New in this mode
+	// runs a background goroutine and implements io.Closer which should be
+	// called to stop it.
+	TargetMemory int64
+
+	// MinEvictionAge is the time since the last access of the bucket; if
+	// buckets not accessed for less than this time are evicted, automatic
+	// sizing enabled with TargetMemory grows the number of buckets. If zero,
+	// 5 minutes is used.
+	MinEvictionAge time.Duration
+
+	// MaxIdle, if positive, makes buckets not accessed for that long
+	// removed in background, so memory held by the built-in storage
+	// shrinks back after a burst of traffic from many addresses instead of
+	// staying at MaxBuckets. Buckets are checked on each maintenance pass,
+	// see MaintenanceEvery. Client whose bucket was removed starts
+	// afresh, so MaxIdle shorter than the time to refill the whole bucket
+	// also works like ForgiveAfter. Handler returned by New in this mode
+	// runs a background goroutine and implements io.Closer which should be
+	// called to stop it.
+	MaxIdle time.Duration
+
+	// MaintenanceEvery is the interval of background maintenance done for
+	// TargetMemory and MaxIdle, see RunMaintenance. If zero, it is 10
+	// seconds with TargetMemory, and a quarter of MaxIdle, but at least a
+	// second, with MaxIdle, whichever is shorter. If negative, no
+	// background goroutine is started, and RunMaintenance should be
+	// called by the embedder instead, e.g. from its own scheduler.
+	// Likewise, if SummaryEvery is not set, EmitSummary can be called.
+	MaintenanceEvery time.Duration
+
+	// TrackStats enables collection of additional statistics, which has a
+	// small cost on each request: lengths of denial streaks — runs of
+	// consecutive denied requests from the same address — are reported in
+	// Stats.DenialStreaks, the time of the last denial of each address is
+	// kept for RecentlyLimited, and the time each bucket was created along
+	// with its request and denial totals are kept for ExportCSV.
+	TrackStats bool
+
+	// TrackHistory makes each bucket keep times and outcomes of its last
+	// HistorySize decisions, reported by History. It's meant for
+	// debugging and costs 9 bytes per decision per bucket, plus some
+	// overhead, see Stats.BookkeepingMemory. If HistorySize is zero, 16 is
+	// used.
+	TrackHistory bool
+	HistorySize  int
+
+	// MaxLimiterTime, if positive, bounds the time spent by the limiter on
+	// a single decision, not counting the wrapped handler. It applies to
+	// blocking operations, like Store calls: if they don't complete in
+	// time, decision is considered failed and request is handled according
+	// to FailClosed. Such timeouts are counted in Stats.LimiterTimeouts.
+	MaxLimiterTime time.Duration
+
+	// Instrument enables collection of timing statistics, which has a
+	// small cost on each request: durations of IPFunc calls are reported
+	// in Stats.IPFuncDurations, and time spent by the limiter before the
+	// request is passed to the handler or denied, in
+	// Stats.LimiterOverhead. The latter is also available to the handler
+	// with OverheadFromContext.
+	Instrument bool
+
+	// IPFuncTimeout, if positive, bounds the time IPFunc may take: if it
+	// doesn't return in time, request is treated as if IPFunc returned
+	// nil, and the timeout is counted in Stats.IPFuncTimeouts. Setting it
+	// makes each IPFunc call run in a separate goroutine on a copy of the
+	// request, which adds allocations and a few microseconds of overhead
+	// to every request.
+	IPFuncTimeout time.Duration
+
+	// Policy holds initial allowlist and denylist, it can be replaced
+	// later with ApplyPolicy. If Policy is invalid, New panics.
+	Policy Policy
+
+	// Exempt lists networks of clients passed to the handler without rate
+	// limiting, e.g. health checkers and internal tooling. Unlike
+	// Policy.Allowlist, it can't be replaced at runtime and requests it
+	// exempts are counted separately, in Stats.BypassedExempt. Lookup time
+	// grows logarithmically with the number of networks. Denylist still
+	// applies to such requests.
+	Exempt []*net.IPNet
+
+	// IPv4Mask and IPv6Mask, if positive, are prefix lengths addresses
+	// are masked with to make bucket keys, so that all addresses of a
+	// network share one bucket, e.g. 24 for IPv4 and 64 for IPv6 to slow
+	// down clients rotating addresses within their networks. Zero values
+	// mean 32 and 128: each address has its own bucket. Policy, Exempt,
+	// bans and logs still see full addresses, unless AnonymizeKeys is set.
+	IPv4Mask int
+	IPv6Mask int
+
+	// AnonymizeKeys, if set, makes the limiter forget client addresses:
+	// they are truncated before keying, to 24 bits for IPv4 and 48 bits for
+	// IPv6 unless IPv4Mask or IPv6Mask are shorter, so limits, bans and
+	// history apply per truncated prefix, and only hashes of prefixes are
+	// kept. Logs print bucket key hashes instead of addresses. Masks longer
+	// than these lengths need full addresses and are rejected by Validate.
+	AnonymizeKeys bool
+
+	// ExactKeys makes sure clients never share a bucket because of a
+	// collision of 64-bit hashes buckets are keyed by: an independent hash
+	// of the address, or of the KeyFunc key, is kept with each bucket and
+	// verified on lookup, and a client whose hash collides with another
+	// one's gets a bucket of its own. It costs about 24 bytes per bucket,
+	// see Stats.BookkeepingMemory; collisions are counted in
+	// Counters.KeyCollisions. It doesn't apply to Store.
+	ExactKeys bool
+
+	// Score, if set, enables scoring mode: requests are never denied by
+	// the rate limit, instead each request is assigned a risk score in [0,
+	// 1] range, reported in the ScoreHeader response header and available
+	// to the wrapped handler with ScoreFromContext, so a later component
+	// can make the decision. See ScoreWeights for the formula. Scoring
+	// mode implies TrackStats. Denylist is still enforced.
+	Score *ScoreWeights
+
+	// MaxBans is the maximum number of active bans set with Ban, 1000 if
+	// not positive. Bans are kept separately from buckets and are never
+	// evicted before they expire.
+	MaxBans int
+
+	// BypassLogEvery, if positive, makes every BypassLogEvery-th request
+	// passed to the handler without rate limiting to be logged, separately
+	// for each reason: no address, Exempt, Policy.Allowlist,
+	// ExemptUserAgents.
+	// Such requests are always counted in Stats.
+	BypassLogEvery int
+
+	// RetryViolationBackoff, if greater than 1, enables harsher handling
+	// of clients ignoring Retry-After: a request which comes before the
+	// Retry-After given to the previous denied request of the same client
+	// is denied regardless of tokens in its bucket, and the wait reported
+	// to it is multiplied by RetryViolationBackoff for each consecutive
+	// violation, up to MaxRetryAfter. Violations are counted in
+	// Stats.RetryViolations regardless of this setting. Not supported with
+	// Store.
+	RetryViolationBackoff float64
+
+	// PenaltyThreshold, if positive, enables penalty bans of clients
+	// persistently hammering the limiter: once requests of a bucket are
+	// denied more than PenaltyThreshold times over its lifetime, all its
+	// requests are denied for PenaltyDuration (10 minutes if not set)
+	// regardless of tokens, with Retry-After reflecting the time left.
+	// Counting starts over after each penalty. Penalty is kept in the
+	// bucket, so it survives refills, but not eviction or expiration.
+	// Penalties imposed are counted in Stats.Penalties. Not supported with
+	// Store.
+	PenaltyThreshold int
+	PenaltyDuration  time.Duration
+
+	// EnforcePercent, if in [1, 99] range, makes the limiter enforce its
+	// decisions on only that percentage of clients, e.g. while rolling
+	// limits out: clients are split into cohorts by their address hash,
+	// so each client is consistently either enforced or observed. Requests
+	// of the observed cohort are evaluated as usual, but those which would
+	// be denied are logged and passed to the handler instead. Decisions of
+	// the observed cohort are counted in Stats.ObservedAllowed and
+	// Stats.ObservedDenied. Zero and 100 enforce all decisions.
+	EnforcePercent int
+
+	// DryRun makes the limiter enforce none of its decisions, as if all
+	// clients were in the observed cohort of EnforcePercent: requests are
+	// evaluated and buckets are charged as usual, but those which would
+	// be denied are logged, counted in Counters.ObservedDenied, and
+	// passed to the handler with DryRunHeader response header set.
+	DryRun bool
+
+	// MaxLogURL is the maximum length of request method and URL in log
+	// lines, 256 bytes if zero; longer ones are truncated with "..."
+	// appended. Control characters are always escaped, so that each
+	// message is logged as a single line.
+	MaxLogURL int
+
+	// KeyByServerName makes buckets keyed by client address together with
+	// the TLS server name (SNI) it requested, so that on a multi-tenant TLS
+	// endpoint clients of one tenant don't consume budget of another.
+	// Server names are compared case-insensitively and without the
+	// trailing dot. Requests made without TLS or SNI are keyed by address
+	// alone. Host header is never considered: it may differ from SNI, e.g.
+	// under domain fronting, and SNI is what selected the tenant
+	// certificate.
+	KeyByServerName bool
+
+	// ServerNameLimits overrides RefillEvery and Burst for requests to the
+	// given TLS server names, only used if KeyByServerName is set. See
+	// LimitSource for precedence of limits.
+	ServerNameLimits map[string]Limit
+
+	// Limits, if set, is called with the client address of each request
+	// reaching the token bucket; if it reports ok, refillEvery and burst
+	// are used for the bucket of the address instead of the limits
+	// otherwise in effect, zero values keep those. This allows higher
+	// quotas for known clients, e.g. partners. Limits are looked up on
+	// each request, so buckets adapt to the new ones on their next access
+	// once the function returns other values. See LimitSource for
+	// precedence of limits. It is not called for requests limited by
+	// KeyFunc.
+	Limits func(ip net.IP) (refillEvery time.Duration, burst int, ok bool)
+
+	// StrictServerNames restricts KeyByServerName to known server names:
+	// those in ServerNameLimits and matching ServerNamePatterns. Requests
+	// to other server names are keyed by address alone, or denied with
+	// "421 Misdirected Request" response if RejectUnknownServerNames is
+	// set. Server name is chosen by the client, so without this
+	// restriction a single client can create any number of buckets,
+	// evicting buckets of other clients.
+	StrictServerNames bool
+
+	// ServerNamePatterns lists known server names for StrictServerNames,
+	// pattern "*.example.com" matches any subdomain of example.com.
+	ServerNamePatterns []string
+
+	// Cost, if set, returns the number of tokens a request takes, so that
+	// expensive requests use more of the client's budget than cheap ones;
+	// by default every request takes a single token. Costs may be
+	// fractional. A request costing more than Burst is never allowed.
+	// Requests of cost that is not positive are allowed without touching
+	// the bucket, and get neither RateLimit headers nor ScoreHeader.
+	Cost func(*http.Request) float64
+
+	// Class, if set, assigns requests to named classes for ClassQuotas.
+	Class func(*http.Request) string
+
+	// ClassQuotas reserves the given fractions of MaxBuckets for buckets
+	// of the given classes. Buckets over the reserve and buckets of
+	// requests of other classes share the rest. When buckets have to be
+	// evicted, only buckets of classes over their reserve are, so a flood
+	// of requests of one class can't evict buckets of another. Bucket
+	// belongs to the class of the request that created it. Fractions must
+	// add up to no more than 1. Only used if Class is set.
+	ClassQuotas map[string]float64
+
+	// Name identifies the limiter in metrics, see MetricsHandler
+	Name string
+
+	// Disabled makes New return handler created by Disabled
+	Disabled bool
+
+	// MaxRetryAfter caps waits reported to clients: Retry-After header
+	// values and Decision.Reset; 24h if not positive. With limits that
+	// refill slower than that, clients told to retry after the cap may be
+	// denied again.
+	MaxRetryAfter time.Duration
+
+	// ForgiveAfter, if positive, makes bucket of a client that made no
+	// requests for that long start afresh: full and with denial streak
+	// cleared, regardless of how much it would be refilled at the regular
+	// rate. It takes precedence over Retry-After violation backoff and
+	// penalty bans of PenaltyThreshold, which are lifted too. Bans set
+	// with Ban are not affected.
+	ForgiveAfter time.Duration
+
+	// InitialTokens, if positive, is the number of tokens buckets start
+	// with, instead of Burst: e.g. with 1, a new client of a signup
+	// endpoint gets a single request right away and earns the rest at
+	// the refill rate. It applies to every bucket created, including
+	// buckets recreated after eviction, and is capped by the burst of
+	// the limits the bucket is created with. It must not exceed Burst.
+	// Buckets of clients forgiven with ForgiveAfter start full. Not
+	// supported with Store.
+	InitialTokens int
+
+	// RejectUnknownServerNames makes requests to unknown server names
+	// denied, see StrictServerNames.
+	RejectUnknownServerNames bool
+
+	// ProblemDetails makes limiter respond with RFC 7807
+	// "application/problem+json" bodies instead of plain text, see
+	// ProblemType.
+	ProblemDetails bool
+
+	// ProblemType is the "type" member of problem details, "about:blank"
+	// if empty. Only used if ProblemDetails is set or Response selects
+	// BodyProblem.
+	ProblemType string
+
+	// Response controls responses to rate limited requests, it can be
+	// overridden with Limit.Response; see Response for precedence.
+	Response Response
+
+	// LimitBody, if not nil, is the body of responses to rate limited
+	// requests, unless Response selects another one: it makes BodyCustom
+	// the default of Response.Body, taking precedence over
+	// ProblemDetails. Its Content-Type is LimitContentType, or detected
+	// with http.DetectContentType if empty; empty body is sent without
+	// one. Status of such responses is set with Response.Status, and
+	// Retry-After is set regardless of it.
+	LimitBody        []byte
+	LimitContentType string
+
+	// ShedResponse controls responses to requests denied because of the
+	// limiter's own capacity rather than the client's usage: ones denied
+	// with FailClosed, e.g. on Store errors or when MaxLimiterTime is
+	// exceeded, and ones denied by the bucket shared by new addresses with
+	// NewKeyAlertOverflow or in drain mode. Zero fields default to status
+	// 503, Retry-After set, and the body Response uses. Such requests are
+	// counted in Counters.Shed, and LimitedHandler doesn't serve them.
+	ShedResponse Response
+
+	// LimitedHandler, if set, serves requests of rate limited and banned
+	// clients, whatever status Response selects for them. It gets the
+	// original request once Retry-After and other headers are set, and
+	// writes the response instead of the status and body selected by
+	// Response. Denials by policy and server name, and ones covered by
+	// ShedResponse, are not affected. It is not called for requests whose
+	// client has already gone, see Counters.Abandoned.
+	LimitedHandler http.Handler
+
+	// SendRateLimitHeaders makes limiter set RateLimit-Limit,
+	// RateLimit-Remaining and RateLimit-Reset headers, as described by
+	// the IETF "RateLimit header fields for HTTP" draft, on responses to
+	// requests decided by the token bucket or a ban, allowed ones
+	// included, so clients can pace themselves before being limited.
+	// Limit is the burst, Remaining is the number of whole tokens left,
+	// and Reset is the number of seconds until the next token is
+	// refilled. Headers are set before the request is passed to the
+	// handler. Requests bypassing the limiter don't get them.
+	SendRateLimitHeaders bool
+
+	// ExemptUserAgents lists User-Agent header prefixes of requests
+	// passed to the handler without rate limiting, e.g. those of uptime
+	// monitoring services which don't have stable addresses. Prefixes are
+	// matched case-sensitively from the start of the header, never as
+	// substrings. Denylist still applies to such requests.
+	//
+	// User-Agent is set by the client, so anyone can get exempted by
+	// sending a matching one: only use this for handlers that are cheap to
+	// serve, like health checks, and make prefixes as specific as
+	// possible.
+	ExemptUserAgents []string
+
+	// NilIPWarnFraction, if positive, enables detection of IPFunc that
+	// can't find client address, e.g. IPFromXForwardedFor used without a
+	// proxy setting the header: if a larger fraction of requests over a
+	// minute has no address, a warning is logged and
+	// Stats.NilIPWarning is set until the fraction drops.
+	NilIPWarnFraction float64
+
+	// KeyConcentrationWarnFraction, if positive, enables detection of
+	// IPFunc returning the same address for everyone, e.g.
+	// IPFromRemoteAddr used behind a proxy: if a larger fraction of
+	// requests over a minute comes from a single address, a warning is
+	// logged and Stats.KeyConcentrationWarning is set until the fraction
+	// drops. Detection is approximate: it lags by a minute, and reliably
+	// catches only addresses making a majority of requests, so the
+	// fraction should be 0.5 or more.
+	KeyConcentrationWarnFraction float64
+
+	// SummaryEvery, if positive, makes limiter log a summary of Counters
+	// accrued over each such interval: numbers of allowed, denied and
+	// bypassed requests, failed decisions and timeouts. Handler returned
+	// by New in this mode runs a background goroutine and implements
+	// io.Closer which should be called to stop it.
+	SummaryEvery time.Duration
+
+	// EvictionSlice, if positive, bounds the time spent on eviction of
+	// excess buckets while handling a single request. Buckets are split
+	// into up to 64 independently locked shards by key, each of at least
+	// 1024 buckets, and each shard holds its share of MaxBuckets. By
+	// default, when the number of buckets of a shard reaches its share, a
+	// tenth of them is evicted at once, which pauses requests to that shard
+	// for the time proportional to its size. With EvictionSlice set,
+	// eviction stops once the slice is used up, and the remainder is
+	// evicted while creating subsequent buckets in the shard, at least one
+	// bucket at a time.
+	EvictionSlice time.Duration
+
+	// PolicyHashHeader, if set, is the name of the header limiter adds to
+	// its denial responses with the PolicyHash value, e.g.
+	// "X-RateLimit-Policy-Hash".
+	PolicyHashHeader string
+
+	// ChargeOnce, if set, makes the limiter mark context of requests it
+	// passes to the handler, and pass requests with such context straight
+	// to the handler, so that handler re-dispatching a request through the
+	// limiter, e.g. to another internal handler, doesn't charge the client
+	// twice. Marker is only seen by requests derived from the original
+	// request context, like ones made by Request.Clone or
+	// Request.WithContext with it; requests made with a fresh context are
+	// charged as usual. Marker is specific to the limiter, so requests
+	// passing another limiter are still charged by it.
+	ChargeOnce bool
+
+	// MaxWait, if positive, makes ServeHTTP delay requests instead of
+	// denying them if the tokens they need are refilled within MaxWait.
+	// Tokens are reserved before waiting, so concurrent requests of the
+	// same client wait in turn instead of all taking the next token. If
+	// request context is done while waiting, reserved tokens are returned
+	// to the bucket and no response is written, see Counters.Abandoned.
+	// Requests which would wait longer are denied as usual. Only applies
+	// to the built-in storage.
+	MaxWait time.Duration
+
+	// Methods, if not empty, restricts limiting to requests with the
+	// listed methods, matched case-insensitively: requests with other
+	// methods are passed straight to the handler without taking tokens
+	// or creating buckets, and are counted in Counters.BypassedMethod.
+	// If empty, requests with any method are limited, including OPTIONS.
+	Methods []string
+
+	// Skip, if set, is called for each request before IPFunc or KeyFunc:
+	// requests it returns true for are passed straight to the handler
+	// without any further processing, and are counted in
+	// Counters.BypassedSkip. Use it for requests which should never be
+	// limited, e.g. authenticated by a shared secret; it must be cheap, as
+	// it runs on every request.
+	Skip func(*http.Request) bool
+
+	// GlobalRefillEvery and GlobalBurst, if both positive, set up a
+	// global token bucket limiting the total rate of requests across all
+	// clients, e.g. to protect the backend from a flood distributed over
+	// many addresses. It is checked after the client bucket: requests
+	// denied by it don't take tokens of their clients, unless buckets are
+	// kept by Store. Such denials are counted in Counters.GlobalDenied.
+	GlobalRefillEvery time.Duration
+	GlobalBurst       int
+
+	// SendScopeHeader makes limiter set ScopeHeader on denials by the
+	// global and the client buckets, so they can be told apart.
+	SendScopeHeader bool
+
+	// Refund, if set, is called with the status of the response to each
+	// request which took tokens: if it returns true, tokens are returned
+	// to the client bucket, up to its burst, and to the global one, see
+	// GlobalBurst. This allows to only charge requests that did work, e.g.
+	// not ones denied by authentication, or only failed ones. Tokens kept
+	// by Store are not returned. Responses on hijacked connections are
+	// never refunded. Refunds are counted in Counters.Refunded.
+	Refund func(status int) bool
+}
+
+// defaultMaxRetryAfter is the default of Config.MaxRetryAfter
+const defaultMaxRetryAfter = 24 * time.Hour
+
+// TraceEvent describes single limiter decision, it is passed to
+// Config.TraceHook.
+type TraceEvent struct {
+	Allowed   bool          // whether request was allowed
+	Charged   float64       // tokens taken from the bucket, see Config.Cost
+	Remaining float64       // tokens left in the bucket after the decision
+	Duration  time.Duration // time spent inside the limiter
+	Evicted   bool          // whether excess buckets eviction happened
+	Stage     Stage         // pipeline stage that made the decision
+	Source    LimitSource   // source of limits governing the request
+
+	// Err is the error the decision failed with, Allowed then reports
+	// whether request is let through anyway, see Config.FailClosed
+	Err error
+
+	// Abandoned reports whether the client went away while waiting for
+	// tokens, see Config.MaxWait; tokens it reserved are returned
+	Abandoned bool
 }
 
 // DefaultConfig returns config with safe defaults: 100k buckets of 10 tokens
-// each refilled every 100 millisecond (10rps rate), IPFunc set to
-// IPFromRemoteAddr
+// each refilled every 100 millisecond (10rps rate, Rate is not set), IPFunc
+// set to IPFromRemoteAddr
 func DefaultConfig() *Config {
 	cfg := defaultConfig
 	return &cfg
@@ -44,159 +583,1094 @@ type IPFunc func(*http.Request) net.IP
 // New returns http.Handler that wraps provided handler and applies per-IP rate
 // limiting. If config is nil, safe defaults would be used (see DefaultConfig).
 // If some values in config is out of sane range, they would be replaced by low
-// stub values.
+// stub values; use NewStrict to get an error instead. New copies everything
+// it needs from config, including slices of Policy; config is not referenced
+// afterwards and may be reused or modified for the next New call.
 //
 // For each IP address this handler uses a separate prefilled "token bucket" of
 // burst size; every interval bucket is refilled with a token. If request hits
 // limit, "429 Too Many Requests" response is served.
+//
+// Limiter sets Retry-After, Cache-Control and Vary headers only on responses
+// it generates itself, so the handler is free to set its own Retry-After,
+// e.g. in maintenance mode. Responses of the wrapped handler only get
+// opt-in headers, set before the handler is called, so it may still
+// override them: RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// if Config.SendRateLimitHeaders is set, ScoreHeader in scoring mode (see
+// Config.Score), and DryRunHeader on requests passed by Config.DryRun.
 func New(h http.Handler, config *Config) http.Handler {
 	if h == nil {
 		panic("nil handler")
 	}
-	cfg := config
-	if cfg == nil {
-		cfg = &defaultConfig
+	cfg := defaultConfig
+	if config != nil {
+		cfg = *config
 	}
-	interval := cfg.RefillEvery
+	if cfg.Disabled {
+		return Disabled(h)
+	}
+	lim := NewLimiter(&cfg).l
+	lim.handler = h
+	return lim
+}
+
+// newLimiter returns limiter configured with cfg, without handler set;
+// cfg must not be used by the caller afterwards
+func newLimiter(cfg *Config) *limiter {
 	burst := cfg.Burst
 	ipfunc := cfg.IPFunc
+	keyfunc := cfg.KeyFunc
 	maxCapacity := cfg.MaxBuckets
-	if interval <= 0 {
-		interval = defaultConfig.RefillEvery
+	log := cfg.Logger
+	if log == nil {
+		log = logger.Noop
 	}
+	interval := refillInterval(cfg, log)
 	if ipfunc == nil {
 		ipfunc = IPFromRemoteAddr
 	}
+	opaqueKeys := keyfunc != nil
+	if !opaqueKeys {
+		keyfunc = func(r *http.Request) []byte { return ipfunc(r) }
+	}
+	var addrfunc func(*http.Request) netip.Addr
+	if f := cfg.AddrFunc; f != nil && !opaqueKeys {
+		addrfunc = func(r *http.Request) netip.Addr {
+			if addr, ok := f(r); ok {
+				return addr
+			}
+			return netip.Addr{}
+		}
+	}
 	if burst < 1 {
 		burst = 1
 	}
+	var autoMax int
+	if maxCapacity == 0 && cfg.TargetMemory > 0 {
+		autoMax = int(cfg.TargetMemory / (bucketMemSize + keyMemSize))
+		if autoMax < autoMinBuckets {
+			autoMax = autoMinBuckets
+		}
+		maxCapacity = autoMinBuckets
+	}
 	if maxCapacity < 100 {
 		maxCapacity = defaultConfig.MaxBuckets
 	}
-	log := cfg.Logger
-	if log == nil {
-		log = logger.Noop
+	maxBans := cfg.MaxBans
+	if maxBans <= 0 {
+		maxBans = 1000
+	}
+	alertRate := cfg.NewKeyAlertRate
+	if alertRate < 0 {
+		alertRate = 0
+	}
+	lim := &limiter{
+		keyfunc:        keyfunc,
+		addrfunc:       addrfunc,
+		opaqueKeys:     opaqueKeys,
+		skip:           cfg.Skip,
+		refundStatus:   cfg.Refund,
+		limitsOf:       cfg.Limits,
+		scopeHeader:    cfg.SendScopeHeader,
+		shards:         newShards(numShards(max(maxCapacity, autoMax)), maxCapacity),
+		log:            log,
+		traceHook:      cfg.TraceHook,
+		alertRate:      alertRate,
+		alertFunc:      cfg.NewKeyAlertFunc,
+		alertOverflow:  cfg.NewKeyAlertOverflow,
+		overflow:       bucket{left: float64(burst)},
+		cacheable:      cfg.CacheableDenials,
+		chargeOnce:     cfg.ChargeOnce,
+		maxDelay:       max(cfg.MaxWait, 0),
+		failClosed:     cfg.FailClosed,
+		store:          cfg.Store,
+		score:          cfg.Score.normalize(),
+		bans:           newBanTable(maxBans),
+		bypassLogEvery: uint64(max(cfg.BypassLogEvery, 0)),
+		maxLogURL:      cfg.MaxLogURL,
+		retryBackoff:   cfg.RetryViolationBackoff,
+		trackStats:     cfg.TrackStats || cfg.Score != nil,
+		maxTime:        cfg.MaxLimiterTime,
+		instrument:     cfg.Instrument,
+		evictSlice:     max(cfg.EvictionSlice, 0),
+		ipfuncTimeout:  cfg.IPFuncTimeout,
+		name:           cfg.Name,
+		forgiveAfter:   int64(max(cfg.ForgiveAfter, 0)),
+		initialTokens:  float64(max(cfg.InitialTokens, 0)),
+		vary:           http.CanonicalHeaderKey(strings.TrimSpace(cfg.Vary)),
+		hashHeader:     http.CanonicalHeaderKey(strings.TrimSpace(cfg.PolicyHashHeader)),
+		capacity:       maxCapacity,
+		now:            time.Now,
+		done:           make(chan struct{}),
+	}
+	maxWait := cfg.MaxRetryAfter
+	if maxWait <= 0 {
+		maxWait = defaultMaxRetryAfter
+	}
+	lim.response = defaultResponse(cfg)
+	lim.shedResponse = defaultShedResponse(cfg, lim.response)
+	def := newLimits(interval, burst, maxWait)
+	def.resp = &lim.response
+	lim.gen.Store(&generation{def: &def})
+	if cfg.GlobalRefillEvery > 0 && cfg.GlobalBurst > 0 {
+		every := min(max(cfg.GlobalRefillEvery, MinRefillEvery), MaxRefillEvery)
+		lim.global = newGlobalBucket(every, cfg.GlobalBurst, maxWait)
+	}
+	lim.maxBurst = def.burst
+	lim.maxBurstBits.Store(math.Float64bits(lim.maxBurst))
+	lim.problemDetails = cfg.ProblemDetails
+	if cfg.LimitBody != nil {
+		lim.limitBody = append([]byte{}, cfg.LimitBody...)
+		lim.limitType = cfg.LimitContentType
+		if lim.limitType == "" {
+			lim.limitType = http.DetectContentType(lim.limitBody)
+		}
+	}
+	lim.limitedHandler = cfg.LimitedHandler
+	lim.rateLimitHeaders = cfg.SendRateLimitHeaders
+	lim.cost = cfg.Cost
+	lim.problemType = cfg.ProblemType
+	if lim.problemType == "" {
+		lim.problemType = "about:blank"
+	}
+	if cfg.KeyByServerName {
+		lim.keyBySNI = true
+		lim.sniLimits = make(map[string]*limits, len(cfg.ServerNameLimits))
+		for name, l := range cfg.ServerNameLimits {
+			sl := l.override(def)
+			lim.sniLimits[normalizeServerName(name)] = &sl
+			lim.maxBurst = max(lim.maxBurst, sl.burst)
+			lim.maxBurstBits.Store(math.Float64bits(lim.maxBurst))
+		}
+		if cfg.StrictServerNames {
+			lim.sniKnown = newServerNameSet(cfg.ServerNamePatterns)
+			lim.sniReject = cfg.RejectUnknownServerNames
+		}
+	}
+	var exempt []*net.IPNet
+	for _, n := range cfg.Exempt {
+		if n = normalizeNet(n); n != nil {
+			exempt = append(exempt, n)
+		}
+	}
+	if p := cfg.EnforcePercent; p > 0 && p < 100 {
+		lim.enforce = uint64(p)
+	}
+	lim.dryRun = cfg.DryRun
+	if cfg.ExactKeys {
+		lim.exactKeys, lim.ownerSeed = true, maphash.MakeSeed()
+	}
+	if lim.maxLogURL <= 0 {
+		lim.maxLogURL = defaultMaxLogURL
+	}
+	lim.exempt = newNetSet(exempt)
+	v4Mask, v6Mask := cfg.IPv4Mask, cfg.IPv6Mask
+	if cfg.AnonymizeKeys {
+		lim.anonymize = true
+		v4Mask = anonymousMask(log, "IPv4Mask", v4Mask, anonymousIPv4Mask)
+		v6Mask = anonymousMask(log, "IPv6Mask", v6Mask, anonymousIPv6Mask)
+	}
+	if n := v4Mask; n > 0 && n < 8*net.IPv4len {
+		lim.v4Mask = net.CIDRMask(n, 8*net.IPv4len)
+	}
+	if n := v6Mask; n > 0 && n < 8*net.IPv6len {
+		lim.v6Mask = net.CIDRMask(n, 8*net.IPv6len)
+	}
+	for _, w := range lim.exempt.shadowed("Config.Exempt") {
+		log.Printf("%s", w)
+	}
+	for _, ua := range cfg.ExemptUserAgents {
+		if ua != "" {
+			lim.exemptUA = append(lim.exemptUA, ua)
+		}
+	}
+	lim.exemptUACounts = make([]atomic.Uint64, len(lim.exemptUA))
+	lim.methods = newMethodSet(cfg.Methods)
+	if lim.refundStatus != nil {
+		lim.observers = append(lim.observers, lim.refundObserver)
 	}
-	retryAfter := int(interval.Truncate(time.Second)/time.Second) + 1
-	return &limiter{
-		refillEvery: float64(interval),
-		burst:       float64(burst),
-		retryAfter:  strconv.Itoa(retryAfter),
-		handler:     h,
-		ipfunc:      ipfunc,
-		ipmap:       make(map[uint64]bucket, maxCapacity),
-		keys:        make(chan uint64, maxCapacity),
-		log:         log,
+	if cfg.Class != nil && len(cfg.ClassQuotas) != 0 {
+		lim.setClasses(cfg.Class, cfg.ClassQuotas)
 	}
+	if err := lim.ApplyPolicy(cfg.Policy); err != nil {
+		panic(err)
+	}
+	if autoMax > 0 {
+		lim.autoMax = autoMax
+		lim.minEvictAge = cfg.MinEvictionAge
+		if lim.minEvictAge <= 0 {
+			lim.minEvictAge = 5 * time.Minute
+		}
+	}
+	if cfg.NilIPWarnFraction > 0 || cfg.KeyConcentrationWarnFraction > 0 {
+		lim.misconfig = &misconfigDetector{
+			nilThreshold: max(cfg.NilIPWarnFraction, 0),
+			keyThreshold: max(cfg.KeyConcentrationWarnFraction, 0),
+		}
+	}
+	if cfg.TrackHistory {
+		lim.historySize = cfg.HistorySize
+		if lim.historySize <= 0 {
+			lim.historySize = defaultHistorySize
+		}
+	}
+	if cfg.PenaltyThreshold > 0 {
+		lim.penaltyThreshold = min(cfg.PenaltyThreshold, math.MaxUint16-1)
+		lim.penaltyDuration = cfg.PenaltyDuration
+		if lim.penaltyDuration <= 0 {
+			lim.penaltyDuration = defaultPenaltyDuration
+		}
+	}
+	if cfg.MaxIdle > 0 && lim.store == nil {
+		lim.maxIdle = int64(cfg.MaxIdle)
+	}
+	if every := lim.maintenanceEvery(cfg.MaintenanceEvery); every > 0 {
+		go lim.maintenanceLoop(every)
+	}
+	lim.summaryAt = lim.now()
+	if cfg.SummaryEvery > 0 {
+		go lim.summaryLoop(cfg.SummaryEvery)
+	}
+	lim.publish(nil)
+	return lim
 }
 
 type limiter struct {
-	refillEvery float64
-	burst       float64
-	retryAfter  string
-	handler     http.Handler
-	ipfunc      IPFunc
-	m           sync.Mutex
-	ipmap       map[uint64]bucket
-	keys        chan uint64 // fifo queue of unique keys, chan must be buffered to the size of ipmap
-	log         logger.Interface
+	gen          atomic.Pointer[generation] // configuration replaceable at runtime, never nil
+	genMu        sync.Mutex                 // serializes publish calls
+	maxBurst     float64                    // largest burst of all limits, guarded by m
+	maxBurstBits atomic.Uint64              // math.Float64bits of maxBurst, read without m, see growMaxBurst
+	handler      http.Handler
+	name         string // Config.Name
+	forgiveAfter int64  // Config.ForgiveAfter in nanoseconds, 0 if disabled
+	maxIdle      int64  // Config.MaxIdle in nanoseconds, 0 if disabled
+	historySize  int    // decisions kept per bucket, 0 if Config.TrackHistory is not set
+
+	summaryMu      sync.Mutex
+	summaryPrev    Counters        // counters as of the last summary, guarded by summaryMu
+	summaryStreaks StreakHistogram // denial streaks as of the last summary, guarded by summaryMu
+	summaryAt      time.Time       // time of the last summary, guarded by summaryMu
+
+	// addrfunc is adapter of Config.AddrFunc, used instead of keyfunc if
+	// set; it returns zero Addr if there is no address
+	addrfunc func(*http.Request) netip.Addr
+
+	limitsOf func(net.IP) (time.Duration, int, bool) // Config.Limits
+
+	addrCache    sync.Map     // *limits by addrLimitsKey, see addrLimits
+	addrCacheLen atomic.Int64 // entries stored in addrCache since it was last cleared
+
+	exactKeys bool         // Config.ExactKeys
+	ownerSeed maphash.Seed // seed of owner hashes, if exactKeys is set
+
+	initialTokens float64                    // Config.InitialTokens, 0 if buckets start full
+	keyfunc       func(*http.Request) []byte // Config.KeyFunc, or adapter of Config.IPFunc
+	opaqueKeys    bool                       // whether keyfunc is Config.KeyFunc
+	skip          func(*http.Request) bool   // Config.Skip
+	refundStatus  func(status int) bool      // Config.Refund
+	global        *globalBucket              // nil if global limit is not set
+	scopeHeader   bool                       // Config.SendScopeHeader
+	m             sync.Mutex                 // guards state shared by shards, always taken after shard lock
+	shards        []shard                    // built-in storage, see shardOf
+	log           logger.Interface
+	traceHook     func(context.Context, TraceEvent)
+	now           func() time.Time
+	cacheable     bool // don't set Cache-Control on denials
+	chargeOnce    bool // Config.ChargeOnce
+
+	maxDelay         time.Duration // Config.MaxWait, 0 if disabled
+	penaltyThreshold int           // Config.PenaltyThreshold, 0 if disabled
+	penaltyDuration  time.Duration // Config.PenaltyDuration resolved with default
+	vary             string        // header to add to Vary on denials
+	failClosed       bool          // deny requests when decision cannot be made
+	store            Store         // external storage, if nil, shards are used
+	trackStats       bool          // whether to maintain per-bucket statistics
+	maxTime          time.Duration // limit on time spent on a single decision
+
+	instrument    bool              // whether to collect timing statistics
+	ipfuncTimeout time.Duration     // limit on keyfunc run time
+	ipfuncTimes   durationHistogram // keyfunc run times, if instrument is set
+	overhead      durationHistogram // limiter overhead, if instrument is set
+	lockHolds     durationHistogram // times shard lock is held by allow, if instrument is set
+	maxLockHold   atomic.Int64      // longest time shard lock is held by allow, if instrument is set
+
+	evictSlice time.Duration // limit on eviction time per request, 0 if disabled
+
+	capacity   int           // configured number of buckets
+	hashHeader string        // header to report PolicyHash in on denials
+	score      *ScoreWeights // weights of scoring mode, nil if disabled
+	bans       *banTable
+
+	keyBySNI  bool               // key buckets by address and TLS server name
+	sniLimits map[string]*limits // limits by normalized server name
+	sniKnown  *serverNameSet     // known server names, nil if not strict
+	sniReject bool               // deny requests to unknown server names
+
+	problemType    string       // "type" of problem details bodies
+	problemDetails bool         // Config.ProblemDetails
+	limitBody      []byte       // Config.LimitBody, copied
+	limitType      string       // Content-Type of limitBody
+	response       Response     // Config.Response resolved with defaults
+	shedResponse   Response     // Config.ShedResponse resolved with defaults
+	limitedHandler http.Handler // Config.LimitedHandler
+
+	rateLimitHeaders bool // Config.SendRateLimitHeaders
+
+	// observers are called with the response of each request passed to
+	// the handler, see pass
+	observers []func(*evaluation, *responseObserver)
+
+	classify   func(*http.Request) string  // Config.Class, nil if quotas are not set
+	cost       func(*http.Request) float64 // Config.Cost, nil if every request takes a token
+	classIndex map[string]uint8            // class indexes by name, 0 is for unknown classes
+	classNames []string                    // class names by index
+	classQuota []float64                   // fractions of shard capacity reserved by class index, nil if quotas are not set
+
+	restoring atomic.Int64 // restores in progress
+
+	counters       counters
+	misconfig      *misconfigDetector // nil if disabled
+	exempt         netSet             // Config.Exempt
+	v4Mask         net.IPMask         // Config.IPv4Mask, nil if addresses are not masked
+	v6Mask         net.IPMask         // Config.IPv6Mask, nil if addresses are not masked
+	anonymize      bool               // Config.AnonymizeKeys
+	exemptUA       []string           // Config.ExemptUserAgents, nil if not set
+	exemptUACounts []atomic.Uint64    // requests exempted by exemptUA index
+	bypassLogEvery uint64             // log every n-th bypassed request, 0 if disabled
+	maxLogURL      int                // Config.MaxLogURL resolved with default
+	retryBackoff   float64            // Config.RetryViolationBackoff
+	enforce        uint64             // Config.EnforcePercent, 0 if all decisions are enforced
+	dryRun         bool               // Config.DryRun
+
+	methods map[string]struct{} // Config.Methods in upper case, nil if all methods are limited
+
+	alertRate     int                 // new keys per minute to raise alert at, 0 if disabled
+	alertFunc     func(float64)       // called when alert is raised
+	alertOverflow bool                // use overflow bucket for new keys while alerting
+	alerting      bool                // whether alert is currently raised, guarded by m
+	newKeys       slidingCounter      // new keys seen, guarded by m
+	overflowKeys  map[uint64]struct{} // keys accounted in overflow bucket while alerting, guarded by m
+	overflow      bucket              // bucket shared by new keys while alerting or draining, guarded by m
+	draining      atomic.Bool         // whether BeginDrain was called
+
+	autoMax     int           // upper limit of automatic sizing, 0 if disabled
+	minEvictAge time.Duration // evictions of buckets younger than this trigger growth
+
+	done      chan struct{} // closed by Close to stop background goroutines
+	closeOnce sync.Once
 }
 
+// bucket fields are only accessed with shard.m held, 64-bit fields come
+// first to keep them aligned and the struct compact on 32-bit platforms
 type bucket struct {
-	left  float64 // tokens left
-	mtime int64   // last access time as nanoseconds since Unix epoch
+	left      float64 // tokens left
+	mtime     int64   // last access time as nanoseconds since Unix epoch
+	denied    int64   // last denial time as nanoseconds since Unix epoch, if TrackStats is set
+	retryAt   int64   // Retry-After given on the last denial as nanoseconds since Unix epoch, 0 if allowed
+	bannedTo  int64   // end of the penalty ban as nanoseconds since Unix epoch, 0 if not banned
+	streak    uint16  // current number of consecutive denials, if TrackStats is set
+	maxStreak uint16  // longest number of consecutive denials, if TrackStats is set
+	denials   uint16  // denials since creation or the last penalty ban, if PenaltyThreshold is set
+	class     uint8   // index of the class of request that created the bucket
+	penalty   uint8   // consecutive Retry-After violations, if RetryViolationBackoff is set
+	used      bool    // accessed since created or last passed over by evict
+
+	// 64-bit platforms pad the struct to 56 bytes anyway, this makes
+	// 32-bit ones do the same, see TestBucketLayout
+	_ [7]byte
+}
+
+// Compact counters of bucket (streak, maxStreak, penalty, denials) saturate: once at
+// their maximum value, they stay there until reset by the usual rules, and
+// never wrap to zero, which would forget the history of the most
+// persistent clients. Counters restored by RestoreCSV are clamped likewise.
+
+// incSaturating returns v incremented by one, or v if it's at maximum
+func incSaturating[T uint8 | uint16 | uint32](v T) T {
+	if v+1 == 0 {
+		return v
+	}
+	return v + 1
+}
+
+// saturated reports whether compact counters of bkt are at their maximum:
+// streak (and so maxStreak) and penalty
+func (bkt *bucket) saturated() (streak, penalty bool) {
+	return bkt.maxStreak == math.MaxUint16, bkt.penalty == math.MaxUint8
+}
+
+// keyOf returns bucket key for canonical form of IP address
+func keyOf(ip net.IP) uint64 { return keyHash(ip) }
+
+// decision holds the outcome of a single allow call
+type decision struct {
+	allow         bool
+	charged       float64       // tokens taken from the bucket, 0 if denied
+	remaining     float64       // tokens left after the decision
+	evictDone     bool          // whether excess buckets were evicted
+	shared        bool          // whether taken from the shared overflow bucket
+	evictDuration time.Duration // time spent on eviction
+	keyAlert      bool          // whether new keys alert has just been raised
+	keyRate       float64       // new keys per minute, set if keyAlert is true
+	streak        uint16        // consecutive denials, if trackStats is set
+	banLeft       time.Duration // time left until ban expires, if banned
+	retryWait     time.Duration // wait reported to the client, if denied by its bucket
+	nextToken     time.Duration // time until the next token is refilled, 0 if bucket is full
+	delay         time.Duration // time until reserved tokens are refilled, see Config.MaxWait
+	global        bool          // whether denied by the global bucket
+	key           uint64        // key of the bucket, differs from the requested one on collisions, see Config.ExactKeys
 }
 
-func (h *limiter) allow(ip net.IP) (allow, evictDone bool, evictDuration time.Duration) {
-	key := xxhash.Sum64(ip)
-	now := time.Now()
-	h.m.Lock()
-	defer h.m.Unlock()
-	bkt, ok := h.ipmap[key]
+// allow makes a decision on a single request taking cost tokens from the
+// bucket with the given key, hash of data, and limits; class is used if the
+// bucket has to be created. If maxDelay is positive, tokens refilled within
+// it are reserved, see Config.MaxWait.
+func (h *limiter) allow(key uint64, data []byte, lim *limits, cost float64, class uint8, maxDelay time.Duration) decision {
+	var d decision
+	now := h.now()
+	s := h.shardOf(key)
+	s.m.Lock()
+	if h.instrument {
+		defer h.unlockTimed(s, time.Now())
+	} else {
+		defer s.m.Unlock()
+	}
+	key, owner := h.slotOf(s, key, data)
+	d.key = key
+	bkt, ok := s.ipmap[key]
+	if !ok && h.alertRate > 0 {
+		h.m.Lock()
+		d.keyAlert, d.keyRate = h.trackNewKey(key, now)
+		if h.alerting && h.alertOverflow {
+			// don't create new buckets while new keys are
+			// arriving too fast, account them all in one shared
+			// bucket instead
+			h.takeOverflow(&d, cost, now)
+			h.m.Unlock()
+			return d
+		}
+		h.m.Unlock()
+	}
+	if !ok && h.draining.Load() {
+		h.m.Lock()
+		h.takeOverflow(&d, cost, now)
+		h.m.Unlock()
+		return d
+	}
 	if !ok {
-		bkt = bucket{left: h.burst}
-	}
-	if maxCap := cap(h.keys); len(h.ipmap) >= maxCap {
-		for i := 0; i < maxCap/10; i++ {
-			select {
-			case k := <-h.keys:
-				delete(h.ipmap, k)
-			default:
-				panic("receive from h.keys is blocked")
+		bkt = bucket{left: h.initialLeft(lim), class: class}
+	} else {
+		if h.forgiveAfter > 0 && now.UnixNano()-bkt.mtime >= h.forgiveAfter {
+			h.forgive(s, &bkt, lim)
+		}
+		bkt.used = true
+	}
+	// evict only when adding a new bucket: evicting on access to existing
+	// bucket may remove its own key from the queue, so the bucket saved
+	// below would never be evicted again
+	if maxCap := s.capacity; !ok && (len(s.ipmap) >= maxCap || s.evictDebt > 0) {
+		begin := time.Now()
+		if h.evictSlice > 0 {
+			if s.evictDebt == 0 {
+				s.evictDebt = max(maxCap/10, 1)
 			}
+			if n := h.evict(s, s.evictDebt, class, now, begin.Add(h.evictSlice)); n > 0 {
+				s.evictDebt -= n
+			} else {
+				// nothing left to evict within class quotas
+				s.evictDebt = 0
+			}
+		} else {
+			h.evict(s, max(maxCap/10, 1), class, now, time.Time{})
 		}
-		evictDone = true
-		evictDuration = time.Since(now)
+		d.evictDone = true
+		d.evictDuration = time.Since(begin)
 	}
 	if !ok {
-		// push new key to fifo queue here and not above because it's
+		// push new key to the queue here and not above because it's
 		// essential to do eviction before pushing to ensure queue has
 		// free space
-		select {
-		case h.keys <- key:
-		default:
-			panic("push to h.keys is blocked")
+		if s.keys.len() >= s.capacity {
+			panic("shard keys queue is full")
+		}
+		s.keys.push(key)
+		if s.classUsage != nil {
+			s.classUsage[class]++
+		}
+	}
+	violation := bkt.retryAt != 0 && now.UnixNano() < bkt.retryAt
+	if violation {
+		h.counters.retryViolations.Add(1)
+	}
+	if (violation && h.retryBackoff > 1) || now.UnixNano() < bkt.bannedTo {
+		// deny regardless of refilled tokens, leaving the bucket
+		// intact
+		d.allow, d.remaining = false, bkt.left
+	} else {
+		d.allow = lim.take(&bkt, cost, now)
+		if !d.allow && maxDelay > 0 {
+			d.delay, d.allow = lim.reserve(&bkt, cost, maxDelay)
+		}
+		if d.allow && h.global != nil {
+			h.takeGlobal(&bkt, &d, cost, now)
 		}
+		d.remaining = max(bkt.left, 0)
 	}
+	if d.allow {
+		d.charged = cost
+	}
+	d.nextToken = lim.nextTokenIn(bkt.left)
+	if h.historySize > 0 {
+		s.recordHistory(key, now.UnixNano(), d.allow, h.historySize)
+	}
+	// denials by the global limit are not the client's fault, they
+	// neither reset nor escalate its Retry-After and penalty state
+	if !d.global {
+		h.trackRetry(&bkt, &d, lim, cost, now, violation)
+		if h.penaltyThreshold > 0 {
+			h.trackPenalty(&bkt, &d, now)
+		}
+	}
+	if h.trackStats {
+		s.trackStreak(&bkt, d.allow)
+		s.trackTotals(key, now.UnixNano(), d.allow)
+		d.streak = bkt.streak
+		if !d.allow {
+			bkt.denied = now.UnixNano()
+		}
+	}
+	s.ipmap[key] = bkt
+	if h.exactKeys && data != nil {
+		s.claim(key, owner)
+	}
+	return d
+}
 
-	if bkt.mtime != 0 {
-		// refill bucket
-		spent := now.Sub(time.Unix(0, bkt.mtime))
-		if refillBy := float64(spent) / h.refillEvery; refillBy > 0 {
-			bkt.left += refillBy
-			if bkt.left > h.burst {
-				bkt.left = h.burst
-			}
+// initialLeft returns the number of tokens of a bucket created with limits
+// lim, see Config.InitialTokens
+func (h *limiter) initialLeft(lim *limits) float64 {
+	if h.initialTokens > 0 {
+		return min(h.initialTokens, lim.burst)
+	}
+	return lim.burst
+}
+
+// forgive resets bucket to its initial state, completing its denial streak.
+// Must be called with s.m held.
+func (h *limiter) forgive(s *shard, bkt *bucket, lim *limits) {
+	if h.trackStats && bkt.streak > 0 {
+		s.streaks.add(bkt.streak)
+	}
+	*bkt = bucket{left: lim.burst, class: bkt.class, denied: bkt.denied}
+}
+
+// unlockTimed releases s.m locked at the given time, recording how long it
+// was held
+func (h *limiter) unlockTimed(s *shard, locked time.Time) {
+	held := time.Since(locked)
+	s.m.Unlock()
+	h.lockHolds.add(held)
+	for {
+		longest := h.maxLockHold.Load()
+		if int64(held) <= longest || h.maxLockHold.CompareAndSwap(longest, int64(held)) {
+			return
+		}
+	}
+}
+
+// evict removes up to n least recently used buckets of shard s and returns
+// the number of buckets removed, must be called with s.m held. If class
+// quotas are set, only buckets of classes over their quota are evicted,
+// counting the bucket of the given class about to be created. If deadline
+// is not zero, eviction stops once it passes, but at least one bucket is
+// evicted.
+//
+// Recency is approximated with the "second chance" algorithm: keys are
+// queued in the order buckets were created, and a bucket accessed since it
+// was created or last passed over is moved to the tail of the queue
+// instead of being evicted, so that buckets of active clients survive
+// floods of new keys. Buckets never accessed after creation are evicted
+// oldest first.
+func (h *limiter) evict(s *shard, n int, class uint8, now, deadline time.Time) int {
+	pop := func() uint64 {
+		if s.keys.len() == 0 {
+			panic("shard keys queue is empty")
+		}
+		return s.keys.pop()
+	}
+	expired := func() bool { return !deadline.IsZero() && time.Now().After(deadline) }
+	n = min(n, s.keys.len())
+	evicted := 0
+	// each used bucket is passed over at most once, so a pass over the
+	// whole queue and n more keys are enough to evict n buckets unless
+	// class quotas keep them
+	for scanned, limit := 0, s.keys.len()+n; evicted < n && scanned < limit; scanned++ {
+		if evicted > 0 && expired() {
+			return evicted
+		}
+		k := pop()
+		if bkt := s.ipmap[k]; bkt.used || (s.classUsage != nil && !h.overQuota(s, bkt.class, class)) {
+			// keep, moving it to the tail of the queue
+			bkt.used = false
+			s.ipmap[k] = bkt
+			s.keys.push(k)
+			continue
 		}
+		h.evictKey(s, k, now)
+		evicted++
 	}
-	if bkt.left >= 1 {
-		bkt.left--
-		allow = true
+	if evicted == 0 && len(s.ipmap) >= s.capacity {
+		// all classes are within their quotas, which is only possible
+		// if quotas add up to the whole capacity
+		h.evictKey(s, pop(), now)
+		evicted++
 	}
-	bkt.mtime = now.UnixNano()
-	h.ipmap[key] = bkt
+	return evicted
+}
 
-	return allow, evictDone, evictDuration
+// evictKey removes bucket with the given key popped from s.keys, must be
+// called with s.m held
+func (h *limiter) evictKey(s *shard, key uint64, now time.Time) {
+	if h.autoMax > 0 || h.trackStats {
+		h.trackEviction(s, key, now)
+	}
+	if s.classUsage != nil {
+		s.classUsage[s.ipmap[key].class]--
+	}
+	delete(s.ipmap, key)
+	delete(s.history, key)
+	delete(s.owners, key)
+	delete(s.totals, key)
+	h.counters.evicted.Add(1)
 }
 
+// trackEviction records eviction of the bucket with the given key, must be
+// called with s.m held before the bucket is removed from s.ipmap.
+func (h *limiter) trackEviction(s *shard, key uint64, now time.Time) {
+	bkt, ok := s.ipmap[key]
+	if !ok {
+		return
+	}
+	if h.autoMax > 0 && now.UnixNano()-bkt.mtime < int64(h.minEvictAge) {
+		s.youngEvictions++
+	}
+	if h.trackStats && bkt.streak > 0 {
+		s.streaks.add(bkt.streak)
+	}
+}
+
+// durationOf converts nanoseconds to time.Duration, saturating values out of
+// its range; NaN is converted to 0.
+func durationOf(ns float64) time.Duration {
+	switch {
+	case ns >= math.MaxInt64:
+		return math.MaxInt64
+	case ns <= math.MinInt64:
+		return math.MinInt64
+	case ns != ns: // NaN
+		return 0
+	}
+	return time.Duration(ns)
+}
+
+// decide makes a decision on a single request from given IP address and
+// reports side effects of it, like eviction or raised alerts. It returns an
+// error if the decision could not be made, e.g. because ctx is already done.
+func (h *limiter) decide(ctx context.Context, e *evaluation) (decision, error) {
+	if err := ctx.Err(); err != nil {
+		return decision{}, err
+	}
+	d := h.allow(e.key, e.keyBytes(), e.lim, e.cost, e.class, e.maxDelay)
+	e.key = d.key
+	if d.evictDone {
+		h.counters.evictions.Add(1)
+		h.counters.evictionTime.Add(int64(d.evictDuration))
+		h.log.Print("excess limit buckets evicted in ", d.evictDuration)
+	}
+	if d.keyAlert {
+		h.log.Printf("new buckets are created at %.0f/min rate, over the limit of %d/min",
+			d.keyRate, h.alertRate)
+		if h.alertFunc != nil {
+			h.alertFunc(d.keyRate)
+		}
+	}
+	return d, nil
+}
+
+// Decision describes the outcome of a rate limiting decision
+type Decision struct {
+	Allowed   bool          // whether request is allowed
+	Remaining float64       // tokens left in the bucket after the decision
+	Reset     time.Duration // time until the bucket is refilled to its capacity
+	Stage     Stage         // pipeline stage that made the decision
+	Source    LimitSource   // source of limits governing the request
+
+	// NextAllowed is the earliest time the next request from the same
+	// address would be allowed, zero if it would never be; see also Next.
+	NextAllowed time.Time
+}
+
+// AllowCtx takes a single token from the bucket of the given IP address and
+// reports whether it succeeded. Requests from nil or unspecified addresses
+// are always allowed, as they are in ServeHTTP. Context is used for cancellation:
+// if it is done, no decision is made and its error is returned; how such
+// errors are handled by ServeHTTP is controlled by Config.FailClosed.
+//
+// Handler returned by New implements
+// interface{ AllowCtx(context.Context, net.IP) (Decision, error) }.
+func (h *limiter) AllowCtx(ctx context.Context, ip net.IP) (Decision, error) {
+	e := evaluation{ctx: ctx, ip: ip}
+	h.evaluate(&e)
+	if e.err != nil {
+		return Decision{Stage: e.stage}, e.err
+	}
+	return Decision{
+		Allowed:     e.d.allow,
+		Remaining:   e.d.remaining,
+		Reset:       e.lim.resetIn(e.d.remaining),
+		Stage:       e.stage,
+		Source:      e.limSource,
+		NextAllowed: h.nextAllowed(&e, h.now()),
+	}, nil
+}
+
+// Allow is a shortcut for AllowCtx with background context, it reports
+// whether request from the given IP address is allowed.
+//
+// Handler returned by New implements interface{ Allow(net.IP) bool }.
+func (h *limiter) Allow(ip net.IP) bool {
+	d, _ := h.AllowCtx(context.Background(), ip)
+	return d.Allowed
+}
+
+// limitedKey is the context key of the marker of requests already passed by
+// the limiter, see Config.ChargeOnce
+type limitedKey struct{ h *limiter }
+
 func (h *limiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ip := h.ipfunc(r)
-	if ip == nil || ip.To4() == nil {
+	if !h.limitsMethod(r.Method) {
+		h.trackBypass(bypassMethod, &evaluation{})
 		h.handler.ServeHTTP(w, r)
 		return
 	}
-	allow, evictDone, evictDuration := h.allow(ip)
-	if evictDone {
-		h.log.Print("excess limit buckets evicted in ", evictDuration)
+	if h.skip != nil && h.skip(r) {
+		h.trackBypass(bypassSkip, &evaluation{})
+		h.handler.ServeHTTP(w, r)
+		return
 	}
-	if !allow {
-		w.Header().Set("Retry-After", h.retryAfter)
-		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
-		h.log.Printf("rate limited for %v: %s %s", ip, r.Method, r.URL)
+	if h.chargeOnce && r.Context().Value(limitedKey{h}) != nil {
+		h.handler.ServeHTTP(w, r)
 		return
 	}
-	h.handler.ServeHTTP(w, r)
+	var begin time.Time
+	if h.traceHook != nil || h.instrument {
+		begin = time.Now()
+	}
+	e := evaluation{ctx: r.Context(), maxDelay: h.maxDelay}
+	switch {
+	case h.opaqueKeys:
+		e.opaque = h.extract(r)
+	case h.addrfunc != nil:
+		e.setAddr(h.extractAddr(r))
+	default:
+		e.ip = h.extract(r)
+	}
+	if h.keyBySNI {
+		e.sni = serverName(r)
+	}
+	if h.classify != nil {
+		e.class = h.classIndex[h.classify(r)]
+	}
+	if h.exemptUA != nil {
+		e.ua = r.UserAgent()
+	}
+	if h.cost != nil {
+		if e.cost = h.cost(r); !(e.cost > 0) {
+			e.cost, e.free = 0, true
+		}
+	}
+	h.evaluate(&e)
+	var overhead time.Duration
+	if !begin.IsZero() {
+		overhead = time.Since(begin)
+	}
+	if h.instrument {
+		h.overhead.add(overhead)
+		r = r.WithContext(context.WithValue(r.Context(), overheadKey{}, overhead))
+	}
+	if e.bypass {
+		h.pass(w, r, &e)
+		return
+	}
+	if e.err != nil {
+		h.trace(r.Context(), &e, overhead, false)
+		if h.failClosed && !e.observed {
+			h.deny(w, r, &e)
+			return
+		}
+		h.pass(w, r, &e)
+		return
+	}
+	if e.d.delay > 0 && !e.observed && !h.wait(r.Context(), &e) {
+		h.trace(r.Context(), &e, overhead, true)
+		return
+	}
+	h.trace(r.Context(), &e, overhead, false)
+	if h.rateLimitHeaders {
+		h.setRateLimitHeaders(w.Header(), &e)
+	}
+	if h.score != nil && e.stage == StageLimit && !e.free {
+		score := h.score.of(e.d, e.lim.burst)
+		w.Header().Set(ScoreHeader, strconv.FormatFloat(score, 'f', 3, 64))
+		h.pass(w, r.WithContext(context.WithValue(r.Context(), scoreKey{}, score)), &e)
+		return
+	}
+	if !e.d.allow && e.observed {
+		if h.dryRun {
+			w.Header().Set(DryRunHeader, "limited")
+		}
+		h.log.Printf("not enforced: %s denied by %s stage: %s", h.formatSubject(&e), e.stage, h.formatRequest(r))
+	}
+	if !e.d.allow && !e.observed {
+		h.deny(w, r, &e)
+		return
+	}
+	h.pass(w, r, &e)
+}
+
+// trace calls Config.TraceHook, if set, with details of request evaluated
+// by e; abandoned reports whether the request went away while waiting
+func (h *limiter) trace(ctx context.Context, e *evaluation, overhead time.Duration, abandoned bool) {
+	if h.traceHook == nil {
+		return
+	}
+	ev := TraceEvent{
+		Allowed:   e.d.allow,
+		Charged:   e.d.charged,
+		Remaining: e.d.remaining,
+		Duration:  overhead,
+		Evicted:   e.d.evictDone,
+		Stage:     e.stage,
+		Source:    e.limSource,
+		Err:       e.err,
+		Abandoned: abandoned,
+	}
+	switch {
+	case e.err != nil:
+		ev.Allowed = !h.failClosed || e.observed
+	case abandoned:
+		ev.Allowed, ev.Charged = false, 0
+	}
+	h.traceHook(ctx, ev)
+}
+
+// pass passes the request to the wrapped handler with Info of the decision
+// attached to its context; if any observers are registered, the response is
+// observed with a single responseObserver and each of them is called once
+// the handler returns
+func (h *limiter) pass(w http.ResponseWriter, r *http.Request, e *evaluation) {
+	ctx := r.Context()
+	if h.chargeOnce {
+		ctx = context.WithValue(ctx, limitedKey{h}, true)
+	}
+	if !e.bypass && e.err == nil {
+		ctx = context.WithValue(ctx, infoKey{}, Info{IP: e.ip, Remaining: e.d.remaining, Limited: !e.d.allow})
+	}
+	if ctx != r.Context() {
+		r = r.WithContext(ctx)
+	}
+	if len(h.observers) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	ww, o := observeWriter(w)
+	h.handler.ServeHTTP(ww, r)
+	for _, f := range h.observers {
+		f(e, o)
+	}
+}
+
+// deny writes response for the request denied by the limiter, unless
+// request context is already done, e.g. because the client has
+// disconnected
+func (h *limiter) deny(w http.ResponseWriter, r *http.Request, e *evaluation) {
+	// denied because of the limiter's own capacity, see Config.ShedResponse
+	shed := e.err != nil || e.d.shared
+	if shed {
+		h.counters.shed.Add(1)
+	}
+	if r.Context().Err() != nil {
+		h.counters.abandoned.Add(1)
+		return
+	}
+	hdr := w.Header()
+	if !h.cacheable {
+		hdr.Set("Cache-Control", "no-store")
+	}
+	if h.vary != "" {
+		hdr.Add("Vary", h.vary)
+	}
+	body := BodyText
+	if h.problemDetails {
+		body = BodyProblem
+	}
+	var code int
+	var retryAfter, what string
+	custom := false // whether response is written by h.limitedHandler
+	switch {
+	case shed:
+		code, body, what = h.shedResponse.Status, h.shedResponse.Body, "shed request of"
+		if h.shedResponse.RetryAfter != RetryAfterOmit {
+			retryAfter = e.lim.retryAfter(e.d.remaining, e.cost)
+		}
+	case e.stage == StageDenylist:
+		code, what = http.StatusForbidden, "denylisted"
+	case e.stage == StageServerName:
+		code, what = http.StatusMisdirectedRequest, "unknown server name from"
+	case e.stage == StageBan:
+		code, what = http.StatusTooManyRequests, "banned"
+		retryAfter = retryAfterValue(e.d.banLeft, e.lim.maxWait)
+		custom = h.limitedHandler != nil
+	default:
+		resp := e.lim.resp
+		if resp == nil {
+			resp = &h.response
+		}
+		code, body, what = resp.Status, resp.Body, "rate limited for"
+		if e.d.global {
+			what = "global rate limit exceeded by"
+		}
+		if resp.RetryAfter != RetryAfterOmit {
+			retryAfter = e.lim.retryAfter(e.d.remaining, e.cost)
+			if e.d.retryWait > 0 {
+				retryAfter = retryAfterValue(e.d.retryWait, e.lim.maxWait)
+			}
+		}
+		if h.scopeHeader && e.stage == StageLimit {
+			scope := "client"
+			if e.d.global {
+				scope = "global"
+			}
+			hdr.Set(ScopeHeader, scope)
+		}
+		custom = h.limitedHandler != nil
+	}
+	if retryAfter != "" {
+		hdr.Set("Retry-After", retryAfter)
+	}
+	if h.hashHeader != "" {
+		hdr.Set(h.hashHeader, e.hash)
+	}
+	switch {
+	case custom:
+		h.limitedHandler.ServeHTTP(w, r)
+	case body == BodyProblem:
+		h.writeProblem(w, code, e.stage, shed, retryAfter, e.lim)
+	case body == BodyEmpty:
+		w.WriteHeader(code)
+	case body == BodyCustom:
+		if len(h.limitBody) != 0 {
+			hdr.Set("Content-Type", h.limitType)
+			hdr.Set("X-Content-Type-Options", "nosniff")
+		}
+		w.WriteHeader(code)
+		w.Write(h.limitBody)
+	default:
+		http.Error(w, http.StatusText(code), code)
+	}
+	if e.cost != 1 {
+		h.log.Printf("%s %s (cost %v): %s", what, h.formatSubject(e), e.cost, h.formatRequest(r))
+		return
+	}
+	h.log.Printf("%s %s: %s", what, h.formatSubject(e), h.formatRequest(r))
 }
 
 // IPFromXForwardedFor extracts first IP address from X-Forwarded-For header of
-// the request
+// the request. Multiple header lines, as added by some proxies, are treated
+// as a single comma-separated list in their order; empty entries are
+// skipped. Clients can send the header themselves, so use this only behind
+// a proxy which replaces it; otherwise see IPFromXForwardedForTrusted.
 func IPFromXForwardedFor(r *http.Request) net.IP {
-	ffor := r.Header.Get("X-Forwarded-For")
-	if ffor == "" {
-		return nil
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for v != "" {
+			var entry string
+			entry, v, _ = strings.Cut(v, ",")
+			if entry = strings.TrimSpace(entry); entry != "" {
+				return net.ParseIP(entry)
+			}
+		}
+	}
+	return nil
+}
+
+// IPFromXForwardedForTrusted returns IPFunc which takes the client address
+// from X-Forwarded-For header appended to by trusted proxies: the list,
+// followed by the address of connected peer, is walked from the right,
+// skipping addresses belonging to trusted networks, and the first other
+// address is returned. Unlike IPFromXForwardedFor, it can't be fooled by
+// clients sending the header themselves: entries to the left of the first
+// untrusted address are ignored. Entries may carry ports, as appended by
+// some proxies.
+//
+// The address of connected peer is returned if it is not trusted, if the
+// header is absent or lists only trusted addresses, and if a malformed
+// entry is met before an untrusted address. Invalid networks in trusted
+// are ignored.
+func IPFromXForwardedForTrusted(trusted []*net.IPNet) IPFunc {
+	var nets []*net.IPNet
+	for _, n := range trusted {
+		if n = normalizeNet(n); n != nil {
+			nets = append(nets, n)
+		}
 	}
-	if idx := strings.Index(ffor, ","); idx > 0 {
-		ffor = ffor[:idx]
+	set := newNetSet(nets)
+	return func(r *http.Request) net.IP {
+		peer := IPFromRemoteAddr(r)
+		if peer == nil || !set.contains(peer) {
+			return peer
+		}
+		lines := r.Header.Values("X-Forwarded-For")
+		for i := len(lines) - 1; i >= 0; i-- {
+			for v := lines[i]; v != ""; {
+				var entry string
+				if j := strings.LastIndexByte(v, ','); j >= 0 {
+					v, entry = v[:j], v[j+1:]
+				} else {
+					v, entry = "", v
+				}
+				if entry = strings.TrimSpace(entry); entry == "" {
+					continue
+				}
+				ip := parseAddr(entry)
+				if ip == nil {
+					return peer
+				}
+				if !set.contains(ip) {
+					return ip
+				}
+			}
+		}
+		return peer
 	}
-	return net.ParseIP(ffor)
 }
 
 // IPFromRemoteAddr returns IP address of connected client, use this only if
-// clients connect directly to your service.
-func IPFromRemoteAddr(r *http.Request) net.IP {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+// clients connect directly to your service. Besides the "host:port" form set
+// by net/http server, it accepts addresses without port, bracketed or not,
+// as set by some middleware and test harnesses. IPv6 zone, as in
+// "[fe80::1%eth0]:1234", is ignored.
+func IPFromRemoteAddr(r *http.Request) net.IP { return parseAddr(r.RemoteAddr) }
+
+// parseAddr parses IP address with optional port in the forms accepted by
+// IPFromRemoteAddr, it returns nil if addr is not valid
+func parseAddr(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil
+		host = addr
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
 	}
+	host, _, _ = strings.Cut(host, "%")
 	return net.ParseIP(host)
 }
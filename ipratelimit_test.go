@@ -1,12 +1,18 @@
 package ipratelimit
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/artyom/ipratelimit/loadgen"
 )
 
 func BenchmarkLimiter(b *testing.B) {
@@ -57,3 +63,618 @@ func Example() {
 	// 200 OK
 	// 429 Too Many Requests
 }
+
+func TestTraceHook(t *testing.T) {
+	var events []TraceEvent
+	var lh *limiter
+	cfg := &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		IPFunc:      IPFromXForwardedFor,
+		TraceHook: func(ctx context.Context, ev TraceEvent) {
+			if ctx == nil {
+				t.Error("nil context passed to hook")
+			}
+			if !lh.m.TryLock() {
+				t.Error("hook called with mutex held")
+			} else {
+				lh.m.Unlock()
+			}
+			for i := range lh.shards {
+				if s := &lh.shards[i]; !s.m.TryLock() {
+					t.Errorf("hook called with shard %d mutex held", i)
+				} else {
+					s.m.Unlock()
+				}
+			}
+			events = append(events, ev)
+		},
+	}
+	lh = New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg).(*limiter)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-For", "192.168.0.1")
+	for i := 0; i < 3; i++ {
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// request without IP bypasses limiter and must not call hook
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	want := []TraceEvent{
+		{Allowed: true, Remaining: 1},
+		{Allowed: true, Remaining: 0},
+		{Allowed: false, Remaining: 0},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, ev := range events {
+		if ev.Duration < 0 || ev.Duration > time.Second {
+			t.Errorf("event %d: implausible duration %v", i, ev.Duration)
+		}
+		if ev.Evicted {
+			t.Errorf("event %d: unexpected eviction", i)
+		}
+		if ev.Allowed != want[i].Allowed || math.Abs(ev.Remaining-want[i].Remaining) > 0.01 {
+			t.Errorf("event %d: got %+v, want %+v", i, ev, want[i])
+		}
+	}
+}
+
+// TestTraceHookFailures checks that hook is called for requests whose
+// decision failed and ones abandoned while waiting for tokens
+func TestTraceHookFailures(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		var events []TraceEvent
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			Store:      failingStore{},
+			FailClosed: failClosed,
+			TraceHook:  func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+		})
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if len(events) != 1 {
+			t.Fatalf("failClosed=%v: got %d events, want 1", failClosed, len(events))
+		}
+		if ev := events[0]; ev.Err == nil || ev.Allowed == failClosed || ev.Abandoned {
+			t.Errorf("failClosed=%v: got %+v", failClosed, ev)
+		}
+	}
+
+	var events []TraceEvent
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Minute,
+		Burst:       1,
+		MaxWait:     time.Hour,
+		TraceHook:   func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+	})
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if ev := events[1]; !ev.Abandoned || ev.Allowed || ev.Charged != 0 || ev.Err != nil {
+		t.Errorf("abandoned wait: got %+v", ev)
+	}
+}
+
+func ExampleConfig_traceHook() {
+	// span is a stand-in for the span type of a tracing library, e.g.
+	// trace.Span from OpenTelemetry obtained with trace.SpanFromContext
+	type span struct{ attrs map[string]interface{} }
+	spanFromContext := func(context.Context) *span { return &span{attrs: make(map[string]interface{})} }
+
+	cfg := &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		TraceHook: func(ctx context.Context, ev TraceEvent) {
+			sp := spanFromContext(ctx)
+			sp.attrs["ratelimit.allowed"] = ev.Allowed
+			sp.attrs["ratelimit.remaining"] = int(ev.Remaining)
+			sp.attrs["ratelimit.evicted"] = ev.Evicted
+			sp.attrs["ratelimit.duration"] = ev.Duration
+			fmt.Println("allowed:", sp.attrs["ratelimit.allowed"],
+				"remaining:", sp.attrs["ratelimit.remaining"])
+		},
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	lh := New(http.HandlerFunc(handler), cfg)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// Output:
+	// allowed: true remaining: 0
+	// allowed: false remaining: 0
+}
+
+func TestDenialCacheHeaders(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "Hello, world!") }
+	for _, tc := range []struct {
+		cfg       Config
+		wantCache string
+		wantVary  string
+	}{
+		{Config{}, "no-store", ""},
+		{Config{Vary: "x-forwarded-for"}, "no-store", "X-Forwarded-For"},
+		{Config{CacheableDenials: true}, "", ""},
+	} {
+		cfg := tc.cfg
+		cfg.Burst = 1
+		cfg.RefillEvery = time.Hour
+		cfg.IPFunc = IPFromXForwardedFor
+		lh := New(http.HandlerFunc(handler), &cfg)
+		for i, wantCode := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Forwarded-For", "192.168.0.1")
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			if w.Code != wantCode {
+				t.Fatalf("%+v: request %d: got status %d, want %d", tc.cfg, i, w.Code, wantCode)
+			}
+			cc, vary := w.Header().Get("Cache-Control"), w.Header().Get("Vary")
+			if w.Code == http.StatusOK {
+				if cc != "" || vary != "" {
+					t.Errorf("%+v: cache headers set on allowed response: %q, %q", tc.cfg, cc, vary)
+				}
+				continue
+			}
+			if cc != tc.wantCache {
+				t.Errorf("%+v: got Cache-Control %q, want %q", tc.cfg, cc, tc.wantCache)
+			}
+			if vary != tc.wantVary {
+				t.Errorf("%+v: got Vary %q, want %q", tc.cfg, vary, tc.wantVary)
+			}
+		}
+	}
+}
+
+func TestAllowCtx(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{RefillEvery: time.Hour, Burst: 1}).(*limiter)
+	ip := net.ParseIP("192.168.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lh.AllowCtx(ctx, ip); err != context.Canceled {
+		t.Fatalf("AllowCtx with canceled context returned %v, want %v", err, context.Canceled)
+	}
+	d, err := lh.AllowCtx(context.Background(), ip)
+	if err != nil || !d.Allowed || d.Remaining != 0 || d.Reset != time.Hour {
+		t.Fatalf("first AllowCtx: %+v, %v", d, err)
+	}
+	if lh.Allow(ip) {
+		t.Fatal("second Allow call succeeded on exhausted bucket")
+	}
+	if !lh.Allow(nil) {
+		t.Fatal("Allow(nil) denied")
+	}
+}
+
+func TestCanceledRequest(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		var called bool
+		handler := func(http.ResponseWriter, *http.Request) { called = true }
+		cfg := &Config{RefillEvery: time.Hour, Burst: 1, FailClosed: failClosed}
+		lh := New(http.HandlerFunc(handler), cfg).(*limiter)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		if called == failClosed {
+			t.Errorf("failClosed=%v: handler called: %v", failClosed, called)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("failClosed=%v: response written to canceled request: %q", failClosed, w.Body)
+		}
+		if c := lh.Counters(); c.Failed != 1 || (c.Abandoned == 1) != failClosed {
+			t.Errorf("failClosed=%v: got counters %+v", failClosed, c)
+		}
+		if n, _ := lh.buckets(); n != 0 {
+			t.Errorf("failClosed=%v: bucket created for canceled request", failClosed)
+		}
+	}
+}
+
+// TestAbandonedDenial checks that no response is written to denied
+// requests of clients that have already gone, on every denial path
+func TestAbandonedDenial(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		addr string
+		prep func(lh *limiter)
+	}{
+		{"limited", "192.0.2.1", func(lh *limiter) { lh.Allow(net.ParseIP("192.0.2.1")) }},
+		{"banned", "192.0.2.2", func(lh *limiter) { lh.Ban(net.ParseIP("192.0.2.2"), time.Hour) }},
+		{"denylisted", "198.51.100.1", func(*limiter) {}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf syncBuffer
+			var called bool
+			lh := New(http.NotFoundHandler(), &Config{
+				RefillEvery:    time.Hour,
+				Burst:          1,
+				IPFunc:         IPFromXForwardedFor,
+				Logger:         log.New(&buf, "", 0),
+				Policy:         Policy{Denylist: []string{"198.51.100.0/24"}},
+				LimitedHandler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }),
+			}).(*limiter)
+			tc.prep(lh)
+			logged := len(buf.String())
+			// the request gets canceled once the decision is made,
+			// as if the client disconnected while it was made
+			ctx, cancel := context.WithCancel(context.Background())
+			req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+			req.Header.Set("X-Forwarded-For", tc.addr)
+			lh.traceHook = func(context.Context, TraceEvent) { cancel() }
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			if called || w.Body.Len() != 0 || len(w.Header()["Retry-After"]) != 0 {
+				t.Errorf("response written: handler called: %v, body %q, headers %v", called, w.Body, w.Header())
+			}
+			if out := buf.String()[logged:]; out != "" {
+				t.Errorf("abandoned denial logged: %s", out)
+			}
+			if c := lh.Counters(); c.Denied != 1 || c.Abandoned != 1 {
+				t.Errorf("got %d denied, %d abandoned", c.Denied, c.Abandoned)
+			}
+		})
+	}
+}
+
+func TestHandlerHeadersPrecedence(t *testing.T) {
+	appHeaders := http.Header{
+		"Retry-After":   {"7200"},
+		"Cache-Control": {"max-age=60"},
+		"Vary":          {"Accept-Encoding"},
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range appHeaders {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, cacheable := range []bool{false, true} {
+		for _, vary := range []string{"", "X-Forwarded-For"} {
+			for _, rateHeaders := range []bool{false, true} {
+				cfg := &Config{
+					RefillEvery:          time.Hour,
+					Burst:                1,
+					IPFunc:               IPFromXForwardedFor,
+					CacheableDenials:     cacheable,
+					Vary:                 vary,
+					SendRateLimitHeaders: rateHeaders,
+				}
+				name := fmt.Sprintf("cacheable=%v, vary=%q, rate headers=%v", cacheable, vary, rateHeaders)
+				lh := New(http.HandlerFunc(handler), cfg)
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Forwarded-For", "192.0.2.1")
+
+				w := httptest.NewRecorder()
+				lh.ServeHTTP(w, req)
+				if w.Code != http.StatusServiceUnavailable {
+					t.Fatalf("%s: got status %d", name, w.Code)
+				}
+				for k, v := range appHeaders {
+					if got := w.Header()[k]; len(got) != len(v) || got[0] != v[0] {
+						t.Errorf("%s: admitted response header %s=%q, want %q", name, k, got, v)
+					}
+				}
+				if rateHeaders {
+					if w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+						t.Errorf("%s: admitted response headers %v", name, w.Header())
+					}
+				} else if len(w.Header()) != len(appHeaders) {
+					t.Errorf("%s: admitted response got limiter headers %v", name, w.Header())
+				}
+
+				w = httptest.NewRecorder()
+				lh.ServeHTTP(w, req)
+				if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("%s: got status %d", name, w.Code)
+				}
+				if ra := w.Header().Get("Retry-After"); ra == appHeaders.Get("Retry-After") {
+					t.Errorf("%s: denial has application Retry-After", name)
+				}
+				if got := w.Header().Get("RateLimit-Remaining"); rateHeaders != (got == "0") {
+					t.Errorf("%s: denial has RateLimit-Remaining %q", name, got)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkReplay replays synthetic traffic of heavy-tailed client population
+// mixed with a flood, driving limiter clock with event timestamps
+func BenchmarkReplay(b *testing.B) {
+	events := loadgen.NewMixer(1,
+		loadgen.ZipfIPs(50000, 1.1, 20000),
+		loadgen.FloodFrom(net.IPv4(192, 0, 2, 1), 5000),
+	).Take(10 * time.Second)
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second / 10,
+		Burst:       10,
+		MaxBuckets:  10000,
+	}).(*limiter)
+	start := time.Unix(1000, 0)
+	var now time.Time
+	lh.now = func() time.Time { return now }
+	b.ResetTimer()
+	var allowed int
+	for i := 0; i < b.N; i++ {
+		ev := events[i%len(events)]
+		now = start.Add(time.Duration(i/len(events))*10*time.Second + ev.At)
+		if lh.Allow(ev.IP) {
+			allowed++
+		}
+	}
+	b.ReportMetric(float64(allowed)/float64(b.N), "allowed/op")
+}
+
+func TestIPFromXForwardedFor(t *testing.T) {
+	for _, tc := range []struct {
+		lines []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"192.0.2.1"}, "192.0.2.1"},
+		{[]string{"192.0.2.1, 198.51.100.1"}, "192.0.2.1"},
+		{[]string{" 192.0.2.1 ,198.51.100.1"}, "192.0.2.1"},
+		{[]string{"192.0.2.1", "198.51.100.1"}, "192.0.2.1"},
+		{[]string{"", "198.51.100.1, 203.0.113.1"}, "198.51.100.1"},
+		{[]string{" , ", "198.51.100.1"}, "198.51.100.1"},
+		{[]string{"garbage, 192.0.2.1"}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, v := range tc.lines {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		got := IPFromXForwardedFor(r)
+		if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.lines, got, tc.want)
+		}
+	}
+}
+
+func TestIPFromXForwardedForTrusted(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "2001:db8:ffff::/48"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, n)
+	}
+	trusted = append(trusted, nil, &net.IPNet{}) // invalid ones are ignored
+	ipfunc := IPFromXForwardedForTrusted(trusted)
+	for _, tc := range []struct {
+		name  string
+		peer  string
+		lines []string
+		want  string
+	}{
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"direct client", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"single proxy", "10.0.0.1:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"spoofed entry", "10.0.0.1:1234", []string{"203.0.113.1, 192.0.2.1"}, "192.0.2.1"},
+		{"spoofed trusted entry", "10.0.0.1:1234", []string{"10.1.1.1, 192.0.2.1"}, "192.0.2.1"},
+		{"chained proxies", "10.0.0.1:1234", []string{"203.0.113.1, 192.0.2.1, 10.0.0.3, 10.0.0.2"}, "192.0.2.1"},
+		{"chained proxies, multiple lines", "10.0.0.1:1234",
+			[]string{"203.0.113.1", "192.0.2.1,10.0.0.3", " ", "10.0.0.2 "}, "192.0.2.1"},
+		{"whitespace and empty entries", "10.0.0.1:1234", []string{" 192.0.2.1 , ,10.0.0.2, "}, "192.0.2.1"},
+		{"entry with port", "10.0.0.1:1234", []string{"[2001:db8::1]:443, 10.0.0.2:80"}, "2001:db8::1"},
+		{"IPv6 proxy", "[2001:db8:ffff::1]:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"IPv4-mapped proxy", "[::ffff:10.0.0.1]:1234", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.1"},
+		{"malformed entry", "10.0.0.1:1234", []string{"192.0.2.1, garbage, 10.0.0.2"}, "10.0.0.1"},
+		{"malformed spoofed entry", "10.0.0.1:1234", []string{"garbage, 192.0.2.1"}, "192.0.2.1"},
+		{"no peer address", "", []string{"192.0.2.1"}, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		for _, v := range tc.lines {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		got := ipfunc(r)
+		if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForgiveAfter(t *testing.T) {
+	for _, tc := range []struct {
+		quiet time.Duration
+		want  int // requests allowed after the quiet period
+	}{
+		{10*time.Minute - time.Nanosecond, 0},
+		{10 * time.Minute, 5},
+		{10*time.Minute + time.Nanosecond, 5},
+	} {
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery:  time.Hour,
+			Burst:        5,
+			TrackStats:   true,
+			ForgiveAfter: 10 * time.Minute,
+		}).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		ip := net.IPv4(192, 0, 2, 1)
+		for i := 0; i < 8; i++ {
+			lh.Allow(ip)
+		}
+		now = now.Add(tc.quiet)
+		var allowed int
+		for i := 0; i < 10; i++ {
+			if lh.Allow(ip) {
+				allowed++
+			}
+		}
+		if allowed != tc.want {
+			t.Errorf("quiet for %v: %d requests allowed, want %d", tc.quiet, allowed, tc.want)
+		}
+		if got, want := lh.Stats().DenialStreaks.Total(), uint64(tc.want/5); got != want {
+			t.Errorf("quiet for %v: %d completed streaks, want %d", tc.quiet, got, want)
+		}
+	}
+}
+
+func TestIPFromRemoteAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]", "192.0.2.1"},
+		{"[fe80::1%eth0]:1234", "fe80::1"},
+		{"", ""},
+		{"[]", ""},
+		{"[2001:db8::1", ""},
+		{"example.com:80", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.addr
+		got := IPFromRemoteAddr(r)
+		if (got == nil && tc.want != "") || (got != nil && got.String() != tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.addr, got, tc.want)
+			continue
+		}
+		if got == nil {
+			continue
+		}
+		// all forms of the same address share the bucket key
+		want := net.ParseIP(tc.want)
+		if v4 := got.To4(); v4 != nil && keyOf(v4) != keyOf(want.To4()) {
+			t.Errorf("%q: key %s, want %s", tc.addr, formatKey(keyOf(v4)), formatKey(keyOf(want.To4())))
+		}
+	}
+}
+
+func TestEvictionSlice(t *testing.T) {
+	const maxBuckets = 200000
+	// eviction is done per shard, test it on a single one
+	fill := func(lh *limiter) {
+		lh.shards = newShards(1, maxBuckets)
+		s := &lh.shards[0]
+		for k := uint64(0); k < maxBuckets; k++ {
+			s.ipmap[k] = bucket{left: 1, mtime: 1}
+			s.keys.push(k)
+		}
+	}
+	t.Run("progress", func(t *testing.T) {
+		lh := New(http.NotFoundHandler(), &Config{
+			MaxBuckets:    maxBuckets,
+			EvictionSlice: time.Nanosecond, // only the minimum of a single bucket fits
+		}).(*limiter)
+		fill(lh)
+		for i := 0; i < maxBuckets/10; i++ {
+			if d := lh.allow(maxBuckets+uint64(i), nil, lh.gen.Load().def, 1, 0, 0); !d.evictDone {
+				t.Fatalf("request %d: no eviction", i)
+			}
+			if n, _ := lh.buckets(); n != maxBuckets {
+				t.Fatalf("request %d: got %d buckets, want %d", i, n, maxBuckets)
+			}
+			if debt, want := lh.shards[0].evictDebt, maxBuckets/10-i-1; debt != want {
+				t.Fatalf("request %d: eviction debt is %d, want %d", i, debt, want)
+			}
+		}
+		if d := lh.allow(maxBuckets, nil, lh.gen.Load().def, 1, 0, 0); d.evictDone {
+			t.Fatal("eviction on access to existing bucket")
+		}
+		if err := lh.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("bound", func(t *testing.T) {
+		const slice = 100 * time.Microsecond
+		lh := New(http.NotFoundHandler(), &Config{
+			MaxBuckets:    maxBuckets,
+			EvictionSlice: slice,
+			Instrument:    true,
+		}).(*limiter)
+		fill(lh)
+		requests := 0
+		for lh.shards[0].evictDebt > 0 || requests == 0 {
+			lh.allow(maxBuckets+uint64(requests), nil, lh.gen.Load().def, 1, 0, 0)
+			requests++
+			if requests > maxBuckets/10 {
+				t.Fatalf("eviction debt %d left after %d requests", lh.shards[0].evictDebt, requests)
+			}
+		}
+		if requests < 2 {
+			t.Fatal("eviction was not split across requests")
+		}
+		// allow for a generous margin over the slice on slow and loaded
+		// machines, and for a few outliers, e.g. because of GC pauses
+		var long uint64
+		for i, b := range DurationBounds {
+			if b > 10*slice {
+				long += lh.lockHolds[i+1].Load()
+			}
+		}
+		if long > uint64(requests/100+1) {
+			t.Fatalf("limiter state locked for over %v %d times of %d requests", 10*slice, long, requests)
+		}
+	})
+}
+
+// TestBucketLayout guards bucket layout on all platforms: 64-bit fields at
+// 8-byte offsets and no padding beyond the trailing one, so that the size
+// matches between 32-bit and 64-bit platforms.
+func TestBucketLayout(t *testing.T) {
+	var b bucket
+	for _, f := range []struct {
+		name   string
+		offset uintptr
+	}{
+		{"left", unsafe.Offsetof(b.left)},
+		{"mtime", unsafe.Offsetof(b.mtime)},
+		{"denied", unsafe.Offsetof(b.denied)},
+		{"retryAt", unsafe.Offsetof(b.retryAt)},
+		{"bannedTo", unsafe.Offsetof(b.bannedTo)},
+	} {
+		if f.offset%8 != 0 {
+			t.Errorf("bucket.%s offset is %d, not a multiple of 8", f.name, f.offset)
+		}
+	}
+	if got := unsafe.Offsetof(b.streak); got != 40 {
+		t.Errorf("64-bit fields don't come first: bucket.streak offset is %d", got)
+	}
+	if got := unsafe.Sizeof(b); got != 56 {
+		t.Errorf("bucket size is %d, want 56", got)
+	}
+}
+
+// TestEvictionLRU checks that a bucket of an active client survives floods
+// of new keys, while buckets of idle clients are evicted.
+func TestEvictionLRU(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       5,
+		MaxBuckets:  100,
+	}).(*limiter)
+	hot := net.IPv4(192, 0, 2, 1)
+	idle := net.IPv4(192, 0, 2, 2)
+	lh.Allow(idle)
+	for lh.Allow(hot) {
+	}
+	for i := 0; i < 10*lh.shards[0].capacity; i++ {
+		lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+		if i%10 == 0 && lh.Allow(hot) {
+			t.Fatalf("scan %d: active client bucket was evicted and refilled", i)
+		}
+	}
+	if _, ok := lh.bucketOf(keyOf(hot.To4())); !ok {
+		t.Fatal("active client bucket evicted")
+	}
+	if _, ok := lh.bucketOf(keyOf(idle.To4())); ok {
+		t.Fatal("idle client bucket survived")
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
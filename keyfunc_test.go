@@ -0,0 +1,69 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyFunc(t *testing.T) {
+	const apiKey = "secret-api-key-1"
+	var buf bytes.Buffer
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:    time.Hour,
+		Burst:          1,
+		Logger:         log.New(&buf, "", 0),
+		BypassLogEvery: 1,
+		Policy:         Policy{Denylist: []string{"192.0.2.0/24"}},
+		KeyFunc: func(r *http.Request) []byte {
+			switch k := r.Header.Get("X-Api-Key"); k {
+			case "":
+				return IPFromRemoteAddr(r)
+			case "skip":
+				return nil
+			default:
+				return []byte(k)
+			}
+		},
+	}).(*limiter)
+	serve := func(addr, key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr + ":1234"
+		if key != "" {
+			req.Header.Set("X-Api-Key", key)
+		}
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i, tc := range []struct {
+		addr, key string
+		want      int
+	}{
+		{"192.0.2.1", apiKey, http.StatusNotFound},
+		{"198.51.100.1", apiKey, http.StatusTooManyRequests}, // same key, other address
+		{"192.0.2.1", "other-key", http.StatusNotFound},
+		{"192.0.2.1", "skip", http.StatusNotFound},
+		{"192.0.2.1", "skip", http.StatusNotFound},
+		{"198.51.100.1", "", http.StatusNotFound}, // anonymous, keyed by address bytes
+		{"198.51.100.1", "", http.StatusTooManyRequests},
+		{"198.51.100.2", "", http.StatusNotFound},
+	} {
+		if got := serve(tc.addr, tc.key); got != tc.want {
+			t.Errorf("%d: %s with key %q: got %d, want %d", i, tc.addr, tc.key, got, tc.want)
+		}
+	}
+	if c := lh.Counters(); c.BypassedNilIP != 2 || c.Denied != 2 {
+		t.Errorf("got %d bypassed, %d denied", c.BypassedNilIP, c.Denied)
+	}
+	if strings.Contains(buf.String(), apiKey) {
+		t.Errorf("key logged:\n%s", buf.String())
+	}
+	if want := "rate limited for " + formatKey([]byte(apiKey)); !strings.Contains(buf.String(), want) {
+		t.Errorf("log has no %q:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,180 @@
+package ipratelimit
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// Limit overrides token bucket parameters of Config for a subset of
+// requests; zero fields fall back to the Config values.
+type Limit struct {
+	RefillEvery time.Duration
+	Burst       int
+	Response    Response // overrides Config.Response
+}
+
+// limits are parameters of a token bucket
+type limits struct {
+	refillEvery float64       // nanoseconds to refill a single token
+	burst       float64       // bucket capacity
+	maxWait     time.Duration // cap of waits reported to clients
+	resp        *Response     // response to rate limited requests, nil for the global one
+}
+
+func newLimits(refillEvery time.Duration, burst int, maxWait time.Duration) limits {
+	return limits{
+		refillEvery: float64(refillEvery),
+		burst:       float64(burst),
+		maxWait:     maxWait,
+	}
+}
+
+// retryAfter returns Retry-After header value for a request taking cost
+// tokens denied with left tokens in the bucket: time until the deficit is
+// refilled,
+//
+//	min((cost-left)*refillEvery, maxWait)
+//
+// in seconds, rounded up, at least 1.
+func (l *limits) retryAfter(left, cost float64) string {
+	return retryAfterValue(l.retryWait(left, cost), l.maxWait)
+}
+
+// retryWait returns the wait retryAfter reports, as a duration
+func (l *limits) retryWait(left, cost float64) time.Duration {
+	return min(durationOf(max(cost-left, 0)*l.refillEvery), l.maxWait)
+}
+
+// retryAfterValue returns Retry-After header value for the wait d: number of
+// seconds rounded up, at least 1, and not over limit rounded up
+func retryAfterValue(d, limit time.Duration) string {
+	d = min(d, limit)
+	secs := int64(d / time.Second)
+	if d%time.Second > 0 {
+		secs++
+	}
+	return strconv.FormatInt(max(secs, 1), 10)
+}
+
+// override returns limits with zero fields of l replaced by the values of
+// def; RefillEvery is clamped the same way New does it.
+func (l Limit) override(def limits) limits {
+	refillEvery, burst := time.Duration(def.refillEvery), int(def.burst)
+	if l.RefillEvery > 0 {
+		refillEvery = min(max(l.RefillEvery, MinRefillEvery), MaxRefillEvery)
+	}
+	if l.Burst > 0 {
+		burst = l.Burst
+	}
+	out := newLimits(refillEvery, burst, def.maxWait)
+	out.resp = def.resp
+	if l.Response != (Response{}) && l.Response.valid() && def.resp != nil {
+		resp := l.Response.merge(*def.resp)
+		out.resp = &resp
+	}
+	return out
+}
+
+// resetIn returns time needed to refill bucket with given number of tokens
+// left to its full capacity, capped at l.maxWait
+func (l *limits) resetIn(left float64) time.Duration {
+	if left >= l.burst {
+		return 0
+	}
+	return min(durationOf((l.burst-left)*l.refillEvery), l.maxWait)
+}
+
+// nextTokenIn returns time until the next token is refilled into bucket
+// with given number of tokens left, 0 if the bucket is full
+func (l *limits) nextTokenIn(left float64) time.Duration {
+	if left >= l.burst {
+		return 0
+	}
+	return durationOf((1 - (left - math.Floor(left))) * l.refillEvery)
+}
+
+// take refills bucket according to the time passed since its last access and
+// tries to take cost tokens from it, reporting whether it succeeded. Bucket
+// is left intact on failure, take never overdraws it, see reserve.
+//
+// Bucket may have been filled under different limits: if burst has shrunk
+// since, bucket is clamped to the new burst; if it has grown, bucket is only
+// refilled at the regular rate.
+func (l *limits) take(bkt *bucket, cost float64, now time.Time) bool {
+	if bkt.mtime != 0 {
+		// refill bucket
+		spent := now.Sub(time.Unix(0, bkt.mtime))
+		if refillBy := float64(spent) / l.refillEvery; refillBy > 0 {
+			bkt.left += refillBy
+		}
+	}
+	if bkt.left > l.burst {
+		bkt.left = l.burst
+	}
+	bkt.mtime = now.UnixNano()
+	if bkt.left >= cost {
+		bkt.left -= cost
+		return true
+	}
+	return false
+}
+
+// reserve takes cost tokens from bucket already refilled by take, which
+// couldn't take them, if they are refilled within maxDelay; bucket is
+// overdrawn, so the following requests wait for their tokens in turn. It
+// returns the time until the tokens are refilled and whether they were
+// taken.
+func (l *limits) reserve(bkt *bucket, cost float64, maxDelay time.Duration) (time.Duration, bool) {
+	wait := durationOf((cost - bkt.left) * l.refillEvery)
+	if wait > maxDelay {
+		return 0, false
+	}
+	bkt.left -= cost
+	return wait, true
+}
+
+// growMaxBurst raises h.maxBurst to burst. Bursts not above it are
+// recognized without taking h.m, which is shared by all requests.
+func (h *limiter) growMaxBurst(burst float64) {
+	if burst <= math.Float64frombits(h.maxBurstBits.Load()) {
+		return
+	}
+	h.m.Lock()
+	h.maxBurst = max(h.maxBurst, burst)
+	h.maxBurstBits.Store(math.Float64bits(h.maxBurst))
+	h.m.Unlock()
+}
+
+// setDefaultLimits replaces default limits, decisions already in progress
+// complete with the previous ones. Existing buckets adapt on their next
+// access, see limits.take.
+func (h *limiter) setDefaultLimits(l limits) {
+	h.growMaxBurst(l.burst)
+	h.publish(func(g *generation) { g.def = &l })
+}
+
+// SetLimit atomically replaces the default refill interval and burst size,
+// see Config.RefillEvery and Config.Burst, which are clamped the same way New
+// does it. Requests already being decided complete with the previous limits,
+// existing buckets keep their tokens and adapt on their next access: if burst
+// has shrunk, they are clamped to it. Per server name limits, which override
+// the defaults, are left as is.
+//
+// Handler returned by New implements interface{ SetLimit(time.Duration, int) }.
+func (h *limiter) SetLimit(refillEvery time.Duration, burst int) {
+	switch {
+	case refillEvery <= 0:
+		refillEvery = defaultConfig.RefillEvery
+	case refillEvery < MinRefillEvery:
+		refillEvery = MinRefillEvery
+	case refillEvery > MaxRefillEvery:
+		refillEvery = MaxRefillEvery
+	}
+	h.growMaxBurst(float64(max(burst, 1)))
+	h.publish(func(g *generation) {
+		l := newLimits(refillEvery, max(burst, 1), g.def.maxWait)
+		l.resp = g.def.resp
+		g.def = &l
+	})
+}
@@ -0,0 +1,365 @@
+package ipratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitsChangeDuringTraffic(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+	}).(*limiter)
+	small, large := newLimits(time.Hour, 2, defaultMaxRetryAfter), newLimits(24*time.Hour, 5, defaultMaxRetryAfter)
+
+	const clients = 8
+	var allowed [clients]atomic.Int64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := net.IPv4(192, 0, 2, byte(i))
+			for j := 0; j < 2000; j++ {
+				if lh.Allow(ip) {
+					allowed[i].Add(1)
+				}
+			}
+		}(i)
+	}
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				lh.setDefaultLimits(large)
+			} else {
+				lh.setDefaultLimits(small)
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	// refill during the test is negligible with the rates used, so no
+	// client may ever get more than the largest burst
+	for i := range allowed {
+		if n := allowed[i].Load(); n > int64(large.burst) || n < 1 {
+			t.Errorf("client %d: %d requests allowed, want within [1, %v]", i, n, large.burst)
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitsShrinkClamps(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       10,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	ip := net.IPv4(192, 0, 2, 1)
+	lh.Allow(ip) // 9 tokens left
+	lh.setDefaultLimits(newLimits(time.Hour, 3, defaultMaxRetryAfter))
+	var n int
+	for lh.Allow(ip) {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("after burst shrunk %d requests allowed, want 3", n)
+	}
+	// growing burst doesn't refill existing buckets instantly
+	lh.setDefaultLimits(newLimits(time.Hour, 10, defaultMaxRetryAfter))
+	if lh.Allow(ip) {
+		t.Fatal("request allowed right after burst grew")
+	}
+}
+
+func TestRetryAfterExtremes(t *testing.T) {
+	for _, tc := range []struct {
+		refill   time.Duration
+		burst    int
+		maxWait  time.Duration
+		ban      time.Duration
+		wantSecs int64
+	}{
+		{time.Hour, 10000, 0, 0, 3600},
+		{MaxRefillEvery, 10000, 0, 0, 86400},
+		{MaxRefillEvery, 10000, math.MaxInt64, 0, int64(MaxRefillEvery / time.Second)},
+		{MinRefillEvery, 1, 0, 0, 1},
+		{time.Hour, 1, 0, math.MaxInt64, 86400},
+		{time.Hour, 1, 90 * time.Second, 1500 * time.Millisecond, 2},
+		{time.Hour, 1, time.Nanosecond, time.Hour, 1},
+	} {
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery:    tc.refill,
+			Burst:          tc.burst,
+			MaxRetryAfter:  tc.maxWait,
+			ProblemDetails: true,
+		}).(*limiter)
+		ip := net.IPv4(192, 0, 2, 1)
+		if tc.ban != 0 {
+			lh.Ban(ip, tc.ban)
+		}
+		var rec *httptest.ResponseRecorder
+		for i := 0; i <= tc.burst; i++ {
+			rec = httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			lh.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				break
+			}
+		}
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("%+v: got code %d", tc, rec.Code)
+		}
+		secs, err := strconv.ParseInt(rec.Header().Get("Retry-After"), 10, 64)
+		if err != nil || secs != tc.wantSecs {
+			t.Errorf("%+v: got Retry-After %q, want %d", tc, rec.Header().Get("Retry-After"), tc.wantSecs)
+		}
+		var p problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil || int64(p.RetryAfter) != secs {
+			t.Errorf("%+v: retry_after %d does not match Retry-After %d (%v)", tc, p.RetryAfter, secs, err)
+		}
+		if tc.ban != 0 {
+			continue
+		}
+		d, _ := lh.AllowCtx(context.Background(), ip)
+		maxWait := tc.maxWait
+		if maxWait == 0 {
+			maxWait = defaultMaxRetryAfter
+		}
+		if d.Allowed || d.Reset <= 0 || d.Reset > maxWait {
+			t.Errorf("%+v: got Reset %v on denial, want within (0, %v]", tc, d.Reset, maxWait)
+		}
+	}
+}
+
+func TestCostRetryAfter(t *testing.T) {
+	const never = -1
+	for _, tc := range []struct {
+		refill     time.Duration
+		left, cost float64
+		allow      bool
+		remaining  float64
+		retryAfter string        // on denial
+		next       time.Duration // NextAllowed offset from now, never if negative
+	}{
+		{time.Second, 0, 1, false, 0, "1", time.Second + 1},
+		{time.Second, 0.5, 1, false, 0.5, "1", 500*time.Millisecond + 1},
+		{time.Second, 0, 5, false, 0, "5", 5*time.Second + 1},
+		{time.Second, 2.5, 5, false, 2.5, "3", 2500*time.Millisecond + 1},
+		{time.Second, 7, 5, true, 2, "", 3*time.Second + 1},
+		{time.Second, 10, 5, true, 5, "", 0},
+		{1500 * time.Millisecond, 0, 1, false, 0, "2", 1500*time.Millisecond + 1},
+		{1500 * time.Millisecond, 1, 3, false, 1, "3", 3*time.Second + 1},
+		{1500 * time.Millisecond, 0, 4, false, 0, "6", 6*time.Second + 1},
+		{time.Minute, 0.5, 2, false, 0.5, "90", 90*time.Second + 1},
+		{time.Minute, 3, 3, true, 0, "", 3*time.Minute + 1},
+		{time.Hour, 0, 48, false, 0, "86400", 48*time.Hour + 1}, // capped by MaxRetryAfter
+		{time.Second, 48, 49, false, 48, "1", never},
+	} {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: tc.refill,
+			Burst:       48,
+		}).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		ip := net.IPv4(192, 0, 2, 1).To4()
+		s := lh.shardOf(keyOf(ip))
+		s.ipmap[keyOf(ip)] = bucket{left: tc.left, mtime: now.UnixNano()}
+		s.keys.push(keyOf(ip))
+
+		e := evaluation{ctx: context.Background(), ip: ip, cost: tc.cost}
+		lh.evaluate(&e)
+		if e.stage != StageLimit || e.d.allow != tc.allow || e.d.remaining != tc.remaining {
+			t.Errorf("%+v: got stage %v, allow %v, remaining %v", tc, e.stage, e.d.allow, e.d.remaining)
+			continue
+		}
+		want := now.Add(tc.next)
+		if tc.next < 0 {
+			want = time.Time{}
+		}
+		if got := lh.nextAllowed(&e, now); !got.Equal(want) {
+			t.Errorf("%+v: got NextAllowed now+%v, want now+%v", tc, got.Sub(now), tc.next)
+		}
+		if tc.allow {
+			continue
+		}
+		rec := httptest.NewRecorder()
+		lh.deny(rec, httptest.NewRequest(http.MethodGet, "/", nil), &e)
+		if got := rec.Header().Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("%+v: got Retry-After %q, want %q", tc, got, tc.retryAfter)
+		}
+	}
+}
+
+// TestRetryAfterBucketState checks that Retry-After follows the bucket
+// state: it's shorter for a partially refilled bucket than for a freshly
+// exhausted one, and grows for a client hammering the limiter
+func TestRetryAfterBucketState(t *testing.T) {
+	for _, backoff := range []float64{0, 2} {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery:           2500 * time.Millisecond,
+			Burst:                 1,
+			RetryViolationBackoff: backoff,
+		}).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		serve := func() (int, string) {
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			return w.Code, w.Header().Get("Retry-After")
+		}
+		if code, _ := serve(); code != http.StatusNotFound {
+			t.Fatalf("backoff %v: first request denied", backoff)
+		}
+		if _, got := serve(); got != "3" {
+			t.Fatalf("backoff %v: freshly exhausted bucket: got Retry-After %q, want 3", backoff, got)
+		}
+		if backoff == 0 {
+			now = now.Add(2 * time.Second)
+			if _, got := serve(); got != "1" {
+				t.Errorf("partially refilled bucket: got Retry-After %q, want 1", got)
+			}
+			continue
+		}
+		for i, want := range []string{"5", "10", "20", "40"} {
+			now = now.Add(100 * time.Millisecond)
+			if _, got := serve(); got != want {
+				t.Fatalf("hammering client, retry %d: got Retry-After %q, want %q", i, got, want)
+			}
+		}
+	}
+}
+
+func TestInitialTokens(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:          time.Second,
+		Burst:                5,
+		MaxBuckets:           100,
+		InitialTokens:        2,
+		IPFunc:               IPFromXForwardedFor,
+		SendRateLimitHeaders: true,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w
+	}
+	ip := net.IPv4(192, 0, 2, 1)
+	if got, want := lh.Next(ip, 3), now.Add(time.Second); got.Before(want) || got.After(want.Add(time.Millisecond)) {
+		t.Fatalf("Next for a new client taking 3 tokens: %v, want %v", got, want)
+	}
+	// a new bucket, then the same one recreated after eviction
+	for round := 0; round < 2; round++ {
+		for i, tc := range []struct {
+			advance               time.Duration
+			code                  int
+			remaining, retryAfter string
+		}{
+			{0, http.StatusNotFound, "1", ""},
+			{0, http.StatusNotFound, "0", ""},
+			{0, http.StatusTooManyRequests, "0", "1"},
+			{time.Second, http.StatusNotFound, "0", ""},
+			{0, http.StatusTooManyRequests, "0", "1"},
+			{3 * time.Second, http.StatusNotFound, "2", ""},
+		} {
+			now = now.Add(tc.advance)
+			w := serve()
+			if w.Code != tc.code || w.Header().Get("RateLimit-Remaining") != tc.remaining ||
+				w.Header().Get("Retry-After") != tc.retryAfter {
+				t.Fatalf("round %d, request %d: got status %d, headers %v", round, i, w.Code, w.Header())
+			}
+		}
+		for i := 0; i < 2*lh.shards[0].capacity; i++ {
+			lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+		}
+		if _, ok := lh.bucketOf(keyOf(ip.To4())); ok {
+			t.Fatal("bucket was not evicted")
+		}
+		// bucket would have been full by now had it not been evicted
+		now = now.Add(time.Hour)
+	}
+
+	if err := (&Config{Burst: 5, InitialTokens: 6}).Validate(); err == nil {
+		t.Error("InitialTokens over Burst passed validation")
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Minute,
+		Burst:       4,
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+	do := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		lh.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		if w := do(); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d", i, w.Code)
+		}
+	}
+	hash := lh.PolicyHash()
+	// bucket with a single token left is kept, then refilled at the new rate
+	lh.SetLimit(time.Hour, 2)
+	if lh.PolicyHash() == hash {
+		t.Error("policy hash unchanged")
+	}
+	if w := do(); w.Code != http.StatusOK {
+		t.Fatalf("got %d, want remaining token taken", w.Code)
+	}
+	w := do()
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d after bucket ran out", w.Code)
+	}
+	if got, want := w.Header().Get("Retry-After"), "3600"; got != want {
+		t.Errorf("Retry-After %q, want %q", got, want)
+	}
+	now = now.Add(time.Minute)
+	if w := do(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want old refill rate no longer in effect", w.Code)
+	}
+	// lowered burst clamps a full bucket on its next access
+	now = now.Add(10 * time.Hour)
+	lh.SetLimit(time.Hour, 1)
+	if w := do(); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if w := do(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("got %d, want burst clamped to 1", w.Code)
+	}
+	if st := lh.Stats(); st.Buckets != 1 {
+		t.Errorf("got %d buckets, want 1", st.Buckets)
+	}
+	// out of range values are clamped
+	lh.SetLimit(time.Nanosecond, 0)
+	if l := lh.gen.Load().def; time.Duration(l.refillEvery) != MinRefillEvery || l.burst != 1 {
+		t.Errorf("got limits %v/%v", time.Duration(l.refillEvery), l.burst)
+	}
+}
@@ -0,0 +1,178 @@
+// Package loadgen generates synthetic traffic for benchmarking and
+// evaluating rate limiter configurations: heavy-tailed client populations,
+// single-source floods and slow distributed attacks.
+//
+// Streams produce events with increasing timestamps; Mixer merges several
+// streams into one. All randomness comes from the seed given to Mixer, so
+// the same seed always produces the same sequence of events.
+package loadgen
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Event is a single request of generated traffic
+type Event struct {
+	At time.Duration // time since the start of traffic
+	IP net.IP        // client address
+}
+
+// Stream produces events in non-decreasing order of their At field
+type Stream interface {
+	// Next returns the next event, rnd is the only source of randomness
+	// implementation may use.
+	Next(rnd *rand.Rand) Event
+}
+
+// ZipfIPs returns stream of requests from n distinct IPv4 addresses, chosen
+// according to Zipf distribution with exponent s, which must be greater than
+// 1: the most active address sends the largest share of requests, and the
+// share falls as a power of the address rank. Requests arrive as Poisson
+// process with the total rate of rps requests per second.
+//
+// Addresses are taken from 10.0.0.0/8 network, address of rank k (starting
+// from 0) is 10.0.0.0 + k + 1.
+func ZipfIPs(n int, s, rps float64) Stream {
+	if n < 1 || s <= 1 || rps <= 0 {
+		panic("loadgen: invalid ZipfIPs parameters")
+	}
+	return &zipfStream{n: uint64(n), s: s, mean: float64(time.Second) / rps}
+}
+
+type zipfStream struct {
+	n    uint64
+	s    float64
+	mean float64 // mean interval between events, in nanoseconds
+	zipf *rand.Zipf
+	at   time.Duration
+}
+
+func (z *zipfStream) Next(rnd *rand.Rand) Event {
+	if z.zipf == nil {
+		z.zipf = rand.NewZipf(rnd, z.s, 1, z.n-1)
+	}
+	z.at += time.Duration(rnd.ExpFloat64() * z.mean)
+	return Event{At: z.at, IP: rankIP(0x0a000000, z.zipf.Uint64())}
+}
+
+// FloodFrom returns stream of requests from a single address arriving at the
+// constant rate of rps requests per second.
+func FloodFrom(ip net.IP, rps float64) Stream {
+	if rps <= 0 {
+		panic("loadgen: invalid FloodFrom rate")
+	}
+	return &floodStream{ip: ip, step: time.Duration(float64(time.Second) / rps)}
+}
+
+type floodStream struct {
+	ip   net.IP
+	step time.Duration
+	at   time.Duration
+}
+
+func (f *floodStream) Next(*rand.Rand) Event {
+	f.at += f.step
+	return Event{At: f.at, IP: f.ip}
+}
+
+// SlowDrip returns stream of requests from the given addresses taking turns,
+// each address sending at the constant rate of rps requests per second. This
+// models a distributed attack where each source stays under per-address
+// limits.
+func SlowDrip(ips []net.IP, rps float64) Stream {
+	if len(ips) == 0 || rps <= 0 {
+		panic("loadgen: invalid SlowDrip parameters")
+	}
+	return &dripStream{ips: ips, step: time.Duration(float64(time.Second) / rps / float64(len(ips)))}
+}
+
+type dripStream struct {
+	ips  []net.IP
+	step time.Duration
+	at   time.Duration
+	i    int
+}
+
+func (d *dripStream) Next(*rand.Rand) Event {
+	d.at += d.step
+	ip := d.ips[d.i]
+	d.i = (d.i + 1) % len(d.ips)
+	return Event{At: d.at, IP: ip}
+}
+
+// Mixer merges multiple streams into a single stream ordered by time
+type Mixer struct {
+	heads mixHeap
+}
+
+// NewMixer returns Mixer over given streams; each stream gets its own source
+// of randomness derived from seed, so the output only depends on the seed
+// and the list of streams.
+func NewMixer(seed int64, streams ...Stream) *Mixer {
+	m := &Mixer{heads: make(mixHeap, 0, len(streams))}
+	for i, s := range streams {
+		rnd := rand.New(rand.NewSource(seed + int64(i)))
+		m.heads = append(m.heads, mixHead{ev: s.Next(rnd), s: s, rnd: rnd, idx: i})
+	}
+	heap.Init(&m.heads)
+	return m
+}
+
+// Next returns the earliest event among all streams. Mixer implements Stream,
+// so mixers can be nested; rnd is ignored as each stream has its own source.
+func (m *Mixer) Next(*rand.Rand) Event {
+	if len(m.heads) == 0 {
+		return Event{}
+	}
+	h := &m.heads[0]
+	ev := h.ev
+	h.ev = h.s.Next(h.rnd)
+	heap.Fix(&m.heads, 0)
+	return ev
+}
+
+// Take returns all events happening within duration d since the start of
+// traffic, that were not returned yet.
+func (m *Mixer) Take(d time.Duration) []Event {
+	var out []Event
+	for len(m.heads) != 0 && m.heads[0].ev.At <= d {
+		out = append(out, m.Next(nil))
+	}
+	return out
+}
+
+type mixHead struct {
+	ev  Event
+	s   Stream
+	rnd *rand.Rand
+	idx int // stream index, breaks ties deterministically
+}
+
+type mixHeap []mixHead
+
+func (h mixHeap) Len() int { return len(h) }
+func (h mixHeap) Less(i, j int) bool {
+	if h[i].ev.At == h[j].ev.At {
+		return h[i].idx < h[j].idx
+	}
+	return h[i].ev.At < h[j].ev.At
+}
+func (h mixHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mixHeap) Push(x interface{}) { *h = append(*h, x.(mixHead)) }
+func (h *mixHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// rankIP returns IPv4 address base + rank + 1
+func rankIP(base uint32, rank uint64) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(rank)+1)
+	return ip
+}
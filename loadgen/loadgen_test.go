@@ -0,0 +1,84 @@
+package loadgen
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestZipfTopShare(t *testing.T) {
+	const n, s = 1000, 1.2
+	var harmonic float64
+	for k := 1; k <= n; k++ {
+		harmonic += math.Pow(float64(k), -s)
+	}
+	wantTop := 1 / harmonic
+
+	const events = 200000
+	m := NewMixer(1, ZipfIPs(n, s, 1000))
+	counts := make(map[string]int)
+	var last time.Duration
+	for i := 0; i < events; i++ {
+		ev := m.Next(nil)
+		if ev.At < last {
+			t.Fatalf("event %d goes back in time: %v < %v", i, ev.At, last)
+		}
+		last = ev.At
+		counts[ev.IP.String()]++
+	}
+	if len(counts) > n {
+		t.Fatalf("%d distinct addresses, want at most %d", len(counts), n)
+	}
+	top := float64(counts["10.0.0.1"]) / events
+	if math.Abs(top-wantTop) > 0.02 {
+		t.Fatalf("top address share %.3f, want %.3f±0.02", top, wantTop)
+	}
+	// 200k events at 1000 rps should take about 200s
+	if last < 190*time.Second || last > 210*time.Second {
+		t.Fatalf("traffic duration %v, want about 200s", last)
+	}
+}
+
+func TestFloodAndDrip(t *testing.T) {
+	flood := net.IPv4(192, 0, 2, 1).To4()
+	drip := []net.IP{{198, 51, 100, 1}, {198, 51, 100, 2}, {198, 51, 100, 3}, {198, 51, 100, 4}}
+	m := NewMixer(1, FloodFrom(flood, 100), SlowDrip(drip, 2))
+	counts := make(map[string]int)
+	for _, ev := range m.Take(10 * time.Second) {
+		counts[ev.IP.String()]++
+	}
+	if n := counts[flood.String()]; n != 1000 {
+		t.Errorf("flood sent %d requests in 10s, want 1000", n)
+	}
+	for _, ip := range drip {
+		if n := counts[ip.String()]; n < 19 || n > 20 {
+			t.Errorf("%v sent %d requests in 10s, want 20", ip, n)
+		}
+	}
+}
+
+func TestMixerDeterministic(t *testing.T) {
+	run := func(seed int64) []Event {
+		return NewMixer(seed,
+			ZipfIPs(100, 1.5, 500),
+			FloodFrom(net.IPv4(192, 0, 2, 1), 50),
+		).Take(time.Second)
+	}
+	a, b, c := run(7), run(7), run(8)
+	if len(a) != len(b) {
+		t.Fatalf("same seed produced %d and %d events", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].At != b[i].At || !a[i].IP.Equal(b[i].IP) {
+			t.Fatalf("event %d differs for the same seed: %v vs %v", i, a[i], b[i])
+		}
+	}
+	same := len(a) == len(c)
+	for i := 0; same && i < len(a); i++ {
+		same = a[i].At == c[i].At && a[i].IP.Equal(c[i].IP)
+	}
+	if same {
+		t.Fatal("different seeds produced the same traffic")
+	}
+}
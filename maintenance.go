@@ -0,0 +1,68 @@
+package ipratelimit
+
+import "time"
+
+var (
+	// autoSizeEvery is the default interval of maintenance with automatic
+	// sizing enabled
+	autoSizeEvery = 10 * time.Second
+
+	// minExpireEvery is the shortest default interval of maintenance with
+	// Config.MaxIdle set
+	minExpireEvery = time.Second
+)
+
+// maintenanceEvery returns the interval of background maintenance for
+// Config.MaintenanceEvery set to every, 0 if there's nothing to maintain or
+// background maintenance is disabled
+func (h *limiter) maintenanceEvery(every time.Duration) time.Duration {
+	if every < 0 || (h.autoMax == 0 && h.maxIdle == 0) {
+		return 0
+	}
+	if every > 0 {
+		return every
+	}
+	if h.autoMax > 0 {
+		every = autoSizeEvery
+	}
+	if h.maxIdle > 0 {
+		idle := max(time.Duration(h.maxIdle)/4, minExpireEvery)
+		if every == 0 || idle < every {
+			every = idle
+		}
+	}
+	return every
+}
+
+// maintenanceLoop calls RunMaintenance every interval until h.done is
+// closed
+func (h *limiter) maintenanceLoop(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.RunMaintenance(h.now())
+		}
+	}
+}
+
+// RunMaintenance makes a single maintenance pass as of now: grows the
+// number of buckets in automatic sizing mode (see Config.TargetMemory), and
+// removes idle buckets (see Config.MaxIdle). It is called in background
+// unless Config.MaintenanceEvery is negative, in which case the embedder
+// should call it instead. It does nothing if neither mode is enabled.
+//
+// Handler returned by New implements interface{ RunMaintenance(time.Time) }.
+func (h *limiter) RunMaintenance(now time.Time) {
+	if h.autoMax > 0 {
+		if from, to := h.autoSize(); to > from {
+			h.log.Printf("number of buckets grown from %d to %d", from, to)
+		}
+	}
+	if h.maxIdle > 0 {
+		h.expire(now)
+	}
+}
@@ -0,0 +1,90 @@
+package ipratelimit
+
+import (
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestManualMaintenance drives automatic sizing, idle bucket expiry and
+// summaries with a fake clock, without any background goroutines
+func TestManualMaintenance(t *testing.T) {
+	var buf syncBuffer
+	goroutines := runtime.NumGoroutine()
+	l := NewLimiter(&Config{
+		RefillEvery:      time.Second,
+		Burst:            1,
+		TargetMemory:     1 << 20,
+		MaxIdle:          time.Minute,
+		MaintenanceEvery: -1,
+		Logger:           log.New(&buf, "", 0),
+	})
+	defer l.Close()
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("%d goroutines started", n-goroutines)
+	}
+	lh := l.l
+	start := time.Unix(1000, 0)
+	now := start
+	lh.now = func() time.Time { return now }
+	l.EmitSummary(now)
+
+	// more keys than the initial number of buckets: young buckets are
+	// evicted, so the next maintenance pass grows the number of buckets
+	for i := 0; i < 1500; i++ {
+		l.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	if st := l.Stats(); st.MaxBuckets != autoMinBuckets || st.Evicted == 0 {
+		t.Fatalf("got %d max buckets, %d evicted", st.MaxBuckets, st.Evicted)
+	}
+	l.RunMaintenance(now)
+	if st := l.Stats(); st.MaxBuckets != 2*autoMinBuckets {
+		t.Fatalf("got %d max buckets after maintenance", st.MaxBuckets)
+	}
+
+	now = now.Add(30 * time.Second)
+	l.Allow(net.IPv4(192, 0, 2, 1))
+	now = now.Add(45 * time.Second)
+	l.RunMaintenance(now)
+	if st := l.Stats(); st.Buckets != 1 || st.Expired == 0 {
+		t.Fatalf("got %d buckets, %d expired after maintenance", st.Buckets, st.Expired)
+	}
+
+	l.EmitSummary(now)
+	l.EmitSummary(now.Add(time.Minute)) // no events, not logged
+	out := buf.String()
+	if !strings.Contains(out, "number of buckets grown from 1000 to 2000") {
+		t.Errorf("no growth logged:\n%s", out)
+	}
+	if n := strings.Count(out, "summary over "); n != 1 || !strings.Contains(out, "summary over 1m15s: allowed 1501,") {
+		t.Errorf("unexpected summaries:\n%s", out)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("%d goroutines started", n-goroutines)
+	}
+}
+
+func TestMaintenanceEvery(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want time.Duration
+	}{
+		{Config{}, 0},
+		{Config{MaintenanceEvery: time.Second}, 0},
+		{Config{TargetMemory: 1 << 20}, autoSizeEvery},
+		{Config{MaxIdle: time.Minute}, 15 * time.Second},
+		{Config{MaxIdle: time.Second}, minExpireEvery},
+		{Config{MaxIdle: time.Hour, TargetMemory: 1 << 20}, autoSizeEvery},
+		{Config{MaxIdle: time.Hour, MaintenanceEvery: time.Minute}, time.Minute},
+		{Config{MaxIdle: time.Hour, MaintenanceEvery: -1}, 0},
+	} {
+		lh := newLimiter(&tc.cfg)
+		lh.Close()
+		if got := lh.maintenanceEvery(tc.cfg.MaintenanceEvery); got != tc.want {
+			t.Errorf("%+v: got %v, want %v", tc.cfg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package ipratelimit
+
+import "net"
+
+// maskIP returns ip, which must be in the form returned by canonicalIP,
+// masked with Config.IPv4Mask or Config.IPv6Mask. It returns ip itself if
+// addresses are not masked.
+func (h *limiter) maskIP(ip net.IP) net.IP {
+	mask := h.v6Mask
+	if len(ip) == net.IPv4len {
+		mask = h.v4Mask
+	}
+	if mask == nil {
+		return ip
+	}
+	return ip.Mask(mask)
+}
@@ -0,0 +1,80 @@
+package ipratelimit
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddressMasks(t *testing.T) {
+	for _, tc := range []struct {
+		v4, v6 int
+		shared bool
+	}{
+		{0, 0, false},
+		{32, 128, false},
+		{24, 64, true},
+	} {
+		var buf syncBuffer
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: time.Hour,
+			Burst:       2,
+			IPFunc:      IPFromXForwardedFor,
+			Logger:      log.New(&buf, "", 0),
+			IPv4Mask:    tc.v4,
+			IPv6Mask:    tc.v6,
+			Exempt:      []*net.IPNet{{IP: net.IPv4(192, 0, 2, 200), Mask: net.CIDRMask(32, 32)}},
+		}).(*limiter)
+		serve := func(addr string) int {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", addr)
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			return w.Code
+		}
+		for _, pair := range [][2]string{
+			{"192.0.2.1", "192.0.2.77"},
+			{"2001:db8:0:1::1", "2001:db8:0:1:ffff::2"},
+		} {
+			serve(pair[0])
+			serve(pair[0])
+			want := http.StatusNotFound
+			if tc.shared {
+				want = http.StatusTooManyRequests
+			}
+			if code := serve(pair[1]); code != want {
+				t.Errorf("masks /%d, /%d: %s after %s exhausted its budget: got status %d, want %d",
+					tc.v4, tc.v6, pair[1], pair[0], code, want)
+			}
+			if tc.shared && !strings.Contains(buf.String(), "rate limited for "+pair[1]+":") {
+				t.Errorf("masks /%d, /%d: log doesn't mention the original address: %s", tc.v4, tc.v6, buf.String())
+			}
+		}
+		// exempt address within the masked network is still exempt
+		if code := serve("192.0.2.200"); code != http.StatusNotFound {
+			t.Errorf("masks /%d, /%d: exempt address got status %d", tc.v4, tc.v6, code)
+		}
+		// networks differing outside of the prefix don't share buckets
+		if code := serve("192.0.3.1"); code != http.StatusNotFound {
+			t.Errorf("masks /%d, /%d: address of another network got status %d", tc.v4, tc.v6, code)
+		}
+		if got := lh.RecentlyLimited(net.ParseIP("192.0.2.5"), time.Hour); got {
+			t.Errorf("masks /%d, /%d: RecentlyLimited without TrackStats", tc.v4, tc.v6)
+		}
+		if next := lh.Next(net.ParseIP("192.0.2.5"), 1); tc.shared != next.After(time.Now()) {
+			t.Errorf("masks /%d, /%d: Next for a network neighbour: %v", tc.v4, tc.v6, next)
+		}
+	}
+}
+
+func TestAddressMasksValidate(t *testing.T) {
+	for _, cfg := range []*Config{{IPv4Mask: -1}, {IPv4Mask: 33}, {IPv6Mask: -1}, {IPv6Mask: 129}} {
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "Mask") {
+			t.Errorf("IPv4Mask %d, IPv6Mask %d: got error %v", cfg.IPv4Mask, cfg.IPv6Mask, err)
+		}
+	}
+}
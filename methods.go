@@ -0,0 +1,29 @@
+package ipratelimit
+
+import "strings"
+
+// newMethodSet returns set of methods in upper case, nil if methods has no
+// non-empty ones
+func newMethodSet(methods []string) map[string]struct{} {
+	var set map[string]struct{}
+	for _, m := range methods {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]struct{}, len(methods))
+		}
+		set[strings.ToUpper(m)] = struct{}{}
+	}
+	return set
+}
+
+// limitsMethod reports whether requests with the given method are subject to
+// limiting, see Config.Methods
+func (h *limiter) limitsMethod(method string) bool {
+	if h.methods == nil {
+		return true
+	}
+	_, ok := h.methods[strings.ToUpper(method)]
+	return ok
+}
@@ -0,0 +1,61 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMethods(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		Methods:     []string{"post", " PUT "},
+	}).(*limiter)
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		return w.Code
+	}
+	for i := 0; i < 10; i++ {
+		if code := serve(http.MethodGet); code != http.StatusNotFound {
+			t.Fatalf("GET request %d: got status %d", i, code)
+		}
+	}
+	if n := lh.Stats().Buckets; n != 0 {
+		t.Fatalf("GET requests created %d buckets", n)
+	}
+	if c := lh.Counters(); c.Requests() != 10 || c.BypassedMethod != 10 {
+		t.Fatalf("GET requests not counted as bypassed: %+v", c)
+	}
+	for i, tc := range []struct {
+		method string
+		code   int
+	}{
+		{http.MethodPost, http.StatusNotFound},
+		{"put", http.StatusNotFound},
+		{http.MethodPost, http.StatusTooManyRequests},
+		{http.MethodGet, http.StatusNotFound},
+	} {
+		if code := serve(tc.method); code != tc.code {
+			t.Fatalf("request %d (%s): got status %d, want %d", i, tc.method, code, tc.code)
+		}
+	}
+}
+
+func TestMethodsEmptyLimitsAll(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+	})
+	var codes []int
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/", nil))
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusNotFound || codes[1] != http.StatusTooManyRequests {
+		t.Fatalf("OPTIONS requests got %v", codes)
+	}
+}
@@ -0,0 +1,186 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsContentType is the Content-Type of MetricsHandler responses
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsHandler returns handler exposing limiter Stats in Prometheus text
+// exposition format. Every metric has the "limiter" label set to
+// Config.Name. Histograms have no _sum series, as only counts of durations
+// and streaks are maintained. Metrics are written in a fixed order.
+//
+// Handler returned by New implements interface{ MetricsHandler() http.Handler }.
+func (h *limiter) MetricsHandler() http.Handler {
+	return metricsHandler(h.name, h.Stats)
+}
+
+func metricsHandler(name string, stats func() Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MetricsContentType)
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, name, stats())
+		bw.Flush()
+	})
+}
+
+func writeMetrics(w io.Writer, name string, st Stats) {
+	m := metricsWriter{w: w, name: labelEscaper.Replace(name)}
+	m.header("ipratelimit_buckets", "gauge", "Current number of buckets.")
+	m.value("ipratelimit_buckets", "", float64(st.Buckets))
+	m.header("ipratelimit_max_buckets", "gauge", "Current maximum number of buckets.")
+	m.value("ipratelimit_max_buckets", "", float64(st.MaxBuckets))
+	m.header("ipratelimit_memory_bytes", "gauge", "Estimated memory held by the built-in storage.")
+	m.value("ipratelimit_memory_bytes", `kind="buckets"`, float64(st.BucketMemory))
+	m.value("ipratelimit_memory_bytes", `kind="bookkeeping"`, float64(st.BookkeepingMemory))
+	m.header("ipratelimit_new_key_rate", "gauge", "Previously unseen addresses over the last minute.")
+	m.value("ipratelimit_new_key_rate", "", st.NewKeyRate)
+	m.header("ipratelimit_new_key_alert", "gauge", "Whether new keys alert is raised.")
+	m.value("ipratelimit_new_key_alert", "", boolValue(st.NewKeyAlert))
+	m.header("ipratelimit_bans", "gauge", "Current number of bans.")
+	m.value("ipratelimit_bans", "", float64(st.Bans))
+	m.header("ipratelimit_max_bans", "gauge", "Maximum number of bans.")
+	m.value("ipratelimit_max_bans", "", float64(st.MaxBans))
+
+	m.header("ipratelimit_decisions_total", "counter", "Requests evaluated by the limiter, by outcome.")
+	m.value("ipratelimit_decisions_total", `decision="allowed"`, float64(st.Allowed))
+	m.value("ipratelimit_decisions_total", `decision="denied"`, float64(st.Denied))
+	m.value("ipratelimit_decisions_total", `decision="failed"`, float64(st.Failed))
+	m.header("ipratelimit_shed_total", "counter", "Requests denied because of the limiter capacity rather than client usage.")
+	m.value("ipratelimit_shed_total", "", float64(st.Shed))
+	m.header("ipratelimit_refunded_total", "counter", "Requests whose tokens were returned by Refund.")
+	m.value("ipratelimit_refunded_total", "", float64(st.Refunded))
+	m.header("ipratelimit_key_collisions_total", "counter", "Bucket lookups which found a key owned by another client, see ExactKeys.")
+	m.value("ipratelimit_key_collisions_total", "", float64(st.KeyCollisions))
+	m.header("ipratelimit_global_denied_total", "counter", "Requests denied by the global limit.")
+	m.value("ipratelimit_global_denied_total", "", float64(st.GlobalDenied))
+	m.header("ipratelimit_observed_decisions_total", "counter", "Requests of the observed cohort of EnforcePercent or DryRun, by outcome.")
+	m.value("ipratelimit_observed_decisions_total", `decision="allowed"`, float64(st.ObservedAllowed))
+	m.value("ipratelimit_observed_decisions_total", `decision="denied"`, float64(st.ObservedDenied))
+	m.header("ipratelimit_limiter_timeouts_total", "counter", "Decisions failed because of MaxLimiterTime.")
+	m.value("ipratelimit_limiter_timeouts_total", "", float64(st.LimiterTimeouts))
+	m.header("ipratelimit_ipfunc_timeouts_total", "counter", "IPFunc calls not completed within IPFuncTimeout.")
+	m.value("ipratelimit_ipfunc_timeouts_total", "", float64(st.IPFuncTimeouts))
+	m.header("ipratelimit_retry_violations_total", "counter", "Requests that came before the Retry-After given to the client.")
+	m.value("ipratelimit_retry_violations_total", "", float64(st.RetryViolations))
+	m.header("ipratelimit_penalties_total", "counter", "Penalty bans imposed after PenaltyThreshold denials.")
+	m.value("ipratelimit_penalties_total", "", float64(st.Penalties))
+	m.header("ipratelimit_evictions_total", "counter", "Times excess buckets were evicted.")
+	m.value("ipratelimit_evictions_total", "", float64(st.Evictions))
+	m.header("ipratelimit_evicted_buckets_total", "counter", "Buckets evicted.")
+	m.value("ipratelimit_evicted_buckets_total", "", float64(st.Evicted))
+	m.header("ipratelimit_eviction_seconds_total", "counter", "Time spent on evictions.")
+	m.value("ipratelimit_eviction_seconds_total", "", st.EvictionTime.Seconds())
+	m.header("ipratelimit_expired_buckets_total", "counter", "Buckets removed after MaxIdle.")
+	m.value("ipratelimit_expired_buckets_total", "", float64(st.Expired))
+	m.header("ipratelimit_abandoned_total", "counter", "Denied requests whose client disconnected before the response.")
+	m.value("ipratelimit_abandoned_total", "", float64(st.Abandoned))
+	m.header("ipratelimit_bypassed_total", "counter", "Requests passed to the handler without rate limiting.")
+	m.value("ipratelimit_bypassed_total", `reason="allowlist"`, float64(st.BypassedAllowlist))
+	m.value("ipratelimit_bypassed_total", `reason="exempt"`, float64(st.BypassedExempt))
+	m.value("ipratelimit_bypassed_total", `reason="method"`, float64(st.BypassedMethod))
+	m.value("ipratelimit_bypassed_total", `reason="nil_ip"`, float64(st.BypassedNilIP))
+	m.value("ipratelimit_bypassed_total", `reason="skip"`, float64(st.BypassedSkip))
+	m.value("ipratelimit_bypassed_total", `reason="user_agent"`, float64(st.BypassedUserAgent))
+	if st.ExemptedUserAgents != nil {
+		prefixes := make([]string, 0, len(st.ExemptedUserAgents))
+		for p := range st.ExemptedUserAgents {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		m.header("ipratelimit_exempted_user_agent_total", "counter", "Requests bypassed by User-Agent prefix.")
+		for _, p := range prefixes {
+			m.value("ipratelimit_exempted_user_agent_total", `prefix="`+labelEscaper.Replace(p)+`"`, float64(st.ExemptedUserAgents[p]))
+		}
+	}
+
+	bounds := make([]float64, len(StreakBounds))
+	for i, b := range StreakBounds {
+		bounds[i] = float64(b)
+	}
+	m.header("ipratelimit_denial_streaks", "histogram", "Completed denial streaks by length.")
+	m.histogram("ipratelimit_denial_streaks", bounds, st.DenialStreaks[:])
+	bounds = make([]float64, len(DurationBounds))
+	for i, b := range DurationBounds {
+		bounds[i] = b.Seconds()
+	}
+	m.header("ipratelimit_ipfunc_duration_seconds", "histogram", "Durations of IPFunc calls.")
+	m.histogram("ipratelimit_ipfunc_duration_seconds", bounds, st.IPFuncDurations[:])
+	m.header("ipratelimit_overhead_seconds", "histogram", "Time spent by the limiter on a request.")
+	m.histogram("ipratelimit_overhead_seconds", bounds, st.LimiterOverhead[:])
+	m.header("ipratelimit_lock_hold_seconds", "histogram", "Time the limiter state is locked for a request.")
+	m.histogram("ipratelimit_lock_hold_seconds", bounds, st.LockHolds[:])
+
+	if st.ClassBuckets != nil {
+		classes := make([]string, 0, len(st.ClassBuckets))
+		for c := range st.ClassBuckets {
+			classes = append(classes, c)
+		}
+		sort.Strings(classes)
+		m.header("ipratelimit_class_buckets", "gauge", "Current number of buckets by class.")
+		for _, c := range classes {
+			m.value("ipratelimit_class_buckets", `class="`+labelEscaper.Replace(c)+`"`, float64(st.ClassBuckets[c]))
+		}
+	}
+	m.header("ipratelimit_misconfiguration", "gauge", "Whether IPFunc looks misconfigured, by symptom.")
+	m.value("ipratelimit_misconfiguration", `symptom="key_concentration"`, boolValue(st.KeyConcentrationWarning))
+	m.value("ipratelimit_misconfiguration", `symptom="nil_ip"`, boolValue(st.NilIPWarning))
+	if len(st.RuleHits) != 0 {
+		m.header("ipratelimit_rule_hits_total", "counter", "Requests matched by policy and exempt entries.")
+		for _, rh := range st.RuleHits {
+			m.value("ipratelimit_rule_hits_total", `list="`+rh.List+`",rule="`+rh.Rule+`"`, float64(rh.Hits))
+		}
+	}
+	m.header("ipratelimit_policy_info", "gauge", "Version and hash of the current policy.")
+	m.value("ipratelimit_policy_info", `version="`+labelEscaper.Replace(st.PolicyVersion)+`",hash="`+st.PolicyHash+`"`, 1)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricsWriter writes metrics in Prometheus text exposition format
+type metricsWriter struct {
+	w    io.Writer
+	name string // escaped limiter name
+}
+
+func (m *metricsWriter) header(metric, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", metric, help, metric, typ)
+}
+
+// value writes a single sample, labels are comma-separated label pairs
+// added after the limiter label
+func (m *metricsWriter) value(metric, labels string, v float64) {
+	if labels != "" {
+		labels = "," + labels
+	}
+	fmt.Fprintf(m.w, "%s{limiter=\"%s\"%s} %s\n", metric, m.name, labels,
+		strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// histogram writes cumulative buckets of counts, which has one more element
+// than bounds for values above the last bound
+func (m *metricsWriter) histogram(metric string, bounds []float64, counts []uint64) {
+	var total uint64
+	for i, b := range bounds {
+		total += counts[i]
+		m.value(metric+"_bucket", `le="`+strconv.FormatFloat(b, 'g', -1, 64)+`"`, float64(total))
+	}
+	total += counts[len(bounds)]
+	m.value(metric+"_bucket", `le="+Inf"`, float64(total))
+	m.value(metric+"_count", "", float64(total))
+}
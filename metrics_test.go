@@ -0,0 +1,94 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxBuckets:  100,
+		TrackStats:  true,
+		Instrument:  true,
+		Name:        `api "v1"`,
+		Policy:      Policy{Version: "p1"},
+	}).(*limiter)
+	ip := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 3; i++ {
+		lh.Allow(ip)
+	}
+	lh.Ban(net.IPv4(192, 0, 2, 2), time.Minute)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "[::]:1234"
+	lh.ServeHTTP(httptest.NewRecorder(), req)
+
+	scrape := func() (string, map[string]string) {
+		rec := httptest.NewRecorder()
+		lh.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != MetricsContentType {
+			t.Fatalf("got Content-Type %q", ct)
+		}
+		samples := make(map[string]string)
+		typed := make(map[string]bool)
+		sc := bufio.NewScanner(strings.NewReader(rec.Body.String()))
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.HasPrefix(line, "# TYPE ") {
+				typed[strings.Fields(line)[2]] = true
+				continue
+			}
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			i := strings.LastIndexByte(line, ' ')
+			if i < 0 {
+				t.Fatalf("malformed line %q", line)
+			}
+			series, value := line[:i], line[i+1:]
+			if !strings.Contains(series, `{limiter="api \"v1\""`) {
+				t.Fatalf("no limiter label in %q", line)
+			}
+			name := series[:strings.IndexByte(series, '{')]
+			base := strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_count")
+			if !typed[name] && !typed[base] {
+				t.Fatalf("no TYPE line before %q", line)
+			}
+			samples[series] = value
+		}
+		return rec.Body.String(), samples
+	}
+	body, samples := scrape()
+	for series, want := range map[string]string{
+		`ipratelimit_buckets{limiter="api \"v1\""}`:                                                 "1",
+		`ipratelimit_max_buckets{limiter="api \"v1\""}`:                                             "100",
+		`ipratelimit_bans{limiter="api \"v1\""}`:                                                    "1",
+		`ipratelimit_bypassed_total{limiter="api \"v1\"",reason="nil_ip"}`:                          "1",
+		`ipratelimit_overhead_seconds_count{limiter="api \"v1\""}`:                                  "1",
+		`ipratelimit_overhead_seconds_bucket{limiter="api \"v1\"",le="+Inf"}`:                       "1",
+		`ipratelimit_ipfunc_duration_seconds_bucket{limiter="api \"v1\"",le="1e-06"}`:               "",
+		`ipratelimit_denial_streaks_count{limiter="api \"v1\""}`:                                    "0",
+		`ipratelimit_policy_info{limiter="api \"v1\"",version="p1",hash="` + lh.PolicyHash() + `"}`: "1",
+		`ipratelimit_limiter_timeouts_total{limiter="api \"v1\""}`:                                  "0",
+		`ipratelimit_ipfunc_duration_seconds_bucket{limiter="api \"v1\"",le="+Inf"}`:                "1",
+		`ipratelimit_new_key_alert{limiter="api \"v1\""}`:                                           "0",
+	} {
+		got, ok := samples[series]
+		if !ok {
+			t.Errorf("no %s in:\n%s", series, body)
+			continue
+		}
+		if want != "" && got != want {
+			t.Errorf("%s: got %s, want %s", series, got, want)
+		}
+	}
+	if again, _ := scrape(); again != body {
+		t.Fatal("output is not deterministic")
+	}
+}
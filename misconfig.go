@@ -0,0 +1,111 @@
+package ipratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// misconfigMinRequests is the minimum number of requests over the window
+// for misconfiguration detection to make a judgement
+const misconfigMinRequests = 100
+
+// misconfigWindow is the window misconfiguration detection works over
+const misconfigWindow = time.Minute
+
+// misconfigDetector looks for signs of a misconfigured IPFunc in fixed
+// windows of traffic: share of requests without address, and share of
+// requests from a single address. The latter is approximated: the most
+// frequent address of the window is found with Boyer-Moore majority vote,
+// and the requests from it are counted exactly over the next window, so
+// detection lags by a window, but never overestimates.
+type misconfigDetector struct {
+	nilThreshold float64 // Config.NilIPWarnFraction, 0 if disabled
+	keyThreshold float64 // Config.KeyConcentrationWarnFraction, 0 if disabled
+
+	mu        sync.Mutex
+	start     int64  // start of the current window as nanoseconds since Unix epoch
+	total     uint64 // requests in the current window
+	nilIP     uint64 // requests without address in the current window
+	candidate uint64 // majority vote candidate key of the current window
+	candIP    net.IP // address of candidate
+	votes     int
+	top       uint64 // candidate key of the previous window
+	topIP     net.IP // address of top, nil if there's no candidate
+	topHits   uint64 // requests from top in the current window
+
+	nilWarning bool // whether share of requests without address is over the threshold
+	keyWarning bool // whether share of requests from top is over the threshold
+}
+
+// observe records the evaluated request
+func (h *limiter) observe(e *evaluation) {
+	m := h.misconfig
+	now := h.now().UnixNano()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now-m.start >= int64(misconfigWindow) {
+		if m.start != 0 {
+			h.judge(m)
+		}
+		m.start = now
+	}
+	m.total++
+	if e.ip == nil {
+		if len(e.opaque) == 0 {
+			m.nilIP++
+		}
+		return // key concentration is only tracked for addresses
+	}
+	if e.key == 0 {
+		return // unspecified address
+	}
+	if m.topIP != nil && e.key == m.top {
+		m.topHits++
+	}
+	switch {
+	case m.votes == 0:
+		m.candidate, m.candIP, m.votes = e.key, e.ip, 1
+		if h.anonymize {
+			m.candIP = e.net
+		}
+	case e.key == m.candidate:
+		m.votes++
+	default:
+		m.votes--
+	}
+}
+
+// judge updates warnings at the end of a window and starts a new one, must
+// be called with m.mu held
+func (h *limiter) judge(m *misconfigDetector) {
+	if m.total >= misconfigMinRequests {
+		share := float64(m.nilIP) / float64(m.total)
+		m.nilWarning = m.nilThreshold > 0 && share > m.nilThreshold
+		if m.nilWarning {
+			h.log.Printf("WARNING: %.0f%% of requests have no client address, all of them bypass rate limiting; "+
+				"check Config.IPFunc, e.g. whether the header it reads is set by a proxy", share*100)
+		}
+		share = float64(m.topHits) / float64(m.total)
+		m.keyWarning = m.keyThreshold > 0 && m.topIP != nil && share > m.keyThreshold
+		if m.keyWarning {
+			h.log.Printf("WARNING: %.0f%% of requests come from %s and share its bucket; "+
+				"check Config.IPFunc, e.g. whether it's the address of a proxy", share*100, h.formatClient(m.topIP))
+		}
+	}
+	m.top, m.topIP, m.topHits = m.candidate, nil, 0
+	if m.votes > 0 {
+		m.topIP = m.candIP
+	}
+	m.total, m.nilIP, m.votes, m.candIP = 0, 0, 0, nil
+}
+
+// warnings returns current warning flags
+func (m *misconfigDetector) warnings() (nilIP, key bool) {
+	if m == nil {
+		return false, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nilWarning, m.keyWarning
+}
@@ -0,0 +1,86 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMisconfigDetection(t *testing.T) {
+	type request struct{ remoteAddr, xff string }
+	for _, tc := range []struct {
+		name    string
+		ipfunc  IPFunc
+		traffic func(i int) request
+		wantNil bool
+		wantKey bool
+	}{
+		{"xff without proxy", IPFromXForwardedFor,
+			func(i int) request { return request{fmt.Sprintf("192.0.2.%d:1234", i%200), ""} },
+			true, false},
+		{"remote address behind proxy", IPFromRemoteAddr,
+			func(i int) request { return request{"10.0.0.1:1234", fmt.Sprintf("192.0.2.%d", i%200)} },
+			false, true},
+		{"xff behind proxy", IPFromXForwardedFor,
+			func(i int) request {
+				r := request{"10.0.0.1:1234", fmt.Sprintf("192.0.2.%d", i%200)}
+				if i%20 == 0 {
+					r.xff = "" // some requests bypass the proxy
+				}
+				return r
+			},
+			false, false},
+		{"heavy client", IPFromRemoteAddr,
+			func(i int) request {
+				if i%3 == 0 {
+					return request{"198.51.100.1:1234", ""}
+				}
+				return request{fmt.Sprintf("192.0.2.%d:1234", i%200), ""}
+			},
+			false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+				IPFunc:                       tc.ipfunc,
+				Logger:                       log.New(&buf, "", 0),
+				NilIPWarnFraction:            0.5,
+				KeyConcentrationWarnFraction: 0.5,
+			}).(*limiter)
+			now := time.Unix(1700000000, 0)
+			lh.now = func() time.Time { return now }
+			for window := 0; window < 3; window++ {
+				for i := 0; i < 1000; i++ {
+					r := tc.traffic(i)
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.RemoteAddr = r.remoteAddr
+					if r.xff != "" {
+						req.Header.Set("X-Forwarded-For", r.xff)
+					}
+					lh.ServeHTTP(httptest.NewRecorder(), req)
+				}
+				now = now.Add(misconfigWindow)
+			}
+			lh.Allow(nil) // close the last window
+			st := lh.Stats()
+			if st.NilIPWarning != tc.wantNil || st.KeyConcentrationWarning != tc.wantKey {
+				t.Fatalf("got warnings nil IP %v, key concentration %v; want %v, %v",
+					st.NilIPWarning, st.KeyConcentrationWarning, tc.wantNil, tc.wantKey)
+			}
+			if got, want := strings.Count(buf.String(), "WARNING"), 0; !tc.wantNil && !tc.wantKey && got != want {
+				t.Fatalf("got %d warnings logged:\n%s", got, buf.String())
+			}
+			if tc.wantKey && !strings.Contains(buf.String(), "come from 10.0.0.1") {
+				t.Fatalf("no key concentration warning logged:\n%s", buf.String())
+			}
+			if tc.wantNil && strings.Count(buf.String(), "no client address") != 3 {
+				t.Fatalf("want nil address warning once per window:\n%s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// netSet is a list of networks with lookup time logarithmic in their
+// number: networks are converted to sorted disjoint address ranges, kept
+// separately for IPv4 and IPv6, so that IPv6 networks never contain IPv4
+// addresses, matching net.IPNet.Contains. Where networks overlap, the range
+// is attributed to the one listed first, which gets the hit on lookup.
+// Zero value is an empty set.
+type netSet struct {
+	nets  []*net.IPNet    // networks as listed, in normalized form
+	spans []ipRange       // whole range of each of nets
+	live  []bool          // whether any range is attributed to each of nets
+	hits  []atomic.Uint64 // lookups matched by each of nets
+	v4    []ipRange       // sorted disjoint ranges attributed to nets
+	v6    []ipRange
+}
+
+// ipRange is an inclusive range of addresses in 16-byte form
+type ipRange struct {
+	lo, hi [net.IPv6len]byte
+	rule   int // index of the network the range is attributed to
+}
+
+// newNetSet returns set of the given networks, which must be in the form
+// returned by normalizeNet
+func newNetSet(nets []*net.IPNet) netSet {
+	s := netSet{
+		nets:  nets,
+		spans: make([]ipRange, len(nets)),
+		live:  make([]bool, len(nets)),
+		hits:  make([]atomic.Uint64, len(nets)),
+	}
+	for i, n := range nets {
+		r := ipRange{rule: i}
+		ip := n.IP.To16()
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for j := range r.lo {
+			r.lo[j] = ip[j] & mask[j]
+			r.hi[j] = ip[j] | ^mask[j]
+		}
+		s.spans[i] = r
+		rs := &s.v6
+		if len(n.IP) == net.IPv4len {
+			rs = &s.v4
+		}
+		rest := subtractRanges(r, *rs)
+		if len(rest) == 0 {
+			continue
+		}
+		s.live[i] = true
+		*rs = append(*rs, rest...)
+		sort.Slice(*rs, func(i, j int) bool { return bytes.Compare((*rs)[i].lo[:], (*rs)[j].lo[:]) < 0 })
+	}
+	return s
+}
+
+// subtractRanges returns parts of r not covered by sorted disjoint ranges
+func subtractRanges(r ipRange, covered []ipRange) []ipRange {
+	var out []ipRange
+	cur := r.lo
+	for _, c := range covered {
+		if bytes.Compare(c.hi[:], cur[:]) < 0 {
+			continue
+		}
+		if bytes.Compare(c.lo[:], r.hi[:]) > 0 {
+			break
+		}
+		if bytes.Compare(c.lo[:], cur[:]) > 0 {
+			out = append(out, ipRange{lo: cur, hi: addrAdd(c.lo, -1), rule: r.rule})
+		}
+		if bytes.Compare(c.hi[:], r.hi[:]) >= 0 {
+			return out
+		}
+		cur = addrAdd(c.hi, 1)
+	}
+	return append(out, ipRange{lo: cur, hi: r.hi, rule: r.rule})
+}
+
+// addrAdd returns a incremented by delta, which must be 1 or -1; result
+// wraps around on overflow
+func addrAdd(a [net.IPv6len]byte, delta int) [net.IPv6len]byte {
+	for i := len(a) - 1; i >= 0; i-- {
+		old := a[i]
+		a[i] += byte(delta)
+		if (delta > 0 && a[i] > old) || (delta < 0 && a[i] < old) {
+			break
+		}
+	}
+	return a
+}
+
+// lookup returns index of the network ip is attributed to, -1 if ip
+// doesn't belong to any network of the set
+func (s *netSet) lookup(ip net.IP) int {
+	rs := s.v6
+	if ip.To4() != nil {
+		rs = s.v4
+	}
+	if len(rs) == 0 {
+		return -1
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return -1
+	}
+	i := sort.Search(len(rs), func(i int) bool { return bytes.Compare(rs[i].hi[:], ip) >= 0 })
+	if i < len(rs) && bytes.Compare(rs[i].lo[:], ip) <= 0 {
+		return rs[i].rule
+	}
+	return -1
+}
+
+// contains reports whether ip belongs to any of the networks of the set
+func (s *netSet) contains(ip net.IP) bool { return s.lookup(ip) >= 0 }
+
+// equal reports whether s and o hold the same networks in the same order
+func (s *netSet) equal(o *netSet) bool {
+	if len(s.nets) != len(o.nets) {
+		return false
+	}
+	for i, n := range s.nets {
+		if !n.IP.Equal(o.nets[i].IP) || !bytes.Equal(n.Mask, o.nets[i].Mask) {
+			return false
+		}
+	}
+	return true
+}
+
+// hit is like contains, but also counts the hit of the matched network
+func (s *netSet) hit(ip net.IP) bool {
+	i := s.lookup(ip)
+	if i < 0 {
+		return false
+	}
+	s.hits[i].Add(1)
+	return true
+}
+
+// covers reports whether the whole range of the i-th network of o is
+// within networks of s
+func (s *netSet) covers(o *netSet, i int) bool {
+	rs := s.v6
+	if len(o.nets[i].IP) == net.IPv4len {
+		rs = s.v4
+	}
+	return len(subtractRanges(o.spans[i], rs)) == 0
+}
+
+// shadowed returns descriptions of networks which never match because
+// networks listed before them cover their whole range
+func (s *netSet) shadowed(list string) []string {
+	var out []string
+	for i, n := range s.nets {
+		if s.live[i] {
+			continue
+		}
+		by := "earlier entries"
+		for j, m := range s.nets[:i] {
+			if len(m.IP) == len(n.IP) &&
+				bytes.Compare(s.spans[j].lo[:], s.spans[i].lo[:]) <= 0 &&
+				bytes.Compare(s.spans[j].hi[:], s.spans[i].hi[:]) >= 0 {
+				by = "earlier entry " + m.String()
+				break
+			}
+		}
+		out = append(out, fmt.Sprintf("%s entry %s never matches: shadowed by %s", list, n, by))
+	}
+	return out
+}
+
+// ruleHits appends hit counts of networks of the set to dst
+func (s *netSet) ruleHits(dst []RuleHits, list string) []RuleHits {
+	for i, n := range s.nets {
+		dst = append(dst, RuleHits{List: list, Rule: n.String(), Hits: s.hits[i].Load()})
+	}
+	return dst
+}
+
+// normalizeNet returns a copy of n with IPv4 networks, including
+// IPv4-mapped IPv6 ones, converted to 4-byte form, nil if n is not a valid
+// network
+func normalizeNet(n *net.IPNet) *net.IPNet {
+	if n == nil {
+		return nil
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 0 {
+		return nil
+	}
+	if v4 := n.IP.To4(); v4 != nil {
+		if bits == 8*net.IPv6len {
+			if ones < 96 {
+				return nil
+			}
+			ones -= 96
+		}
+		return &net.IPNet{IP: v4.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}
+	}
+	ip := n.IP.To16()
+	if ip == nil || bits != 8*net.IPv6len {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(n.Mask), Mask: net.CIDRMask(ones, bits)}
+}
@@ -0,0 +1,134 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNetSet(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randIP := func(v4 bool) net.IP {
+		if v4 {
+			// narrow space, so that networks overlap and
+			// addresses hit them
+			return net.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256))).To4()
+		}
+		ip := make(net.IP, net.IPv6len)
+		ip[0], ip[1], ip[2] = 0x20, 0x01, byte(rnd.Intn(4))
+		rnd.Read(ip[3:])
+		return ip
+	}
+	for i := 0; i < 100; i++ {
+		var list []string
+		for n := rnd.Intn(300); n > 0; n-- {
+			if rnd.Intn(2) == 0 {
+				list = append(list, fmt.Sprintf("%s/%d", randIP(true), 14+rnd.Intn(19)))
+			} else {
+				list = append(list, fmt.Sprintf("%s/%d", randIP(false), 14+rnd.Intn(115)))
+			}
+		}
+		nets, err := parseNets(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := newNetSet(nets)
+		for j := 0; j < 1000; j++ {
+			ip := randIP(j%2 == 0)
+			want := false
+			for _, n := range nets {
+				if n.Contains(ip) {
+					want = true
+					break
+				}
+			}
+			if got := set.contains(ip); got != want {
+				t.Fatalf("set of %v: contains(%v) = %v, want %v", list, ip, got, want)
+			}
+		}
+	}
+
+	nets, err := parseNets([]string{"::/0", "192.0.2.0/24", "::ffff:198.51.100.0/120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newNetSet(nets)
+	for ip, want := range map[string]bool{
+		"2001:db8::1":        true,
+		"192.0.2.1":          true,
+		"::ffff:192.0.2.1":   true,
+		"198.51.100.7":       true,
+		"203.0.113.1":        false, // IPv6 networks never contain IPv4 addresses
+		"::ffff:203.0.113.1": false,
+	} {
+		if got := set.contains(net.ParseIP(ip)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	var empty netSet
+	if empty.contains(net.IPv4(192, 0, 2, 1)) {
+		t.Error("empty set contains an address")
+	}
+}
+
+func TestExempt(t *testing.T) {
+	var exempt []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "192.0.2.0/24", "198.51.100.0/24", "2001:db8:1::/48"} {
+		_, n, _ := net.ParseCIDR(s)
+		exempt = append(exempt, n)
+	}
+	// plenty of unrelated networks, so lookup is not trivial
+	for i := 0; i < 500; i++ {
+		exempt = append(exempt, &net.IPNet{IP: net.IPv4(172, 16, byte(i>>8), byte(i)), Mask: net.CIDRMask(32, 32)})
+	}
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc:      IPFromXForwardedFor,
+		Exempt:      exempt,
+		Policy:      Policy{Denylist: []string{"192.0.2.66"}},
+	}).(*limiter)
+	serve := func(addr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	exempted := []string{"10.1.2.3", "192.0.2.1", "::ffff:198.51.100.1", "2001:db8:1::1", "172.16.1.2"}
+	for i := 0; i < 1000; i++ {
+		for _, addr := range exempted {
+			if code := serve(addr); code != http.StatusOK {
+				t.Fatalf("request %d from exempt %s: got status %d", i, addr, code)
+			}
+		}
+	}
+	if n, _ := lh.buckets(); n != 0 {
+		t.Fatalf("exempt requests created %d buckets", n)
+	}
+	st := lh.Stats()
+	if want := uint64(1000 * len(exempted)); st.BypassedExempt != want {
+		t.Fatalf("got BypassedExempt %d, want %d", st.BypassedExempt, want)
+	}
+
+	if code := serve("192.0.2.66"); code != http.StatusForbidden {
+		t.Fatalf("denylisted exempt address: got status %d", code)
+	}
+	serve("203.0.113.1")
+	if code := serve("203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("address outside exempt networks: got status %d", code)
+	}
+	now := time.Now()
+	lh.now = func() time.Time { return now }
+	if !lh.Next(net.ParseIP("10.9.9.9"), 100).Equal(now) {
+		t.Fatal("Next doesn't account for exempt networks")
+	}
+
+	if err := (&Config{Exempt: []*net.IPNet{nil}}).Validate(); err == nil {
+		t.Fatal("nil Exempt network is valid")
+	}
+}
@@ -0,0 +1,89 @@
+package ipratelimit
+
+import "time"
+
+// maxOverflowKeys is the maximum number of keys remembered while new keys
+// are accounted in the overflow bucket, see limiter.overflowKeys
+const maxOverflowKeys = 1 << 16
+
+// trackNewKey records arrival of a key without a bucket and updates alert
+// state. It reports whether alert has just been raised along with the
+// current rate of new keys per minute. Must be called with h.m held.
+//
+// While Config.NewKeyAlertOverflow keeps new keys from getting buckets,
+// they are remembered, so that repeated requests of the same client are
+// not counted as new keys again and can't keep the alert raised alone.
+func (h *limiter) trackNewKey(key uint64, now time.Time) (raised bool, rate float64) {
+	if _, ok := h.overflowKeys[key]; !ok {
+		h.newKeys.add(now)
+	}
+	rate = h.newKeys.rate(now)
+	switch {
+	case !h.alerting && rate > float64(h.alertRate):
+		h.alerting, raised = true, true
+	case h.alerting && rate <= float64(h.alertRate):
+		h.lowerAlert()
+	}
+	if h.alerting && h.alertOverflow {
+		if len(h.overflowKeys) >= maxOverflowKeys {
+			clear(h.overflowKeys)
+		}
+		if h.overflowKeys == nil {
+			h.overflowKeys = make(map[uint64]struct{})
+		}
+		h.overflowKeys[key] = struct{}{}
+	}
+	return raised, rate
+}
+
+// lowerAlert clears alert state, must be called with h.m held
+func (h *limiter) lowerAlert() {
+	h.alerting = false
+	clear(h.overflowKeys)
+}
+
+// slidingCounter approximates number of events over the last minute by
+// weighting the count of the previous fixed one-minute window with the part
+// of it still covered by the sliding window.
+type slidingCounter struct {
+	start int64 // start of the current window as nanoseconds since Unix epoch
+	cur   int   // events in the current window
+	prev  int   // events in the previous window
+}
+
+const slidingWindow = int64(time.Minute)
+
+func (c *slidingCounter) advance(now time.Time) {
+	ts := now.UnixNano()
+	if c.start == 0 {
+		c.start = ts
+		return
+	}
+	elapsed := ts - c.start
+	if elapsed < slidingWindow {
+		return
+	}
+	if elapsed < 2*slidingWindow {
+		c.prev = c.cur
+	} else {
+		c.prev = 0
+	}
+	c.cur = 0
+	c.start = ts - elapsed%slidingWindow
+}
+
+func (c *slidingCounter) add(now time.Time) {
+	c.advance(now)
+	c.cur++
+}
+
+// rate returns estimated number of events over the last minute
+func (c *slidingCounter) rate(now time.Time) float64 {
+	c.advance(now)
+	elapsed := now.UnixNano() - c.start
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	weight := 1 - float64(elapsed)/float64(slidingWindow)
+	return float64(c.prev)*weight + float64(c.cur)
+}
@@ -0,0 +1,124 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewKeyAlert(t *testing.T) {
+	for _, overflow := range []bool{false, true} {
+		var alerts []float64
+		cfg := &Config{
+			RefillEvery:         time.Hour,
+			Burst:               2,
+			IPFunc:              IPFromXForwardedFor,
+			NewKeyAlertRate:     10,
+			NewKeyAlertFunc:     func(rate float64) { alerts = append(alerts, rate) },
+			NewKeyAlertOverflow: overflow,
+		}
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg).(*limiter)
+		now := time.Unix(1000, 0)
+		lh.now = func() time.Time { return now }
+		var allowed int
+		for i := 0; i < 20; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Forwarded-For", net.IPv4(10, 0, 0, byte(i)).String())
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			if w.Code == http.StatusOK {
+				allowed++
+			}
+		}
+		if len(alerts) != 1 {
+			t.Fatalf("overflow=%v: got %d alerts, want 1", overflow, len(alerts))
+		}
+		if alerts[0] != 11 {
+			t.Errorf("overflow=%v: alert rate %v, want 11", overflow, alerts[0])
+		}
+		st := lh.Stats()
+		if !st.NewKeyAlert || st.NewKeyRate != 20 {
+			t.Errorf("overflow=%v: unexpected stats: %+v", overflow, st)
+		}
+		wantBuckets, wantAllowed := 20, 20
+		if overflow {
+			// 10 keys got own buckets, the rest shared one bucket of 2 tokens
+			wantBuckets, wantAllowed = 10, 12
+		}
+		if n, _ := lh.buckets(); n != wantBuckets {
+			t.Errorf("overflow=%v: %d buckets, want %d", overflow, n, wantBuckets)
+		}
+		if allowed != wantAllowed {
+			t.Errorf("overflow=%v: %d requests allowed, want %d", overflow, allowed, wantAllowed)
+		}
+
+		// rate subsides: new keys get their own buckets again
+		now = now.Add(3 * time.Minute)
+		if st := lh.Stats(); st.NewKeyAlert || st.NewKeyRate != 0 {
+			t.Errorf("overflow=%v: unexpected stats after pause: %+v", overflow, st)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.1.1")
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("overflow=%v: new key after pause got status %d", overflow, w.Code)
+		}
+		if n, _ := lh.buckets(); n != wantBuckets+1 {
+			t.Errorf("overflow=%v: %d buckets after pause, want %d", overflow, n, wantBuckets+1)
+		}
+	}
+}
+
+// TestNewKeyAlertRepeats checks that repeated requests of a client kept
+// in the overflow bucket are not counted as new keys
+func TestNewKeyAlertRepeats(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:         time.Hour,
+		Burst:               2,
+		NewKeyAlertRate:     10,
+		NewKeyAlertOverflow: true,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	for i := 0; i < 11; i++ {
+		lh.Allow(net.IPv4(10, 0, 0, byte(i)))
+	}
+	if !lh.Stats().NewKeyAlert {
+		t.Fatal("alert not raised")
+	}
+	// a single client making a request every second for three minutes
+	// is a single new key
+	ip := net.IPv4(10, 0, 1, 1)
+	for i := 0; i < 180; i++ {
+		lh.Allow(ip)
+		now = now.Add(time.Second)
+	}
+	if st := lh.Stats(); st.NewKeyAlert {
+		t.Errorf("alert kept raised by a single client, rate %v", st.NewKeyRate)
+	}
+	if _, ok := lh.bucketOf(keyOf(ip.To4())); !ok {
+		t.Error("client got no bucket after alert was lowered")
+	}
+}
+
+func TestSlidingCounter(t *testing.T) {
+	var c slidingCounter
+	now := time.Unix(1000, 0)
+	for i := 0; i < 60; i++ {
+		c.add(now)
+	}
+	if r := c.rate(now); r != 60 {
+		t.Fatalf("rate: %v, want 60", r)
+	}
+	now = now.Add(time.Minute + time.Minute/2)
+	if r := c.rate(now); r != 30 {
+		t.Fatalf("rate after 1.5m: %v, want 30", r)
+	}
+	now = now.Add(time.Minute)
+	if r := c.rate(now); r != 0 {
+		t.Fatalf("rate after 2.5m: %v, want 0", r)
+	}
+}
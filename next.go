@@ -0,0 +1,106 @@
+package ipratelimit
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// nextAt returns the earliest time bucket holds cost tokens, assuming
+// nothing is taken from it meanwhile. Result is never before now.
+func (l *limits) nextAt(bkt bucket, cost float64, now time.Time) time.Time {
+	need := cost - bkt.left
+	if need <= 0 || bkt.mtime == 0 {
+		return now
+	}
+	// round up, so that refill computed by take at the returned time is
+	// not below need because of truncation
+	at := time.Unix(0, bkt.mtime).Add(durationOf(math.Ceil(need*l.refillEvery)) + 1)
+	if at.Before(now) {
+		return now
+	}
+	return at
+}
+
+// nextAllowed returns the earliest time a request of the same cost from the
+// same client would be allowed after e was evaluated at now, zero Time if it
+// would never be.
+func (h *limiter) nextAllowed(e *evaluation, now time.Time) time.Time {
+	switch {
+	case e.stage == StageDenylist:
+		return time.Time{}
+	case e.stage == StageBan:
+		return now.Add(e.d.banLeft)
+	case e.d.global:
+		// client bucket kept its tokens, retryWait is that of the global one
+		return now.Add(e.d.retryWait)
+	case e.bypass || e.d.remaining >= e.cost:
+		return now
+	case e.cost > e.lim.burst:
+		return time.Time{}
+	}
+	at := e.lim.nextAt(bucket{left: e.d.remaining, mtime: now.UnixNano()}, e.cost, now)
+	if retryAt := now.Add(e.d.retryWait); h.retryBackoff > 1 && retryAt.After(at) {
+		return retryAt
+	}
+	return at
+}
+
+// Next returns the earliest time a request from the given IP address taking
+// cost tokens would be allowed, without taking any tokens. It accounts for
+// policy, bans, the state of the address bucket and of the global one, see
+// Config.GlobalBurst. Zero Time is returned if such request would never be
+// allowed: address is denylisted or cost exceeds Burst or GlobalBurst. If Config.Store is
+// set, address bucket state is not available and is not accounted for.
+//
+// Handler returned by New implements interface{ Next(net.IP, int) time.Time }.
+func (h *limiter) Next(ip net.IP, cost int) time.Time {
+	now := h.now()
+	if ip = canonicalIP(ip); ip == nil {
+		return now
+	}
+	g := h.gen.Load()
+	p, def := g.policy, g.def
+	if h.limitsOf != nil {
+		if lim := h.addrLimits(ip, def); lim != nil {
+			def = lim
+		}
+	}
+	switch {
+	case p.deny.contains(ip):
+		return time.Time{}
+	case h.exempt.contains(ip), p.allow.contains(ip):
+		return now
+	case float64(cost) > def.burst:
+		return time.Time{}
+	}
+	masked := h.maskIP(ip)
+	at := now.Add(h.bans.left(h.banKey(ip), now))
+	if h.global != nil {
+		t := h.global.nextAt(float64(cost), now)
+		if t.IsZero() {
+			return t
+		}
+		if t.After(at) {
+			at = t
+		}
+	}
+	if h.store != nil {
+		return at
+	}
+	bkt, ok := h.bucketOfData(keyOf(masked), masked)
+	if !ok {
+		// bucket would be created with Config.InitialTokens
+		bkt = bucket{left: h.initialLeft(def), mtime: now.UnixNano()}
+	}
+	if t := def.nextAt(bkt, float64(cost), now); t.After(at) {
+		at = t
+	}
+	if t := time.Unix(0, bkt.retryAt); h.retryBackoff > 1 && bkt.retryAt != 0 && t.After(at) {
+		at = t
+	}
+	if t := time.Unix(0, bkt.bannedTo); bkt.bannedTo != 0 && t.After(at) {
+		at = t
+	}
+	return at
+}
@@ -0,0 +1,105 @@
+package ipratelimit
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		refill := time.Duration(1+rnd.Intn(5000)) * time.Millisecond / 3
+		burst := 1 + rnd.Intn(10)
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery: refill,
+			Burst:       burst,
+		}).(*limiter)
+		now := time.Unix(1700000000, 0)
+		lh.now = func() time.Time { return now }
+		ip := net.IPv4(192, 0, 2, 1)
+
+		// drain the bucket partially at random instants
+		for n := rnd.Intn(2 * burst); n > 0; n-- {
+			now = now.Add(time.Duration(rnd.Int63n(int64(refill))))
+			lh.Allow(ip)
+		}
+		cost := 1 + rnd.Intn(burst)
+		at := lh.Next(ip, cost)
+		if at.Before(now) {
+			t.Fatalf("Next %v is before now %v", at, now)
+		}
+		if at.After(now) {
+			// prediction holds as the clock approaches it
+			now = at.Add(-2 * time.Nanosecond)
+			if lh.Next(ip, cost) != at {
+				t.Fatalf("prediction changed as clock advanced")
+			}
+		}
+		now = at
+		for j := 0; j < cost; j++ {
+			if !lh.Allow(ip) {
+				t.Fatalf("iteration %d: token %d of %d denied at predicted %v (refill %v, burst %d)",
+					i, j+1, cost, at, refill, burst)
+			}
+		}
+		d, err := lh.AllowCtx(context.Background(), ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed {
+			if !d.NextAllowed.Equal(now) && d.Remaining >= 1 {
+				t.Fatalf("got NextAllowed %v with tokens left", d.NextAllowed)
+			}
+			continue
+		}
+		now = d.NextAllowed
+		if !lh.Allow(ip) {
+			t.Fatalf("denied at NextAllowed %v", d.NextAllowed)
+		}
+	}
+}
+
+func TestNextPolicyAndBans(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Second,
+		Burst:       2,
+		Policy: Policy{
+			Allowlist: []string{"192.0.2.0/24"},
+			Denylist:  []string{"198.51.100.1"},
+		},
+	}).(*limiter)
+	now := time.Unix(1700000000, 0)
+	lh.now = func() time.Time { return now }
+
+	if at := lh.Next(net.IPv4(198, 51, 100, 1), 1); !at.IsZero() {
+		t.Fatalf("denylisted address: got %v, want zero time", at)
+	}
+	if at := lh.Next(net.IPv4(192, 0, 2, 1), 100); !at.Equal(now) {
+		t.Fatalf("allowlisted address: got %v, want now", at)
+	}
+	ip := net.IPv4(203, 0, 113, 1)
+	if at := lh.Next(ip, 3); !at.IsZero() {
+		t.Fatalf("cost over burst: got %v, want zero time", at)
+	}
+	if at := lh.Next(ip, 2); !at.Equal(now) {
+		t.Fatalf("unseen address: got %v, want now", at)
+	}
+	if err := lh.Ban(ip, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if at := lh.Next(ip, 1); !at.Equal(now.Add(time.Minute)) {
+		t.Fatalf("banned address: got %v, want %v", at, now.Add(time.Minute))
+	}
+	d, _ := lh.AllowCtx(context.Background(), ip)
+	if d.Allowed || !d.NextAllowed.Equal(now.Add(time.Minute)) {
+		t.Fatalf("banned address: got %+v", d)
+	}
+	now = now.Add(time.Minute)
+	if !lh.Allow(ip) {
+		t.Fatal("denied once ban expired")
+	}
+}
@@ -0,0 +1,218 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// responseObserver wraps http.ResponseWriter of a request passed to the
+// handler, recording the response status, number of body bytes written and
+// whether the connection was hijacked. It's the only wrapper limiter puts
+// around the writer, created once per request and shared by all features
+// registered in limiter.observers.
+type responseObserver struct {
+	http.ResponseWriter
+	status   int   // final status written, 0 if none yet
+	written  int64 // body bytes written
+	hijacked bool  // whether connection was hijacked
+}
+
+// observeWriter returns writer wrapping w which implements the same
+// optional interfaces as w among http.Flusher, http.Hijacker,
+// io.ReaderFrom and http.Pusher, and the observer it reports to
+func observeWriter(w http.ResponseWriter) (http.ResponseWriter, *responseObserver) {
+	o := &responseObserver{ResponseWriter: w}
+	var set int
+	if _, ok := w.(http.Flusher); ok {
+		set |= 1
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		set |= 2
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		set |= 4
+	}
+	if _, ok := w.(http.Pusher); ok {
+		set |= 8
+	}
+	// ResponseWriter embedded as an interface only promotes its own
+	// methods, so each optional interface is added explicitly
+	switch set {
+	case 0:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+		}{o, o}, o
+	case 1:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+		}{o, o, o}, o
+	case 2:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Hijacker
+		}{o, o, o}, o
+	case 3:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			http.Hijacker
+		}{o, o, o, o}, o
+	case 4:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			io.ReaderFrom
+		}{o, o, o}, o
+	case 5:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			io.ReaderFrom
+		}{o, o, o, o}, o
+	case 6:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Hijacker
+			io.ReaderFrom
+		}{o, o, o, o}, o
+	case 7:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{o, o, o, o, o}, o
+	case 8:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Pusher
+		}{o, o, o}, o
+	case 9:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			http.Pusher
+		}{o, o, o, o}, o
+	case 10:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Hijacker
+			http.Pusher
+		}{o, o, o, o}, o
+	case 11:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{o, o, o, o, o}, o
+	case 12:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			io.ReaderFrom
+			http.Pusher
+		}{o, o, o, o}, o
+	case 13:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{o, o, o, o, o}, o
+	case 14:
+		return struct {
+			http.ResponseWriter
+			rwUnwrapper
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{o, o, o, o, o}, o
+	}
+	return struct {
+		http.ResponseWriter
+		rwUnwrapper
+		http.Flusher
+		http.Hijacker
+		io.ReaderFrom
+		http.Pusher
+	}{o, o, o, o, o, o}, o
+}
+
+// rwUnwrapper is implemented by writers wrapping another one, see
+// http.ResponseController
+type rwUnwrapper interface{ Unwrap() http.ResponseWriter }
+
+// Status returns status of the response, http.StatusOK if the handler
+// didn't write it explicitly, 0 if the connection was hijacked before any
+// status was written
+func (o *responseObserver) Status() int {
+	switch {
+	case o.status != 0:
+		return o.status
+	case o.hijacked:
+		return 0
+	}
+	return http.StatusOK
+}
+
+func (o *responseObserver) Unwrap() http.ResponseWriter { return o.ResponseWriter }
+
+func (o *responseObserver) WriteHeader(code int) {
+	if o.status == 0 && code >= 200 {
+		o.status = code
+	}
+	o.ResponseWriter.WriteHeader(code)
+}
+
+func (o *responseObserver) Write(b []byte) (int, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	n, err := o.ResponseWriter.Write(b)
+	o.written += int64(n)
+	return n, err
+}
+
+func (o *responseObserver) ReadFrom(r io.Reader) (int64, error) {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	n, err := o.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	o.written += n
+	return n, err
+}
+
+func (o *responseObserver) Flush() {
+	if o.status == 0 {
+		o.status = http.StatusOK
+	}
+	o.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (o *responseObserver) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := o.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		o.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (o *responseObserver) Push(target string, opts *http.PushOptions) error {
+	return o.ResponseWriter.(http.Pusher).Push(target, opts)
+}
@@ -0,0 +1,234 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeWriter implements all optional interfaces observeWriter preserves,
+// fakeWriterWith exposes their subsets
+type fakeWriter struct {
+	*httptest.ResponseRecorder
+	flushed, hijacked, pushed bool
+}
+
+func (w *fakeWriter) Flush() { w.flushed = true; w.ResponseRecorder.Flush() }
+
+func (w *fakeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func (w *fakeWriter) ReadFrom(r io.Reader) (int64, error) { return io.Copy(w.ResponseRecorder, r) }
+
+func (w *fakeWriter) Push(string, *http.PushOptions) error { w.pushed = true; return nil }
+
+// fakeWriterWith returns w exposing optional interfaces selected by set
+// bits: 1 for http.Flusher, 2 for http.Hijacker, 4 for io.ReaderFrom, 8 for
+// http.Pusher
+func fakeWriterWith(w *fakeWriter, set int) http.ResponseWriter {
+	switch set {
+	case 0:
+		return struct {
+			http.ResponseWriter
+		}{w}
+	case 1:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, w}
+	case 2:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, w}
+	case 3:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case 4:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{w, w}
+	case 5:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w}
+	case 6:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w}
+	case 7:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	case 8:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, w}
+	case 9:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	case 10:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	case 11:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	case 12:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w}
+	case 13:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	case 14:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	case 15:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w}
+	}
+	panic("invalid set")
+}
+
+func TestObserveWriter(t *testing.T) {
+	for set := 0; set < 16; set++ {
+		for _, enabled := range []bool{false, true} {
+			fake := &fakeWriter{ResponseRecorder: httptest.NewRecorder()}
+			under := fakeWriterWith(fake, set)
+			var got []*responseObserver
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !enabled && w != under {
+					t.Errorf("set %d: writer wrapped without observers", set)
+				}
+				_, fl := w.(http.Flusher)
+				_, hj := w.(http.Hijacker)
+				_, rf := w.(io.ReaderFrom)
+				_, pu := w.(http.Pusher)
+				if fl != (set&1 != 0) || hj != (set&2 != 0) || rf != (set&4 != 0) || pu != (set&8 != 0) {
+					t.Errorf("set %d, observed %v: got Flusher %v, Hijacker %v, ReaderFrom %v, Pusher %v",
+						set, enabled, fl, hj, rf, pu)
+				}
+				w.WriteHeader(http.StatusAccepted)
+				if fl {
+					w.(http.Flusher).Flush()
+				}
+				io.WriteString(w, "hello")
+				if rf {
+					w.(io.ReaderFrom).ReadFrom(io.LimitReader(zeros{}, 3))
+				}
+				if pu {
+					w.(http.Pusher).Push("/style.css", nil)
+				}
+				if hj {
+					w.(http.Hijacker).Hijack()
+				}
+			})
+			lh := New(handler, &Config{RefillEvery: time.Hour, Burst: 1}).(*limiter)
+			if enabled {
+				lh.observers = append(lh.observers, func(_ *evaluation, o *responseObserver) { got = append(got, o) })
+			}
+			lh.ServeHTTP(under, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if fake.flushed != (set&1 != 0) || fake.hijacked != (set&2 != 0) || fake.pushed != (set&8 != 0) {
+				t.Errorf("set %d, observed %v: calls not forwarded: %+v", set, enabled, fake)
+			}
+			wantBody := 5
+			if set&4 != 0 {
+				wantBody += 3
+			}
+			if fake.Code != http.StatusAccepted || fake.Body.Len() != wantBody {
+				t.Errorf("set %d, observed %v: got status %d, %d bytes", set, enabled, fake.Code, fake.Body.Len())
+			}
+			if !enabled {
+				continue
+			}
+			if len(got) != 1 {
+				t.Fatalf("set %d: observer called %d times", set, len(got))
+			}
+			o := got[0]
+			if o.Status() != http.StatusAccepted || o.written != int64(wantBody) || o.hijacked != (set&2 != 0) {
+				t.Errorf("set %d: observed status %d, %d bytes, hijacked %v", set, o.Status(), o.written, o.hijacked)
+			}
+		}
+	}
+}
+
+func TestObserveWriterStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		serve func(http.ResponseWriter)
+		want  int
+	}{
+		{"nothing written", func(http.ResponseWriter) {}, http.StatusOK},
+		{"implicit", func(w http.ResponseWriter) { io.WriteString(w, "x") }, http.StatusOK},
+		{"explicit", func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }, http.StatusInternalServerError},
+		{"informational first", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusEarlyHints)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, http.StatusServiceUnavailable},
+		{"second ignored", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK)
+		}, http.StatusNotFound},
+	} {
+		w, o := observeWriter(httptest.NewRecorder())
+		tc.serve(w)
+		if got := o.Status(); got != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	w, _ := observeWriter(httptest.NewRecorder())
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Errorf("ResponseController can't reach the wrapped writer: %v", err)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,29 @@
+package ipratelimit
+
+import "time"
+
+// defaultPenaltyDuration is the default of Config.PenaltyDuration
+const defaultPenaltyDuration = 10 * time.Minute
+
+// trackPenalty counts denials of bkt after decision d, imposing a penalty
+// ban once there are more than h.penaltyThreshold of them; while bkt is
+// banned, d.retryWait is the time left. Must be called with lock of the
+// bucket shard held.
+func (h *limiter) trackPenalty(bkt *bucket, d *decision, now time.Time) {
+	if d.allow {
+		bkt.bannedTo = 0 // ban has expired
+		return
+	}
+	if now.UnixNano() >= bkt.bannedTo {
+		bkt.bannedTo = 0
+		if bkt.denials = incSaturating(bkt.denials); int(bkt.denials) > h.penaltyThreshold {
+			bkt.denials = 0
+			bkt.bannedTo = now.Add(h.penaltyDuration).UnixNano()
+			h.counters.penalties.Add(1)
+		}
+	}
+	if bkt.bannedTo != 0 {
+		d.retryWait = time.Duration(bkt.bannedTo - now.UnixNano())
+		bkt.retryAt = bkt.bannedTo
+	}
+}
@@ -0,0 +1,108 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPenalty(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:      10 * time.Second,
+		Burst:            2,
+		IPFunc:           IPFromXForwardedFor,
+		PenaltyThreshold: 3,
+		PenaltyDuration:  time.Minute,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func(addr string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+
+	// compliant client is never penalized, however long it runs
+	for i := 0; i < 100; i++ {
+		if code, _ := serve("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("compliant client: request %d denied", i)
+		}
+		now = now.Add(10 * time.Second)
+	}
+	if n := lh.Counters().Penalties; n != 0 {
+		t.Fatalf("compliant client got %d penalties", n)
+	}
+
+	// flooding client is banned on the 4th denial
+	for i, want := range []string{"", "", "10", "10", "10", "60"} {
+		code, retryAfter := serve("192.0.2.2")
+		if retryAfter != want || (code == http.StatusOK) != (want == "") {
+			t.Fatalf("flood request %d: got %d, Retry-After %q, want %q", i, code, retryAfter, want)
+		}
+	}
+	if n := lh.Counters().Penalties; n != 1 {
+		t.Fatalf("got %d penalties, want 1", n)
+	}
+	// ban survives refill, and further denials don't extend it
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 5; i++ {
+		if code, retryAfter := serve("192.0.2.2"); code != http.StatusTooManyRequests || retryAfter != "30" {
+			t.Fatalf("banned request %d: got %d, Retry-After %q", i, code, retryAfter)
+		}
+	}
+	if at := lh.Next(net.ParseIP("192.0.2.2"), 1); !at.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Next doesn't account for the ban: %v", at.Sub(now))
+	}
+	// client recovers once the ban ends
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 2; i++ {
+		if code, _ := serve("192.0.2.2"); code != http.StatusOK {
+			t.Fatalf("request %d after ban: got %d", i, code)
+		}
+	}
+	if n := lh.Counters().Penalties; n != 1 {
+		t.Errorf("got %d penalties, want 1", n)
+	}
+	w := httptest.NewRecorder()
+	lh.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), `ipratelimit_penalties_total{limiter=""} 1`) {
+		t.Errorf("penalties missing from metrics:\n%s", w.Body)
+	}
+}
+
+// TestPenaltyForgiven checks that ForgiveAfter lifts a penalty ban of a
+// client that went quiet
+func TestPenaltyForgiven(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:      time.Hour,
+		Burst:            1,
+		PenaltyThreshold: 1,
+		PenaltyDuration:  time.Hour,
+		ForgiveAfter:     time.Minute,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	ip := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 3; i++ {
+		lh.Allow(ip)
+	}
+	if n := lh.Counters().Penalties; n != 1 {
+		t.Fatalf("got %d penalties, want 1", n)
+	}
+	now = now.Add(time.Minute - time.Second)
+	if lh.Allow(ip) {
+		t.Fatal("banned client allowed before ForgiveAfter")
+	}
+	now = now.Add(time.Minute)
+	if !lh.Allow(ip) {
+		t.Fatal("banned client not forgiven after ForgiveAfter")
+	}
+	if bkt, _ := lh.bucketOf(keyOf(ip.To4())); bkt.bannedTo != 0 || bkt.denials != 0 {
+		t.Errorf("got bucket %+v after forgiveness", bkt)
+	}
+}
@@ -0,0 +1,260 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Stage identifies a step of the request evaluation pipeline. Address is
+// extracted from the request once, then stages are evaluated in the order
+// listed below; the first stage making the final decision short-circuits the
+// rest of the pipeline:
+//
+//  1. StageAddress: requests without usable address are allowed and are not
+//     subject to any further processing, see canonicalIP. IPv4-mapped IPv6
+//     addresses are treated as IPv4. Likewise for requests without key if
+//     Config.KeyFunc is set; requests with a key skip address-based stages.
+//  2. StageServerName: if Config.KeyByServerName is set, bucket key and
+//     limits are selected by the TLS server name; with
+//     Config.RejectUnknownServerNames, requests to unknown server names are
+//     denied with "421 Misdirected Request" response.
+//  3. StageDenylist: requests from addresses in Policy.Denylist are denied
+//     with "403 Forbidden" response.
+//  4. StageExempt: requests from addresses in Config.Exempt are allowed and
+//     are not subject to any further processing.
+//  5. StageUserAgent: requests with User-Agent starting with one of
+//     Config.ExemptUserAgents are allowed and are not subject to any further
+//     processing.
+//  6. StageAllowlist: requests from addresses in Policy.Allowlist are allowed
+//     and are not subject to any further processing.
+//  7. StageBan: requests from addresses banned with Ban are denied with
+//     Retry-After reflecting the time left until the ban expires.
+//  8. StageLimit: per-address token bucket decides whether request is
+//     allowed.
+//
+// Numeric values of stages are stable and don't reflect the evaluation order.
+type Stage uint8
+
+const (
+	_               Stage = iota
+	StageAddress          // address validation
+	StageLimit            // per-address token bucket
+	StageDenylist         // Policy.Denylist
+	StageAllowlist        // Policy.Allowlist
+	StageBan              // bans set with Ban
+	StageServerName       // Config.KeyByServerName
+	StageUserAgent        // Config.ExemptUserAgents
+	StageExempt           // Config.Exempt
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageAddress:
+		return "address"
+	case StageLimit:
+		return "limit"
+	case StageDenylist:
+		return "denylist"
+	case StageAllowlist:
+		return "allowlist"
+	case StageBan:
+		return "ban"
+	case StageServerName:
+		return "server name"
+	case StageUserAgent:
+		return "user agent"
+	case StageExempt:
+		return "exempt"
+	}
+	return "Stage(" + strconv.Itoa(int(s)) + ")"
+}
+
+// evaluation holds the state of a single request passing the pipeline
+type evaluation struct {
+	ctx    context.Context
+	ip     net.IP   // address extracted from request
+	ipBuf  [16]byte // storage of ip, if extracted by Config.AddrFunc
+	d      decision // decision made by the pipeline
+	bypass bool     // request is not subject to limiting
+	err    error    // set if decision could not be made
+	stage  Stage    // stage that made the final decision
+	policy *policy  // policy in effect for this request
+	key    uint64   // bucket key, set by StageAddress
+	lim    *limits  // limits of the bucket, never nil during evaluation, see setLimits
+	sni    string   // normalized TLS server name, if KeyByServerName is set
+	class  uint8    // request class index, if class quotas are set
+	cost   float64  // tokens request takes, 1 if not set
+	free   bool     // request takes no tokens, see Config.Cost
+	ua     string   // User-Agent header, if ExemptUserAgents are set
+	net    net.IP   // ip masked for the bucket key, set by StageAddress
+	opaque []byte   // key returned by Config.KeyFunc, nil if keyed by ip
+	hash   string   // PolicyHash of the configuration in effect for this request
+
+	maxDelay time.Duration // how long request may wait for tokens, see Config.MaxWait
+
+	limSource     LimitSource     // source of lim
+	limCandidates limitCandidates // limits of all sources applicable to the request
+
+	observed bool // decision is not enforced, see Config.EnforcePercent
+}
+
+// pipeline lists stages in the order of evaluation. Each stage function
+// reports whether it made the final decision. New stages must be added here
+// and documented on the Stage type.
+var pipeline = [...]struct {
+	stage Stage
+	eval  func(*limiter, *evaluation) bool
+}{
+	{StageAddress, (*limiter).evalAddress},
+	{StageServerName, (*limiter).evalServerName},
+	{StageDenylist, (*limiter).evalDenylist},
+	{StageExempt, (*limiter).evalExempt},
+	{StageUserAgent, (*limiter).evalUserAgent},
+	{StageAllowlist, (*limiter).evalAllowlist},
+	{StageBan, (*limiter).evalBan},
+	{StageLimit, (*limiter).evalLimit},
+}
+
+// evaluate runs e through the pipeline. If no stage makes the final decision,
+// request is allowed.
+func (h *limiter) evaluate(e *evaluation) {
+	// load configuration once, so all stages see the same policy, and
+	// the whole decision and response are made with the same limits,
+	// even if they are replaced concurrently
+	g := h.gen.Load()
+	e.policy, e.hash = g.policy, g.hash
+	e.setLimits(SourceDefault, g.def)
+	defer h.counters.count(e)
+	if h.misconfig != nil {
+		defer h.observe(e)
+	}
+	if e.cost == 0 {
+		e.cost = 1
+	}
+	if h.maxTime > 0 {
+		parent := e.ctx
+		ctx, cancel := context.WithTimeout(parent, h.maxTime)
+		defer cancel()
+		e.ctx = ctx
+		defer func() {
+			e.ctx = parent
+			if e.err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+				h.counters.limiterTimeouts.Add(1)
+			}
+		}()
+	}
+	for _, st := range pipeline {
+		if st.eval(h, e) {
+			e.stage = st.stage
+			return
+		}
+	}
+	e.d.allow = true
+}
+
+func (h *limiter) evalAddress(e *evaluation) bool {
+	if e.opaque != nil {
+		return h.evalOpaqueKey(e)
+	}
+	ip := canonicalIP(e.ip)
+	if ip == nil {
+		h.trackBypass(bypassNilIP, e)
+		e.d.allow, e.bypass = true, true
+		return true
+	}
+	e.ip = ip
+	e.net = h.maskIP(ip)
+	e.key = keyOf(e.net)
+	e.observed = h.observed(e.key)
+	return false
+}
+
+// evalOpaqueKey is evalAddress for requests keyed by Config.KeyFunc
+func (h *limiter) evalOpaqueKey(e *evaluation) bool {
+	if len(e.opaque) == 0 {
+		h.trackBypass(bypassNilIP, e)
+		e.d.allow, e.bypass = true, true
+		return true
+	}
+	e.key = keyHash(e.opaque)
+	e.observed = h.observed(e.key)
+	return false
+}
+
+// keyBytes returns the data bucket key is the hash of: masked address or
+// opaque key
+func (e *evaluation) keyBytes() []byte {
+	if e.opaque != nil {
+		return e.opaque
+	}
+	return e.net
+}
+
+// canonicalIP returns the form of address used for bucket keys: 4-byte for
+// IPv4 addresses, so that 16-byte and IPv4-mapped IPv6 forms (as reported by
+// dual-stack listeners) of the same IPv4 address share the same bucket, and
+// 16-byte for IPv6 addresses. It returns nil for nil, malformed and
+// unspecified addresses ("0.0.0.0", "::"), which don't identify a client.
+// Other special addresses, like link-local or loopback ones, are limited as
+// any other address.
+func canonicalIP(ip net.IP) net.IP {
+	if ip.IsUnspecified() {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func (h *limiter) evalLimit(e *evaluation) bool {
+	if h.limitsOf != nil && e.opaque == nil {
+		if lim := h.addrLimits(e.ip, e.lim); lim != nil {
+			e.setLimits(SourceAddress, lim)
+		}
+	}
+	if e.free {
+		e.d.allow = true
+		return true
+	}
+	store := h.store != nil && !h.draining.Load()
+	if store {
+		e.d, e.err = h.takeStore(e.ctx, e)
+	} else {
+		e.d, e.err = h.decide(e.ctx, e)
+	}
+	// client buckets of the built-in storage check the global one
+	// themselves, see allow
+	if h.global != nil && e.err == nil && e.d.allow && (store || e.d.shared) {
+		h.takeGlobalShared(e)
+	}
+	return true
+}
+
+func (h *limiter) evalDenylist(e *evaluation) bool {
+	if e.policy.deny.hit(e.ip) {
+		e.d.allow = false
+		return true
+	}
+	return false
+}
+
+func (h *limiter) evalExempt(e *evaluation) bool {
+	if h.exempt.hit(e.ip) {
+		h.trackBypass(bypassExempt, e)
+		e.d.allow, e.bypass = true, true
+		return true
+	}
+	return false
+}
+
+func (h *limiter) evalAllowlist(e *evaluation) bool {
+	if e.policy.allow.hit(e.ip) {
+		h.trackBypass(bypassAllowlist, e)
+		e.d.allow, e.bypass = true, true
+		return true
+	}
+	return false
+}
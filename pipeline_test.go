@@ -0,0 +1,197 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name       string
+		xff        string
+		ctx        context.Context
+		exhausted  bool // bucket exhausted before the request
+		failClosed bool
+		wantStage  Stage
+		wantCode   int
+		wantHook   bool
+	}{
+		{name: "no address", wantStage: StageAddress, wantCode: http.StatusOK},
+		{name: "unspecified address", xff: "::", wantStage: StageAddress, wantCode: http.StatusOK},
+		{name: "ipv6", xff: "2001:db8::1", wantStage: StageLimit,
+			wantCode: http.StatusOK, wantHook: true},
+		{name: "no address, canceled", ctx: canceled, failClosed: true,
+			wantStage: StageAddress, wantCode: http.StatusOK},
+		{name: "allowed", xff: "192.0.2.1", wantStage: StageLimit,
+			wantCode: http.StatusOK, wantHook: true},
+		{name: "limited", xff: "192.0.2.1", exhausted: true, wantStage: StageLimit,
+			wantCode: http.StatusTooManyRequests, wantHook: true},
+		{name: "canceled, fail open", xff: "192.0.2.1", ctx: canceled,
+			wantStage: StageLimit, wantCode: http.StatusOK, wantHook: true},
+		// request is denied, but no response is written once the
+		// client is gone, see TestAbandonedDenial
+		{name: "canceled, fail closed", xff: "192.0.2.1", ctx: canceled, failClosed: true,
+			wantStage: StageLimit, wantCode: http.StatusOK, wantHook: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var events []TraceEvent
+			cfg := &Config{
+				RefillEvery: time.Hour,
+				Burst:       1,
+				IPFunc:      IPFromXForwardedFor,
+				FailClosed:  tc.failClosed,
+				TraceHook:   func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+			}
+			lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), cfg).(*limiter)
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.xff != "" {
+				req.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.exhausted {
+				lh.ServeHTTP(httptest.NewRecorder(), req)
+				events = nil
+			}
+			if tc.ctx != nil {
+				req = req.WithContext(tc.ctx)
+			}
+
+			// evaluate the same request on a separate limiter in
+			// the same state, so ServeHTTP check below is not
+			// affected by the consumed token
+			e := evaluation{ctx: req.Context(), ip: lh.extract(req)}
+			probe := New(http.NotFoundHandler(), cfg).(*limiter)
+			if tc.exhausted {
+				probe.Allow(e.ip)
+			}
+			probe.evaluate(&e)
+			if e.stage != tc.wantStage {
+				t.Errorf("got stage %v, want %v", e.stage, tc.wantStage)
+			}
+
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			if w.Code != tc.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantCode)
+			}
+			if (len(events) != 0) != tc.wantHook {
+				t.Fatalf("got %d trace events, want hook called: %v", len(events), tc.wantHook)
+			}
+			if tc.wantHook && events[0].Stage != tc.wantStage {
+				t.Errorf("trace event stage %v, want %v", events[0].Stage, tc.wantStage)
+			}
+		})
+	}
+}
+
+func TestStageString(t *testing.T) {
+	seen := make(map[Stage]bool)
+	for _, st := range pipeline {
+		if seen[st.stage] {
+			t.Errorf("stage %v is listed in pipeline more than once", st.stage)
+		}
+		seen[st.stage] = true
+		if s := st.stage.String(); s == "" || s[0] == 'S' {
+			t.Errorf("stage %d has no name: %q", st.stage, s)
+		}
+	}
+}
+
+func TestMappedIPv4SharesBucket(t *testing.T) {
+	handler := func(http.ResponseWriter, *http.Request) {}
+	lh := New(http.HandlerFunc(handler), &Config{RefillEvery: time.Hour, Burst: 4}).(*limiter)
+	for i, req := range []*http.Request{
+		// dual-stack listener
+		func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "[::ffff:203.0.113.9]:1234"
+			return r
+		}(),
+		// pure IPv4 listener
+		func() *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "203.0.113.9:1234"
+			return r
+		}(),
+	} {
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d", i, w.Code)
+		}
+	}
+	// forwarded header literal in both forms
+	for _, s := range []string{"203.0.113.9", "::ffff:203.0.113.9"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-For", s)
+		if !lh.Allow(IPFromXForwardedFor(r)) {
+			t.Fatalf("request with X-Forwarded-For %q denied", s)
+		}
+	}
+	if n, _ := lh.buckets(); n != 1 {
+		t.Fatalf("got %d buckets, want 1", n)
+	}
+	// 4-byte form must hit the same, now exhausted, bucket
+	if lh.Allow(net.IP{203, 0, 113, 9}) {
+		t.Fatal("request allowed on exhausted bucket")
+	}
+}
+
+func TestIPv6Buckets(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		Policy:      Policy{Denylist: []string{"2001:db8:bad::/48"}},
+	}).(*limiter)
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	clients := []string{
+		"192.0.2.1:1234",
+		"[2001:db8::1]:1234",
+		"[2001:db8::2]:1234",
+		"[fe80::1%eth0]:1234", // link-local addresses are limited too
+	}
+	for round, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		for _, addr := range clients {
+			if got := serve(addr); got != want {
+				t.Fatalf("round %d, %s: got status %d, want %d", round, addr, got, want)
+			}
+		}
+	}
+	// IPv4-mapped form shares the bucket of the IPv4 address
+	if got := serve("[::ffff:192.0.2.1]:1234"); got != http.StatusTooManyRequests {
+		t.Fatalf("IPv4-mapped address: got status %d", got)
+	}
+	if n, _ := lh.buckets(); n != len(clients) {
+		t.Fatalf("got %d buckets, want %d", n, len(clients))
+	}
+	if got := serve("[2001:db8:bad::1]:1234"); got != http.StatusForbidden {
+		t.Fatalf("denylisted IPv6 address: got status %d", got)
+	}
+	for _, addr := range []string{"[::]:1234", "0.0.0.0:1234"} {
+		for i := 0; i < 3; i++ {
+			if got := serve(addr); got != http.StatusOK {
+				t.Fatalf("unspecified address %s: got status %d", addr, got)
+			}
+		}
+	}
+	if err := lh.Ban(net.ParseIP("2001:db8::3"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve("[2001:db8::3]:1234"); got != http.StatusTooManyRequests {
+		t.Fatalf("banned IPv6 address: got status %d", got)
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
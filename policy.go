@@ -0,0 +1,193 @@
+package ipratelimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/artyom/logger"
+)
+
+// Policy holds address tables which can be replaced at runtime as a whole
+// with ApplyPolicy. Its fields are plain types, so it can be loaded from
+// JSON or a similar format.
+type Policy struct {
+	// Version is an optional label of the policy, it is logged when policy
+	// is applied and reported in Stats.PolicyVersion.
+	Version string `json:"version,omitempty"`
+
+	// Allowlist holds addresses or CIDR networks never rate limited
+	Allowlist []string `json:"allowlist,omitempty"`
+
+	// Denylist holds addresses or CIDR networks always denied with "403
+	// Forbidden" response; it takes precedence over Allowlist.
+	Denylist []string `json:"denylist,omitempty"`
+}
+
+// policy is the parsed form of Policy, it is immutable once created
+type policy struct {
+	version string
+	allow   netSet
+	deny    netSet
+}
+
+func parsePolicy(p Policy) (*policy, error) {
+	allow, err := parseNets(p.Allowlist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %w", err)
+	}
+	deny, err := parseNets(p.Denylist)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %w", err)
+	}
+	return &policy{version: p.Version, allow: newNetSet(allow), deny: newNetSet(deny)}, nil
+}
+
+// equal reports whether p and q are parsed from equivalent policies
+func (p *policy) equal(q *policy) bool {
+	return p.version == q.version && p.allow.equal(&q.allow) && p.deny.equal(&q.deny)
+}
+
+// parseNets parses list of IP addresses and CIDR networks, single addresses
+// are converted to networks of a single address. IPv4 networks, including
+// IPv4-mapped IPv6 ones, are converted to 4-byte form.
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			if n = normalizeNet(n); n == nil {
+				return nil, fmt.Errorf("%q is not a valid network", s)
+			}
+			out = append(out, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", s)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			out = append(out, &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)})
+			continue
+		}
+		out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+	}
+	return out, nil
+}
+
+// RuleHits is the number of requests matched by a single entry of
+// Policy.Allowlist, Policy.Denylist or Config.Exempt. Where entries
+// overlap, requests are counted by the first listed one.
+type RuleHits struct {
+	List string // "denylist", "exempt" or "allowlist"
+	Rule string // network in CIDR form
+	Hits uint64
+}
+
+// warnings returns descriptions of entries of p which never match: those
+// shadowed by entries listed before them in the same list, and allowlist
+// entries covered by denylist or exempt networks evaluated before it
+func (p *policy) warnings(exempt *netSet) []string {
+	out := append(p.deny.shadowed("denylist"), p.allow.shadowed("allowlist")...)
+	for i, n := range p.allow.nets {
+		switch {
+		case !p.allow.live[i]:
+		case p.deny.covers(&p.allow, i):
+			out = append(out, fmt.Sprintf("allowlist entry %s never matches: covered by denylist", n))
+		case exempt.covers(&p.allow, i):
+			out = append(out, fmt.Sprintf("allowlist entry %s never matches: covered by Config.Exempt", n))
+		}
+	}
+	return out
+}
+
+// ruleHits returns hit counts of entries of p and Config.Exempt in the
+// order of evaluation
+func (h *limiter) ruleHits(p *policy) []RuleHits {
+	return p.allow.ruleHits(h.exempt.ruleHits(p.deny.ruleHits(nil, "denylist"), "exempt"), "allowlist")
+}
+
+// logHits logs non-zero hit counts of entries of p
+func (p *policy) logHits(log logger.Interface) {
+	var b strings.Builder
+	var dead int
+	for _, rh := range p.allow.ruleHits(p.deny.ruleHits(nil, "denylist"), "allowlist") {
+		if rh.Hits == 0 {
+			dead++
+			continue
+		}
+		if b.Len() != 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s %s: %d", rh.List, rh.Rule, rh.Hits)
+	}
+	if b.Len() == 0 && dead == 0 {
+		return
+	}
+	log.Printf("policy %q rule hits: [%s], %d entries without hits", p.version, b.String(), dead)
+}
+
+// ApplyPolicy validates p and atomically replaces the current policy with
+// it: each request is evaluated either with the old or the new policy
+// entirely. If p is invalid, the current policy is kept and an error is
+// returned. PolicyHash is updated accordingly. Entries which can never
+// match are logged. Hit counts of entries, see Stats.RuleHits, start from
+// zero with the new policy; the previous ones are logged. If p is equal to
+// the current policy, which WatchPolicy usually finds, nothing is done.
+//
+// Handler returned by New implements interface{ ApplyPolicy(Policy) error }.
+func (h *limiter) ApplyPolicy(p Policy) error {
+	pp, err := parsePolicy(p)
+	if err != nil {
+		return fmt.Errorf("ipratelimit: %w", err)
+	}
+	if cur := h.gen.Load().policy; cur != nil && cur.equal(pp) {
+		return nil
+	}
+	var old *policy
+	g := h.publish(func(g *generation) { old, g.policy = g.policy, pp })
+	if old != nil {
+		old.logHits(h.log)
+		h.log.Printf("policy %q replaced with %q, policy hash %s", old.version, pp.version, g.hash)
+	}
+	for _, w := range pp.warnings(&h.exempt) {
+		h.log.Printf("policy %q: %s", pp.version, w)
+	}
+	return nil
+}
+
+// WatchPolicy calls load every given interval and applies the policy it
+// returns with ApplyPolicy; errors are logged and the current policy is kept.
+// It blocks until ctx is canceled, returning its error. Interval must be
+// positive, otherwise an error is returned right away.
+//
+// Handler returned by New implements interface{ WatchPolicy(context.Context,
+// func() (Policy, error), time.Duration) error }.
+func (h *limiter) WatchPolicy(ctx context.Context, load func() (Policy, error), every time.Duration) error {
+	if every <= 0 {
+		return fmt.Errorf("ipratelimit: non-positive policy watch interval %v", every)
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		p, err := load()
+		if err != nil {
+			h.log.Printf("policy load: %v", err)
+			continue
+		}
+		if err := h.ApplyPolicy(p); err != nil {
+			h.log.Printf("policy apply: %v", err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	handler := func(http.ResponseWriter, *http.Request) {}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc:      IPFromXForwardedFor,
+		Policy: Policy{
+			Version:   "v1",
+			Allowlist: []string{"10.0.0.0/8", "192.0.2.7"},
+			Denylist:  []string{"10.1.0.0/16", "198.51.100.1"},
+		},
+	}).(*limiter)
+	for _, tc := range []struct {
+		ip        string
+		wantCodes []int
+	}{
+		{"10.0.0.1", []int{200, 200, 200}},
+		{"192.0.2.7", []int{200, 200, 200}},
+		{"10.1.2.3", []int{403, 403}},        // denylist wins over allowlist
+		{"198.51.100.1", []int{403, 403}},    // single address
+		{"::ffff:10.0.0.2", []int{200, 200}}, // mapped address
+		{"192.0.2.8", []int{200, 429}},
+	} {
+		for i, want := range tc.wantCodes {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Forwarded-For", tc.ip)
+			w := httptest.NewRecorder()
+			lh.ServeHTTP(w, req)
+			if w.Code != want {
+				t.Errorf("%s: request %d: got status %d, want %d", tc.ip, i, w.Code, want)
+			}
+			if w.Code == http.StatusForbidden && w.Header().Get("Retry-After") != "" {
+				t.Errorf("%s: Retry-After set on denylisted request", tc.ip)
+			}
+		}
+	}
+	if n, _ := lh.buckets(); n != 1 {
+		t.Errorf("%d buckets created, want 1", n)
+	}
+	if v := lh.Stats().PolicyVersion; v != "v1" {
+		t.Errorf("PolicyVersion: %q", v)
+	}
+	for _, bad := range []Policy{
+		{Version: "bad", Allowlist: []string{"10.0.0.0/33"}},
+		{Version: "bad", Denylist: []string{"2001:db8::/129"}},
+		{Version: "bad", Denylist: []string{"example.com"}},
+	} {
+		if err := lh.ApplyPolicy(bad); err == nil {
+			t.Errorf("invalid policy %+v applied", bad)
+		}
+		if err := (&Config{Policy: bad}).Validate(); err == nil {
+			t.Errorf("invalid policy %+v passed validation", bad)
+		}
+	}
+	if v := lh.Stats().PolicyVersion; v != "v1" {
+		t.Errorf("PolicyVersion after failed updates: %q", v)
+	}
+	if err := lh.ApplyPolicy(Policy{Version: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := lh.AllowCtx(context.Background(), net.ParseIP("10.1.2.3")); d.Stage != StageLimit {
+		t.Errorf("decision after policy reset made at stage %v", d.Stage)
+	}
+}
+
+// TestPolicySwapConsistency hammers limiter with requests while policy is
+// replaced back and forth between two versions with opposite tables: address
+// is either allowlisted or denylisted in both versions, so a decision made
+// at the limit stage means a request saw parts of both policies.
+func TestPolicySwapConsistency(t *testing.T) {
+	a := Policy{Version: "a", Allowlist: []string{"10.0.0.0/8"}, Denylist: []string{"192.0.2.0/24"}}
+	b := Policy{Version: "b", Allowlist: []string{"192.0.2.0/24"}, Denylist: []string{"10.0.0.0/8"}}
+	lh := New(http.NotFoundHandler(), &Config{Policy: a}).(*limiter)
+	ips := []net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("192.0.2.1")}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(ip net.IP) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				d, _ := lh.AllowCtx(context.Background(), ip)
+				if d.Stage != StageAllowlist && d.Stage != StageDenylist {
+					t.Errorf("%v: decision made at stage %v", ip, d.Stage)
+					return
+				}
+			}
+		}(ips[i%2])
+	}
+	for i := 0; i < 2000; i++ {
+		p := a
+		if i%2 == 0 {
+			p = b
+		}
+		if err := lh.ApplyPolicy(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestWatchPolicy(t *testing.T) {
+	lh := New(http.NotFoundHandler(), nil).(*limiter)
+	var mu sync.Mutex
+	var calls int
+	ctx, cancel := context.WithCancel(context.Background())
+	load := func() (Policy, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+		if calls == 2 {
+			return Policy{Denylist: []string{"bad"}}, nil
+		}
+		return Policy{Version: "watched"}, nil
+	}
+	if err := lh.WatchPolicy(ctx, load, time.Millisecond); err != context.Canceled {
+		t.Fatalf("WatchPolicy returned %v", err)
+	}
+	if v := lh.Stats().PolicyVersion; v != "watched" {
+		t.Fatalf("PolicyVersion: %q", v)
+	}
+	for _, every := range []time.Duration{0, -time.Second} {
+		if err := lh.WatchPolicy(context.Background(), load, every); err == nil {
+			t.Errorf("interval %v: no error", every)
+		}
+	}
+}
+
+func TestRuleHits(t *testing.T) {
+	var buf bytes.Buffer
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		Logger:      log.New(&buf, "", 0),
+		Exempt:      []*net.IPNet{exempt},
+		Policy: Policy{
+			Version:   "v1",
+			Denylist:  []string{"198.51.100.0/24", "198.51.100.7", "203.0.113.1"},
+			Allowlist: []string{"192.0.2.0/25", "192.0.2.0/24", "192.0.2.10", "198.51.100.8/29", "10.1.0.0/16"},
+		},
+	}).(*limiter)
+	for _, want := range []string{
+		`policy "v1": denylist entry 198.51.100.7/32 never matches: shadowed by earlier entry 198.51.100.0/24`,
+		`policy "v1": allowlist entry 192.0.2.10/32 never matches: shadowed by earlier entry 192.0.2.0/25`,
+		`policy "v1": allowlist entry 198.51.100.8/29 never matches: covered by denylist`,
+		`policy "v1": allowlist entry 10.1.0.0/16 never matches: covered by Config.Exempt`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("no warning %q in log:\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "192.0.2.0/24 never matches") {
+		t.Errorf("partially shadowed entry reported:\n%s", buf.String())
+	}
+
+	traffic := map[string]int{
+		"198.51.100.7": 3, // first, broader entry gets the hits
+		"203.0.113.1":  1,
+		"10.1.2.3":     4,
+		"192.0.2.10":   2,
+		"192.0.2.200":  5,
+		"2001:db8::1":  2, // no match
+	}
+	for addr, n := range traffic {
+		for i := 0; i < n; i++ {
+			lh.Allow(net.ParseIP(addr))
+		}
+	}
+	want := []RuleHits{
+		{"denylist", "198.51.100.0/24", 3},
+		{"denylist", "198.51.100.7/32", 0},
+		{"denylist", "203.0.113.1/32", 1},
+		{"exempt", "10.0.0.0/8", 4},
+		{"allowlist", "192.0.2.0/25", 2},
+		{"allowlist", "192.0.2.0/24", 5},
+		{"allowlist", "192.0.2.10/32", 0},
+		{"allowlist", "198.51.100.8/29", 0},
+		{"allowlist", "10.1.0.0/16", 0},
+	}
+	if got := lh.Stats().RuleHits; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got rule hits\n%+v\nwant\n%+v", got, want)
+	}
+	var metrics strings.Builder
+	writeMetrics(&metrics, "", lh.Stats())
+	if line := `ipratelimit_rule_hits_total{limiter="",list="allowlist",rule="192.0.2.0/24"} 5`; !strings.Contains(metrics.String(), line) {
+		t.Errorf("no %q in metrics:\n%s", line, metrics.String())
+	}
+
+	buf.Reset()
+	if err := lh.ApplyPolicy(Policy{Version: "v2", Denylist: []string{"198.51.100.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	wantLog := `policy "v1" rule hits: [denylist 198.51.100.0/24: 3, denylist 203.0.113.1/32: 1, ` +
+		`allowlist 192.0.2.0/25: 2, allowlist 192.0.2.0/24: 5], 4 entries without hits`
+	if !strings.Contains(buf.String(), wantLog) {
+		t.Errorf("no previous hits in log:\n%s", buf.String())
+	}
+	want = []RuleHits{{"denylist", "198.51.100.0/24", 0}, {"exempt", "10.0.0.0/8", 4}}
+	if got := lh.Stats().RuleHits; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after policy swap got rule hits %+v, want %+v", got, want)
+	}
+
+	// re-applying the same policy, as WatchPolicy does, keeps its hits
+	lh.Allow(net.ParseIP("198.51.100.1"))
+	buf.Reset()
+	if err := lh.ApplyPolicy(Policy{Version: "v2", Denylist: []string{"198.51.100.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unchanged policy logged:\n%s", buf.String())
+	}
+	want = []RuleHits{{"denylist", "198.51.100.0/24", 1}, {"exempt", "10.0.0.0/8", 4}}
+	if got := lh.Stats().RuleHits; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after unchanged policy got rule hits %+v, want %+v", got, want)
+	}
+}
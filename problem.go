@@ -0,0 +1,63 @@
+package ipratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// ProblemContentType is the Content-Type of denial responses if
+// Config.ProblemDetails is set
+const ProblemContentType = "application/problem+json"
+
+// problem is the RFC 7807 problem details object of denial responses. Besides
+// standard members it carries retry_after, matching the Retry-After header,
+// and limit, the bucket capacity.
+type problem struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+// writeProblem writes problem details response with the given status code
+// for request denied at the given stage, or shed, see Config.ShedResponse;
+// retryAfter is the value of Retry-After header, empty if it's not set.
+func (h *limiter) writeProblem(w http.ResponseWriter, code int, stage Stage, shed bool, retryAfter string, lim *limits) {
+	p := problem{
+		Type:   h.problemType,
+		Title:  http.StatusText(code),
+		Status: code,
+	}
+	switch {
+	case shed:
+		p.Detail = "Service is over capacity."
+		if retryAfter != "" {
+			p.RetryAfter, _ = strconv.Atoi(retryAfter)
+			p.Detail = "Service is over capacity, retry in " + retryAfter + " seconds."
+		}
+	case stage == StageDenylist:
+		p.Detail = "Requests from this address are not allowed."
+	case stage == StageServerName:
+		p.Detail = "Requested server name is not served here."
+	default:
+		p.Limit = int(lim.burst)
+		p.Detail = "Request rate limit of " + strconv.Itoa(p.Limit) + " exceeded."
+		if retryAfter != "" {
+			p.RetryAfter, _ = strconv.Atoi(retryAfter)
+			p.Detail = "Request rate limit of " + strconv.Itoa(p.Limit) +
+				" exceeded, retry in " + retryAfter + " seconds."
+		}
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", ProblemContentType)
+	hdr.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,89 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProblemDetails(t *testing.T) {
+	for _, tc := range []struct {
+		typ, wantType string
+	}{
+		{"", "about:blank"},
+		{"https://example.com/probs/rate-limited", "https://example.com/probs/rate-limited"},
+	} {
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery:    90 * time.Second,
+			Burst:          2,
+			IPFunc:         IPFromXForwardedFor,
+			ProblemDetails: true,
+			ProblemType:    tc.typ,
+			Policy:         Policy{Denylist: []string{"198.51.100.1"}},
+		})
+		serve := func(addr string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", addr)
+			rec := httptest.NewRecorder()
+			lh.ServeHTTP(rec, req)
+			return rec
+		}
+		decode := func(rec *httptest.ResponseRecorder) map[string]interface{} {
+			t.Helper()
+			if ct := rec.Header().Get("Content-Type"); ct != ProblemContentType {
+				t.Fatalf("got Content-Type %q, want %q", ct, ProblemContentType)
+			}
+			dec := json.NewDecoder(bytes.NewReader(rec.Body.Bytes()))
+			dec.UseNumber()
+			var m map[string]interface{}
+			if err := dec.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"type", "title", "status"} {
+				if _, ok := m[k]; !ok {
+					t.Fatalf("no %q member in %s", k, rec.Body)
+				}
+			}
+			if m["type"] != tc.wantType {
+				t.Fatalf("got type %v, want %q", m["type"], tc.wantType)
+			}
+			if m["status"] != json.Number(strconv.Itoa(rec.Code)) {
+				t.Fatalf("status %v does not match code %d", m["status"], rec.Code)
+			}
+			if m["title"] != http.StatusText(rec.Code) {
+				t.Fatalf("got title %v for code %d", m["title"], rec.Code)
+			}
+			return m
+		}
+
+		serve("192.0.2.1")
+		serve("192.0.2.1")
+		rec := serve("192.0.2.1")
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("got code %d, want %d", rec.Code, http.StatusTooManyRequests)
+		}
+		m := decode(rec)
+		if ra := rec.Header().Get("Retry-After"); m["retry_after"] != json.Number(ra) {
+			t.Fatalf("retry_after %v does not match Retry-After %q", m["retry_after"], ra)
+		}
+		if m["limit"] != json.Number("2") {
+			t.Fatalf("got limit %v, want 2", m["limit"])
+		}
+		if detail, _ := m["detail"].(string); !strings.Contains(detail, "90 seconds") {
+			t.Fatalf("detail does not mention the wait: %q", detail)
+		}
+
+		rec = serve("198.51.100.1")
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("got code %d, want %d", rec.Code, http.StatusForbidden)
+		}
+		if m := decode(rec); m["retry_after"] != nil || rec.Header().Get("Retry-After") != "" {
+			t.Fatalf("retry hints on forbidden response: %s", rec.Body)
+		}
+	}
+}
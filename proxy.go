@@ -0,0 +1,41 @@
+package ipratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// ProxyHandler returns a reverse proxy to target with the limiter in front
+// of it, configured with cfg the same way as NewStrict does. If cfg.IPFunc
+// is nil, clients are identified by the address of the connection, which is
+// the right choice when proxy is exposed directly.
+//
+// Requests passed to target carry X-Forwarded-For with the client address
+// appended to any value received, X-Forwarded-Host with the original Host
+// header, and X-Forwarded-Proto set to "https" for TLS connections and
+// "http" otherwise. Responses carry RateLimit-* headers, as if
+// cfg.SendRateLimitHeaders was set.
+func ProxyHandler(target *url.URL, cfg *Config) (http.Handler, error) {
+	if target == nil || target.Scheme == "" || target.Host == "" {
+		return nil, errors.New("ipratelimit: proxy target must be an absolute URL")
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// Rewrite drops X-Forwarded-For of the inbound request,
+			// restore it so SetXForwarded appends to it
+			if xff, ok := r.In.Header["X-Forwarded-For"]; ok {
+				r.Out.Header["X-Forwarded-For"] = xff
+			}
+			r.SetXForwarded()
+		},
+	}
+	c := DefaultConfig()
+	if cfg != nil {
+		*c = *cfg
+	}
+	c.SendRateLimitHeaders = true
+	return NewStrict(proxy, c)
+}
@@ -0,0 +1,87 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyHandler(t *testing.T) {
+	got := make(chan http.Header, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		w.Header().Set("X-Origin", "yes")
+	}))
+	defer origin.Close()
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProxyHandler(&url.URL{Path: "/relative"}, nil); err == nil {
+		t.Fatal("relative target accepted")
+	}
+	if _, err := ProxyHandler(target, &Config{Burst: -1}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	ph, err := ProxyHandler(target, &Config{RefillEvery: time.Hour, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(ph)
+	defer front.Close()
+
+	do := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, front.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		resp := do()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Origin") != "yes" {
+			t.Fatalf("request %d: got code %d, headers %v", i, resp.StatusCode, resp.Header)
+		}
+		if got, want := resp.Header.Get("RateLimit-Remaining"), strconv.Itoa(1-i); got != want ||
+			resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Reset") == "" {
+			t.Fatalf("request %d: got RateLimit headers %v, want remaining %s", i, resp.Header, want)
+		}
+		hdr := <-got
+		if want := "203.0.113.7, 127.0.0.1"; hdr.Get("X-Forwarded-For") != want {
+			t.Fatalf("got X-Forwarded-For %q, want %q", hdr.Get("X-Forwarded-For"), want)
+		}
+		if hdr.Get("X-Forwarded-Proto") != "http" {
+			t.Fatalf("got X-Forwarded-Proto %q, want http", hdr.Get("X-Forwarded-Proto"))
+		}
+		if hdr.Get("X-Forwarded-Host") != "example.com" {
+			t.Fatalf("got X-Forwarded-Host %q, want example.com", hdr.Get("X-Forwarded-Host"))
+		}
+	}
+	// client is identified by the connection address, not the spoofable
+	// header, so the third request is limited
+	resp := do()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got code %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("no Retry-After on limited response")
+	}
+	if resp.Header.Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("got RateLimit-Remaining %q on limited response", resp.Header.Get("RateLimit-Remaining"))
+	}
+	select {
+	case <-got:
+		t.Fatal("limited request reached origin")
+	default:
+	}
+}
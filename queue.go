@@ -0,0 +1,52 @@
+package ipratelimit
+
+// minQueueSize is the smallest non-zero size of keyQueue buffer
+const minQueueSize = 16
+
+// keyQueue is a FIFO queue of bucket keys in a ring buffer which grows and
+// shrinks with the number of keys, so its memory is proportional to the
+// number of buckets and not to their maximum number. Zero value is an empty
+// queue.
+type keyQueue struct {
+	buf  []uint64
+	head int // index of the first key in buf
+	n    int // number of keys
+}
+
+func (q *keyQueue) len() int { return q.n }
+
+// push adds key to the tail of the queue
+func (q *keyQueue) push(key uint64) {
+	if q.n == len(q.buf) {
+		q.resize(max(2*len(q.buf), minQueueSize))
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = key
+	q.n++
+}
+
+// pop removes key from the head of the queue, which must not be empty
+func (q *keyQueue) pop() uint64 {
+	key := q.buf[q.head]
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	// shrink only once the queue is a quarter full, so that alternating
+	// pushes and pops don't resize it back and forth
+	if len(q.buf) > minQueueSize && q.n <= len(q.buf)/4 {
+		q.resize(len(q.buf) / 2)
+	}
+	return key
+}
+
+// resize moves keys into a new buffer of the given size, which must fit
+// them
+func (q *keyQueue) resize(size int) {
+	buf := make([]uint64, size)
+	if q.n > 0 {
+		k := copy(buf, q.buf[q.head:min(q.head+q.n, len(q.buf))])
+		copy(buf[k:], q.buf[:q.n-k])
+	}
+	q.buf, q.head = buf, 0
+}
+
+// memSize returns memory held by the queue buffer, in bytes
+func (q *keyQueue) memSize() int64 { return int64(len(q.buf)) * keyMemSize }
@@ -0,0 +1,77 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyQueue(t *testing.T) {
+	var q keyQueue
+	var next, want uint64 // next key to push, next key expected to pop
+	// push and pop in uneven runs, so that keys wrap around the buffer
+	// while it grows and shrinks
+	for round, n := range []int{5, 40, 3, 100, 1000, 7, 2000} {
+		for i := 0; i < n; i++ {
+			q.push(next)
+			next++
+		}
+		for i := 0; i < q.len()*2/3; i++ {
+			if k := q.pop(); k != want {
+				t.Fatalf("round %d: popped %d, want %d", round, k, want)
+			}
+			want++
+		}
+		if q.len() != int(next-want) {
+			t.Fatalf("round %d: len %d, want %d", round, q.len(), next-want)
+		}
+	}
+	for q.len() > 0 {
+		if k := q.pop(); k != want {
+			t.Fatalf("popped %d, want %d", k, want)
+		}
+		want++
+	}
+	if len(q.buf) > minQueueSize {
+		t.Fatalf("empty queue holds buffer of %d", len(q.buf))
+	}
+}
+
+// TestBookkeepingMemory checks that memory of the eviction queues scales
+// with the number of buckets and not with MaxBuckets
+func TestBookkeepingMemory(t *testing.T) {
+	const buckets = 5000
+	fill := func(maxBuckets int) Stats {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: time.Hour,
+			MaxBuckets:  maxBuckets,
+		}).(*limiter)
+		for i := 0; i < buckets; i++ {
+			lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+		}
+		if err := lh.checkInvariants(); err != nil {
+			t.Fatal(err)
+		}
+		return lh.Stats()
+	}
+	small, large := fill(2*buckets), fill(100*buckets)
+	if small.Buckets != buckets || large.Buckets != buckets {
+		t.Fatalf("got %d and %d buckets, want %d", small.Buckets, large.Buckets, buckets)
+	}
+	if small.BucketMemory != buckets*bucketMemSize || large.BucketMemory != small.BucketMemory {
+		t.Errorf("bucket memory: got %d and %d", small.BucketMemory, large.BucketMemory)
+	}
+	// each shard holds at most 4 slots per key, and at least the minimum
+	// buffer size if it holds any
+	bound := int64(4*buckets+maxShards*minQueueSize) * keyMemSize
+	for _, st := range []Stats{small, large} {
+		if st.BookkeepingMemory < buckets*keyMemSize || st.BookkeepingMemory > bound {
+			t.Errorf("%d buckets of %d: bookkeeping memory %d, want in [%d, %d]",
+				st.Buckets, st.MaxBuckets, st.BookkeepingMemory, buckets*keyMemSize, bound)
+		}
+	}
+	if empty := New(http.NotFoundHandler(), nil).(*limiter).Stats(); empty.BookkeepingMemory != 0 {
+		t.Errorf("bookkeeping memory of empty limiter: %d", empty.BookkeepingMemory)
+	}
+}
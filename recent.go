@@ -0,0 +1,34 @@
+package ipratelimit
+
+import (
+	"net"
+	"time"
+)
+
+// RecentlyLimited reports whether a request from the given IP address was
+// denied by its token bucket within the given duration. It never changes
+// limiter state and is safe for concurrent use.
+//
+// Denial times are only recorded if Config.TrackStats is set; otherwise
+// RecentlyLimited always returns false. It also returns false for addresses
+// without a local bucket: ones never seen, ones whose bucket was evicted,
+// and all addresses if Config.Store is set. Because buckets are evicted
+// least recently used first once Config.MaxBuckets is reached, a recently denied address
+// may be reported as not limited under heavy churn of addresses. Denials by
+// policy or bans are not accounted for.
+//
+// Handler returned by New implements interface{ RecentlyLimited(net.IP, time.Duration) bool }.
+func (h *limiter) RecentlyLimited(ip net.IP, within time.Duration) bool {
+	if !h.trackStats || h.store != nil {
+		return false
+	}
+	if ip = canonicalIP(ip); ip == nil {
+		return false
+	}
+	masked := h.maskIP(ip)
+	bkt, ok := h.bucketOfData(keyOf(masked), masked)
+	if !ok || bkt.denied == 0 {
+		return false
+	}
+	return h.now().UnixNano()-bkt.denied <= int64(within)
+}
@@ -0,0 +1,78 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecentlyLimited(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+		MaxBuckets:  100,
+		TrackStats:  true,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	ip := net.IPv4(192, 0, 2, 1)
+
+	if lh.RecentlyLimited(ip, time.Hour) {
+		t.Fatal("unknown address reported as limited")
+	}
+	if !lh.Allow(ip) {
+		t.Fatal("first request denied")
+	}
+	if lh.RecentlyLimited(ip, time.Hour) {
+		t.Fatal("address without denials reported as limited")
+	}
+	if lh.Allow(ip) {
+		t.Fatal("second request allowed")
+	}
+	const window = 30 * time.Second
+	now = now.Add(window)
+	if !lh.RecentlyLimited(ip, window) {
+		t.Fatal("denial at window boundary not reported")
+	}
+	if !lh.RecentlyLimited(ip.To16(), window) {
+		t.Fatal("16-byte form of the same address not reported")
+	}
+	now = now.Add(time.Nanosecond)
+	if lh.RecentlyLimited(ip, window) {
+		t.Fatal("denial past the window reported")
+	}
+	// allowed request doesn't clear the last denial
+	if !lh.Allow(ip) {
+		t.Fatal("request after refill denied")
+	}
+	if !lh.RecentlyLimited(ip, time.Minute) {
+		t.Fatal("denial forgotten after allowed request")
+	}
+
+	// fill the table with other addresses to evict ip bucket
+	for i := 0; i < 2*lh.shards[0].capacity; i++ {
+		lh.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	if _, ok := lh.bucketOf(keyOf(ip.To4())); ok {
+		t.Fatal("bucket not evicted")
+	}
+	if lh.RecentlyLimited(ip, time.Hour) {
+		t.Fatal("evicted address reported as limited")
+	}
+}
+
+func TestRecentlyLimitedNoStats(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+	}).(*limiter)
+	ip := net.IPv4(192, 0, 2, 1)
+	lh.Allow(ip)
+	if lh.Allow(ip) {
+		t.Fatal("second request allowed")
+	}
+	if lh.RecentlyLimited(ip, time.Hour) {
+		t.Fatal("denial reported with TrackStats disabled")
+	}
+}
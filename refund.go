@@ -0,0 +1,28 @@
+package ipratelimit
+
+// refundObserver returns tokens taken by the request if Config.Refund
+// reports true for the status of its response
+func (h *limiter) refundObserver(e *evaluation, o *responseObserver) {
+	if e.bypass || e.err != nil || e.d.charged == 0 || o.hijacked || !h.refundStatus(o.Status()) {
+		return
+	}
+	if h.store == nil {
+		h.refund(e.key, e.lim, e.d.charged)
+	}
+	if h.global != nil {
+		h.global.refund(e.d.charged)
+	}
+	h.counters.refunded.Add(1)
+}
+
+// refund returns cost tokens taken by a request which didn't proceed to the
+// bucket with the given key, if it still exists, up to its burst
+func (h *limiter) refund(key uint64, lim *limits, cost float64) {
+	s := h.shardOf(key)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if bkt, ok := s.ipmap[key]; ok {
+		bkt.left = min(bkt.left+cost, lim.burst)
+		s.ipmap[key] = bkt
+	}
+}
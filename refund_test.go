@@ -0,0 +1,57 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRefund(t *testing.T) {
+	var flusher bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	lh := New(handler, &Config{
+		RefillEvery:       time.Hour,
+		Burst:             2,
+		GlobalRefillEvery: time.Hour,
+		GlobalBurst:       2,
+		IPFunc:            IPFromXForwardedFor,
+		Refund:            func(status int) bool { return status == http.StatusNotFound },
+	}).(*limiter)
+	serve := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		if code := serve("/missing"); code != http.StatusNotFound {
+			t.Fatalf("request %d to missing page: got status %d", i, code)
+		}
+	}
+	if !flusher {
+		t.Error("wrapped ResponseWriter doesn't implement http.Flusher")
+	}
+	if n := lh.Counters().Refunded; n != 5 {
+		t.Errorf("got %d refunded requests, want 5", n)
+	}
+	for i := 0; i < 2; i++ {
+		if code := serve("/"); code != http.StatusOK {
+			t.Fatalf("request %d: got status %d", i, code)
+		}
+	}
+	if code := serve("/"); code != http.StatusTooManyRequests {
+		t.Fatalf("request over burst: got status %d", code)
+	}
+	if n := lh.Counters().Refunded; n != 5 {
+		t.Errorf("got %d refunded requests after successful ones, want 5", n)
+	}
+}
@@ -0,0 +1,89 @@
+package ipratelimit
+
+import "net/http"
+
+// Response controls responses to rate limited requests. It can be set
+// globally with Config.Response and overridden for a subset of requests with
+// Limit.Response, e.g. to omit Retry-After for a login endpoint so that
+// credential stuffing tools don't learn when to retry.
+//
+// Each field is resolved separately, the first non-zero value is used:
+// Limit.Response, then Config.Response, then defaults: status 429,
+// Retry-After set, Config.LimitBody if set, otherwise plain text body or
+// problem details if Config.ProblemDetails is set.
+//
+// Responses to requests denied for other reasons, like Policy.Denylist or
+// bans, are not affected.
+type Response struct {
+	Status     int            // status code, must be 4xx or 5xx
+	RetryAfter RetryAfterMode // whether Retry-After header is set
+	Body       BodyMode       // format of the body
+}
+
+// RetryAfterMode controls Retry-After header of Response
+type RetryAfterMode uint8
+
+const (
+	RetryAfterDefault RetryAfterMode = iota // use the less specific setting
+	RetryAfterSet                           // set Retry-After
+	RetryAfterOmit                          // don't set Retry-After
+)
+
+// BodyMode controls body of Response
+type BodyMode uint8
+
+const (
+	BodyDefault BodyMode = iota // use the less specific setting
+	BodyText                    // plain text status
+	BodyProblem                 // RFC 7807 problem details, see Config.ProblemType
+	BodyEmpty                   // no body
+	BodyCustom                  // Config.LimitBody
+)
+
+// merge returns r with zero fields replaced by the fields of def
+func (r Response) merge(def Response) Response {
+	if r.Status == 0 {
+		r.Status = def.Status
+	}
+	if r.RetryAfter == RetryAfterDefault {
+		r.RetryAfter = def.RetryAfter
+	}
+	if r.Body == BodyDefault {
+		r.Body = def.Body
+	}
+	return r
+}
+
+// valid reports whether r only holds values documented on Response
+func (r Response) valid() bool {
+	return (r.Status == 0 || r.Status >= 400 && r.Status < 600) &&
+		r.RetryAfter <= RetryAfterOmit && r.Body <= BodyCustom
+}
+
+// defaultResponse returns global response settings resolved from the config
+func defaultResponse(cfg *Config) Response {
+	def := Response{Status: http.StatusTooManyRequests, RetryAfter: RetryAfterSet, Body: BodyText}
+	switch {
+	case cfg.LimitBody != nil:
+		def.Body = BodyCustom
+	case cfg.ProblemDetails:
+		def.Body = BodyProblem
+	}
+	resp := cfg.Response
+	if !resp.valid() {
+		resp = Response{}
+	}
+	return resp.merge(def)
+}
+
+// defaultShedResponse returns settings of responses to shed requests
+// resolved from the config, falling back to the resolved global response
+// for the body
+func defaultShedResponse(cfg *Config, global Response) Response {
+	def := Response{Status: http.StatusServiceUnavailable, RetryAfter: RetryAfterSet, Body: global.Body}
+	resp := cfg.ShedResponse
+	if !resp.valid() {
+		resp = Response{}
+	}
+	return resp.merge(def)
+}
@@ -0,0 +1,214 @@
+package ipratelimit
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponsePrecedence(t *testing.T) {
+	globals := []Response{
+		{},
+		{RetryAfter: RetryAfterOmit},
+		{Body: BodyProblem},
+		{Status: http.StatusServiceUnavailable, RetryAfter: RetryAfterSet, Body: BodyEmpty},
+	}
+	overrides := []Response{
+		{},
+		{RetryAfter: RetryAfterSet},
+		{RetryAfter: RetryAfterOmit, Body: BodyEmpty},
+		{Status: http.StatusForbidden, Body: BodyText},
+	}
+	for _, problemDetails := range []bool{false, true} {
+		for _, global := range globals {
+			for _, override := range overrides {
+				name := fmt.Sprintf("problemDetails=%v/global=%+v/override=%+v", problemDetails, global, override)
+				lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+					RefillEvery:      time.Hour,
+					Burst:            1,
+					IPFunc:           IPFromXForwardedFor,
+					ProblemDetails:   problemDetails,
+					Response:         global,
+					KeyByServerName:  true,
+					ServerNameLimits: map[string]Limit{"login.example": {Response: override}},
+				})
+				for _, sni := range []string{"api.example", "login.example"} {
+					// expected values, the most specific setting wins
+					status, retryAfter, body := http.StatusTooManyRequests, true, BodyText
+					if problemDetails {
+						body = BodyProblem
+					}
+					layers := []Response{global}
+					if sni == "login.example" {
+						layers = append(layers, override)
+					}
+					for _, r := range layers {
+						if r.Status != 0 {
+							status = r.Status
+						}
+						if r.RetryAfter != RetryAfterDefault {
+							retryAfter = r.RetryAfter == RetryAfterSet
+						}
+						if r.Body != BodyDefault {
+							body = r.Body
+						}
+					}
+
+					var rec *httptest.ResponseRecorder
+					for i := 0; i < 2; i++ {
+						req := httptest.NewRequest(http.MethodGet, "/", nil)
+						req.Header.Set("X-Forwarded-For", "192.0.2.1")
+						req.TLS = &tls.ConnectionState{ServerName: sni}
+						rec = httptest.NewRecorder()
+						lh.ServeHTTP(rec, req)
+					}
+					if rec.Code != status {
+						t.Errorf("%s, %s: got status %d, want %d", name, sni, rec.Code, status)
+					}
+					if got := rec.Header().Get("Retry-After") != ""; got != retryAfter {
+						t.Errorf("%s, %s: got Retry-After %v, want %v", name, sni, got, retryAfter)
+					}
+					ct := rec.Header().Get("Content-Type")
+					switch body {
+					case BodyText:
+						if ct != "text/plain; charset=utf-8" {
+							t.Errorf("%s, %s: got Content-Type %q for text body", name, sni, ct)
+						}
+					case BodyProblem:
+						if ct != ProblemContentType {
+							t.Errorf("%s, %s: got Content-Type %q for problem body", name, sni, ct)
+						}
+					case BodyEmpty:
+						if rec.Body.Len() != 0 {
+							t.Errorf("%s, %s: got body %q, want none", name, sni, rec.Body)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestResponseOtherStages(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		IPFunc:   IPFromXForwardedFor,
+		Response: Response{Status: http.StatusServiceUnavailable, Body: BodyEmpty},
+		Policy:   Policy{Denylist: []string{"192.0.2.1"}},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rec := httptest.NewRecorder()
+	lh.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || rec.Body.Len() == 0 {
+		t.Fatalf("denylisted request: got status %d, body %q", rec.Code, rec.Body)
+	}
+	for _, r := range []Response{{Status: 200}, {Status: 600}, {RetryAfter: 3}, {Body: 5}} {
+		if err := (&Config{Response: r}).Validate(); err == nil {
+			t.Errorf("invalid %+v passed validation", r)
+		}
+	}
+}
+
+func TestLimitedHandler(t *testing.T) {
+	var got *http.Request
+	var gotRetryAfter string
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc:      IPFromXForwardedFor,
+		Policy:      Policy{Denylist: []string{"198.51.100.1"}},
+		LimitedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, gotRetryAfter = r, w.Header().Get("Retry-After")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"slow down"}`))
+		}),
+	}).(*limiter)
+	serve := func(addr string) (*http.Request, *httptest.ResponseRecorder) {
+		got, gotRetryAfter = nil, ""
+		req := httptest.NewRequest(http.MethodPost, "/api/items", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return req, rec
+	}
+
+	if _, rec := serve("192.0.2.1"); got != nil || rec.Code != http.StatusNotFound {
+		t.Fatalf("allowed request: handler called %v, code %d", got != nil, rec.Code)
+	}
+	req, rec := serve("192.0.2.1")
+	if got != req {
+		t.Fatal("rate limited request not passed to LimitedHandler as is")
+	}
+	if gotRetryAfter != "3600" {
+		t.Fatalf("Retry-After seen by LimitedHandler: %q", gotRetryAfter)
+	}
+	if rec.Code != http.StatusTooManyRequests || rec.Body.String() != `{"error":"slow down"}` {
+		t.Fatalf("rate limited request: got %d %q", rec.Code, rec.Body)
+	}
+
+	if err := lh.Ban(net.IPv4(203, 0, 113, 1), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if req, _ := serve("203.0.113.1"); got != req || gotRetryAfter != "60" {
+		t.Fatalf("banned request: handler called %v, Retry-After %q", got != nil, gotRetryAfter)
+	}
+
+	if _, rec := serve("198.51.100.1"); got != nil || rec.Code != http.StatusForbidden {
+		t.Fatalf("denylisted request: handler called %v, code %d", got != nil, rec.Code)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cfg    Config
+		status int
+		body   string
+		ctype  string
+	}{
+		{"detected type", Config{LimitBody: []byte("<html>slow down</html>")},
+			http.StatusTooManyRequests, "<html>slow down</html>", "text/html; charset=utf-8"},
+		{"explicit type", Config{
+			LimitBody:        []byte(`{"error":"slow down"}`),
+			LimitContentType: "application/json",
+			Response:         Response{Status: http.StatusServiceUnavailable},
+		}, http.StatusServiceUnavailable, `{"error":"slow down"}`, "application/json"},
+		{"empty body", Config{LimitBody: []byte{}, Response: Response{Status: http.StatusServiceUnavailable}},
+			http.StatusServiceUnavailable, "", ""},
+		{"precedence over problem details", Config{LimitBody: []byte("slow down"), ProblemDetails: true},
+			http.StatusTooManyRequests, "slow down", "text/plain; charset=utf-8"},
+		{"overridden by Response", Config{LimitBody: []byte("slow down"), Response: Response{Body: BodyEmpty}},
+			http.StatusTooManyRequests, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.RefillEvery, cfg.Burst, cfg.IPFunc = time.Hour, 1, IPFromXForwardedFor
+			cfg.Policy = Policy{Denylist: []string{"198.51.100.1"}}
+			lh := New(http.NotFoundHandler(), &cfg)
+			serve := func(addr string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", addr)
+				rec := httptest.NewRecorder()
+				lh.ServeHTTP(rec, req)
+				return rec
+			}
+			serve("192.0.2.1")
+			rec := serve("192.0.2.1")
+			if rec.Code != tc.status || rec.Body.String() != tc.body || rec.Header().Get("Content-Type") != tc.ctype {
+				t.Fatalf("got status %d, body %q of type %q", rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Fatal("Retry-After not set")
+			}
+			// other denials are not affected
+			if rec := serve("198.51.100.1"); rec.Code != http.StatusForbidden || rec.Body.String() == tc.body {
+				t.Fatalf("denylisted request: got status %d, body %q", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package ipratelimit
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// restoreEntry is a bucket read from the restore input
+type restoreEntry struct {
+	key    uint64
+	bkt    bucket
+	totals totals
+}
+
+// RestoreCSV reads buckets in the format written by ExportCSV and adds them
+// to the limiter. Input is processed in batches, the lock is released
+// between them, so live traffic proceeds while restore is in progress.
+// Buckets already present take precedence over restored ones with the same
+// key, as they reflect more recent state; buckets are not restored into
+// full shards of the storage. Progress is reported in Stats. Input written
+// before ExportCSV had lifetime totals columns is accepted as well; totals
+// are only restored if Config.TrackStats is set.
+//
+// Restore stops on the first malformed row or when ctx is done, returning
+// an error; buckets from batches processed before that are kept.
+//
+// Handler returned by New implements
+// interface{ RestoreCSV(context.Context, io.Reader) error }.
+func (h *limiter) RestoreCSV(ctx context.Context, r io.Reader) error {
+	h.restoring.Add(1)
+	defer h.restoring.Add(-1)
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true // all records must have as many fields as the header
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("ipratelimit: restore: reading header: %w", err)
+	}
+	if got := strings.Join(header, ","); got != strings.Join(csvHeader, ",") &&
+		got != strings.Join(csvHeader[:csvHeaderColumns1], ",") {
+		return fmt.Errorf("ipratelimit: restore: unexpected header %q", header)
+	}
+	h.m.Lock()
+	maxBurst := h.maxBurst
+	h.m.Unlock()
+	batch := make([]restoreEntry, 0, exportBatch)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		var eof bool
+		for len(batch) < cap(batch) {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("ipratelimit: restore: %w", err)
+			}
+			ent, err := h.parseRestoreRecord(rec, maxBurst)
+			if err != nil {
+				line, _ := cr.FieldPos(0)
+				return fmt.Errorf("ipratelimit: restore: line %d: %w", line, err)
+			}
+			batch = append(batch, ent)
+		}
+		h.restoreBatch(batch)
+		if eof {
+			return nil
+		}
+	}
+}
+
+func (h *limiter) parseRestoreRecord(rec []string, maxBurst float64) (restoreEntry, error) {
+	var ent restoreEntry
+	hex, ok := strings.CutPrefix(rec[0], "#")
+	if !ok {
+		return ent, fmt.Errorf("invalid key %q", rec[0])
+	}
+	key, err := strconv.ParseUint(hex, 16, 64)
+	if err != nil {
+		return ent, fmt.Errorf("invalid key %q", rec[0])
+	}
+	left, err := strconv.ParseFloat(rec[1], 64)
+	if err != nil || math.IsNaN(left) || math.IsInf(left, 0) {
+		return ent, fmt.Errorf("invalid tokens %q", rec[1])
+	}
+	mtime, err := time.Parse(time.RFC3339Nano, rec[2])
+	if err != nil {
+		return ent, err
+	}
+	streak, err := strconv.ParseUint(rec[3], 10, 64)
+	if err != nil {
+		return ent, fmt.Errorf("invalid denial streak %q", rec[3])
+	}
+	maxStreak, err := strconv.ParseUint(rec[4], 10, 64)
+	if err != nil {
+		return ent, fmt.Errorf("invalid max denial streak %q", rec[4])
+	}
+	ent.key = key
+	ent.bkt = bucket{
+		left:      min(max(left, 0), maxBurst),
+		mtime:     mtime.UnixNano(),
+		streak:    uint16(min(streak, math.MaxUint16)),
+		maxStreak: uint16(min(maxStreak, math.MaxUint16)),
+		class:     h.classIndex[rec[5]],
+	}
+	if ent.bkt.mtime <= 0 {
+		return ent, errors.New("last access time is out of range")
+	}
+	if len(rec) == csvHeaderColumns1 {
+		return ent, nil
+	}
+	if rec[6] != "" {
+		firstSeen, err := time.Parse(time.RFC3339Nano, rec[6])
+		if err != nil {
+			return ent, err
+		}
+		if ent.totals.firstSeen = firstSeen.UnixNano(); ent.totals.firstSeen <= 0 {
+			return ent, errors.New("first seen time is out of range")
+		}
+	}
+	requests, err := strconv.ParseUint(rec[7], 10, 64)
+	if err != nil {
+		return ent, fmt.Errorf("invalid requests %q", rec[7])
+	}
+	denials, err := strconv.ParseUint(rec[8], 10, 64)
+	if err != nil {
+		return ent, fmt.Errorf("invalid denials %q", rec[8])
+	}
+	ent.totals.requests = uint32(min(requests, math.MaxUint32))
+	ent.totals.denials = uint32(min(denials, math.MaxUint32))
+	return ent, nil
+}
+
+// restoreBatch adds restored buckets, taking lock of each shard once
+func (h *limiter) restoreBatch(batch []restoreEntry) {
+	var restored, skipped uint64
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		for _, ent := range batch {
+			if h.shardOf(ent.key) != s {
+				continue
+			}
+			if _, ok := s.ipmap[ent.key]; ok || len(s.ipmap) >= s.capacity || h.draining.Load() {
+				skipped++
+				continue
+			}
+			s.keys.push(ent.key)
+			s.ipmap[ent.key] = ent.bkt
+			if h.trackStats && ent.totals != (totals{}) {
+				if s.totals == nil {
+					s.totals = make(map[uint64]totals)
+				}
+				s.totals[ent.key] = ent.totals
+			}
+			if s.classUsage != nil {
+				s.classUsage[ent.bkt.class]++
+			}
+			restored++
+		}
+		s.m.Unlock()
+	}
+	h.counters.restored.Add(restored)
+	h.counters.restoreSkipped.Add(skipped)
+}
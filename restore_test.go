@@ -0,0 +1,162 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreCSV(t *testing.T) {
+	newLimiter := func() *limiter {
+		return New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery: time.Hour,
+			Burst:       3,
+			MaxBuckets:  100000,
+			TrackStats:  true,
+		}).(*limiter)
+	}
+	src := newLimiter()
+	now := time.Now()
+	src.now = func() time.Time { return now }
+	const n = 20000
+	ipOf := func(i int) net.IP {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, 0x0a000000+uint32(i))
+		return ip
+	}
+	for i := 0; i < n; i++ {
+		src.Allow(ipOf(i))
+	}
+	conflict := ipOf(0)
+	var snapshot bytes.Buffer
+	if err := src.ExportCSV(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newLimiter()
+	dst.now = func() time.Time { return now }
+	// live state for one of the keys, it must win over the restored one
+	for i := 0; i < 3; i++ {
+		dst.Allow(conflict)
+	}
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			ip := net.IPv4(192, 0, 2, byte(g))
+			for ctx.Err() == nil {
+				dst.Allow(ip)
+				dst.Stats()
+			}
+		}(g)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// as SetLimit raising burst does, without changing the limits
+		for burst := 4.0; ctx.Err() == nil; burst++ {
+			dst.growMaxBurst(burst)
+		}
+	}()
+	err := dst.RestoreCSV(context.Background(), bytes.NewReader(snapshot.Bytes()))
+	cancel()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	st := dst.Stats()
+	if st.Restoring || st.Restored != n-1 || st.RestoreSkipped != 1 {
+		t.Fatalf("got restore stats: restoring %v, restored %d, skipped %d", st.Restoring, st.Restored, st.RestoreSkipped)
+	}
+	if dst.Allow(conflict) {
+		t.Fatal("restored state replaced live state")
+	}
+	if d, _ := dst.AllowCtx(context.Background(), ipOf(1)); !d.Allowed || int(d.Remaining) != 1 {
+		t.Fatalf("restored bucket: got %+v, want allowed with 1 token left", d)
+	}
+	key := keyOf(ipOf(1))
+	want := totals{firstSeen: now.UnixNano(), requests: 2}
+	if got := dst.shardOf(key).totals[key]; got != want {
+		t.Fatalf("restored bucket: got totals %+v, want %+v", got, want)
+	}
+}
+
+func TestRestoreCSVErrors(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{Burst: 3}).(*limiter)
+	header := strings.Join(csvHeader, ",") + "\n"
+	for _, input := range []string{
+		"",
+		"bogus,header\n",
+		header + "#0000000000000001,1,2024-01-02T03:04:05Z,0,0,\n",
+		header + "0000000000000001,1,2024-01-02T03:04:05Z,0,0,,,0,0\n",
+		header + "#0000000000000001,NaN,2024-01-02T03:04:05Z,0,0,,,0,0\n",
+		header + "#0000000000000001,1,yesterday,0,0,,,0,0\n",
+		header + "#0000000000000001,1,2024-01-02T03:04:05Z,-1,0,,,0,0\n",
+		header + "#0000000000000001,1,2024-01-02T03:04:05Z,0,0,,yesterday,0,0\n",
+		header + "#0000000000000001,1,2024-01-02T03:04:05Z,0,0,,,-1,0\n",
+		header + "#0000000000000001,1,2024-01-02T03:04:05Z,0,0,,,0,x\n",
+	} {
+		if err := lh.RestoreCSV(context.Background(), strings.NewReader(input)); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	input := header + "#0000000000000001,1,2024-01-02T03:04:05Z,0,0,,,0,0\n"
+	if err := lh.RestoreCSV(ctx, strings.NewReader(input)); err != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if st := lh.Stats(); st.Restored != 0 || st.Restoring {
+		t.Fatalf("canceled restore changed state: %+v", st)
+	}
+}
+
+func TestRestoreCSVSaturates(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{Burst: 3, TrackStats: true}).(*limiter)
+	input := strings.Join(csvHeader, ",") + "\n" +
+		"#0000000000000001,1,2024-01-02T03:04:05Z,70000,100000,,2024-01-01T00:00:00Z,5000000000,4300000000\n"
+	if err := lh.RestoreCSV(context.Background(), strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	bkt, ok := lh.bucketOf(1)
+	if !ok || bkt.streak != math.MaxUint16 || bkt.maxStreak != math.MaxUint16 {
+		t.Fatalf("got %+v, want saturated streaks", bkt)
+	}
+	if got := lh.shardOf(1).totals[1]; got.requests != math.MaxUint32 || got.denials != math.MaxUint32 {
+		t.Fatalf("got totals %+v, want saturated", got)
+	}
+}
+
+// TestRestoreCSVColumns1 checks that input without lifetime totals columns
+// is accepted
+func TestRestoreCSVColumns1(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{Burst: 3, TrackStats: true}).(*limiter)
+	input := strings.Join(csvHeader[:csvHeaderColumns1], ",") + "\n" +
+		"#0000000000000001,1,2024-01-02T03:04:05Z,0,0,\n"
+	if err := lh.RestoreCSV(context.Background(), strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lh.bucketOf(1); !ok {
+		t.Fatal("bucket not restored")
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
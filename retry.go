@@ -0,0 +1,28 @@
+package ipratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// trackRetry records in bkt when its client may retry after decision d on a
+// request taking cost tokens, setting d.retryWait for denied requests. With
+// h.retryBackoff set, the wait grows with each consecutive violation. Must
+// be called with lock of the bucket shard held.
+func (h *limiter) trackRetry(bkt *bucket, d *decision, lim *limits, cost float64, now time.Time, violation bool) {
+	if d.allow {
+		bkt.retryAt, bkt.penalty = 0, 0
+		return
+	}
+	wait := lim.retryWait(bkt.left, cost)
+	if h.retryBackoff > 1 {
+		if violation {
+			bkt.penalty = incSaturating(bkt.penalty)
+		} else {
+			bkt.penalty = 0
+		}
+		wait = min(durationOf(float64(wait)*math.Pow(h.retryBackoff, float64(bkt.penalty))), lim.maxWait)
+	}
+	bkt.retryAt = now.Add(wait).UnixNano()
+	d.retryWait = wait
+}
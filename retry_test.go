@@ -0,0 +1,134 @@
+package ipratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryViolations(t *testing.T) {
+	for _, backoff := range []float64{0, 2} {
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery:           10 * time.Second,
+			Burst:                 1,
+			IPFunc:                IPFromXForwardedFor,
+			MaxRetryAfter:         100 * time.Second,
+			RetryViolationBackoff: backoff,
+		}).(*limiter)
+		now := time.Unix(1000, 0)
+		lh.now = func() time.Time { return now }
+		// serve returns status and Retry-After of a request from addr
+		serve := func(addr string) (int, string) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", addr)
+			rec := httptest.NewRecorder()
+			lh.ServeHTTP(rec, req)
+			return rec.Code, rec.Header().Get("Retry-After")
+		}
+
+		// compliant client waits as told and is never penalized
+		serve("192.0.2.1")
+		for i := 0; i < 3; i++ {
+			code, retryAfter := serve("192.0.2.1")
+			if code != http.StatusTooManyRequests || retryAfter != "10" {
+				t.Fatalf("backoff %v: compliant client: got %d, Retry-After %q", backoff, code, retryAfter)
+			}
+			now = now.Add(10 * time.Second)
+			if code, _ := serve("192.0.2.1"); code != http.StatusOK {
+				t.Fatalf("backoff %v: compliant client denied after waiting", backoff)
+			}
+		}
+		if n := lh.Stats().RetryViolations; n != 0 {
+			t.Fatalf("backoff %v: compliant client made %d violations", backoff, n)
+		}
+
+		// impatient client retries every 4 seconds
+		serve("192.0.2.2")
+		if _, retryAfter := serve("192.0.2.2"); retryAfter != "10" {
+			t.Fatalf("backoff %v: first Retry-After %q", backoff, retryAfter)
+		}
+		want := []string{"20", "40", "80", "100", "100"}
+		if backoff == 0 {
+			// denials follow the bucket, which has a token by
+			// the third retry
+			want = []string{"6", "2", "", "6", "2"}
+		}
+		for i, w := range want {
+			now = now.Add(4 * time.Second)
+			code, retryAfter := serve("192.0.2.2")
+			if retryAfter != w || (code == http.StatusOK) != (w == "") {
+				t.Fatalf("backoff %v: retry %d: got %d, Retry-After %q, want %q", backoff, i, code, retryAfter, w)
+			}
+		}
+		if n := lh.Stats().RetryViolations; n == 0 || (backoff > 1 && n != uint64(len(want))) {
+			t.Fatalf("backoff %v: got %d violations", backoff, n)
+		}
+		if backoff > 1 {
+			if at := lh.Next(net.ParseIP("192.0.2.2"), 1); !at.Equal(now.Add(100 * time.Second)) {
+				t.Fatalf("Next doesn't account for the penalty: %v", at.Sub(now))
+			}
+			// waiting as told clears the penalty
+			now = now.Add(100 * time.Second)
+			if code, _ := serve("192.0.2.2"); code != http.StatusOK {
+				t.Fatal("penalized client denied after waiting")
+			}
+			if _, retryAfter := serve("192.0.2.2"); retryAfter != "10" {
+				t.Fatalf("Retry-After after penalty is cleared: %q", retryAfter)
+			}
+		}
+	}
+}
+
+func TestRetryPenaltySaturates(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:           10 * time.Second,
+		Burst:                 1,
+		IPFunc:                IPFromXForwardedFor,
+		MaxRetryAfter:         100 * time.Second,
+		RetryViolationBackoff: 2,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	serve := func() (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code, rec.Header().Get("Retry-After")
+	}
+	key := keyOf(net.IPv4(192, 0, 2, 1).To4())
+	serve()
+	serve()
+	s := lh.shardOf(key)
+	s.m.Lock()
+	bkt := s.ipmap[key]
+	bkt.penalty = math.MaxUint8 - 1
+	s.ipmap[key] = bkt
+	s.m.Unlock()
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Second)
+		if code, retryAfter := serve(); code != http.StatusTooManyRequests || retryAfter != "100" {
+			t.Fatalf("violation %d: got %d, Retry-After %q", i, code, retryAfter)
+		}
+		if bkt, _ := lh.bucketOf(key); bkt.penalty != math.MaxUint8 {
+			t.Fatalf("violation %d: got penalty %d", i, bkt.penalty)
+		}
+	}
+	if s := lh.dumpState(0); !strings.Contains(s, "saturated penalties: 1\n") {
+		t.Errorf("saturation not in debug output:\n%s", s)
+	}
+	now = now.Add(100 * time.Second)
+	if code, _ := serve(); code != http.StatusOK {
+		t.Fatal("penalized client denied after waiting")
+	}
+	if bkt, _ := lh.bucketOf(key); bkt.penalty != 0 {
+		t.Errorf("penalty %d after waiting", bkt.penalty)
+	}
+	if _, retryAfter := serve(); retryAfter != "10" {
+		t.Errorf("Retry-After after penalty is cleared: %q", retryAfter)
+	}
+}
@@ -0,0 +1,59 @@
+package ipratelimit
+
+import (
+	"context"
+	"math"
+)
+
+// ScoreHeader is the response header carrying the request score in scoring
+// mode, see Config.Score
+const ScoreHeader = "X-RateLimit-Score"
+
+// ScoreWeights configures scoring mode, see Config.Score. Score is computed
+// as a weighted average of two components, each in [0, 1] range:
+//
+//	usage  = 1 - remaining/burst
+//	streak = 1 - 1/(1 + consecutive denials)
+//	score  = (Usage*usage + Streak*streak) / (Usage + Streak)
+//
+// Usage grows as the client spends its budget and reaches 1 when the bucket
+// is empty; streak grows once the client exceeds its budget, with each
+// request that would have been denied. Score therefore never decreases as
+// the client approaches and exceeds its budget.
+type ScoreWeights struct {
+	Usage  float64 // weight of bucket usage
+	Streak float64 // weight of denial streak
+}
+
+// normalize returns copy of w with invalid weights replaced, or nil if w is
+// nil
+func (w *ScoreWeights) normalize() *ScoreWeights {
+	if w == nil {
+		return nil
+	}
+	out := *w
+	valid := func(v float64) bool { return v >= 0 && !math.IsInf(v, 0) }
+	if !valid(out.Usage) || !valid(out.Streak) || out.Usage+out.Streak == 0 {
+		out = ScoreWeights{Usage: 0.7, Streak: 0.3}
+	}
+	return &out
+}
+
+func (w *ScoreWeights) of(d decision, burst float64) float64 {
+	usage := 1 - d.remaining/burst
+	if usage < 0 {
+		usage = 0
+	}
+	streak := 1 - 1/(1+float64(d.streak))
+	score := (w.Usage*usage + w.Streak*streak) / (w.Usage + w.Streak)
+	return math.Min(math.Max(score, 0), 1)
+}
+
+type scoreKey struct{}
+
+// ScoreFromContext returns request score attached to the request context in
+// scoring mode, see Config.Score
+func ScoreFromContext(ctx context.Context) (score float64, ok bool) {
+	score, ok = ctx.Value(scoreKey{}).(float64)
+	return score, ok
+}
@@ -0,0 +1,67 @@
+package ipratelimit
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScoreMode(t *testing.T) {
+	var ctxScore float64
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if ctxScore, ok = ScoreFromContext(r.Context()); !ok {
+			t.Error("no score in request context")
+		}
+	}
+	lh := New(http.HandlerFunc(handler), &Config{
+		RefillEvery: time.Hour,
+		Burst:       5,
+		IPFunc:      IPFromXForwardedFor,
+		Score:       &ScoreWeights{Usage: 1, Streak: 1},
+	})
+	prev := -1.0
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d in scoring mode", i, w.Code)
+		}
+		score, err := strconv.ParseFloat(w.Header().Get(ScoreHeader), 64)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if math.Abs(score-ctxScore) > 0.001 {
+			t.Fatalf("request %d: header score %v, context score %v", i, score, ctxScore)
+		}
+		if score <= prev || score < 0 || score > 1 {
+			t.Fatalf("request %d: score %v after %v, want monotonic increase within [0, 1]", i, score, prev)
+		}
+		prev = score
+	}
+	// bucket is exhausted after 5 requests, so usage component maxes out;
+	// the following 15 denials give streak component of 1-1/16
+	if want := (1 + (1 - 1.0/16)) / 2; math.Abs(prev-want) > 0.001 {
+		t.Fatalf("final score %v, want %v", prev, want)
+	}
+}
+
+func TestScoreWeightsNormalize(t *testing.T) {
+	if (*ScoreWeights)(nil).normalize() != nil {
+		t.Fatal("nil weights normalized to non-nil")
+	}
+	def := ScoreWeights{Usage: 0.7, Streak: 0.3}
+	for _, w := range []ScoreWeights{{}, {Usage: -1, Streak: 1}, {Usage: math.Inf(1)}, {Streak: math.NaN()}} {
+		if got := *w.normalize(); got != def {
+			t.Errorf("%+v normalized to %+v, want %+v", w, got, def)
+		}
+	}
+	if got := *(&ScoreWeights{Usage: 0, Streak: 2}).normalize(); got != (ScoreWeights{Streak: 2}) {
+		t.Errorf("valid weights changed: %+v", got)
+	}
+}
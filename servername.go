@@ -0,0 +1,84 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+// normalizeServerName returns TLS server name in the form used for bucket
+// keys and ServerNameLimits lookups: lowercase, without the trailing dot
+func normalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// serverName returns normalized TLS server name requested by the client, or
+// an empty string if request was not made over TLS or without SNI
+func serverName(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return normalizeServerName(r.TLS.ServerName)
+}
+
+// serverNameKey returns bucket key of the masked address or opaque key k
+// combined with the normalized server name
+func serverNameKey(k []byte, name string) uint64 {
+	b := make([]byte, 0, len(k)+1+len(name))
+	b = append(b, k...)
+	b = append(b, 0)
+	b = append(b, name...)
+	return xxhash.Sum64(b)
+}
+
+// serverNameSet matches server names against exact names and "*.suffix"
+// patterns
+type serverNameSet struct {
+	names    map[string]struct{}
+	suffixes []string // with the leading dot
+}
+
+func newServerNameSet(patterns []string) *serverNameSet {
+	s := &serverNameSet{names: make(map[string]struct{})}
+	for _, p := range patterns {
+		p = normalizeServerName(strings.TrimSpace(p))
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			s.suffixes = append(s.suffixes, "."+suffix)
+			continue
+		}
+		s.names[p] = struct{}{}
+	}
+	return s
+}
+
+func (s *serverNameSet) contains(name string) bool {
+	if _, ok := s.names[name]; ok {
+		return true
+	}
+	for _, suffix := range s.suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *limiter) evalServerName(e *evaluation) bool {
+	if e.sni == "" {
+		return false
+	}
+	lim, ok := h.sniLimits[e.sni]
+	if !ok && h.sniKnown != nil && !h.sniKnown.contains(e.sni) {
+		if h.sniReject {
+			e.d.allow = false
+			return true
+		}
+		return false
+	}
+	e.key = serverNameKey(e.keyBytes(), e.sni)
+	if ok {
+		e.setLimits(SourceServerName, lim)
+	}
+	return false
+}
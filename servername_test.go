@@ -0,0 +1,118 @@
+package ipratelimit
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyByServerName(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:     time.Hour,
+		Burst:           1,
+		IPFunc:          IPFromXForwardedFor,
+		KeyByServerName: true,
+		ServerNameLimits: map[string]Limit{
+			"Big.Example.": {Burst: 3, RefillEvery: time.Minute},
+		},
+	}).(*limiter)
+	serve := func(sni string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		if sni != "-" {
+			req.TLS = &tls.ConnectionState{ServerName: sni}
+		}
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	for _, step := range []struct {
+		sni  string
+		want int
+	}{
+		{"a.example", http.StatusOK},
+		{"A.EXAMPLE.", http.StatusTooManyRequests}, // same tenant after normalization
+		{"b.example", http.StatusOK},               // separate budget
+		{"-", http.StatusOK},                       // no TLS, keyed by address alone
+		{"", http.StatusTooManyRequests},           // no SNI shares the address bucket
+		{"big.example", http.StatusOK},
+		{"big.example", http.StatusOK},
+		{"big.example", http.StatusOK},
+		{"big.example", http.StatusTooManyRequests},
+	} {
+		resp := serve(step.sni)
+		if resp.StatusCode != step.want {
+			t.Fatalf("server name %q: got code %d, want %d", step.sni, resp.StatusCode, step.want)
+		}
+		if step.sni == "big.example" && resp.StatusCode != http.StatusOK {
+			if got := resp.Header.Get("Retry-After"); got != "60" {
+				t.Fatalf("got Retry-After %q for overridden limit, want 60", got)
+			}
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Config{ServerNameLimits: map[string]Limit{"x": {Burst: -1}}}).Validate(); err == nil {
+		t.Fatal("negative burst of server name limit passed validation")
+	}
+}
+
+func TestStrictServerNames(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+			RefillEvery:              time.Hour,
+			Burst:                    1,
+			MaxBuckets:               100,
+			IPFunc:                   IPFromXForwardedFor,
+			KeyByServerName:          true,
+			ServerNameLimits:         map[string]Limit{"big.example": {Burst: 2}},
+			StrictServerNames:        true,
+			ServerNamePatterns:       []string{"a.example", "*.tenants.example"},
+			RejectUnknownServerNames: reject,
+		}).(*limiter)
+		serve := func(sni string) int {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Forwarded-For", "192.0.2.1")
+			req.TLS = &tls.ConnectionState{ServerName: sni}
+			rec := httptest.NewRecorder()
+			lh.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		// known names get their own buckets
+		for _, sni := range []string{"a.example", "big.example", "x.tenants.example", "y.tenants.example"} {
+			if code := serve(sni); code != http.StatusOK {
+				t.Fatalf("reject=%v: known name %q: got code %d", reject, sni, code)
+			}
+		}
+		// host spraying flood from a single address
+		for i := 0; i < 1000; i++ {
+			code := serve("spray" + strconv.Itoa(i) + ".example")
+			want := http.StatusTooManyRequests
+			switch {
+			case reject:
+				want = http.StatusMisdirectedRequest
+			case i == 0:
+				want = http.StatusOK
+			}
+			if code != want {
+				t.Fatalf("reject=%v: unknown name #%d: got code %d, want %d", reject, i, code, want)
+			}
+		}
+		if code := serve("tenants.example"); code == http.StatusOK {
+			t.Fatalf("reject=%v: wildcard matched its own suffix", reject)
+		}
+		if n := lh.Stats().Buckets; n > 5 {
+			t.Fatalf("reject=%v: %d buckets after spraying, want at most 5", reject, n)
+		}
+		if code := serve("big.example"); code != http.StatusOK {
+			t.Fatalf("reject=%v: known name bucket affected by flood: %d", reject, code)
+		}
+	}
+	if err := (&Config{ServerNamePatterns: []string{"*"}}).Validate(); err == nil {
+		t.Fatal("invalid pattern passed validation")
+	}
+}
@@ -0,0 +1,90 @@
+package ipratelimit
+
+import "sync"
+
+const (
+	// maxShards is the maximum number of shards of the built-in storage
+	maxShards = 64
+
+	// minShardBuckets is the minimum number of buckets per shard: smaller
+	// shards make eviction, which is done per shard, less precise
+	minShardBuckets = 1024
+)
+
+// shard is an independently locked part of the built-in storage holding
+// buckets of keys equal to its index modulo the number of shards. Each
+// shard has its own share of capacity and evicts its own buckets.
+type shard struct {
+	m              sync.Mutex
+	ipmap          map[uint64]bucket
+	keys           keyQueue            // eviction queue of keys of ipmap
+	capacity       int                 // maximum number of buckets
+	evictDebt      int                 // buckets left to evict, if evictSlice is set
+	classUsage     []int               // buckets by class index, nil if quotas are not set
+	streaks        StreakHistogram     // completed denial streaks, if trackStats is set
+	youngEvictions int                 // evictions of young buckets since the last growth check
+	history        map[uint64]*history // last decisions by key, if historySize is set
+	owners         map[uint64]uint64   // owner hashes by key, if exactKeys is set
+	totals         map[uint64]totals   // lifetime totals by key, if trackStats is set
+
+	_ [64]byte // keeps locks of adjacent shards on separate cache lines
+}
+
+// numShards returns the number of shards to split capacity of the given
+// number of buckets into
+func numShards(capacity int) int {
+	return min(max(capacity/minShardBuckets, 1), maxShards)
+}
+
+// newShards returns n shards sharing capacity buckets
+func newShards(n, capacity int) []shard {
+	shards := make([]shard, n)
+	for i := range shards {
+		size := shardCapacity(capacity, n, i)
+		shards[i].ipmap = make(map[uint64]bucket, size)
+		shards[i].capacity = size
+	}
+	return shards
+}
+
+// shardCapacity returns share of capacity buckets of the i-th of n shards,
+// shares add up to capacity
+func shardCapacity(capacity, n, i int) int {
+	size := capacity / n
+	if i < capacity%n {
+		size++
+	}
+	return max(size, 1)
+}
+
+// shardOf returns shard holding bucket with the given key
+func (h *limiter) shardOf(key uint64) *shard {
+	return &h.shards[key%uint64(len(h.shards))]
+}
+
+// bucketOf returns copy of the bucket with the given key, if any
+func (h *limiter) bucketOf(key uint64) (bucket, bool) { return h.bucketOfData(key, nil) }
+
+// bucketOfData returns copy of the bucket of data with the given key hash,
+// if any, see Config.ExactKeys
+func (h *limiter) bucketOfData(key uint64, data []byte) (bucket, bool) {
+	s := h.shardOf(key)
+	s.m.Lock()
+	defer s.m.Unlock()
+	key, _ = h.slotOf(s, key, data)
+	bkt, ok := s.ipmap[key]
+	return bkt, ok
+}
+
+// buckets returns the number of buckets and their maximum number summed
+// over all shards, locking one shard at a time
+func (h *limiter) buckets() (n, capacity int) {
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		n += len(s.ipmap)
+		capacity += s.capacity
+		s.m.Unlock()
+	}
+	return n, capacity
+}
@@ -0,0 +1,112 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNumShards(t *testing.T) {
+	for _, tc := range []struct{ capacity, want int }{
+		{100, 1},
+		{2047, 1},
+		{2048, 2},
+		{20000, 19},
+		{100000, 64},
+		{1 << 30, 64},
+	} {
+		if got := numShards(tc.capacity); got != tc.want {
+			t.Errorf("numShards(%d) = %d, want %d", tc.capacity, got, tc.want)
+		}
+		n, total := numShards(tc.capacity), 0
+		for i := 0; i < n; i++ {
+			total += shardCapacity(tc.capacity, n, i)
+		}
+		if total != tc.capacity {
+			t.Errorf("shards of %d buckets add up to %d", tc.capacity, total)
+		}
+	}
+}
+
+// TestShardsConcurrent drives concurrent requests from more addresses than
+// the limiter can hold, checking that each shard keeps within its share and
+// its invariants hold
+func TestShardsConcurrent(t *testing.T) {
+	const maxBuckets = 20000
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		MaxBuckets:  maxBuckets,
+		TrackStats:  true,
+		Class:       func(r *http.Request) string { return r.Method },
+		ClassQuotas: map[string]float64{http.MethodPost: 0.1},
+	}).(*limiter)
+	if n := len(lh.shards); n != numShards(maxBuckets) || n < 2 {
+		t.Fatalf("got %d shards", n)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < maxBuckets/2; i++ {
+				ip := net.IPv4(10, byte(g), byte(i>>8), byte(i))
+				lh.Allow(ip)
+				lh.Allow(ip)
+				lh.Allow(ip)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatalf("%v\nstate:\n%s", err, lh.dumpState(20))
+	}
+	st := lh.Stats()
+	if st.MaxBuckets != maxBuckets || st.Buckets > maxBuckets || st.Buckets < maxBuckets/2 {
+		t.Errorf("got %d buckets of %d", st.Buckets, st.MaxBuckets)
+	}
+	if st.DenialStreaks.Total() == 0 {
+		t.Error("denial streaks of evicted buckets not merged across shards")
+	}
+	if st.ClassBuckets[""] != st.Buckets {
+		t.Errorf("class buckets %v don't add up to %d", st.ClassBuckets, st.Buckets)
+	}
+}
+
+// BenchmarkParallel compares throughput of the limiter handling requests
+// from distinct addresses with a single shard and with the default number
+// of shards
+func BenchmarkParallel(b *testing.B) {
+	const maxBuckets = 100000
+	for _, single := range []bool{true, false} {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: time.Second / 10,
+			Burst:       5,
+			MaxBuckets:  maxBuckets,
+			IPFunc:      IPFromXForwardedFor,
+		}).(*limiter)
+		if single {
+			lh.shards = newShards(1, maxBuckets)
+		}
+		b.Run(fmt.Sprintf("shards=%d", len(lh.shards)), func(b *testing.B) {
+			var seq atomic.Uint32
+			b.RunParallel(func(pb *testing.PB) {
+				req := httptest.NewRequest("GET", "/", nil)
+				w := httptest.NewRecorder()
+				base := seq.Add(1) << 20
+				for i := uint32(0); pb.Next(); i++ {
+					n := base + i%maxBuckets
+					req.Header.Set("X-Forwarded-For", "10."+strconv.Itoa(int(n>>16&0xff))+"."+
+						strconv.Itoa(int(n>>8&0xff))+"."+strconv.Itoa(int(n&0xff)))
+					lh.ServeHTTP(w, req)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package ipratelimit
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestShedResponse checks that requests denied by the shared bucket of new
+// addresses get ShedResponse, unlike requests of rate limited clients
+func TestShedResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cfg        Config
+		wantStatus int
+		wantRetry  bool
+		wantType   string
+	}{
+		{"default", Config{}, http.StatusServiceUnavailable, true, "text/plain; charset=utf-8"},
+		{"custom", Config{ShedResponse: Response{Status: http.StatusInternalServerError, RetryAfter: RetryAfterOmit}},
+			http.StatusInternalServerError, false, "text/plain; charset=utf-8"},
+		{"problem details", Config{ProblemDetails: true}, http.StatusServiceUnavailable, true, ProblemContentType},
+		{"limit response not applied", Config{Response: Response{Status: http.StatusForbidden, Body: BodyEmpty}},
+			http.StatusServiceUnavailable, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var limited int
+			cfg := tc.cfg
+			cfg.RefillEvery, cfg.Burst = time.Hour, 1
+			cfg.IPFunc = IPFromXForwardedFor
+			cfg.LimitedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				limited++
+				w.WriteHeader(http.StatusTooManyRequests)
+			})
+			lh := New(http.NotFoundHandler(), &cfg).(*limiter)
+			serve := func(addr string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", addr)
+				w := httptest.NewRecorder()
+				lh.ServeHTTP(w, req)
+				return w
+			}
+			serve("192.0.2.1")
+			lh.BeginDrain()
+			// rate limited client of existing bucket
+			if w := serve("192.0.2.1"); w.Code != http.StatusTooManyRequests || limited != 1 {
+				t.Fatalf("rate limited client: got status %d, LimitedHandler called %d times", w.Code, limited)
+			}
+			// new addresses share a single bucket while draining
+			if w := serve("198.51.100.1"); w.Code != http.StatusNotFound {
+				t.Fatalf("first new address: got status %d", w.Code)
+			}
+			w := serve("198.51.100.2")
+			if w.Code != tc.wantStatus || limited != 1 {
+				t.Fatalf("shed request: got status %d, LimitedHandler called %d times", w.Code, limited)
+			}
+			if got := w.Header().Get("Retry-After") != ""; got != tc.wantRetry {
+				t.Errorf("Retry-After set: %v, want %v", got, tc.wantRetry)
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.wantType {
+				t.Errorf("got Content-Type %q, want %q", got, tc.wantType)
+			}
+			if tc.wantType == ProblemContentType {
+				var p problem
+				if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Status != tc.wantStatus ||
+					p.Limit != 0 || !strings.HasPrefix(p.Detail, "Service is over capacity") {
+					t.Errorf("got problem %+v, %v", p, err)
+				}
+			}
+			if c := lh.Counters(); c.Denied != 2 || c.Shed != 1 {
+				t.Errorf("got %d denied, %d shed", c.Denied, c.Shed)
+			}
+			rec := httptest.NewRecorder()
+			lh.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			for _, line := range []string{
+				`ipratelimit_shed_total{limiter=""} 1`,
+				`ipratelimit_decisions_total{limiter="",decision="denied"} 2`,
+			} {
+				if !strings.Contains(rec.Body.String(), line+"\n") {
+					t.Errorf("metrics have no %s", line)
+				}
+			}
+		})
+	}
+}
+
+// TestShedNewKeyOverflow checks that requests denied by the shared bucket
+// of NewKeyAlertOverflow are shed
+func TestShedNewKeyOverflow(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:         time.Hour,
+		Burst:               1,
+		NewKeyAlertRate:     1,
+		NewKeyAlertOverflow: true,
+	}).(*limiter)
+	var codes []int
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = net.IPv4(192, 0, 2, byte(i)).String() + ":1234"
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	// the first key is under the alert rate, the second one takes the
+	// token of the shared bucket, the rest are shed
+	want := []int{http.StatusNotFound, http.StatusNotFound, http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("got statuses %v, want %v", codes, want)
+		}
+	}
+	if c := lh.Counters(); c.Shed != 2 {
+		t.Fatalf("got %d shed", c.Shed)
+	}
+}
@@ -0,0 +1,52 @@
+package ipratelimit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSkip(t *testing.T) {
+	var ipfuncCalls int
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		IPFunc: func(r *http.Request) net.IP {
+			ipfuncCalls++
+			return IPFromXForwardedFor(r)
+		},
+		Skip: func(r *http.Request) bool { return r.Header.Get("X-App-Secret") == "s3cr3t" },
+	}).(*limiter)
+	serve := func(addr, secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		if secret != "" {
+			req.Header.Set("X-App-Secret", secret)
+		}
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < 5; i++ {
+		if code := serve("192.0.2.1", "s3cr3t"); code != http.StatusNotFound {
+			t.Fatalf("skipped request %d: got status %d", i, code)
+		}
+	}
+	if ipfuncCalls != 0 {
+		t.Fatalf("IPFunc called %d times for skipped requests", ipfuncCalls)
+	}
+	if n := lh.Stats().Buckets; n != 0 {
+		t.Fatalf("skipped requests created %d buckets", n)
+	}
+	if code := serve("192.0.2.1", "wrong"); code != http.StatusNotFound {
+		t.Fatalf("first request: got status %d", code)
+	}
+	if code := serve("192.0.2.1", ""); code != http.StatusTooManyRequests {
+		t.Fatalf("second request: got status %d", code)
+	}
+	if n := lh.Stats().Buckets; n != 1 {
+		t.Fatalf("got %d buckets, want 1", n)
+	}
+}
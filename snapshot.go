@@ -0,0 +1,232 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/cespare/xxhash"
+)
+
+// Snapshot binary encoding, version 2, all integers are big-endian:
+//
+//	size field
+//	4    magic "IPRL"
+//	1    version, 2
+//
+// followed by blocks of buckets, each block is:
+//
+//	4    number of buckets n
+//	34*n buckets: 8 bytes key hash, 8 bytes tokens left as IEEE 754
+//	     float64 bits, 8 bytes last access time as nanoseconds since Unix
+//	     epoch, 8 bytes end of the penalty ban as nanoseconds since Unix
+//	     epoch or 0, 2 bytes denials counted towards the penalty
+//
+// and terminated by a block of zero buckets followed by 8 bytes xxhash of
+// all bucket bytes. Version 1 buckets are 24 bytes, without the penalty
+// fields.
+const (
+	snapshotMagic      = "IPRL"
+	snapshotVersion1   = 1
+	snapshotVersion2   = 2
+	snapshotEntrySize1 = 24
+	snapshotEntrySize  = 34
+	snapshotHeaderSize = len(snapshotMagic) + 1
+)
+
+var (
+	errSnapshotMagic    = errors.New("ipratelimit: not a snapshot")
+	errSnapshotVersion  = errors.New("ipratelimit: unsupported snapshot version")
+	errSnapshotChecksum = errors.New("ipratelimit: snapshot checksum mismatch")
+)
+
+// Snapshot writes buckets of the built-in storage to w in a compact
+// versioned binary encoding, to be loaded with Restore, e.g. by the next
+// instance of the service after restart. Only tokens left, last access
+// time and penalty state (see Config.PenaltyThreshold) of each bucket are
+// saved, addresses are not stored, only their hashes.
+//
+// Shards are saved one by one: buckets of a shard are copied under its
+// lock, which is released before writing them, so traffic proceeds while
+// snapshot is in progress. Snapshot is not consistent across shards.
+//
+// Handler returned by New implements interface{ Snapshot(io.Writer) error }.
+func (h *limiter) Snapshot(w io.Writer) error {
+	sw := newSnapshotWriter(w)
+	var buf []byte
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		buf = buf[:0]
+		for k, bkt := range s.ipmap {
+			buf = binary.BigEndian.AppendUint64(buf, k)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(bkt.left))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(bkt.mtime))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(bkt.bannedTo))
+			buf = binary.BigEndian.AppendUint16(buf, bkt.denials)
+		}
+		s.m.Unlock()
+		sw.block(buf)
+	}
+	return sw.close()
+}
+
+// snapshotWriter writes snapshot encoding, keeping the first error
+type snapshotWriter struct {
+	w   *bufio.Writer
+	sum hash.Hash64
+	err error
+}
+
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	sw := &snapshotWriter{w: bufio.NewWriter(w), sum: xxhash.New()}
+	sw.write(append([]byte(snapshotMagic), snapshotVersion2))
+	return sw
+}
+
+func (sw *snapshotWriter) write(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+// block writes block of encoded buckets, skipping empty ones
+func (sw *snapshotWriter) block(buckets []byte) {
+	if len(buckets) == 0 {
+		return
+	}
+	sw.write(binary.BigEndian.AppendUint32(nil, uint32(len(buckets)/snapshotEntrySize)))
+	sw.write(buckets)
+	sw.sum.Write(buckets)
+}
+
+// close writes the terminating block and flushes the output
+func (sw *snapshotWriter) close() error {
+	sw.write(binary.BigEndian.AppendUint32(nil, 0))
+	sw.write(binary.BigEndian.AppendUint64(nil, sw.sum.Sum64()))
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.err
+}
+
+// Restore loads buckets saved by Snapshot. Input is read and verified as a
+// whole before any bucket is added, so on error the limiter is left
+// intact. Skipped are buckets that would have been refilled to the full
+// burst since their last access, unless their penalty ban is still on,
+// buckets already present, which reflect more recent state, and ones which
+// don't fit into shards of the storage. Progress is reported in Stats, as
+// for RestoreCSV.
+//
+// Handler returned by New implements interface{ Restore(io.Reader) error }.
+func (h *limiter) Restore(r io.Reader) error {
+	h.restoring.Add(1)
+	defer h.restoring.Add(-1)
+	entries, err := h.readSnapshot(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		n := min(len(entries), exportBatch)
+		h.restoreBatch(entries[:n])
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// readSnapshot decodes snapshot from r, returning entries of buckets still
+// worth restoring
+func (h *limiter) readSnapshot(r io.Reader) ([]restoreEntry, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("ipratelimit: restore: reading header: %w", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errSnapshotMagic
+	}
+	var size int
+	switch header[len(snapshotMagic)] {
+	case snapshotVersion1:
+		size = snapshotEntrySize1
+	case snapshotVersion2:
+		size = snapshotEntrySize
+	default:
+		return nil, errSnapshotVersion
+	}
+	now := h.now().UnixNano()
+	def := h.gen.Load().def
+	h.m.Lock()
+	maxBurst := h.maxBurst
+	h.m.Unlock()
+	sum := xxhash.New()
+	var entries []restoreEntry
+	var skipped uint64
+	buf := make([]byte, size*exportBatch)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return nil, fmt.Errorf("ipratelimit: restore: reading block: %w", unexpectedEOF(err))
+		}
+		n := int(binary.BigEndian.Uint32(hdr[:4]))
+		if n == 0 {
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				return nil, fmt.Errorf("ipratelimit: restore: reading checksum: %w", unexpectedEOF(err))
+			}
+			if binary.BigEndian.Uint64(hdr[:]) != sum.Sum64() {
+				return nil, errSnapshotChecksum
+			}
+			h.counters.restoreSkipped.Add(skipped)
+			return entries, nil
+		}
+		for n > 0 {
+			chunk := buf[:min(n, exportBatch)*size]
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, fmt.Errorf("ipratelimit: restore: reading buckets: %w", unexpectedEOF(err))
+			}
+			sum.Write(chunk)
+			n -= len(chunk) / size
+			for b := chunk; len(b) > 0; b = b[size:] {
+				ent := restoreEntry{key: binary.BigEndian.Uint64(b)}
+				left := math.Float64frombits(binary.BigEndian.Uint64(b[8:]))
+				mtime := int64(binary.BigEndian.Uint64(b[16:]))
+				var bannedTo int64
+				var denials uint16
+				if size == snapshotEntrySize {
+					bannedTo = int64(binary.BigEndian.Uint64(b[24:]))
+					denials = binary.BigEndian.Uint16(b[32:])
+				}
+				if math.IsNaN(left) || math.IsInf(left, 0) || mtime <= 0 || bannedTo < 0 {
+					return nil, fmt.Errorf("ipratelimit: restore: invalid bucket %s", formatKey(ent.key))
+				}
+				// clocks of hosts may differ a bit
+				mtime = min(mtime, now)
+				if bannedTo <= now {
+					if left+float64(now-mtime)/def.refillEvery >= def.burst {
+						skipped++ // would be full by now
+						continue
+					}
+					bannedTo = 0
+				}
+				ent.bkt = bucket{
+					left:     min(max(left, 0), maxBurst),
+					mtime:    mtime,
+					bannedTo: bannedTo,
+					denials:  denials,
+				}
+				entries = append(entries, ent)
+			}
+		}
+	}
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF, err otherwise
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	newLimiter := func(now *time.Time) *limiter {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery: time.Minute,
+			Burst:       5,
+			MaxBuckets:  100000,
+		}).(*limiter)
+		lh.now = func() time.Time { return *now }
+		return lh
+	}
+	now := time.Unix(1700000000, 0)
+	src := newLimiter(&now)
+	ipOf := func(i int) net.IP {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, 0x0a000000+uint32(i))
+		return ip
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		for j := 0; j <= i%5; j++ {
+			src.Allow(ipOf(i))
+		}
+	}
+	// takes a single token, full again in a minute
+	now = now.Add(-time.Minute)
+	src.Allow(net.IPv4(192, 0, 2, 1))
+	now = now.Add(time.Minute)
+
+	var snap bytes.Buffer
+	if err := src.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if max := snapshotHeaderSize + len(src.shards)*4 + (n+1)*snapshotEntrySize + 12; snap.Len() > max {
+		t.Errorf("snapshot is %d bytes, want at most %d", snap.Len(), max)
+	}
+	now = now.Add(time.Second)
+	dst := newLimiter(&now)
+	if err := dst.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+	st := dst.Stats()
+	if st.Buckets != n || st.Restored != n || st.RestoreSkipped != 1 || st.Restoring {
+		t.Fatalf("got %d buckets, %d restored, %d skipped", st.Buckets, st.Restored, st.RestoreSkipped)
+	}
+	for i := 0; i < n; i++ {
+		key := keyOf(ipOf(i))
+		want, _ := src.bucketOf(key)
+		got, ok := dst.bucketOf(key)
+		if !ok || got.left != want.left || got.mtime != want.mtime {
+			t.Fatalf("bucket %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	// restored state is enforced
+	if dst.Allow(ipOf(4)) {
+		t.Error("client which used up its burst allowed after restore")
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	src := New(http.NotFoundHandler(), &Config{RefillEvery: time.Minute, Burst: 5}).(*limiter)
+	src.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		src.Allow(net.IPv4(192, 0, 2, byte(i)))
+	}
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap := buf.Bytes()
+	// valid snapshot with the given buckets encoded
+	encode := func(buckets []byte) []byte {
+		var b bytes.Buffer
+		sw := newSnapshotWriter(&b)
+		sw.block(buckets)
+		sw.close()
+		return b.Bytes()
+	}
+	nanBucket := binary.BigEndian.AppendUint64(nil, 1)
+	nanBucket = binary.BigEndian.AppendUint64(nanBucket, math.Float64bits(math.NaN()))
+	nanBucket = binary.BigEndian.AppendUint64(nanBucket, uint64(now.UnixNano()))
+	nanBucket = append(nanBucket, make([]byte, snapshotEntrySize-len(nanBucket))...)
+
+	inputs := map[string][]byte{
+		"empty":       nil,
+		"magic":       append([]byte("IPRX"), snap[4:]...),
+		"version":     append(append([]byte(snapshotMagic), 3), snap[5:]...),
+		"checksum":    append(append([]byte(nil), snap[:len(snap)-1]...), snap[len(snap)-1]^1),
+		"bucket":      append(append([]byte(nil), snap[:10]...), append([]byte{snap[10] ^ 1}, snap[11:]...)...),
+		"nan":         encode(nanBucket),
+		"zero mtime":  encode(make([]byte, snapshotEntrySize)),
+		"short block": encode(make([]byte, snapshotEntrySize))[:snapshotHeaderSize+4+snapshotEntrySize-1],
+	}
+	for i := 1; i < len(snap); i++ {
+		inputs[fmt.Sprintf("truncated to %d bytes", i)] = snap[:i]
+	}
+	for name, input := range inputs {
+		dst := New(http.NotFoundHandler(), &Config{RefillEvery: time.Minute, Burst: 5}).(*limiter)
+		dst.now = src.now
+		err := dst.Restore(bytes.NewReader(input))
+		if err == nil {
+			t.Errorf("%s: no error", name)
+			continue
+		}
+		if st := dst.Stats(); st.Buckets != 0 || st.Restored != 0 {
+			t.Errorf("%s: %v: restored %d buckets", name, err, st.Restored)
+		}
+	}
+	dst := New(http.NotFoundHandler(), nil).(*limiter)
+	if err := dst.Restore(bytes.NewReader(inputs["version"])); !errors.Is(err, errSnapshotVersion) {
+		t.Errorf("version: got %v", err)
+	}
+	if err := dst.Restore(bytes.NewReader(inputs["checksum"])); !errors.Is(err, errSnapshotChecksum) {
+		t.Errorf("checksum: got %v", err)
+	}
+}
+
+// TestSnapshotPenalty checks that penalty bans survive restore, even of
+// buckets which would have been refilled by then
+func TestSnapshotPenalty(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	newLimiter := func() *limiter {
+		lh := New(http.NotFoundHandler(), &Config{
+			RefillEvery:      time.Minute,
+			Burst:            1,
+			PenaltyThreshold: 3,
+			PenaltyDuration:  time.Hour,
+		}).(*limiter)
+		lh.now = func() time.Time { return now }
+		return lh
+	}
+	src := newLimiter()
+	banned, denied := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	for i := 0; i < 5; i++ {
+		src.Allow(banned)
+	}
+	src.Allow(denied)
+	src.Allow(denied)
+	want, _ := src.bucketOf(keyOf(banned.To4()))
+	if want.bannedTo == 0 {
+		t.Fatalf("client not banned: %+v", want)
+	}
+	var snap bytes.Buffer
+	if err := src.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	dst := newLimiter()
+	if err := dst.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := dst.bucketOf(keyOf(banned.To4())); !ok || got.bannedTo != want.bannedTo || got.denials != want.denials {
+		t.Fatalf("restored bucket %+v, want %+v", got, want)
+	}
+	if st := dst.Stats(); st.Restored != 1 || st.RestoreSkipped != 1 {
+		t.Fatalf("got %d restored, %d skipped", st.Restored, st.RestoreSkipped)
+	}
+	if dst.Allow(banned) {
+		t.Fatal("banned client allowed after restore")
+	}
+	if !dst.Allow(denied) {
+		t.Fatal("refilled client denied after restore")
+	}
+
+	// bans which ended by the time of restore are dropped
+	now = now.Add(time.Hour)
+	dst = newLimiter()
+	if err := dst.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if st := dst.Stats(); st.Buckets != 0 {
+		t.Fatalf("got %d buckets restored after ban has ended", st.Buckets)
+	}
+}
+
+// TestSnapshotVersion1 checks that snapshots without penalty state can still
+// be restored
+func TestSnapshotVersion1(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bkt := binary.BigEndian.AppendUint64(nil, 42)
+	bkt = binary.BigEndian.AppendUint64(bkt, math.Float64bits(0.5))
+	bkt = binary.BigEndian.AppendUint64(bkt, uint64(now.UnixNano()))
+	snap := append([]byte(snapshotMagic), snapshotVersion1)
+	snap = binary.BigEndian.AppendUint32(snap, 1)
+	snap = append(snap, bkt...)
+	snap = binary.BigEndian.AppendUint32(snap, 0)
+	snap = binary.BigEndian.AppendUint64(snap, xxhash.Sum64(bkt))
+
+	lh := New(http.NotFoundHandler(), &Config{RefillEvery: time.Minute, Burst: 5}).(*limiter)
+	lh.now = func() time.Time { return now }
+	if err := lh.Restore(bytes.NewReader(snap)); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := lh.bucketOf(42); !ok || got.left != 0.5 || got.mtime != now.UnixNano() || got.bannedTo != 0 {
+		t.Fatalf("restored bucket %+v", got)
+	}
+}
+
+// TestSnapshotConcurrent takes snapshots while requests are served
+func TestSnapshotConcurrent(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{RefillEvery: time.Minute, Burst: 5, MaxBuckets: 20000}).(*limiter)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ctx.Err() == nil; i++ {
+				lh.Allow(net.IPv4(10, byte(g), byte(i>>8), byte(i)))
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		if err := lh.Snapshot(&buf); err != nil {
+			t.Fatal(err)
+		}
+		dst := New(http.NotFoundHandler(), &Config{RefillEvery: time.Minute, Burst: 5, MaxBuckets: 20000}).(*limiter)
+		if err := dst.Restore(&buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
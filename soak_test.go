@@ -0,0 +1,150 @@
+package ipratelimit
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestSoak drives randomized traffic with churn and evictions through the
+// limiter, mixed with bans, policy and limit updates, maintenance passes and
+// counter resets, periodically checking its invariants and that counters
+// never decrease between resets. By default it runs for a
+// small number of iterations; set IPRATELIMIT_SOAK environment variable to
+// a duration (e.g. "24h") for a long run. The test is skipped in -short mode.
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping soak test in short mode")
+	}
+	iterations, deadline := 200000, time.Time{}
+	if s := os.Getenv("IPRATELIMIT_SOAK"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatalf("invalid IPRATELIMIT_SOAK value: %v", err)
+		}
+		iterations, deadline = 0, time.Now().Add(d)
+	}
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	cfg := &Config{
+		RefillEvery:         time.Second,
+		Burst:               5,
+		MaxBuckets:          1000,
+		NewKeyAlertRate:     5000,
+		NewKeyAlertOverflow: true,
+		MaxBans:             100,
+		MaxIdle:             time.Minute,
+		MaintenanceEvery:    -1,
+	}
+	lh := New(http.NotFoundHandler(), cfg).(*limiter)
+	defer lh.Close()
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+
+	check := func(i int) {
+		t.Helper()
+		if err := lh.checkInvariants(); err != nil {
+			t.Fatalf("iteration %d: %v\nstate:\n%s", i, err, lh.dumpState(20))
+		}
+	}
+	prev := lh.Counters()
+	checkCounters := func(i int) {
+		t.Helper()
+		cur := lh.Counters()
+		if err := monotonic(prev, cur); err != nil {
+			t.Fatalf("iteration %d: %v", i, err)
+		}
+		prev = cur
+	}
+	// heap baseline is taken once buckets, bans and queues have grown to
+	// their steady-state size
+	const warmup, heapEvery = 50000, 50000
+	var baseHeap uint64
+	var ms runtime.MemStats
+	ip := make(net.IP, 4)
+	heavy := func() net.IP { return net.IPv4(10, 0, 0, byte(rnd.Intn(16))) }
+	for i := 0; iterations == 0 || i < iterations; i++ {
+		now = now.Add(time.Duration(rnd.Int63n(int64(time.Millisecond))))
+		switch n := rnd.Intn(1000); {
+		case n < 700: // heavy hitters
+			ip[0], ip[1], ip[2], ip[3] = 10, 0, 0, byte(rnd.Intn(16))
+		case n < 990: // churn of unique clients
+			rnd.Read(ip)
+		case n < 993: // pause letting buckets refill and expire
+			now = now.Add(time.Duration(rnd.Int63n(int64(2 * time.Minute))))
+		case n < 995:
+			if err := lh.Ban(heavy(), time.Duration(rnd.Int63n(int64(time.Minute)))); err != nil && err != ErrBanTableFull {
+				t.Fatalf("iteration %d: %v", i, err)
+			}
+		case n < 996:
+			lh.Unban(heavy())
+		case n < 997:
+			p := Policy{Denylist: []string{heavy().String()}}
+			if rnd.Intn(2) == 0 {
+				p.Allowlist = []string{heavy().String()}
+			}
+			if err := lh.ApplyPolicy(p); err != nil {
+				t.Fatalf("iteration %d: %v", i, err)
+			}
+		case n < 998:
+			lh.SetLimit(time.Duration(1+rnd.Intn(2000))*time.Millisecond, 1+rnd.Intn(10))
+		case n < 999:
+			lh.RunMaintenance(now)
+		default:
+			checkCounters(i)
+			lh.ResetCounters()
+			prev = lh.Counters()
+		}
+		lh.Allow(ip)
+		if i%1000 == 0 {
+			checkCounters(i)
+		}
+		if i%10000 != 0 {
+			continue
+		}
+		check(i)
+		if i < warmup || i%heapEvery != 0 {
+			continue
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		if baseHeap == 0 {
+			baseHeap = ms.HeapAlloc
+		} else if ms.HeapAlloc > 2*baseHeap+1<<20 {
+			t.Fatalf("iteration %d: heap grown from %d to %d bytes\nstate:\n%s",
+				i, baseHeap, ms.HeapAlloc, lh.dumpState(20))
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+	}
+	check(-1)
+	checkCounters(-1)
+}
+
+// monotonic returns an error if any of the counters of cur is below its
+// value in prev
+func monotonic(prev, cur Counters) error {
+	p, c := reflect.ValueOf(prev), reflect.ValueOf(cur)
+	for i := 0; i < c.NumField(); i++ {
+		var less bool
+		if c.Field(i).CanInt() {
+			less = c.Field(i).Int() < p.Field(i).Int()
+		} else {
+			less = c.Field(i).Uint() < p.Field(i).Uint()
+		}
+		if less {
+			return fmt.Errorf("counter %s decreased from %v to %v",
+				c.Type().Field(i).Name, p.Field(i), c.Field(i))
+		}
+	}
+	return nil
+}
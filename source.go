@@ -0,0 +1,65 @@
+package ipratelimit
+
+import "strconv"
+
+// LimitSource identifies configuration the limits governing a request come
+// from. When several sources have limits for a request, the one listed
+// first here wins:
+//
+//	address      Config.Limits of the client address
+//	server name  Config.ServerNameLimits of the TLS server name
+//	default      Config.RefillEvery and Config.Burst, or SetLimit
+//
+// Numeric values of sources are stable and don't reflect the precedence.
+type LimitSource uint8
+
+const (
+	_                LimitSource = iota
+	SourceDefault                // limits of the limiter
+	SourceServerName             // Config.ServerNameLimits
+	SourceAddress                // Config.Limits
+
+	numLimitSources
+)
+
+func (s LimitSource) String() string {
+	switch s {
+	case SourceDefault:
+		return "default"
+	case SourceServerName:
+		return "server name"
+	case SourceAddress:
+		return "address"
+	}
+	return "LimitSource(" + strconv.Itoa(int(s)) + ")"
+}
+
+// limitPrecedence lists sources in the order of precedence, highest first.
+// It must match the table documented on LimitSource.
+var limitPrecedence = [...]LimitSource{
+	SourceAddress,
+	SourceServerName,
+	SourceDefault,
+}
+
+// limitCandidates holds limits of each source applicable to a request,
+// indexed by source, nil for sources without limits for it
+type limitCandidates [numLimitSources]*limits
+
+// resolveLimits returns limits of the highest precedence source among c,
+// and the source; it returns nil and zero source if c is empty
+func resolveLimits(c *limitCandidates) (*limits, LimitSource) {
+	for _, src := range limitPrecedence {
+		if c[src] != nil {
+			return c[src], src
+		}
+	}
+	return nil, 0
+}
+
+// setLimits records limits of the given source applicable to request and
+// selects the ones governing it
+func (e *evaluation) setLimits(src LimitSource, lim *limits) {
+	e.limCandidates[src] = lim
+	e.lim, e.limSource = resolveLimits(&e.limCandidates)
+}
@@ -0,0 +1,101 @@
+package ipratelimit
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResolveLimits checks every source alone and every pair of sources
+// against the precedence order
+func TestResolveLimits(t *testing.T) {
+	rank := make(map[LimitSource]int)
+	for i, src := range limitPrecedence {
+		if _, ok := rank[src]; ok {
+			t.Fatalf("%v listed twice", src)
+		}
+		rank[src] = i
+	}
+	for src := LimitSource(1); src < numLimitSources; src++ {
+		if _, ok := rank[src]; !ok {
+			t.Fatalf("%v is missing from limitPrecedence", src)
+		}
+	}
+	var c limitCandidates
+	if lim, src := resolveLimits(&c); lim != nil || src != 0 {
+		t.Errorf("empty candidates resolved to %v", src)
+	}
+	for a := LimitSource(1); a < numLimitSources; a++ {
+		for b := LimitSource(1); b < numLimitSources; b++ {
+			var c limitCandidates
+			c[a], c[b] = &limits{burst: float64(a)}, &limits{burst: float64(b)}
+			want := a
+			if rank[b] < rank[a] {
+				want = b
+			}
+			lim, src := resolveLimits(&c)
+			if src != want || lim != c[want] {
+				t.Errorf("%v and %v: got limits of %v, want %v", a, b, src, want)
+			}
+		}
+	}
+}
+
+// TestLimitSourceDocumented checks that precedence table on LimitSource
+// matches limitPrecedence
+func TestLimitSourceDocumented(t *testing.T) {
+	b, err := os.ReadFile("source.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, doc, _ := strings.Cut(string(b), "first here wins:\n//\n")
+	doc, _, _ = strings.Cut(doc, "\n//\n")
+	var got []string
+	for _, line := range strings.Split(doc, "\n") {
+		name, _, _ := strings.Cut(strings.TrimPrefix(line, "//\t"), "  ")
+		got = append(got, name)
+	}
+	var want []string
+	for _, src := range limitPrecedence {
+		want = append(want, src.String())
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("documented precedence %q, want %q", got, want)
+	}
+}
+
+func TestLimitSourceReported(t *testing.T) {
+	var events []TraceEvent
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:      time.Hour,
+		Burst:            1,
+		KeyByServerName:  true,
+		ServerNameLimits: map[string]Limit{"api.example.com": {Burst: 5}},
+		TraceHook:        func(_ context.Context, ev TraceEvent) { events = append(events, ev) },
+	}).(*limiter)
+	for _, sni := range []string{"api.example.com", "www.example.com", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if sni != "" {
+			req.TLS = &tls.ConnectionState{ServerName: sni}
+		}
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	want := []LimitSource{SourceServerName, SourceDefault, SourceDefault}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, ev := range events {
+		if ev.Source != want[i] {
+			t.Errorf("request %d: limits source %v, want %v", i, ev.Source, want[i])
+		}
+	}
+	if d, _ := lh.AllowCtx(context.Background(), net.ParseIP("192.0.2.2")); d.Source != SourceDefault {
+		t.Errorf("AllowCtx: limits source %v", d.Source)
+	}
+}
@@ -0,0 +1,146 @@
+package ipratelimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Limiter applies per-IP rate limiting outside of HTTP, e.g. to SMTP
+// connections by peer address. Handler returned by New is built on the
+// same machinery: token buckets, eviction, policy, bans and exemptions,
+// and Limiter methods behave as the handler methods of the same names.
+// It's safe for concurrent use.
+type Limiter struct {
+	l *limiter // nil if Config.Disabled is set
+}
+
+// NewLimiter returns Limiter configured as New would configure a handler.
+// Config fields specific to HTTP, like IPFunc, responses and headers, are
+// ignored. If Config.Disabled is set, all requests are allowed. Limiter
+// should be closed with Close when no longer needed.
+func NewLimiter(config *Config) *Limiter {
+	cfg := defaultConfig
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.Disabled {
+		return &Limiter{}
+	}
+	return &Limiter{l: newLimiter(&cfg)}
+}
+
+// Allow reports whether a request from the given IP address is allowed,
+// taking a single token from its bucket.
+func (l *Limiter) Allow(ip net.IP) bool { return l.AllowN(ip, 1) }
+
+// AllowN reports whether a request from the given IP address taking n
+// tokens is allowed; tokens are only taken if it is. Values of n less than
+// 1 are treated as 1. A request taking more than Burst tokens is never
+// allowed. Requests the decision could not be made for, e.g. because of
+// Store errors, are allowed unless Config.FailClosed is set, as they are by
+// ServeHTTP.
+func (l *Limiter) AllowN(ip net.IP, n int) bool {
+	if l.l == nil {
+		return true
+	}
+	e := evaluation{ctx: context.Background(), ip: ip, cost: float64(max(n, 1))}
+	l.l.evaluate(&e)
+	if e.err != nil {
+		return e.observed || !l.l.failClosed
+	}
+	return e.observed || e.d.allow
+}
+
+// Stats returns current limiter state, zero if Config.Disabled is set.
+func (l *Limiter) Stats() Stats {
+	if l.l == nil {
+		return Stats{}
+	}
+	return l.l.Stats()
+}
+
+// Counters returns current Counters without taking any locks, zero if
+// Config.Disabled is set.
+func (l *Limiter) Counters() Counters {
+	if l.l == nil {
+		return Counters{}
+	}
+	return l.l.Counters()
+}
+
+// SetLimit replaces the refill interval and burst size of the limiter,
+// existing buckets keep their tokens.
+func (l *Limiter) SetLimit(refillEvery time.Duration, burst int) {
+	if l.l != nil {
+		l.l.SetLimit(refillEvery, burst)
+	}
+}
+
+// RunMaintenance makes a single maintenance pass as of now, see
+// Config.MaintenanceEvery.
+func (l *Limiter) RunMaintenance(now time.Time) {
+	if l.l != nil {
+		l.l.RunMaintenance(now)
+	}
+}
+
+// EmitSummary logs counters accrued since the previous summary, see
+// Config.SummaryEvery.
+func (l *Limiter) EmitSummary(now time.Time) {
+	if l.l != nil {
+		l.l.EmitSummary(now)
+	}
+}
+
+// Close stops background goroutines of the limiter, if any.
+func (l *Limiter) Close() error {
+	if l.l == nil {
+		return nil
+	}
+	return l.l.Close()
+}
+
+// Ban makes all requests from the given IP address denied for the duration
+// d, see Config.MaxBans.
+func (l *Limiter) Ban(ip net.IP, d time.Duration) error {
+	if l.l == nil {
+		return disabled{}.Ban(ip, d)
+	}
+	return l.l.Ban(ip, d)
+}
+
+// Unban lifts the ban of the given IP address, if any.
+func (l *Limiter) Unban(ip net.IP) {
+	if l.l != nil {
+		l.l.Unban(ip)
+	}
+}
+
+// ApplyPolicy validates p and atomically replaces the current policy with
+// it, see Config.Policy.
+func (l *Limiter) ApplyPolicy(p Policy) error {
+	if l.l == nil {
+		return disabled{}.ApplyPolicy(p)
+	}
+	return l.l.ApplyPolicy(p)
+}
+
+// Snapshot writes state of all buckets to w in a compact binary format,
+// which can be loaded with Restore.
+func (l *Limiter) Snapshot(w io.Writer) error {
+	if l.l == nil {
+		return disabled{}.Snapshot(w)
+	}
+	return l.l.Snapshot(w)
+}
+
+// Restore loads buckets saved by Snapshot, buckets already present take
+// precedence over restored ones.
+func (l *Limiter) Restore(r io.Reader) error {
+	if l.l == nil {
+		return disabled{}.Restore(r)
+	}
+	return l.l.Restore(r)
+}
@@ -0,0 +1,153 @@
+package ipratelimit
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(&Config{
+		RefillEvery: time.Hour,
+		Burst:       5,
+		MaxBuckets:  100,
+		Policy:      Policy{Allowlist: []string{"192.0.2.1"}, Denylist: []string{"192.0.2.2"}},
+	})
+	defer l.Close()
+	ip := net.IPv4(198, 51, 100, 1)
+	if !l.AllowN(ip, 3) {
+		t.Fatal("AllowN(3) denied on a full bucket")
+	}
+	if l.AllowN(ip, 3) {
+		t.Fatal("AllowN(3) allowed with 2 tokens left")
+	}
+	if !l.AllowN(ip, 2) {
+		t.Fatal("denied AllowN took tokens")
+	}
+	if l.Allow(ip) {
+		t.Fatal("Allow allowed on an empty bucket")
+	}
+	if l.AllowN(net.IPv4(198, 51, 100, 2), 6) {
+		t.Fatal("AllowN over Burst allowed")
+	}
+	if !l.AllowN(net.IPv4(198, 51, 100, 3), 0) || !l.AllowN(net.IPv4(198, 51, 100, 3), 4) || l.Allow(net.IPv4(198, 51, 100, 3)) {
+		t.Fatal("AllowN(0) is not treated as AllowN(1)")
+	}
+	for i := 0; i < 10; i++ {
+		if !l.Allow(net.IPv4(192, 0, 2, 1)) {
+			t.Fatal("allowlisted address denied")
+		}
+	}
+	if l.Allow(net.IPv4(192, 0, 2, 2)) {
+		t.Fatal("denylisted address allowed")
+	}
+
+	// eviction keeps the number of buckets bounded, as with New
+	for i := 0; i < 1000; i++ {
+		l.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)))
+	}
+	if st := l.Stats(); st.Buckets > st.MaxBuckets || st.MaxBuckets != 100 {
+		t.Fatalf("got %d buckets, maximum %d", st.Buckets, st.MaxBuckets)
+	}
+	if err := l.l.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	const burst = 100
+	l := NewLimiter(&Config{RefillEvery: time.Hour, Burst: burst})
+	defer l.Close()
+	ip := net.IPv4(192, 0, 2, 1)
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if l.Allow(ip) {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := allowed.Load(); n != burst {
+		t.Fatalf("%d requests allowed, want %d", n, burst)
+	}
+}
+
+// TestLimiterControl checks bans, policy and snapshots of Limiter
+func TestLimiterControl(t *testing.T) {
+	l := NewLimiter(&Config{RefillEvery: time.Hour, Burst: 2})
+	defer l.Close()
+	ip := net.IPv4(192, 0, 2, 1)
+	if err := l.Ban(ip, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if l.Allow(ip) {
+		t.Fatal("banned address allowed")
+	}
+	l.Unban(ip)
+	if !l.Allow(ip) {
+		t.Fatal("unbanned address denied")
+	}
+	if err := l.ApplyPolicy(Policy{Denylist: []string{"bogus"}}); err == nil {
+		t.Fatal("invalid policy applied")
+	}
+	if err := l.ApplyPolicy(Policy{Denylist: []string{"192.0.2.0/24"}}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Allow(ip) {
+		t.Fatal("denylisted address allowed")
+	}
+	if err := l.ApplyPolicy(Policy{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewLimiter(&Config{RefillEvery: time.Hour, Burst: 2})
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.Allow(ip) || dst.Allow(ip) {
+		t.Fatal("restored bucket doesn't hold a single token")
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l := NewLimiter(&Config{Burst: 1, Disabled: true})
+	ip := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 10; i++ {
+		if !l.Allow(ip) {
+			t.Fatal("disabled limiter denied request")
+		}
+	}
+	if st := l.Stats(); st.Allowed != 0 {
+		t.Fatalf("disabled limiter stats: %+v", st)
+	}
+	if err := l.Ban(ip, time.Hour); err != nil || !l.Allow(ip) {
+		t.Fatalf("disabled limiter ban: %v", err)
+	}
+	if err := l.ApplyPolicy(Policy{Denylist: []string{"bogus"}}); err == nil {
+		t.Fatal("disabled limiter applied invalid policy")
+	}
+	var buf bytes.Buffer
+	if err := l.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
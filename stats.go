@@ -0,0 +1,139 @@
+package ipratelimit
+
+import "time"
+
+// Stats describes the limiter state. Handler returned by New implements
+// interface{ Stats() Stats } which can be used to obtain it.
+type Stats struct {
+	Buckets     int     // current number of buckets
+	MaxBuckets  int     // current maximum number of buckets
+	NewKeyRate  float64 // previously unseen addresses over the last minute
+	NewKeyAlert bool    // whether NewKeyAlertRate alert is currently raised
+
+	// Estimated memory held by the built-in storage, in bytes: by buckets
+	// themselves, and by bookkeeping of their eviction order and, if
+	// Config.TrackHistory is set, of their decisions, as well as of their
+	// owners if Config.ExactKeys is set and of their lifetime totals if
+	// Config.TrackStats is set. Both grow and shrink with the current
+	// number of buckets, not with MaxBuckets.
+	BucketMemory      int64
+	BookkeepingMemory int64
+
+	// DenialStreaks counts completed denial streaks by length, only
+	// maintained if Config.TrackStats is set
+	DenialStreaks StreakHistogram
+
+	Counters
+
+	// IPFuncDurations counts durations of IPFunc calls, only maintained if
+	// Config.Instrument is set
+	IPFuncDurations DurationHistogram
+
+	// LimiterOverhead counts durations of ServeHTTP calls up to the
+	// point request is passed to the handler or denied, only maintained
+	// if Config.Instrument is set
+	LimiterOverhead DurationHistogram
+
+	// LockHolds counts durations a shard of the limiter state is locked for
+	// a single request, MaxLockHold is the longest of them; only maintained if
+	// Config.Instrument is set. See Config.EvictionSlice.
+	LockHolds   DurationHistogram
+	MaxLockHold time.Duration
+
+	PolicyVersion string // Version of the current Policy
+	PolicyHash    string // see PolicyHash
+
+	// RuleHits lists entries of Policy.Denylist, Config.Exempt and
+	// Policy.Allowlist in the order of evaluation with the number of
+	// requests each matched; policy entries are counted since the current
+	// policy was applied. Entries which never get hits are either unused
+	// or shadowed by earlier ones, see ApplyPolicy.
+	RuleHits []RuleHits
+
+	Bans    int // number of bans, including expired ones not yet removed
+	MaxBans int // maximum number of bans
+
+	// ExemptedUserAgents is the number of bypassed requests by each of
+	// Config.ExemptUserAgents
+	ExemptedUserAgents map[string]uint64
+
+	// ClassBuckets is the number of buckets by class if Config.ClassQuotas
+	// are set; buckets of classes not listed there are reported under the
+	// empty name
+	ClassBuckets map[string]int
+
+	Restoring bool // whether RestoreCSV is in progress
+	Draining  bool // whether BeginDrain was called
+
+	// Signs of misconfigured IPFunc, see Config.NilIPWarnFraction and
+	// Config.KeyConcentrationWarnFraction
+	NilIPWarning            bool
+	KeyConcentrationWarning bool
+}
+
+// Stats returns current limiter state
+func (h *limiter) Stats() Stats {
+	now := h.now()
+	var buckets, capacity int
+	var bookkeeping int64
+	var streaks StreakHistogram
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		buckets += len(s.ipmap)
+		capacity += s.capacity
+		bookkeeping += s.keys.memSize()
+		if h.historySize > 0 {
+			bookkeeping += int64(len(s.history)) * historyMemSize(h.historySize)
+		}
+		bookkeeping += int64(len(s.owners)) * ownerMemSize
+		bookkeeping += int64(len(s.totals)) * totalsMemSize
+		streaks.merge(s.streaks)
+		s.m.Unlock()
+	}
+	classBuckets := h.classBuckets()
+	h.m.Lock()
+	defer h.m.Unlock()
+	rate := h.newKeys.rate(now)
+	if h.alerting && rate <= float64(h.alertRate) {
+		h.lowerAlert()
+	}
+	nilIPWarning, keyWarning := h.misconfig.warnings()
+	g := h.gen.Load()
+	p := g.policy
+	return Stats{
+		Buckets:     buckets,
+		MaxBuckets:  capacity,
+		NewKeyRate:  rate,
+		NewKeyAlert: h.alerting,
+
+		BucketMemory:      int64(buckets) * bucketMemSize,
+		BookkeepingMemory: bookkeeping,
+
+		DenialStreaks: streaks,
+
+		Counters: h.counters.snapshot(),
+
+		IPFuncDurations: h.ipfuncTimes.snapshot(),
+		LimiterOverhead: h.overhead.snapshot(),
+		LockHolds:       h.lockHolds.snapshot(),
+		MaxLockHold:     time.Duration(h.maxLockHold.Load()),
+
+		PolicyVersion: p.version,
+		PolicyHash:    g.hash,
+		RuleHits:      h.ruleHits(p),
+
+		Bans:    h.bans.len(),
+		MaxBans: h.bans.max,
+
+		ExemptedUserAgents: h.exemptedUserAgents(),
+
+		ClassBuckets: classBuckets,
+
+		Restoring: h.restoring.Load() > 0,
+		Draining:  h.draining.Load(),
+
+		NilIPWarning:            nilIPWarning,
+		KeyConcentrationWarning: keyWarning,
+	}
+}
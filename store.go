@@ -0,0 +1,46 @@
+package ipratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps token buckets for the limiter, see Config.Store. It allows
+// limiter state to live outside of the process, e.g. to be shared by
+// multiple instances of the service. Implementations must be safe for
+// concurrent use.
+//
+// Package storetest provides implementations for use in tests, and
+// RunConformance to check other implementations against the built-in
+// storage.
+type Store interface {
+	// Take refills the bucket identified by key with tokens accrued
+	// since its last access at the rate of one token per refillEvery, up
+	// to burst tokens, then takes cost tokens from it if it holds enough.
+	// It reports whether tokens were taken and the number of tokens left.
+	// Bucket for a previously unseen key starts with burst tokens.
+	//
+	// Implementation should respect ctx cancellation if it does any
+	// blocking operations. Limiter handles returned error according to
+	// Config.FailClosed.
+	Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (allowed bool, remaining float64, err error)
+}
+
+// takeStore makes a decision on a single request evaluated by e using
+// h.store
+func (h *limiter) takeStore(ctx context.Context, e *evaluation) (decision, error) {
+	if err := ctx.Err(); err != nil {
+		return decision{}, err
+	}
+	allowed, remaining, err := h.store.Take(ctx, e.key, h.now(), e.cost,
+		e.lim.burst, time.Duration(e.lim.refillEvery))
+	if err != nil {
+		h.log.Printf("store error for %s: %v", h.formatSubject(e), err)
+		return decision{}, err
+	}
+	d := decision{allow: allowed, remaining: remaining, nextToken: e.lim.nextTokenIn(remaining)}
+	if allowed {
+		d.charged = e.cost
+	}
+	return d, nil
+}
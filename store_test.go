@@ -0,0 +1,322 @@
+package ipratelimit_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+	"github.com/artyom/ipratelimit/storetest"
+)
+
+type allowCtxer interface {
+	AllowCtx(context.Context, net.IP) (ipratelimit.Decision, error)
+}
+
+func TestStore(t *testing.T) {
+	store := storetest.NewMemStore()
+	handler := func(http.ResponseWriter, *http.Request) {}
+	lh := ipratelimit.New(http.HandlerFunc(handler), &ipratelimit.Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		IPFunc:      ipratelimit.IPFromXForwardedFor,
+		Store:       store,
+	})
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("request %d: got status %d, want %d", i, w.Code, want)
+		}
+	}
+	if n := store.Len(); n != 1 {
+		t.Fatalf("store holds %d buckets, want 1", n)
+	}
+}
+
+func TestStoreFailures(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		store := storetest.NewFlakyStore(storetest.NewMemStore(), 1)
+		store.ErrorRate = 1
+		handler := func(http.ResponseWriter, *http.Request) {}
+		lh := ipratelimit.New(http.HandlerFunc(handler), &ipratelimit.Config{
+			Store:      store,
+			FailClosed: failClosed,
+		})
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, req)
+		want := http.StatusOK
+		if failClosed {
+			want = http.StatusServiceUnavailable
+		}
+		if w.Code != want {
+			t.Errorf("failClosed=%v: got status %d, want %d", failClosed, w.Code, want)
+		}
+		if store.Calls() != 1 {
+			t.Errorf("failClosed=%v: store called %d times", failClosed, store.Calls())
+		}
+		c := lh.(interface{ Counters() ipratelimit.Counters }).Counters()
+		if c.Failed != 1 || c.Denied != 0 || (c.Shed == 1) != failClosed {
+			t.Errorf("failClosed=%v: got counters %+v", failClosed, c)
+		}
+	}
+}
+
+func TestStoreCancel(t *testing.T) {
+	store := storetest.NewFlakyStore(storetest.NewMemStore(), 1)
+	store.Partition(true)
+	lh := ipratelimit.New(http.NotFoundHandler(), &ipratelimit.Config{Store: store})
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := lh.(allowCtxer).AllowCtx(ctx, net.ParseIP("192.0.2.1"))
+		errc <- err
+	}()
+	for store.Calls() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("AllowCtx returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AllowCtx not unblocked by context cancellation")
+	}
+}
+
+func TestMaxLimiterTime(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		store := storetest.NewFlakyStore(storetest.NewMemStore(), 1)
+		store.Latency = time.Second
+		handler := func(http.ResponseWriter, *http.Request) {}
+		lh := ipratelimit.New(http.HandlerFunc(handler), &ipratelimit.Config{
+			Store:          store,
+			FailClosed:     failClosed,
+			MaxLimiterTime: 20 * time.Millisecond,
+		})
+		begin := time.Now()
+		w := httptest.NewRecorder()
+		lh.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if d := time.Since(begin); d > 500*time.Millisecond {
+			t.Errorf("failClosed=%v: request took %v", failClosed, d)
+		}
+		want := http.StatusOK
+		if failClosed {
+			want = http.StatusServiceUnavailable
+		}
+		if w.Code != want {
+			t.Errorf("failClosed=%v: got status %d, want %d", failClosed, w.Code, want)
+		}
+		st := lh.(interface{ Stats() ipratelimit.Stats }).Stats()
+		if st.LimiterTimeouts != 1 || (st.Shed == 1) != failClosed {
+			t.Errorf("failClosed=%v: LimiterTimeouts=%d, Shed=%d", failClosed, st.LimiterTimeouts, st.Shed)
+		}
+	}
+}
+
+func TestMaxLimiterTimeClientGone(t *testing.T) {
+	store := storetest.NewFlakyStore(storetest.NewMemStore(), 1)
+	store.Partition(true)
+	lh := ipratelimit.New(http.NotFoundHandler(), &ipratelimit.Config{
+		Store:          store,
+		MaxLimiterTime: time.Minute,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lh.(allowCtxer).AllowCtx(ctx, net.ParseIP("192.0.2.1")); err == nil {
+		t.Fatal("AllowCtx succeeded on partitioned store")
+	}
+	// deadline of the caller context is not a limiter timeout
+	if n := lh.(interface{ Stats() ipratelimit.Stats }).Stats().LimiterTimeouts; n != 0 {
+		t.Fatalf("LimiterTimeouts=%d, want 0", n)
+	}
+}
+
+// slowStore delays Take calls for a single key, which is the first key it
+// sees
+type slowStore struct {
+	ipratelimit.Store
+	delay   time.Duration
+	once    sync.Once
+	slowKey uint64
+}
+
+func (s *slowStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	s.once.Do(func() { s.slowKey = key })
+	if key == s.slowKey {
+		time.Sleep(s.delay)
+	}
+	return s.Store.Take(ctx, key, now, cost, burst, refillEvery)
+}
+
+func TestStoreSlowKeyNoConvoy(t *testing.T) {
+	store := &slowStore{Store: storetest.NewMemStore(), delay: 200 * time.Millisecond}
+	lh := ipratelimit.New(http.NotFoundHandler(), &ipratelimit.Config{
+		RefillEvery: time.Millisecond,
+		Burst:       1000,
+		Store:       store,
+	}).(allowCtxer)
+	slowIP := net.IPv4(192, 0, 2, 1)
+	lh.AllowCtx(context.Background(), slowIP) // make its key the slow one
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lh.AllowCtx(context.Background(), slowIP)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond) // let slow requests block
+	var maxLatency atomic.Int64
+	var others sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		others.Add(1)
+		go func(i int) {
+			defer others.Done()
+			begin := time.Now()
+			lh.AllowCtx(context.Background(), net.IPv4(10, 0, byte(i>>8), byte(i)))
+			d := int64(time.Since(begin))
+			for {
+				cur := maxLatency.Load()
+				if d <= cur || maxLatency.CompareAndSwap(cur, d) {
+					break
+				}
+			}
+		}(i)
+	}
+	others.Wait()
+	// generous threshold, still well below the slow key delay
+	if d := time.Duration(maxLatency.Load()); d >= store.delay/2 {
+		t.Errorf("requests for other keys took up to %v while one key was slow", d)
+	}
+	wg.Wait()
+}
+
+// countingStore counts Take calls
+type countingStore struct {
+	ipratelimit.Store
+	calls atomic.Int64
+}
+
+func (s *countingStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	s.calls.Add(1)
+	return s.Store.Take(ctx, key, now, cost, burst, refillEvery)
+}
+
+func TestStoreDrain(t *testing.T) {
+	store := &countingStore{Store: storetest.NewMemStore()}
+	lh := ipratelimit.New(http.NotFoundHandler(), &ipratelimit.Config{
+		RefillEvery: time.Hour,
+		Burst:       2,
+		Store:       store,
+	})
+	limiter := lh.(interface {
+		Allow(net.IP) bool
+		BeginDrain()
+	})
+	limiter.Allow(net.IPv4(192, 0, 2, 1))
+	limiter.BeginDrain()
+	var allowed int
+	for i := 0; i < 5; i++ {
+		if limiter.Allow(net.IPv4(192, 0, 2, byte(i))) {
+			allowed++
+		}
+	}
+	if n := store.calls.Load(); n != 1 {
+		t.Fatalf("store called %d times, want 1", n)
+	}
+	if allowed != 2 {
+		t.Fatalf("%d requests allowed while draining, want 2", allowed)
+	}
+}
+
+// takeCall records arguments of a single Store.Take call
+type takeCall struct {
+	key         uint64
+	now         time.Time
+	cost, burst float64
+	refillEvery time.Duration
+}
+
+// recordingStore records arguments of Take calls, allowing all of them
+type recordingStore struct {
+	mu    sync.Mutex
+	calls []takeCall
+}
+
+func (s *recordingStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, takeCall{key, now, cost, burst, refillEvery})
+	return true, burst - cost, nil
+}
+
+func TestStoreParams(t *testing.T) {
+	store := &recordingStore{}
+	lh := ipratelimit.New(http.NotFoundHandler(), &ipratelimit.Config{
+		RefillEvery:      time.Minute,
+		Burst:            5,
+		IPFunc:           ipratelimit.IPFromXForwardedFor,
+		KeyByServerName:  true,
+		ServerNameLimits: map[string]ipratelimit.Limit{"api.example.com": {RefillEvery: time.Second, Burst: 20}},
+		Cost: func(r *http.Request) float64 {
+			if r.Method == http.MethodPost {
+				return 3
+			}
+			return 1
+		},
+		Store: store,
+	})
+	begin := time.Now()
+	for _, tc := range []struct{ method, addr, sni string }{
+		{http.MethodGet, "192.0.2.1", ""},
+		{http.MethodPost, "192.0.2.1", ""},
+		{http.MethodGet, "192.0.2.2", ""},
+		{http.MethodGet, "192.0.2.1", "api.example.com"},
+	} {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		req.Header.Set("X-Forwarded-For", tc.addr)
+		if tc.sni != "" {
+			req.TLS = &tls.ConnectionState{ServerName: tc.sni}
+		}
+		lh.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	end := time.Now()
+	calls := store.calls
+	if len(calls) != 4 {
+		t.Fatalf("got %d Take calls, want 4", len(calls))
+	}
+	for i, want := range []takeCall{
+		{cost: 1, burst: 5, refillEvery: time.Minute},
+		{cost: 3, burst: 5, refillEvery: time.Minute},
+		{cost: 1, burst: 5, refillEvery: time.Minute},
+		{cost: 1, burst: 20, refillEvery: time.Second},
+	} {
+		c := calls[i]
+		if c.cost != want.cost || c.burst != want.burst || c.refillEvery != want.refillEvery {
+			t.Errorf("call %d: got cost %v, burst %v, refill every %v; want %v, %v, %v",
+				i, c.cost, c.burst, c.refillEvery, want.cost, want.burst, want.refillEvery)
+		}
+		if c.now.Before(begin) || c.now.After(end) {
+			t.Errorf("call %d: time %v out of [%v, %v]", i, c.now, begin, end)
+		}
+	}
+	if calls[0].key != calls[1].key {
+		t.Error("requests from the same address got different keys")
+	}
+	if calls[0].key == calls[2].key || calls[0].key == calls[3].key {
+		t.Error("requests of different buckets got the same key")
+	}
+}
@@ -0,0 +1,89 @@
+package storetest
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+// ConformanceVectors holds test vectors RunConformance uses, in JSON. It is
+// a list of vectors, each setting token bucket parameters and listing steps:
+// requests made at the given offset from the common start time, taking cost
+// tokens (1 if not set) from the bucket of the given key (0 if not set),
+// along with the expected decision, tokens remaining and Retry-After value
+// in seconds, the latter only for denied requests.
+//
+// The same vectors are checked against the limiter built-in storage, so
+// forks and ports of the token bucket algorithm can use them to verify their
+// semantics match.
+//
+//go:embed testdata/conformance.json
+var ConformanceVectors []byte
+
+type vector struct {
+	Name          string
+	Burst         int
+	RefillEvery   duration `json:"refill_every"`
+	MaxRetryAfter duration `json:"max_retry_after"`
+	Steps         []struct {
+		At         duration
+		Key        uint64
+		Cost       float64
+		Allow      bool
+		Remaining  float64
+		RetryAfter int `json:"retry_after"`
+	}
+}
+
+// duration is time.Duration decoded from its string form
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// RunConformance checks that store implements the same token bucket
+// semantics as the limiter built-in storage by running ConformanceVectors
+// against it, each vector as a subtest. Retry-After values are derived by
+// the limiter from the tokens remaining, so they are not checked here.
+//
+// Vectors use distinct keys, and times far from the current one, so store
+// should be empty, or at least not used by anything else.
+func RunConformance(t *testing.T, store ipratelimit.Store) {
+	t.Helper()
+	var vectors []vector
+	if err := json.Unmarshal(ConformanceVectors, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			for j, s := range v.Steps {
+				if s.Cost == 0 {
+					s.Cost = 1
+				}
+				key := uint64(i)<<32 | s.Key
+				allowed, remaining, err := store.Take(context.Background(), key, start.Add(time.Duration(s.At)),
+					s.Cost, float64(v.Burst), time.Duration(v.RefillEvery))
+				if err != nil {
+					t.Fatalf("step %d: %v", j, err)
+				}
+				if allowed != s.Allow || math.Abs(remaining-s.Remaining) > 1e-9 {
+					t.Fatalf("step %d (key %d at %v, cost %v): got allowed=%v, remaining=%v, want %v, %v",
+						j, s.Key, time.Duration(s.At), s.Cost, allowed, remaining, s.Allow, s.Remaining)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+var _ ipratelimit.Store = (*FlakyStore)(nil)
+
+// ErrInjected is returned by FlakyStore for injected failures
+var ErrInjected = errors.New("storetest: injected store failure")
+
+// FlakyStore wraps ipratelimit.Store injecting latency, errors and network
+// partitions. Given the same seed and sequence of calls it injects the same
+// faults. Exported fields must not be modified concurrently with Take calls.
+type FlakyStore struct {
+	Store     ipratelimit.Store
+	Latency   time.Duration // added to every call
+	Jitter    time.Duration // random latency in [0, Jitter) added to every call
+	ErrorRate float64       // probability of a call failing with ErrInjected
+
+	mu          sync.Mutex
+	rnd         *rand.Rand
+	partitioned bool
+	calls       int
+}
+
+// NewFlakyStore returns FlakyStore wrapping s, which injects no faults until
+// configured to do so. Random faults are derived from seed.
+func NewFlakyStore(s ipratelimit.Store, seed int64) *FlakyStore {
+	return &FlakyStore{Store: s, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Partition simulates network partition: while it is on, calls to Take
+// block until their context is done and return its error.
+func (f *FlakyStore) Partition(on bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.partitioned = on
+}
+
+// Calls returns number of Take calls made
+func (f *FlakyStore) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// Take implements ipratelimit.Store
+func (f *FlakyStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	f.mu.Lock()
+	f.calls++
+	partitioned := f.partitioned
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(f.rnd.Int63n(int64(f.Jitter)))
+	}
+	fail := f.ErrorRate > 0 && f.rnd.Float64() < f.ErrorRate
+	f.mu.Unlock()
+	if partitioned {
+		<-ctx.Done()
+		return false, 0, ctx.Err()
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return false, 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+	if fail {
+		return false, 0, ErrInjected
+	}
+	return f.Store.Take(ctx, key, now, cost, burst, refillEvery)
+}
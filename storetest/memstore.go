@@ -0,0 +1,63 @@
+// Package storetest provides ipratelimit.Store implementations meant for
+// testing code that uses the Store interface, without running external
+// services. Both implementations are supported API for downstream tests.
+package storetest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+var _ ipratelimit.Store = (*MemStore)(nil)
+
+// MemStore is an in-memory ipratelimit.Store implementation applying the
+// same token bucket math as the limiter built-in storage. It never evicts
+// buckets, so it's only suitable for tests.
+type MemStore struct {
+	mu      sync.Mutex
+	buckets map[uint64]bucket
+}
+
+type bucket struct {
+	left  float64
+	mtime time.Time
+}
+
+// NewMemStore returns new empty MemStore
+func NewMemStore() *MemStore { return &MemStore{buckets: make(map[uint64]bucket)} }
+
+// Take implements ipratelimit.Store
+func (s *MemStore) Take(ctx context.Context, key uint64, now time.Time, cost, burst float64, refillEvery time.Duration) (bool, float64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bkt, ok := s.buckets[key]
+	if !ok {
+		bkt.left = burst
+	} else if refillBy := float64(now.Sub(bkt.mtime)) / float64(refillEvery); refillBy > 0 {
+		bkt.left += refillBy
+	}
+	if bkt.left > burst {
+		bkt.left = burst
+	}
+	bkt.mtime = now
+	var allowed bool
+	if bkt.left >= cost {
+		bkt.left -= cost
+		allowed = true
+	}
+	s.buckets[key] = bkt
+	return allowed, bkt.left, nil
+}
+
+// Len returns number of buckets in the store
+func (s *MemStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
@@ -0,0 +1,108 @@
+package storetest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/artyom/ipratelimit"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+	for i, want := range []bool{true, true, false} {
+		ok, _, err := s.Take(ctx, 1, now, 1, 2, time.Second)
+		if err != nil || ok != want {
+			t.Fatalf("take %d: got %v, %v, want %v", i, ok, err, want)
+		}
+	}
+	ok, left, _ := s.Take(ctx, 1, now.Add(1500*time.Millisecond), 1, 2, time.Second)
+	if !ok || left != 0.5 {
+		t.Fatalf("take after refill: got %v, %v", ok, left)
+	}
+	if ok, _, _ := s.Take(ctx, 2, now, 3, 2, time.Second); ok {
+		t.Fatal("cost above burst allowed")
+	}
+	if n := s.Len(); n != 2 {
+		t.Fatalf("Len: %d, want 2", n)
+	}
+}
+
+func TestFlakyStoreDeterministic(t *testing.T) {
+	run := func(seed int64) []bool {
+		f := NewFlakyStore(NewMemStore(), seed)
+		f.ErrorRate = 0.5
+		var out []bool
+		for i := 0; i < 50; i++ {
+			_, _, err := f.Take(context.Background(), uint64(i), time.Unix(0, 0), 1, 1, time.Second)
+			out = append(out, err == ErrInjected)
+		}
+		return out
+	}
+	a, b := run(42), run(42)
+	var failures int
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("call %d: different outcome with the same seed", i)
+		}
+		if a[i] {
+			failures++
+		}
+	}
+	if failures == 0 || failures == len(a) {
+		t.Fatalf("%d failures out of %d calls with 0.5 error rate", failures, len(a))
+	}
+}
+
+func TestFlakyStoreLatencyAndPartition(t *testing.T) {
+	f := NewFlakyStore(NewMemStore(), 1)
+	f.Latency = 20 * time.Millisecond
+	begin := time.Now()
+	if _, _, err := f.Take(context.Background(), 1, begin, 1, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(begin); d < f.Latency {
+		t.Fatalf("call took %v, less than configured latency", d)
+	}
+	f.Partition(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := f.Take(ctx, 1, begin, 1, 1, time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("partitioned call returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := f.Calls(); n != 2 {
+		t.Fatalf("Calls: %d, want 2", n)
+	}
+}
+
+// TestLimiterStoreErrors checks that Limiter handles Store errors as
+// configured by FailClosed
+func TestLimiterStoreErrors(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		s := NewFlakyStore(NewMemStore(), 1)
+		s.ErrorRate = 1
+		l := ipratelimit.NewLimiter(&ipratelimit.Config{
+			RefillEvery: time.Hour,
+			Burst:       1,
+			Store:       s,
+			FailClosed:  failClosed,
+		})
+		for i := 0; i < 3; i++ {
+			if got := l.Allow(net.IPv4(192, 0, 2, 1)); got == failClosed {
+				t.Fatalf("FailClosed=%v: request %d allowed: %v", failClosed, i, got)
+			}
+		}
+		if c := l.Counters(); c.Failed != 3 || s.Calls() != 3 {
+			t.Fatalf("FailClosed=%v: got %d failed decisions, %d store calls", failClosed, c.Failed, s.Calls())
+		}
+		l.Close()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("MemStore", func(t *testing.T) { RunConformance(t, NewMemStore()) })
+	t.Run("FlakyStore", func(t *testing.T) { RunConformance(t, NewFlakyStore(NewMemStore(), 1)) })
+}
@@ -0,0 +1,110 @@
+package ipratelimit
+
+import (
+	"math"
+	"strconv"
+)
+
+// StreakBounds lists inclusive upper bounds of StreakHistogram buckets, the
+// last bucket counts all streaks longer than the last bound.
+var StreakBounds = [...]int{1, 2, 4, 8, 16, 32, 64, 128}
+
+// StreakHistogram counts completed denial streaks by their length: i-th
+// element counts streaks not longer than StreakBounds[i] and longer than the
+// previous bound; the last element counts streaks longer than all bounds. A
+// streak is completed when the next request from the same address is
+// allowed or its bucket is evicted.
+type StreakHistogram [len(StreakBounds) + 1]uint64
+
+func (hs *StreakHistogram) add(streak uint16) {
+	for i, b := range StreakBounds {
+		if int(streak) <= b {
+			hs[i]++
+			return
+		}
+	}
+	hs[len(hs)-1]++
+}
+
+// Total returns number of streaks counted
+func (hs StreakHistogram) Total() uint64 {
+	var n uint64
+	for _, v := range hs {
+		n += v
+	}
+	return n
+}
+
+// Percentile returns the upper bound of the histogram bucket holding the
+// p-th percentile of streak lengths, p must be in (0, 100] range. It returns
+// 0 if the histogram is empty, and math.MaxInt if the percentile falls into
+// the last, unbounded bucket.
+func (hs StreakHistogram) Percentile(p float64) int {
+	total := hs.Total()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var n uint64
+	for i, v := range hs[:len(StreakBounds)] {
+		if n += v; n >= rank {
+			return StreakBounds[i]
+		}
+	}
+	return math.MaxInt
+}
+
+// since returns streaks counted since prev was taken
+func (hs StreakHistogram) since(prev StreakHistogram) StreakHistogram {
+	for i := range hs {
+		hs[i] -= min(prev[i], hs[i])
+	}
+	return hs
+}
+
+// formatStreakLength returns text form of a bound returned by Percentile
+func formatStreakLength(n int) string {
+	if n == math.MaxInt {
+		return ">" + strconv.Itoa(StreakBounds[len(StreakBounds)-1])
+	}
+	return "<=" + strconv.Itoa(n)
+}
+
+// denialStreaks returns completed denial streaks merged across shards,
+// locking one shard at a time
+func (h *limiter) denialStreaks() StreakHistogram {
+	var hs StreakHistogram
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.m.Lock()
+		hs.merge(s.streaks)
+		s.m.Unlock()
+	}
+	return hs
+}
+
+// merge adds counts of o to hs
+func (hs *StreakHistogram) merge(o StreakHistogram) {
+	for i, v := range o {
+		hs[i] += v
+	}
+}
+
+// trackStreak updates streak counters of bkt after a decision, recording
+// the completed streak in s.streaks. Must be called with s.m held.
+func (s *shard) trackStreak(bkt *bucket, allowed bool) {
+	if allowed {
+		if bkt.streak > 0 {
+			s.streaks.add(bkt.streak)
+			bkt.streak = 0
+		}
+		return
+	}
+	bkt.streak = incSaturating(bkt.streak)
+	if bkt.streak > bkt.maxStreak {
+		bkt.maxStreak = bkt.streak
+	}
+}
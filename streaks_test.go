@@ -0,0 +1,133 @@
+package ipratelimit
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDenialStreaks(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+		MaxBuckets:  100,
+		TrackStats:  true,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+
+	// streak of given length for ip, completed by allowed request if
+	// complete is set
+	streak := func(ip net.IP, n int, complete bool) {
+		t.Helper()
+		if !lh.Allow(ip) {
+			t.Fatalf("%v: first request denied", ip)
+		}
+		for i := 0; i < n; i++ {
+			if lh.Allow(ip) {
+				t.Fatalf("%v: request %d allowed", ip, i)
+			}
+		}
+		if complete {
+			now = now.Add(time.Second)
+			if !lh.Allow(ip) {
+				t.Fatalf("%v: request after refill denied", ip)
+			}
+		}
+	}
+	streak(net.IPv4(10, 0, 0, 1), 1, true)
+	streak(net.IPv4(10, 0, 0, 2), 3, true)
+	streak(net.IPv4(10, 0, 0, 3), 3, true)
+	streak(net.IPv4(10, 0, 0, 4), 50, true)
+	streak(net.IPv4(10, 0, 0, 5), 200, false) // completed by eviction below
+
+	want := StreakHistogram{1, 0, 2, 0, 0, 0, 1, 0, 0}
+	if got := lh.Stats().DenialStreaks; got != want {
+		t.Fatalf("before eviction: got %v, want %v", got, want)
+	}
+	ip := make(net.IP, 4)
+	for i := 0; i < 200; i++ {
+		binary.BigEndian.PutUint32(ip, uint32(0x0b000000+i))
+		lh.Allow(ip)
+	}
+	want[len(want)-1]++
+	got := lh.Stats().DenialStreaks
+	if got != want {
+		t.Fatalf("after eviction: got %v, want %v", got, want)
+	}
+	if p := got.Percentile(50); p != 4 {
+		t.Errorf("50th percentile: %d, want 4", p)
+	}
+	if p := got.Percentile(20); p != 1 {
+		t.Errorf("20th percentile: %d, want 1", p)
+	}
+	if p := got.Percentile(100); p != math.MaxInt {
+		t.Errorf("100th percentile: %d, want %d", p, math.MaxInt)
+	}
+	if p := (StreakHistogram{}).Percentile(99); p != 0 {
+		t.Errorf("percentile of empty histogram: %d", p)
+	}
+}
+
+func TestDenialStreaksDisabled(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{RefillEvery: time.Hour, Burst: 1}).(*limiter)
+	ip := net.IPv4(10, 0, 0, 1)
+	for i := 0; i < 5; i++ {
+		lh.Allow(ip)
+	}
+	if bkt, _ := lh.bucketOf(keyOf(ip.To4())); bkt.streak != 0 || bkt.maxStreak != 0 {
+		t.Fatalf("streak tracked with TrackStats disabled: %+v", bkt)
+	}
+}
+
+func TestDenialStreakSaturates(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+		TrackStats:  true,
+	}).(*limiter)
+	now := time.Unix(1000, 0)
+	lh.now = func() time.Time { return now }
+	ip := net.IPv4(192, 0, 2, 1).To4()
+	key := keyOf(ip)
+	bucketOf := func() bucket {
+		bkt, _ := lh.bucketOf(key)
+		return bkt
+	}
+	lh.Allow(ip)
+	lh.Allow(ip)
+	s := lh.shardOf(key)
+	s.m.Lock()
+	bkt := s.ipmap[key]
+	bkt.streak = math.MaxUint16 - 1
+	s.ipmap[key] = bkt
+	s.m.Unlock()
+	for i := 0; i < 3; i++ {
+		if lh.Allow(ip) {
+			t.Fatalf("request %d allowed", i)
+		}
+		if bkt := bucketOf(); bkt.streak != math.MaxUint16 || bkt.maxStreak != math.MaxUint16 {
+			t.Fatalf("request %d: got streak %d, max %d", i, bkt.streak, bkt.maxStreak)
+		}
+	}
+	if s := lh.dumpState(0); !strings.Contains(s, "saturated streaks: 1,") {
+		t.Errorf("saturation not in debug output:\n%s", s)
+	}
+	now = now.Add(time.Second)
+	if !lh.Allow(ip) {
+		t.Fatal("request after refill denied")
+	}
+	if bkt := bucketOf(); bkt.streak != 0 || bkt.maxStreak != math.MaxUint16 {
+		t.Errorf("after allowed request: got streak %d, max %d", bkt.streak, bkt.maxStreak)
+	}
+	if got := lh.Stats().DenialStreaks; got[len(got)-1] != 1 || got.Total() != 1 {
+		t.Errorf("saturated streak recorded as %v", got)
+	}
+	if lh.Allow(ip) {
+		t.Error("request allowed right after refill was used")
+	}
+}
@@ -0,0 +1,31 @@
+package ipratelimit
+
+// totalsMemSize is an estimated memory footprint of totals of a single
+// bucket: map entry with its share of map overhead
+const totalsMemSize = 40
+
+// totals are lifetime counts of a bucket, reported by ExportCSV. They are
+// kept by shards apart from buckets, if Config.TrackStats is set, so that
+// buckets of limiters not tracking them stay small.
+type totals struct {
+	firstSeen int64  // bucket creation time as nanoseconds since Unix epoch
+	requests  uint32 // decisions made by the bucket
+	denials   uint32 // denied requests among them
+}
+
+// trackTotals records decision of the bucket with the given key made at
+// now, must be called with s.m held
+func (s *shard) trackTotals(key uint64, now int64, allowed bool) {
+	t, ok := s.totals[key]
+	if !ok {
+		if s.totals == nil {
+			s.totals = make(map[uint64]totals)
+		}
+		t.firstSeen = now
+	}
+	t.requests = incSaturating(t.requests)
+	if !allowed {
+		t.denials = incSaturating(t.denials)
+	}
+	s.totals[key] = t
+}
@@ -0,0 +1,28 @@
+package ipratelimit
+
+import "strings"
+
+func (h *limiter) evalUserAgent(e *evaluation) bool {
+	for i, prefix := range h.exemptUA {
+		if strings.HasPrefix(e.ua, prefix) {
+			h.exemptUACounts[i].Add(1)
+			h.trackBypass(bypassUserAgent, e)
+			e.d.allow, e.bypass = true, true
+			return true
+		}
+	}
+	return false
+}
+
+// exemptedUserAgents returns number of requests exempted by each of
+// Config.ExemptUserAgents, nil if they are not set
+func (h *limiter) exemptedUserAgents() map[string]uint64 {
+	if len(h.exemptUA) == 0 {
+		return nil
+	}
+	out := make(map[string]uint64, len(h.exemptUA))
+	for i, prefix := range h.exemptUA {
+		out[prefix] += h.exemptUACounts[i].Load()
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package ipratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExemptUserAgents(t *testing.T) {
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), &Config{
+		RefillEvery:      time.Hour,
+		Burst:            1,
+		IPFunc:           IPFromXForwardedFor,
+		ExemptUserAgents: []string{"UptimeProbe/", "Pingdom.com_bot_version_1.4", ""},
+		Policy:           Policy{Denylist: []string{"198.51.100.1"}},
+	}).(*limiter)
+	serve := func(addr, ua string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", addr)
+		req.Header.Set("User-Agent", ua)
+		rec := httptest.NewRecorder()
+		lh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i, tc := range []struct {
+		addr, ua string
+		want     int
+	}{
+		{"192.0.2.1", "curl/8.0", http.StatusOK},
+		{"192.0.2.1", "curl/8.0", http.StatusTooManyRequests},
+		{"192.0.2.1", "UptimeProbe/2.1 (+https://example.com)", http.StatusOK},
+		{"192.0.2.1", "UptimeProbe/2.1 (+https://example.com)", http.StatusOK},
+		{"192.0.2.1", "Pingdom.com_bot_version_1.4_(http://www.pingdom.com/)", http.StatusOK},
+		// substring and case-insensitive matches are not exempt
+		{"192.0.2.1", "Mozilla/5.0 UptimeProbe/2.1", http.StatusTooManyRequests},
+		{"192.0.2.1", "uptimeprobe/2.1", http.StatusTooManyRequests},
+		{"192.0.2.1", "UptimeProbe", http.StatusTooManyRequests},
+		// denylist takes precedence
+		{"198.51.100.1", "UptimeProbe/2.1", http.StatusForbidden},
+	} {
+		if got := serve(tc.addr, tc.ua); got != tc.want {
+			t.Errorf("request %d with User-Agent %q: got status %d, want %d", i, tc.ua, got, tc.want)
+		}
+	}
+	st := lh.Stats()
+	if st.BypassedUserAgent != 3 {
+		t.Errorf("got %d bypassed requests, want 3", st.BypassedUserAgent)
+	}
+	want := map[string]uint64{"UptimeProbe/": 2, "Pingdom.com_bot_version_1.4": 1}
+	if len(st.ExemptedUserAgents) != len(want) {
+		t.Errorf("got exempted counts %v, want %v", st.ExemptedUserAgents, want)
+	}
+	for ua, n := range want {
+		if st.ExemptedUserAgents[ua] != n {
+			t.Errorf("got exempted counts %v, want %v", st.ExemptedUserAgents, want)
+			break
+		}
+	}
+	if err := (&Config{ExemptUserAgents: []string{""}}).Validate(); err == nil {
+		t.Error("empty prefix is valid")
+	}
+}
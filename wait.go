@@ -0,0 +1,26 @@
+package ipratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// wait delays request evaluated by e until tokens it reserved are refilled,
+// see Config.MaxWait, and reports whether the request should proceed. If
+// ctx is done first, reserved tokens are returned to the bucket, and tokens
+// taken from the global one, see Config.GlobalBurst, are returned as well.
+func (h *limiter) wait(ctx context.Context, e *evaluation) bool {
+	t := time.NewTimer(e.d.delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+	}
+	h.refund(e.key, e.lim, e.cost)
+	if h.global != nil {
+		h.global.refund(e.cost)
+	}
+	h.counters.abandoned.Add(1)
+	return false
+}
@@ -0,0 +1,139 @@
+package ipratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMaxWaitOrder(t *testing.T) {
+	const (
+		requests = 4
+		every    = 50 * time.Millisecond
+	)
+	var mu sync.Mutex
+	var order []int
+	var passed []time.Duration
+	begin := time.Now()
+	lh := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, int(r.Header.Get("X-Seq")[0]-'0'))
+		passed = append(passed, time.Since(begin))
+	}), &Config{
+		RefillEvery: every,
+		Burst:       1,
+		MaxWait:     time.Second,
+	}).(*limiter)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Seq", string(rune('0'+i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lh.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		time.Sleep(every / 10) // so that requests reserve tokens in order
+	}
+	wg.Wait()
+	if len(order) != requests {
+		t.Fatalf("%d of %d requests passed", len(order), requests)
+	}
+	for i := range order {
+		if order[i] != i {
+			t.Fatalf("requests passed in order %v", order)
+		}
+		if due := time.Duration(i) * every; passed[i] < due-every/10 {
+			t.Errorf("request %d passed after %v, want at least %v", i, passed[i], due)
+		}
+	}
+	if err := lh.checkInvariants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxWaitCancel(t *testing.T) {
+	var called int
+	lh := New(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called++ }), &Config{
+		RefillEvery: time.Second,
+		Burst:       1,
+		MaxWait:     time.Minute,
+	}).(*limiter)
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	lh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if called != 1 {
+		t.Fatalf("handler called %d times, want 1", called)
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || len(w.Header()) != 0 {
+		t.Fatalf("response written to abandoned request: %d %v %q", w.Code, w.Header(), w.Body)
+	}
+	if n := lh.Counters().Abandoned; n != 1 {
+		t.Fatalf("got %d abandoned requests, want 1", n)
+	}
+	bkt, _ := lh.bucketOf(keyOf(net.ParseIP("192.0.2.1").To4()))
+	if bkt.left < 0 {
+		t.Fatalf("reserved token not returned, %v tokens left", bkt.left)
+	}
+}
+
+// TestMaxWaitCancelGlobal checks that abandoned waits return tokens taken
+// from the global bucket
+func TestMaxWaitCancelGlobal(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery:       time.Second,
+		Burst:             1,
+		MaxWait:           time.Minute,
+		GlobalRefillEvery: time.Hour,
+		GlobalBurst:       3,
+	}).(*limiter)
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		cancel()
+	}
+	if n := lh.Counters().Abandoned; n != 3 {
+		t.Fatalf("got %d abandoned requests, want 3", n)
+	}
+	lh.global.m.Lock()
+	left := lh.global.bkt.left
+	lh.global.m.Unlock()
+	if left < 2 {
+		t.Fatalf("global bucket holds %v tokens after abandoned waits, want 2", left)
+	}
+}
+
+func TestMaxWaitExceeded(t *testing.T) {
+	lh := New(http.NotFoundHandler(), &Config{
+		RefillEvery: time.Hour,
+		Burst:       1,
+		MaxWait:     time.Second,
+	}).(*limiter)
+	lh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	begin := time.Now()
+	w := httptest.NewRecorder()
+	lh.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if d := time.Since(begin); d > time.Second/2 {
+		t.Fatalf("denial took %v", d)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3600" {
+		t.Fatalf("got Retry-After %q", got)
+	}
+	// decisions made outside of ServeHTTP don't reserve tokens
+	lh.maxDelay = time.Hour
+	if lh.Allow(net.ParseIP("192.0.2.1")) {
+		t.Fatal("Allow reserved a token")
+	}
+}
@@ -0,0 +1,101 @@
+package ipratelimit
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// DecisionContentType is the media type of Decision binary encoding produced
+// by Decision.MarshalBinary
+const DecisionContentType = "application/x-ipratelimit-decision"
+
+// Decision binary encoding, version 2, all integers are big-endian:
+//
+//	offset size field
+//	0      1    version, 2
+//	1      1    flags, bit 0 set if request is allowed
+//	2      1    stage (reason) that made the decision
+//	3      8    remaining tokens, IEEE 754 float64 bits
+//	11     4    reset delay in milliseconds, saturated at 2^32-1
+//	15     1    source of limits
+//	16     8    next allowed time in milliseconds since Unix epoch, 0 if
+//	            zero time
+//
+// Version 1 is the first 15 bytes of version 2, with version byte 1.
+const (
+	wireVersion1    = 1
+	wireVersion2    = 2
+	wireSize1       = 15
+	wireSize2       = 24
+	wireFlagAllowed = 1 << 0
+)
+
+var (
+	errWireShort   = errors.New("ipratelimit: decision encoding too short")
+	errWireVersion = errors.New("ipratelimit: unsupported decision encoding version")
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler, producing compact
+// versioned encoding of the decision. Reset and NextAllowed are encoded with
+// millisecond precision. It never returns an error.
+func (d Decision) MarshalBinary() ([]byte, error) {
+	b := make([]byte, wireSize2)
+	b[0] = wireVersion2
+	if d.Allowed {
+		b[1] |= wireFlagAllowed
+	}
+	b[2] = byte(d.Stage)
+	binary.BigEndian.PutUint64(b[3:], math.Float64bits(d.Remaining))
+	var ms uint32
+	switch reset := d.Reset / time.Millisecond; {
+	case reset <= 0:
+	case reset > math.MaxUint32:
+		ms = math.MaxUint32
+	default:
+		ms = uint32(reset)
+	}
+	binary.BigEndian.PutUint32(b[11:], ms)
+	b[15] = byte(d.Source)
+	if !d.NextAllowed.IsZero() {
+		binary.BigEndian.PutUint64(b[16:], uint64(d.NextAllowed.UnixMilli()))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, decoding data
+// produced by MarshalBinary, of the current or the previous version;
+// NextAllowed is decoded in UTC. Unknown flags are ignored, trailing data is
+// allowed for forward compatibility.
+func (d *Decision) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errWireShort
+	}
+	var size int
+	switch data[0] {
+	case wireVersion1:
+		size = wireSize1
+	case wireVersion2:
+		size = wireSize2
+	default:
+		return errWireVersion
+	}
+	if len(data) < size {
+		return errWireShort
+	}
+	*d = Decision{
+		Allowed:   data[1]&wireFlagAllowed != 0,
+		Stage:     Stage(data[2]),
+		Remaining: math.Float64frombits(binary.BigEndian.Uint64(data[3:])),
+		Reset:     time.Duration(binary.BigEndian.Uint32(data[11:])) * time.Millisecond,
+	}
+	if data[0] == wireVersion1 {
+		return nil
+	}
+	d.Source = LimitSource(data[15])
+	if ms := int64(binary.BigEndian.Uint64(data[16:])); ms != 0 {
+		d.NextAllowed = time.UnixMilli(ms).UTC()
+	}
+	return nil
+}
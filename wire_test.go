@@ -0,0 +1,139 @@
+package ipratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecisionBinaryRoundTrip(t *testing.T) {
+	full := Decision{
+		Allowed:     true,
+		Remaining:   9,
+		Reset:       time.Second,
+		Stage:       StageLimit,
+		Source:      SourceAddress,
+		NextAllowed: time.UnixMilli(1700000000123).UTC(),
+	}
+	// fields added to Decision must be added to the encoding as well
+	v := reflect.ValueOf(full)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Fatalf("field %s is not set", v.Type().Field(i).Name)
+		}
+	}
+	for _, d := range []Decision{
+		{},
+		full,
+		{Remaining: 0.25, Reset: 123 * time.Millisecond, Stage: StageAddress, Source: SourceDefault},
+		{Remaining: math.MaxFloat64, Reset: time.Duration(math.MaxUint32) * time.Millisecond},
+		{NextAllowed: time.UnixMilli(-1).UTC()},
+	} {
+		b, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Decision
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%+v: %v", d, err)
+		}
+		if got != d {
+			t.Errorf("round trip: got %+v, want %+v", got, d)
+		}
+	}
+}
+
+func TestDecisionBinaryEdgeCases(t *testing.T) {
+	b, _ := Decision{Reset: 100 * 24 * time.Hour}.MarshalBinary()
+	var d Decision
+	if err := d.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Duration(math.MaxUint32) * time.Millisecond; d.Reset != want {
+		t.Errorf("large reset decoded as %v, want saturated %v", d.Reset, want)
+	}
+	b, _ = Decision{Reset: -time.Second}.MarshalBinary()
+	if err := d.UnmarshalBinary(b); err != nil || d.Reset != 0 {
+		t.Errorf("negative reset decoded as %v, %v", d.Reset, err)
+	}
+	for _, bad := range [][]byte{nil, {wireVersion1}, {wireVersion1, 1, 2}, b[:wireSize2-1]} {
+		if err := d.UnmarshalBinary(bad); err != errWireShort {
+			t.Errorf("%x: got error %v, want %v", bad, err, errWireShort)
+		}
+	}
+	v1 := append([]byte{wireVersion1}, b[1:wireSize1-1]...)
+	if err := d.UnmarshalBinary(v1); err != errWireShort {
+		t.Errorf("short version 1: got error %v, want %v", err, errWireShort)
+	}
+	bad := append([]byte(nil), b...)
+	bad[0] = 3
+	if err := d.UnmarshalBinary(bad); err != errWireVersion {
+		t.Errorf("got error %v, want %v", err, errWireVersion)
+	}
+}
+
+// TestDecisionBinaryVector guards the encoding against silent changes: the
+// vectors in testdata must never be modified, new versions of the encoding
+// should come with new vectors.
+func TestDecisionBinaryVector(t *testing.T) {
+	v1 := readHexVector(t, "testdata/decision-v1.hex")
+	d := Decision{Allowed: true, Remaining: 2.5, Reset: 1500 * time.Millisecond, Stage: StageLimit}
+	var dec Decision
+	if err := dec.UnmarshalBinary(v1); err != nil {
+		t.Fatal(err)
+	}
+	if dec != d {
+		t.Fatalf("decoded version 1 %+v, want %+v", dec, d)
+	}
+
+	want := readHexVector(t, "testdata/decision-v2.hex")
+	d.Source = SourceServerName
+	d.NextAllowed = time.UnixMilli(1700000000123).UTC()
+	got, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encoding changed:\ngot  %x\nwant %x", got, want)
+	}
+	if err := dec.UnmarshalBinary(want); err != nil {
+		t.Fatal(err)
+	}
+	if dec != d {
+		t.Fatalf("decoded %+v, want %+v", dec, d)
+	}
+}
+
+// readHexVector reads hex-encoded bytes from file, ignoring whitespace and
+// lines starting with #
+func readHexVector(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var s strings.Builder
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		s.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := hex.DecodeString(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}